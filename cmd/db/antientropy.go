@@ -0,0 +1,535 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dk872/architecture-lab5/datastore"
+)
+
+// merkleDepth splits the key space into 1<<merkleDepth ranges by the hash of
+// the key, the leaves of the Merkle tree.
+const merkleDepth = 8
+
+// merkleTree holds the hex digests of every level, the root first. A leaf
+// covers the keys of its range and their timestamps, an inner node its two
+// children.
+type merkleTree struct {
+	Levels [][]string `json:"levels"`
+}
+
+// keyStamp is the timestamp of a key's value, or of its tombstone when it
+// was deleted.
+type keyStamp struct {
+	Key       string `json:"key"`
+	Timestamp uint64 `json:"timestamp"`
+	Deleted   bool   `json:"deleted,omitempty"`
+	// Expires is in Unix nanoseconds, 0 for values that do not expire.
+	Expires int64  `json:"expires,omitempty"`
+	Flags   uint32 `json:"flags,omitempty"`
+}
+
+func keyRange(key string) int {
+	sum := sha1.Sum([]byte(key))
+	return int(binary.BigEndian.Uint16(sum[:2]) >> (16 - merkleDepth))
+}
+
+// stamps returns the keys, in sorted order, of the ranges want accepts.
+// Deleted keys are listed while their tombstones are kept.
+func stamps(db *datastore.Db, want func(int) bool) ([]keyStamp, error) {
+	var res []keyStamp
+	for _, list := range []struct {
+		keys    []string
+		deleted bool
+	}{{db.Keys(), false}, {db.DeletedKeys(), true}} {
+		for _, key := range list.keys {
+			if !want(keyRange(key)) {
+				continue
+			}
+			var item datastore.Item
+			var err error
+			if list.deleted {
+				item.Timestamp, err = db.Timestamp(key)
+			} else {
+				item, err = db.Stat(key)
+			}
+			if errors.Is(err, datastore.ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, keyStamp{Key: key, Timestamp: item.Timestamp, Deleted: list.deleted, Expires: unixNano(item.Expires), Flags: item.Flags})
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Key < res[j].Key })
+	return res, nil
+}
+
+func buildTree(db *datastore.Db) (merkleTree, error) {
+	all, err := stamps(db, func(int) bool { return true })
+	if err != nil {
+		return merkleTree{}, err
+	}
+	leaves := make([][]byte, 1<<merkleDepth)
+	hashes := make([]hash.Hash, len(leaves))
+	for i := range hashes {
+		hashes[i] = sha1.New()
+	}
+	for _, ks := range all {
+		h := hashes[keyRange(ks.Key)]
+		h.Write(binary.LittleEndian.AppendUint64(nil, uint64(len(ks.Key))))
+		io.WriteString(h, ks.Key)
+		h.Write(binary.LittleEndian.AppendUint64(nil, ks.Timestamp))
+		if ks.Deleted {
+			h.Write([]byte{1})
+		} else {
+			h.Write([]byte{0})
+		}
+	}
+	for i, h := range hashes {
+		leaves[i] = h.Sum(nil)
+	}
+
+	levels := [][][]byte{leaves}
+	for level := leaves; len(level) > 1; {
+		next := make([][]byte, len(level)/2)
+		for i := range next {
+			h := sha1.New()
+			h.Write(level[2*i])
+			h.Write(level[2*i+1])
+			next[i] = h.Sum(nil)
+		}
+		levels = append([][][]byte{next}, levels...)
+		level = next
+	}
+
+	var tree merkleTree
+	for _, level := range levels {
+		digests := make([]string, len(level))
+		for i, d := range level {
+			digests[i] = hex.EncodeToString(d)
+		}
+		tree.Levels = append(tree.Levels, digests)
+	}
+	return tree, nil
+}
+
+// diffRanges walks both trees from the root, only into the subtrees whose
+// digests differ, and returns the leaves that do.
+func diffRanges(a, b merkleTree) ([]int, error) {
+	if len(a.Levels) != merkleDepth+1 || len(b.Levels) != merkleDepth+1 {
+		return nil, errors.New("merkle trees of different shapes")
+	}
+	nodes := []int{0}
+	for depth := 0; depth < merkleDepth; depth++ {
+		var next []int
+		for _, n := range nodes {
+			if a.Levels[depth][n] != b.Levels[depth][n] {
+				next = append(next, 2*n, 2*n+1)
+			}
+		}
+		nodes = next
+	}
+	var diff []int
+	for _, n := range nodes {
+		if a.Levels[merkleDepth][n] != b.Levels[merkleDepth][n] {
+			diff = append(diff, n)
+		}
+	}
+	return diff, nil
+}
+
+// repairReport is what one repair against a peer found and did.
+type repairReport struct {
+	Peer   string `json:"peer"`
+	Ranges []int  `json:"ranges"`
+	// Pulled keys were newer on the peer, pushed keys here.
+	Pulled []string  `json:"pulled"`
+	Pushed []string  `json:"pushed"`
+	Error  string    `json:"error,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// antiEntropy reconciles the datastore with its peers. Both sides build a
+// Merkle tree over the key ranges, the keys of the ranges that differ are
+// compared, and the value with the newer timestamp is copied over the other
+// one. Values written without a timestamp never win over each other.
+type antiEntropy struct {
+	db     *datastore.Db
+	peers  []string
+	client *http.Client
+
+	// runMutex keeps one repair running at a time.
+	runMutex sync.Mutex
+
+	mutex   sync.Mutex
+	reports []repairReport
+	runs    uint64
+	pulled  uint64
+	pushed  uint64
+}
+
+func newAntiEntropy(db *datastore.Db, peers []string) *antiEntropy {
+	return &antiEntropy{db: db, peers: peers, client: &http.Client{}}
+}
+
+// run repairs against every peer once per interval until ctx is done.
+func (a *antiEntropy) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, report := range a.repair(ctx, a.peers) {
+				if report.Error != "" {
+					log.Printf("Repair against %s failed: %s", report.Peer, report.Error)
+				} else if len(report.Pulled)+len(report.Pushed) > 0 {
+					log.Printf("Repair against %s pulled %d and pushed %d keys", report.Peer, len(report.Pulled), len(report.Pushed))
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (a *antiEntropy) repair(ctx context.Context, peers []string) []repairReport {
+	a.runMutex.Lock()
+	defer a.runMutex.Unlock()
+
+	reports := make([]repairReport, 0, len(peers))
+	for _, peer := range peers {
+		report := repairReport{Peer: peer, Time: time.Now()}
+		if err := a.repairWith(ctx, peer, &report); err != nil {
+			report.Error = err.Error()
+		}
+		reports = append(reports, report)
+	}
+
+	a.mutex.Lock()
+	a.reports = reports
+	a.runs++
+	for _, report := range reports {
+		a.pulled += uint64(len(report.Pulled))
+		a.pushed += uint64(len(report.Pushed))
+	}
+	a.mutex.Unlock()
+	return reports
+}
+
+func (a *antiEntropy) repairWith(ctx context.Context, peer string, report *repairReport) error {
+	local, err := buildTree(a.db)
+	if err != nil {
+		return err
+	}
+	var remote merkleTree
+	if err := a.getJSON(ctx, peer+"/db/_merkle", &remote); err != nil {
+		return err
+	}
+	report.Ranges, err = diffRanges(local, remote)
+	if err != nil || len(report.Ranges) == 0 {
+		return err
+	}
+
+	in := make(map[int]bool)
+	ranges := make([]string, len(report.Ranges))
+	for i, n := range report.Ranges {
+		in[n] = true
+		ranges[i] = strconv.Itoa(n)
+	}
+	localStamps, err := stamps(a.db, func(n int) bool { return in[n] })
+	if err != nil {
+		return err
+	}
+	remoteStamps, err := a.getStamps(ctx, peer+"/db/_merkle/keys?ranges="+strings.Join(ranges, ","))
+	if err != nil {
+		return err
+	}
+
+	theirs := make(map[string]keyStamp, len(remoteStamps))
+	for _, ks := range remoteStamps {
+		theirs[ks.Key] = ks
+	}
+	for _, ks := range localStamps {
+		remote, ok := theirs[ks.Key]
+		delete(theirs, ks.Key)
+		switch {
+		case !ok || remote.Timestamp < ks.Timestamp:
+			if err := a.push(ctx, peer, ks); err != nil {
+				return err
+			}
+			report.Pushed = append(report.Pushed, ks.Key)
+		case remote.Timestamp > ks.Timestamp:
+			if err := a.pull(ctx, peer, remote); err != nil {
+				return err
+			}
+			report.Pulled = append(report.Pulled, ks.Key)
+		}
+	}
+	for _, ks := range remoteStamps {
+		if _, missing := theirs[ks.Key]; missing {
+			if err := a.pull(ctx, peer, ks); err != nil {
+				return err
+			}
+			report.Pulled = append(report.Pulled, ks.Key)
+		}
+	}
+	return nil
+}
+
+// pull copies the peer's value of a key, or deletes the key. A value the
+// peer wrote after listing its keys is stored with the listed timestamp and
+// corrected by the next repair.
+func (a *antiEntropy) pull(ctx context.Context, peer string, ks keyStamp) error {
+	if ks.Deleted {
+		err := a.db.DeleteAt(ctx, ks.Key, ks.Timestamp)
+		if errors.Is(err, datastore.ErrStale) {
+			return nil
+		}
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, peer+"/db/"+url.PathEscape(ks.Key), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", octetStream)
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching %q from %s: status %d", ks.Key, peer, resp.StatusCode)
+	}
+	err = a.db.PutWith(ctx, ks.Key, resp.Body, datastore.WriteOptions{Timestamp: ks.Timestamp, Expires: fromUnixNano(ks.Expires), Flags: ks.Flags})
+	if errors.Is(err, datastore.ErrStale) {
+		return nil
+	}
+	return err
+}
+
+func (a *antiEntropy) push(ctx context.Context, peer string, ks keyStamp) error {
+	query := url.Values{"key": {ks.Key}, "timestamp": {strconv.FormatUint(ks.Timestamp, 10)}}
+	var value io.Reader = http.NoBody
+	if ks.Expires != 0 {
+		query.Set("expires", strconv.FormatInt(ks.Expires, 10))
+	}
+	if ks.Flags != 0 {
+		query.Set("flags", strconv.FormatUint(uint64(ks.Flags), 10))
+	}
+	if ks.Deleted {
+		query.Set("deleted", "true")
+	} else {
+		rc, _, err := a.db.GetReader(ctx, ks.Key)
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		value = rc
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, peer+"/db/_merkle/put?"+query.Encode(), value)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", octetStream)
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusConflict {
+		return fmt.Errorf("pushing %q to %s: status %d", ks.Key, peer, resp.StatusCode)
+	}
+	return nil
+}
+
+func (a *antiEntropy) getJSON(ctx context.Context, url string, v any) error {
+	resp, err := a.get(ctx, url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (a *antiEntropy) getStamps(ctx context.Context, url string) ([]keyStamp, error) {
+	resp, err := a.get(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var res []keyStamp
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var ks keyStamp
+		if err := json.Unmarshal(scanner.Bytes(), &ks); err != nil {
+			return nil, err
+		}
+		res = append(res, ks)
+	}
+	return res, scanner.Err()
+}
+
+func (a *antiEntropy) get(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: status %d: %s", url, resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	return resp, nil
+}
+
+// treeHandler serves GET /db/_merkle, the tree peers compare theirs with.
+func treeHandler(db *datastore.Db) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tree, err := buildTree(db)
+		if err != nil {
+			writeError(w, err, "failed to build the merkle tree")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(tree)
+	})
+}
+
+// stampsHandler serves GET /db/_merkle/keys?ranges=1,2 with the keys of the
+// ranges and their timestamps as JSON lines.
+func stampsHandler(db *datastore.Db) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		in := make(map[int]bool)
+		for _, s := range strings.Split(r.URL.Query().Get("ranges"), ",") {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 || n >= 1<<merkleDepth {
+				http.Error(w, fmt.Sprintf("invalid range %q", s), http.StatusBadRequest)
+				return
+			}
+			in[n] = true
+		}
+		res, err := stamps(db, func(n int) bool { return in[n] })
+		if err != nil {
+			writeError(w, err, "failed to list keys")
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		enc := json.NewEncoder(w)
+		for _, ks := range res {
+			if err := enc.Encode(ks); err != nil {
+				return
+			}
+		}
+	})
+}
+
+// repairPutHandler serves POST /db/_merkle/put?key=&timestamp=&expires=&flags=
+// with the raw value a peer pushes, or with deleted=true and no body for a
+// delete. It answers 409 when the stored value is newer.
+func repairPutHandler(db *datastore.Db) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		key := r.URL.Query().Get("key")
+		ts, err := strconv.ParseUint(r.URL.Query().Get("timestamp"), 10, 64)
+		if key == "" || err != nil {
+			http.Error(w, "missing key or timestamp", http.StatusBadRequest)
+			return
+		}
+		var expires int64
+		if s := r.URL.Query().Get("expires"); s != "" {
+			if expires, err = strconv.ParseInt(s, 10, 64); err != nil {
+				http.Error(w, "invalid expires", http.StatusBadRequest)
+				return
+			}
+		}
+		var flags uint64
+		if s := r.URL.Query().Get("flags"); s != "" {
+			if flags, err = strconv.ParseUint(s, 10, 32); err != nil {
+				http.Error(w, "invalid flags", http.StatusBadRequest)
+				return
+			}
+		}
+		if deleted, _ := strconv.ParseBool(r.URL.Query().Get("deleted")); deleted {
+			err = db.DeleteAt(r.Context(), key, ts)
+		} else {
+			err = db.PutWith(r.Context(), key, r.Body, datastore.WriteOptions{Timestamp: ts, Expires: fromUnixNano(expires), Flags: uint32(flags)})
+		}
+		switch {
+		case err == nil:
+			w.WriteHeader(http.StatusOK)
+		case errors.Is(err, datastore.ErrStale):
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			writeError(w, err, "failed to store value")
+		}
+	})
+}
+
+// repairHandler triggers a repair with POST /db/_repair, against one peer
+// with ?peer=url or else all of them, and reports what differed. GET
+// reports the last repair.
+func (a *antiEntropy) repairHandler(w http.ResponseWriter, r *http.Request) {
+	var reports []repairReport
+	switch r.Method {
+	case http.MethodGet:
+		a.mutex.Lock()
+		reports = a.reports
+		a.mutex.Unlock()
+	case http.MethodPost:
+		peers := a.peers
+		if peer := r.URL.Query().Get("peer"); peer != "" {
+			peers = []string{strings.TrimSuffix(peer, "/")}
+		}
+		if len(peers) == 0 {
+			http.Error(w, "no peers to repair against", http.StatusBadRequest)
+			return
+		}
+		reports = a.repair(r.Context(), peers)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if reports == nil {
+		reports = []repairReport{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(reports)
+}
+
+func (a *antiEntropy) writeTo(w io.Writer) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	writeHeader(w, "db_repair_runs_total", "counter", "Anti-entropy repairs run.")
+	fmt.Fprintf(w, "db_repair_runs_total %d\n", a.runs)
+	writeHeader(w, "db_repair_keys_total", "counter", "Keys copied by anti-entropy repairs.")
+	fmt.Fprintf(w, "db_repair_keys_total{direction=\"pulled\"} %d\n", a.pulled)
+	fmt.Fprintf(w, "db_repair_keys_total{direction=\"pushed\"} %d\n", a.pushed)
+}
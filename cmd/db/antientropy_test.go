@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/dk872/architecture-lab5/datastore"
+)
+
+func startReplica(t *testing.T) (*datastore.Db, *httptest.Server) {
+	t.Helper()
+	db, err := datastore.Open(t.TempDir(), 1024, datastore.WithTimestamps())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	mux := http.NewServeMux()
+	mux.Handle("/db/_merkle", treeHandler(db))
+	mux.Handle("/db/_merkle/keys", stampsHandler(db))
+	mux.Handle("/db/_merkle/put", repairPutHandler(db))
+	mux.HandleFunc("/db/", func(w http.ResponseWriter, r *http.Request) {
+		value, err := db.Get(r.URL.Path[len("/db/"):])
+		if err != nil {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte(value))
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return db, server
+}
+
+func TestAntiEntropy(t *testing.T) {
+	local, _ := startReplica(t)
+	remote, server := startReplica(t)
+
+	// Replicated keys have the same timestamp on both sides.
+	for _, key := range []string{"shared1", "shared2", "conflict"} {
+		if err := remote.Put(key, "value of "+key); err != nil {
+			t.Fatal(err)
+		}
+		ts, err := remote.Timestamp(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := local.PutAt(context.Background(), key, strings.NewReader("value of "+key), ts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The remote write happens later and wins.
+	if err := local.Put("conflict", "old"); err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Put("conflict", "new"); err != nil {
+		t.Fatal(err)
+	}
+	// A delete replicates like a write.
+	if err := remote.Delete("shared2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := local.Put("onlyLocal", "l"); err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Put("onlyRemote", "r"); err != nil {
+		t.Fatal(err)
+	}
+
+	ae := newAntiEntropy(local, []string{server.URL})
+	reports := ae.repair(context.Background(), ae.peers)
+	if len(reports) != 1 || reports[0].Error != "" {
+		t.Fatalf("Repair returned %+v", reports)
+	}
+	report := reports[0]
+	sort.Strings(report.Pulled)
+	if len(report.Pulled) != 3 || report.Pulled[0] != "conflict" || report.Pulled[1] != "onlyRemote" || report.Pulled[2] != "shared2" {
+		t.Errorf("Pulled %v", report.Pulled)
+	}
+	if len(report.Pushed) != 1 || report.Pushed[0] != "onlyLocal" {
+		t.Errorf("Pushed %v", report.Pushed)
+	}
+	if len(report.Ranges) == 0 || len(report.Ranges) > 4 {
+		t.Errorf("Ranges that differ: %v", report.Ranges)
+	}
+
+	for _, db := range []*datastore.Db{local, remote} {
+		for key, want := range map[string]string{"conflict": "new", "onlyLocal": "l", "onlyRemote": "r", "shared1": "value of shared1"} {
+			if value, err := db.Get(key); err != nil || value != want {
+				t.Errorf("%s = %q, %v, wanted %q", key, value, err, want)
+			}
+		}
+		if _, err := db.Get("shared2"); !errors.Is(err, datastore.ErrNotFound) {
+			t.Errorf("Deleted key shared2 returned %v", err)
+		}
+	}
+
+	// The repair kept the timestamps, so the trees now match.
+	reports = ae.repair(context.Background(), ae.peers)
+	if len(reports[0].Ranges) != 0 {
+		t.Errorf("Ranges still differ after a repair: %v", reports[0].Ranges)
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dk872/architecture-lab5/datastore"
+)
+
+const (
+	maxBatchOps      = 1000
+	defaultScanLimit = 100
+	maxScanLimit     = 1000
+)
+
+const (
+	opExpire = "expire"
+	opIncr   = "incr"
+)
+
+var errUnknownOp = errors.New("unknown op")
+
+// applyCommand runs a write on the local datastore.
+func applyCommand(ctx context.Context, db *datastore.Db, cmd command) error {
+	switch cmd.Op {
+	case datastore.OpPut.String():
+		return db.PutWith(ctx, cmd.Key, strings.NewReader(cmd.Value), datastore.WriteOptions{
+			Expires:   fromUnixNano(cmd.Expires),
+			Flags:     cmd.Flags,
+			IfAbsent:  cmd.IfAbsent,
+			IfPresent: cmd.IfPresent,
+		})
+	case datastore.OpDelete.String():
+		return db.DeleteContext(ctx, cmd.Key)
+	case opExpire:
+		return db.Expire(ctx, cmd.Key, fromUnixNano(cmd.Expires))
+	case opIncr:
+		by, err := strconv.ParseInt(cmd.Value, 10, 64)
+		if err != nil {
+			return errNotInteger
+		}
+		_, err = incr(ctx, db, cmd.Key, by)
+		return err
+	default:
+		return fmt.Errorf("%w %q", errUnknownOp, cmd.Op)
+	}
+}
+
+var (
+	errNotInteger = errors.New("value is not an integer or out of range")
+	errOverflow   = errors.New("increment or decrement would overflow")
+)
+
+// incr adds by to the integer value of key, a missing key counting as 0,
+// and keeps its expiry and flags. A write that lands in between makes it
+// start over.
+func incr(ctx context.Context, db *datastore.Db, key string, by int64) (int64, error) {
+	for {
+		var n int64
+		opts := datastore.WriteOptions{IfAbsent: true}
+		item, err := db.GetItem(ctx, key)
+		switch {
+		case errors.Is(err, datastore.ErrNotFound):
+		case err != nil:
+			return 0, err
+		default:
+			if n, err = strconv.ParseInt(item.Value, 10, 64); err != nil {
+				return 0, errNotInteger
+			}
+			opts = datastore.WriteOptions{IfTimestamp: item.Timestamp, Expires: item.Expires, Flags: item.Flags}
+		}
+		if (by > 0 && n > math.MaxInt64-by) || (by < 0 && n < math.MinInt64-by) {
+			return 0, errOverflow
+		}
+		n += by
+
+		err = db.PutWith(ctx, key, strings.NewReader(strconv.FormatInt(n, 10)), opts)
+		if errors.Is(err, datastore.ErrConflict) {
+			continue
+		}
+		return n, err
+	}
+}
+
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func fromUnixNano(ns int64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
+type batchRequest struct {
+	Ops []command `json:"ops"`
+}
+
+type batchResult struct {
+	Key    string `json:"key"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type batchResponse struct {
+	Results []batchResult `json:"results"`
+}
+
+// batchHandler serves POST /db/_batch. The ops run in order, each on its
+// own: a failed op does not undo the ones before it. Every result carries
+// the status the single request would have got.
+func batchHandler(apply func(context.Context, command) error, redirect func(http.ResponseWriter, *http.Request) bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if redirect(w, r) {
+			return
+		}
+		var req batchRequest
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+		if len(req.Ops) > maxBatchOps {
+			http.Error(w, fmt.Sprintf("at most %d ops in a batch", maxBatchOps), http.StatusBadRequest)
+			return
+		}
+
+		resp := batchResponse{Results: make([]batchResult, len(req.Ops))}
+		for i, op := range req.Ops {
+			result := batchResult{Key: op.Key, Status: http.StatusOK}
+			keyErr := validateKey(op.Key)
+			var err error
+			switch {
+			case op.Key == "":
+				result.Status, result.Error = http.StatusBadRequest, "missing key"
+			case keyErr != nil:
+				result.Status, result.Error = http.StatusBadRequest, keyErr.Error()
+			case op.Op == datastore.OpPut.String() && op.Value == "":
+				result.Status, result.Error = http.StatusBadRequest, "missing value"
+			default:
+				err = apply(r.Context(), op)
+			}
+			if err != nil {
+				result.Status, result.Error = errorStatus(err, "failed to apply "+op.Op)
+			}
+			resp.Results[i] = result
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(resp)
+	})
+}
+
+type mgetRequest struct {
+	Keys []string `json:"keys"`
+}
+
+type mgetResponse struct {
+	Values  map[string]string `json:"values"`
+	Missing []string          `json:"missing"`
+}
+
+// mgetHandler serves POST /db/_mget: the values of the keys that have one,
+// read together, and the keys that have none in the order they were asked
+// for.
+func mgetHandler(db *datastore.Db) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req mgetRequest
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+		if len(req.Keys) > maxBatchOps {
+			http.Error(w, fmt.Sprintf("at most %d keys in a request", maxBatchOps), http.StatusBadRequest)
+			return
+		}
+
+		values, err := db.GetManyContext(r.Context(), req.Keys)
+		if err != nil {
+			writeError(w, err, "failed to read the keys")
+			return
+		}
+		resp := mgetResponse{Values: values, Missing: []string{}}
+		for _, key := range req.Keys {
+			if _, ok := values[key]; !ok && !slices.Contains(resp.Missing, key) {
+				resp.Missing = append(resp.Missing, key)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(resp)
+	})
+}
+
+type scanItem struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type scanResponse struct {
+	Items []scanItem `json:"items"`
+	Next  string     `json:"next,omitempty"`
+}
+
+// scanHandler serves GET /db/_scan?prefix=&after=&limit=: the keys with the
+// prefix that sort after the given key, with their values. Next is set when
+// there are more, and is the after of the following page.
+func scanHandler(db *datastore.Db) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		query := r.URL.Query()
+		prefix, after := query.Get("prefix"), query.Get("after")
+		limit := defaultScanLimit
+		if s := query.Get("limit"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n <= 0 {
+				http.Error(w, "invalid limit", http.StatusBadRequest)
+				return
+			}
+			limit = min(n, maxScanLimit)
+		}
+
+		keys := db.Keys()
+		sort.Strings(keys)
+		i := sort.SearchStrings(keys, max(prefix, after))
+		resp := scanResponse{Items: []scanItem{}}
+		for ; i < len(keys) && strings.HasPrefix(keys[i], prefix); i++ {
+			if keys[i] == after {
+				continue
+			}
+			if len(resp.Items) == limit {
+				resp.Next = resp.Items[limit-1].Key
+				break
+			}
+			value, err := db.GetContext(r.Context(), keys[i])
+			if errors.Is(err, datastore.ErrNotFound) {
+				// Deleted since Keys.
+				continue
+			}
+			if err != nil {
+				writeError(w, err, "failed to read "+keys[i])
+				return
+			}
+			resp.Items = append(resp.Items, scanItem{Key: keys[i], Value: value})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(resp)
+	})
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dk872/architecture-lab5/datastore"
+)
+
+func TestBatchHandler(t *testing.T) {
+	db, err := datastore.Open(t.TempDir(), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Put("old", "value"); err != nil {
+		t.Fatal(err)
+	}
+	apply := func(ctx context.Context, cmd command) error { return applyCommand(ctx, db, cmd) }
+	noRedirect := func(http.ResponseWriter, *http.Request) bool { return false }
+
+	body := `{"ops": [
+		{"op": "put", "key": "a", "value": "1"},
+		{"op": "delete", "key": "old"},
+		{"op": "delete", "key": "missing"},
+		{"op": "put", "key": "b"},
+		{"op": "rename", "key": "a"},
+		{"op": "put", "key": "_log", "value": "1"}
+	]}`
+	rec := httptest.NewRecorder()
+	batchHandler(apply, noRedirect).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/db/_batch", strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Batch returned %d: %s", rec.Code, rec.Body)
+	}
+	var resp batchResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	var statuses []int
+	for _, result := range resp.Results {
+		statuses = append(statuses, result.Status)
+	}
+	if want := []int{200, 200, 404, 400, 400, 400}; !reflect.DeepEqual(statuses, want) {
+		t.Errorf("Statuses %v, wanted %v", statuses, want)
+	}
+	if value, _ := db.Get("a"); value != "1" {
+		t.Errorf("a = %q", value)
+	}
+	if _, err := db.Get("old"); !errors.Is(err, datastore.ErrNotFound) {
+		t.Errorf("Deleted key returned %v", err)
+	}
+}
+
+func TestMgetHandler(t *testing.T) {
+	db, err := datastore.Open(t.TempDir(), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, key := range []string{"a", "b", "c"} {
+		if err := db.Put(key, "value-"+key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	body := `{"keys": ["a", "missing", "c", "a", "gone", "missing"]}`
+	rec := httptest.NewRecorder()
+	mgetHandler(db).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/db/_mget", strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Mget returned %d: %s", rec.Code, rec.Body)
+	}
+	var resp mgetResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	want := mgetResponse{
+		Values:  map[string]string{"a": "value-a", "c": "value-c"},
+		Missing: []string{"missing", "gone"},
+	}
+	if !reflect.DeepEqual(resp, want) {
+		t.Errorf("Mget returned %+v, wanted %+v", resp, want)
+	}
+
+	rec = httptest.NewRecorder()
+	mgetHandler(db).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/db/_mget", strings.NewReader("[")))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Mget of invalid JSON returned %d", rec.Code)
+	}
+}
+
+func TestScanHandler(t *testing.T) {
+	db, err := datastore.Open(t.TempDir(), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, key := range []string{"user:3", "user:1", "user:2", "other", "user:4"} {
+		if err := db.Put(key, "value of "+key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete("user:4"); err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	after := ""
+	for pages := 0; ; pages++ {
+		if pages == 5 {
+			t.Fatal("Scan does not end")
+		}
+		rec := httptest.NewRecorder()
+		scanHandler(db).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/db/_scan?prefix=user:&limit=2&after="+after, nil))
+		var resp scanResponse
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		for _, item := range resp.Items {
+			if item.Value != "value of "+item.Key {
+				t.Errorf("%s = %q", item.Key, item.Value)
+			}
+			keys = append(keys, item.Key)
+		}
+		if resp.Next == "" {
+			break
+		}
+		after = resp.Next
+	}
+	if want := []string{"user:1", "user:2", "user:3"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("Scanned %v, wanted %v", keys, want)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/dk872/architecture-lab5/datastore"
+	"github.com/dk872/architecture-lab5/kvwire"
+)
+
+// maxBinaryInFlight is the number of requests of a connection that run at
+// once; the connection is not read while that many are running.
+const maxBinaryInFlight = 64
+
+// binaryServer serves the datastore over kvwire. The requests of a
+// connection run concurrently and each response is written once its
+// request is done.
+type binaryServer struct {
+	db *datastore.Db
+	// apply runs writes, through the raft log in raft mode.
+	apply    func(context.Context, command) error
+	readOnly bool
+}
+
+func (s *binaryServer) handle(ctx context.Context, conn net.Conn) {
+	responses := make(chan kvwire.Frame, maxBinaryInFlight)
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		w := bufio.NewWriterSize(conn, 64<<10)
+		for resp := range responses {
+			// After an error the responses are still drained, the requests
+			// waiting to send theirs must not block.
+			if err := kvwire.WriteFrame(w, resp); err != nil {
+				conn.Close()
+				continue
+			}
+			if len(responses) == 0 {
+				if err := w.Flush(); err != nil {
+					conn.Close()
+				}
+			}
+		}
+	}()
+
+	r := bufio.NewReaderSize(conn, 64<<10)
+	inFlight := make(chan struct{}, maxBinaryInFlight)
+	var wg sync.WaitGroup
+	for {
+		req, err := kvwire.ReadFrame(r)
+		if err != nil {
+			if errors.Is(err, kvwire.ErrFrameTooLarge) || errors.Is(err, kvwire.ErrMalformed) {
+				log.Printf("Dropping binary connection from %s: %v", conn.RemoteAddr(), err)
+			}
+			break
+		}
+		inFlight <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp := s.exec(ctx, req)
+			if len(resp.Body) > kvwire.MaxBodySize {
+				resp.Status, resp.Body = http.StatusInternalServerError, []byte("response is too large")
+			}
+			responses <- resp
+			<-inFlight
+		}()
+	}
+	wg.Wait()
+	close(responses)
+	<-written
+}
+
+// exec runs a request and returns its response.
+func (s *binaryServer) exec(ctx context.Context, req kvwire.Frame) kvwire.Frame {
+	resp := kvwire.Frame{ID: req.ID, Op: req.Op}
+	d := kvwire.NewDecoder(req.Body)
+	var message string
+	switch req.Op {
+	case kvwire.OpGet:
+		key := d.Text()
+		if err := d.Err(); err != nil {
+			resp.Status, message = http.StatusBadRequest, err.Error()
+			break
+		}
+		resp.Status, message = s.get(ctx, key)
+
+	case kvwire.OpPut:
+		key, value := d.Text(), d.Text()
+		if err := d.Err(); err != nil {
+			resp.Status, message = http.StatusBadRequest, err.Error()
+			break
+		}
+		resp.Status, message = s.write(ctx, command{Op: datastore.OpPut.String(), Key: key, Value: value})
+
+	case kvwire.OpDelete:
+		key := d.Text()
+		if err := d.Err(); err != nil {
+			resp.Status, message = http.StatusBadRequest, err.Error()
+			break
+		}
+		resp.Status, message = s.write(ctx, command{Op: datastore.OpDelete.String(), Key: key})
+
+	case kvwire.OpGetMany:
+		keys := make([]string, d.Count())
+		for i := range keys {
+			keys[i] = d.Text()
+		}
+		if err := d.Err(); err != nil {
+			resp.Status, message = http.StatusBadRequest, err.Error()
+			break
+		}
+		values, err := s.db.GetManyContext(ctx, keys)
+		if err != nil {
+			status, text := errorStatus(err, "failed to read the keys")
+			resp.Status, message = uint16(status), text
+			break
+		}
+		resp.Status = http.StatusOK
+		resp.Body = kvwire.AppendUvarint(nil, uint64(len(keys)))
+		for _, key := range keys {
+			if value, ok := values[key]; ok {
+				resp.Body = kvwire.AppendString(kvwire.AppendStatus(resp.Body, http.StatusOK), value)
+			} else {
+				resp.Body = kvwire.AppendString(kvwire.AppendStatus(resp.Body, http.StatusNotFound), "not found")
+			}
+		}
+		return resp
+
+	case kvwire.OpPutMany:
+		cmds := make([]command, d.Count())
+		for i := range cmds {
+			cmds[i] = command{Op: datastore.OpPut.String(), Key: d.Text(), Value: d.Text()}
+		}
+		if err := d.Err(); err != nil {
+			resp.Status, message = http.StatusBadRequest, err.Error()
+			break
+		}
+		resp.Status = http.StatusOK
+		resp.Body = kvwire.AppendUvarint(nil, uint64(len(cmds)))
+		for _, cmd := range cmds {
+			status, message := s.write(ctx, cmd)
+			resp.Body = kvwire.AppendString(kvwire.AppendStatus(resp.Body, status), message)
+		}
+		return resp
+
+	default:
+		resp.Status, message = http.StatusBadRequest, "unknown op "+req.Op.String()
+	}
+	resp.Body = []byte(message)
+	return resp
+}
+
+// get returns the status and the value of key, or the error message.
+func (s *binaryServer) get(ctx context.Context, key string) (uint16, string) {
+	if key == "" {
+		return http.StatusBadRequest, "missing key"
+	}
+	value, err := s.db.GetContext(ctx, key)
+	if err != nil {
+		status, message := errorStatus(err, "internal error")
+		return uint16(status), message
+	}
+	return http.StatusOK, value
+}
+
+func (s *binaryServer) write(ctx context.Context, cmd command) (uint16, string) {
+	switch {
+	case cmd.Key == "":
+		return http.StatusBadRequest, "missing key"
+	case cmd.Op == datastore.OpPut.String() && cmd.Value == "":
+		return http.StatusBadRequest, "missing value"
+	case s.readOnly:
+		return http.StatusMisdirectedRequest, "this node is a read-only follower"
+	}
+	if err := s.apply(ctx, cmd); err != nil {
+		status, message := errorStatus(err, "failed to apply "+cmd.Op)
+		return uint16(status), message
+	}
+	return http.StatusOK, ""
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/dk872/architecture-lab5/datastore"
+	"github.com/dk872/architecture-lab5/dbclient"
+	"github.com/dk872/architecture-lab5/kvwire"
+)
+
+func startBinary(t *testing.T, readOnly bool) (*datastore.Db, string) {
+	t.Helper()
+	db, err := datastore.Open(t.TempDir(), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	apply := func(ctx context.Context, cmd command) error {
+		return applyCommand(ctx, db, cmd)
+	}
+	s := newConnServer("binary", (&binaryServer{db: db, apply: apply, readOnly: readOnly}).handle)
+	go s.serve(l)
+	t.Cleanup(func() {
+		s.close()
+		db.Close()
+	})
+	return db, l.Addr().String()
+}
+
+func TestBinary(t *testing.T) {
+	db, addr := startBinary(t, false)
+	ctx := context.Background()
+	c, err := dbclient.DialBinary(ctx, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Put(ctx, "key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := c.Get(ctx, "key"); err != nil || value != "value" {
+		t.Errorf("Get = %q, %v", value, err)
+	}
+	if _, err := c.Get(ctx, "missing"); !errors.Is(err, dbclient.ErrNotFound) {
+		t.Errorf("Get of a missing key returned %v", err)
+	}
+	var statusErr *dbclient.StatusError
+	if err := c.Put(ctx, "key", ""); !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("Put of an empty value returned %v", err)
+	}
+
+	errs, err := c.PutMany(ctx, dbclient.KeyValue{Key: "a", Value: "1"}, dbclient.KeyValue{Key: "", Value: "2"}, dbclient.KeyValue{Key: "b", Value: "3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs[0] != nil || errs[1] == nil || errs[2] != nil {
+		t.Errorf("PutMany returned %v", errs)
+	}
+	values, err := c.GetMany(ctx, "a", "missing", "b", "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"a": "1", "b": "3", "key": "value"}; !reflect.DeepEqual(values, want) {
+		t.Errorf("GetMany = %v, wanted %v", values, want)
+	}
+
+	if err := c.Delete(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Delete(ctx, "key"); !errors.Is(err, dbclient.ErrNotFound) {
+		t.Errorf("Second Delete returned %v", err)
+	}
+	if _, err := db.Get("key"); !errors.Is(err, datastore.ErrNotFound) {
+		t.Errorf("Get after Delete returned %v", err)
+	}
+}
+
+func TestBinaryPipelining(t *testing.T) {
+	_, addr := startBinary(t, false)
+	ctx := context.Background()
+	c, err := dbclient.DialBinary(ctx, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Every goroutine shares the one connection.
+	var wg sync.WaitGroup
+	errs := make(chan error, 200)
+	for i := range 200 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			key, value := fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)
+			if err := c.Put(ctx, key, value); err != nil {
+				errs <- err
+				return
+			}
+			if got, err := c.Get(ctx, key); err != nil || got != value {
+				errs <- fmt.Errorf("Get(%q) = %q, %v", key, got, err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestBinaryFrames(t *testing.T) {
+	_, addr := startBinary(t, false)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The requests are written at once and answered by ID.
+	var requests []byte
+	requests = kvwire.AppendFrame(requests, kvwire.Frame{ID: 7, Op: kvwire.OpPut, Body: kvwire.AppendString(kvwire.AppendString(nil, "key"), "value")})
+	requests = kvwire.AppendFrame(requests, kvwire.Frame{ID: 8, Op: kvwire.OpGet, Body: []byte{0xff}})
+	requests = kvwire.AppendFrame(requests, kvwire.Frame{ID: 9, Op: 100})
+	if _, err := conn.Write(requests); err != nil {
+		t.Fatal(err)
+	}
+	statuses := make(map[uint32]uint16)
+	for range 3 {
+		resp, err := kvwire.ReadFrame(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		statuses[resp.ID] = resp.Status
+	}
+	if want := map[uint32]uint16{7: http.StatusOK, 8: http.StatusBadRequest, 9: http.StatusBadRequest}; !reflect.DeepEqual(statuses, want) {
+		t.Errorf("Statuses by ID = %v, wanted %v", statuses, want)
+	}
+}
+
+func TestBinaryReadOnly(t *testing.T) {
+	_, addr := startBinary(t, true)
+	ctx := context.Background()
+	c, err := dbclient.DialBinary(ctx, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	var statusErr *dbclient.StatusError
+	if err := c.Put(ctx, "key", "value"); !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusMisdirectedRequest {
+		t.Errorf("Put on a follower returned %v", err)
+	}
+
+	c.Close()
+	if _, err := c.Get(ctx, "key"); !errors.Is(err, dbclient.ErrConnectionClosed) {
+		t.Errorf("Get after Close returned %v", err)
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/dk872/architecture-lab5/datastore"
+	"github.com/dk872/architecture-lab5/raft"
+)
+
+// command is a write that goes through the raft log.
+type command struct {
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	// Expires is in Unix nanoseconds, 0 for values that do not expire.
+	Expires   int64  `json:"expires,omitempty"`
+	Flags     uint32 `json:"flags,omitempty"`
+	IfAbsent  bool   `json:"ifAbsent,omitempty"`
+	IfPresent bool   `json:"ifPresent,omitempty"`
+}
+
+// appliedFileName is the file next to the datastore that holds the index
+// of the last raft entry applied to it.
+const appliedFileName = "RAFT_APPLIED"
+
+// dbMachine applies committed commands to the datastore. The datastore is
+// durable, and the index of the last command applied is saved after every
+// command, so a restart does not apply a command twice: an increment would
+// be added again. Only a crash between a command and the save applies that
+// one command again.
+type dbMachine struct {
+	db   *datastore.Db
+	path string
+}
+
+func newDBMachine(db *datastore.Db, dir string) dbMachine {
+	return dbMachine{db: db, path: filepath.Join(dir, appliedFileName)}
+}
+
+func (m dbMachine) Apply(index uint64, data []byte) error {
+	var cmd command
+	if err := json.Unmarshal(data, &cmd); err != nil {
+		return err
+	}
+	err := applyCommand(context.Background(), m.db, cmd)
+	m.save(index)
+	return err
+}
+
+// Applied returns the saved index, 0 if there is none.
+func (m dbMachine) Applied() uint64 {
+	data, err := os.ReadFile(m.path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Failed to read the applied raft index: %v", err)
+		}
+		return 0
+	}
+	index, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		log.Printf("Failed to read the applied raft index: %v", err)
+		return 0
+	}
+	return index
+}
+
+// save writes the index of the last command applied. A failed save only
+// makes a restart apply the commands since the previous one again.
+func (m dbMachine) save(index uint64) {
+	tmp := m.path + ".tmp"
+	err := os.WriteFile(tmp, []byte(strconv.FormatUint(index, 10)+"\n"), 0600)
+	if err == nil {
+		err = os.Rename(tmp, m.path)
+	}
+	if err != nil {
+		log.Printf("Failed to save the applied raft index: %v", err)
+	}
+}
+
+func (m dbMachine) Snapshot(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	for _, key := range m.db.Keys() {
+		item, err := m.db.GetItem(context.Background(), key)
+		if errors.Is(err, datastore.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		cmd := command{Op: datastore.OpPut.String(), Key: key, Value: item.Value, Expires: unixNano(item.Expires), Flags: item.Flags}
+		if err := enc.Encode(cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Restore applies the puts of a snapshot and deletes the keys it does not
+// hold.
+func (m dbMachine) Restore(r io.Reader) error {
+	restored := make(map[string]bool)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 64<<20)
+	for scanner.Scan() {
+		var cmd command
+		if err := json.Unmarshal(scanner.Bytes(), &cmd); err != nil {
+			return err
+		}
+		if err := applyCommand(context.Background(), m.db, cmd); err != nil {
+			return err
+		}
+		restored[cmd.Key] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	for _, key := range m.db.Keys() {
+		if restored[key] {
+			continue
+		}
+		if err := m.db.Delete(key); err != nil && !errors.Is(err, datastore.ErrNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseMembers parses "id=url,id=url".
+func parseMembers(s string) (raft.Members, error) {
+	members := make(raft.Members)
+	for _, member := range strings.Split(s, ",") {
+		id, addr, ok := strings.Cut(strings.TrimSpace(member), "=")
+		if !ok || id == "" || addr == "" {
+			return nil, fmt.Errorf("invalid raft member %q, want id=url", member)
+		}
+		members[id] = addr
+	}
+	return members, nil
+}
+
+// cluster routes the writes of a raft node through the log.
+type cluster struct {
+	node *raft.Node
+}
+
+// apply proposes a write and waits until this node has applied it.
+func (c cluster) apply(ctx context.Context, cmd command) error {
+	data, _ := json.Marshal(cmd)
+	return c.node.Propose(ctx, data)
+}
+
+// propose writes cmd through the log. Followers redirect the client to the
+// leader; 307 keeps the method and body.
+func (c cluster) propose(w http.ResponseWriter, r *http.Request, cmd command) {
+	err := c.apply(r.Context(), cmd)
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusOK)
+	case errors.Is(err, raft.ErrNotLeader) && c.redirect(w, r):
+	default:
+		writeError(w, err, "failed to apply "+cmd.Op)
+	}
+}
+
+// redirect sends the client of a write to the leader and reports whether
+// this node is not the leader.
+func (c cluster) redirect(w http.ResponseWriter, r *http.Request) bool {
+	s := c.node.Status()
+	switch {
+	case s.Role == raft.Leader:
+		return false
+	case s.LeaderAddr != "":
+		http.Redirect(w, r, strings.TrimSuffix(s.LeaderAddr, "/")+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+	default:
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "no raft leader", http.StatusServiceUnavailable)
+	}
+	return true
+}
+
+type statusResponse struct {
+	ID          string       `json:"id"`
+	Role        string       `json:"role"`
+	Term        uint64       `json:"term"`
+	Leader      string       `json:"leader"`
+	LeaderAddr  string       `json:"leaderAddr"`
+	CommitIndex uint64       `json:"commitIndex"`
+	LastApplied uint64       `json:"lastApplied"`
+	Members     raft.Members `json:"members"`
+}
+
+type memberRequest struct {
+	ID      string `json:"id"`
+	Address string `json:"address"`
+}
+
+// statusHandler serves GET /raft/status.
+func (c cluster) statusHandler(w http.ResponseWriter, r *http.Request) {
+	s := c.node.Status()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(statusResponse{
+		ID:          s.ID,
+		Role:        s.Role.String(),
+		Term:        s.Term,
+		Leader:      s.Leader,
+		LeaderAddr:  s.LeaderAddr,
+		CommitIndex: s.CommitIndex,
+		LastApplied: s.LastApplied,
+		Members:     s.Members,
+	})
+}
+
+// membersHandler adds a member with POST {"id", "address"} and removes one
+// with DELETE ?id=. Only the leader changes the membership.
+func (c cluster) membersHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+	switch r.Method {
+	case http.MethodPost:
+		var req memberRequest
+		if decodeErr := json.NewDecoder(r.Body).Decode(&req); decodeErr != nil || req.ID == "" || req.Address == "" {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		err = c.node.AddMember(r.Context(), req.ID, req.Address)
+	case http.MethodDelete:
+		err = c.node.RemoveMember(r.Context(), r.URL.Query().Get("id"))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusOK)
+	case errors.Is(err, raft.ErrNotLeader):
+		if leader := c.node.Status().LeaderAddr; leader != "" {
+			http.Redirect(w, r, strings.TrimSuffix(leader, "/")+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+			return
+		}
+		http.Error(w, "no raft leader", http.StatusServiceUnavailable)
+	case errors.Is(err, raft.ErrUnknownMember):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, raft.ErrChangeInFlight):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		writeError(w, err, "membership change failed")
+	}
+}
+
+func (c cluster) writeTo(w io.Writer) {
+	s := c.node.Status()
+	leader := 0
+	if s.Role == raft.Leader {
+		leader = 1
+	}
+	writeHeader(w, "db_raft_term", "gauge", "Current raft term.")
+	fmt.Fprintf(w, "db_raft_term %d\n", s.Term)
+	writeHeader(w, "db_raft_leader", "gauge", "Whether this node is the raft leader.")
+	fmt.Fprintf(w, "db_raft_leader %d\n", leader)
+	writeHeader(w, "db_raft_members", "gauge", "Voting members of the cluster.")
+	fmt.Fprintf(w, "db_raft_members %d\n", len(s.Members))
+	writeHeader(w, "db_raft_commit_index", "gauge", "Index of the last committed log entry.")
+	fmt.Fprintf(w, "db_raft_commit_index %d\n", s.CommitIndex)
+	writeHeader(w, "db_raft_applied_index", "gauge", "Index of the last log entry applied to the datastore.")
+	fmt.Fprintf(w, "db_raft_applied_index %d\n", s.LastApplied)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dk872/architecture-lab5/datastore"
+	"github.com/dk872/architecture-lab5/raft"
+)
+
+type clusterNode struct {
+	db      *datastore.Db
+	server  *httptest.Server
+	cluster *cluster
+}
+
+func startCluster(t *testing.T, size int) []*clusterNode {
+	t.Helper()
+	nodes := make([]*clusterNode, size)
+	handlers := make([]atomic.Pointer[http.ServeMux], size)
+	members := make(raft.Members)
+	dirs := make([]string, size)
+	for i := range nodes {
+		dirs[i] = t.TempDir()
+		db, err := datastore.Open(dirs[i], 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if mux := handlers[i].Load(); mux != nil {
+				mux.ServeHTTP(w, r)
+				return
+			}
+			http.Error(w, "starting", http.StatusServiceUnavailable)
+		}))
+		nodes[i] = &clusterNode{db: db, server: server}
+		members[string(rune('a'+i))] = server.URL
+	}
+	for i, n := range nodes {
+		node, err := raft.Start(string(rune('a'+i)), t.TempDir(), newDBMachine(n.db, dirs[i]),
+			raft.WithMembers(members), raft.WithAddress(n.server.URL),
+			raft.WithTimeouts(100*time.Millisecond, 20*time.Millisecond))
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.cluster = &cluster{node: node}
+
+		mux := http.NewServeMux()
+		mux.Handle("/raft/", node.Handler())
+		mux.HandleFunc("/db/", func(w http.ResponseWriter, r *http.Request) {
+			var buf bytes.Buffer
+			_, _ = buf.ReadFrom(r.Body)
+			n.cluster.propose(w, r, command{Op: datastore.OpPut.String(), Key: strings.TrimPrefix(r.URL.Path, "/db/"), Value: buf.String()})
+		})
+		handlers[i].Store(mux)
+	}
+	t.Cleanup(func() {
+		for _, n := range nodes {
+			n.cluster.node.Stop()
+			n.server.Close()
+			n.db.Close()
+		}
+	})
+	return nodes
+}
+
+func TestClusterPut(t *testing.T) {
+	nodes := startCluster(t, 3)
+
+	// Wait for a leader, then write through a follower; the client follows
+	// the redirect to the leader.
+	var follower *clusterNode
+	deadline := time.Now().Add(5 * time.Second)
+	for follower == nil && time.Now().Before(deadline) {
+		for _, n := range nodes {
+			if s := n.cluster.node.Status(); s.Role == raft.Follower && s.LeaderAddr != "" {
+				follower = n
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if follower == nil {
+		t.Fatal("No leader was elected")
+	}
+
+	resp, err := http.Post(follower.server.URL+"/db/key", octetStream, strings.NewReader("value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Put through a follower returned %d", resp.StatusCode)
+	}
+	for _, n := range nodes {
+		waitForValue(t, n.db, "key", "value")
+	}
+}
+
+// applyRetrying applies cmd once the single node of a cluster has become
+// the leader.
+func applyRetrying(t *testing.T, c cluster, cmd command) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		err := c.apply(context.Background(), cmd)
+		if err == nil {
+			return
+		}
+		if !errors.Is(err, raft.ErrNotLeader) || time.Now().After(deadline) {
+			t.Fatalf("Applying %s returned %v", cmd.Op, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClusterRestartAppliesOnce(t *testing.T) {
+	dir, raftDir := t.TempDir(), t.TempDir()
+	db, err := datastore.Open(dir, 1024, datastore.WithTimestamps())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	start := func() cluster {
+		node, err := raft.Start("a", raftDir, newDBMachine(db, dir),
+			raft.WithMembers(raft.Members{"a": "http://127.0.0.1:1"}), raft.WithAddress("http://127.0.0.1:1"),
+			raft.WithTimeouts(50*time.Millisecond, 10*time.Millisecond))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cluster{node: node}
+	}
+
+	c := start()
+	for i := 0; i < 3; i++ {
+		applyRetrying(t, c, command{Op: opIncr, Key: "counter", Value: "1"})
+	}
+	c.node.Stop()
+
+	// The increments are in the datastore and must not be applied again.
+	c = start()
+	defer c.node.Stop()
+	applyRetrying(t, c, command{Op: datastore.OpPut.String(), Key: "after", Value: "restart"})
+	if value, _ := db.Get("counter"); value != "3" {
+		t.Errorf("counter = %q after a restart, wanted 3", value)
+	}
+}
+
+func TestDBMachineSnapshot(t *testing.T) {
+	src, err := datastore.Open(t.TempDir(), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	for _, key := range []string{"a", "b", "c"} {
+		if err := src.Put(key, "value of "+key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var snapshot bytes.Buffer
+	if err := (dbMachine{db: src}).Snapshot(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+	dst, err := datastore.Open(t.TempDir(), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	if err := (dbMachine{db: dst}).Restore(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		if value, err := dst.Get(key); err != nil || value != "value of "+key {
+			t.Errorf("Restored %q = %q, %v", key, value, err)
+		}
+	}
+}
+
+func TestParseMembers(t *testing.T) {
+	members, err := parseMembers("a=http://a:8083, b=http://b:8083")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 2 || members["b"] != "http://b:8083" {
+		t.Errorf("Parsed %v", members)
+	}
+	if _, err := parseMembers("a"); err == nil {
+		t.Error("Expected an error for a member without an address")
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"sync"
+)
+
+// connServer runs a handler for every connection of the TCP listeners of
+// a protocol, until close drops them all.
+type connServer struct {
+	name   string
+	handle func(ctx context.Context, conn net.Conn)
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mutex     sync.Mutex
+	listeners []net.Listener
+	conns     map[net.Conn]struct{}
+}
+
+func newConnServer(name string, handle func(ctx context.Context, conn net.Conn)) *connServer {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &connServer{
+		name:   name,
+		handle: handle,
+		ctx:    ctx,
+		cancel: cancel,
+		conns:  make(map[net.Conn]struct{}),
+	}
+}
+
+// serve accepts connections until close is called.
+func (s *connServer) serve(l net.Listener) {
+	s.mutex.Lock()
+	s.listeners = append(s.listeners, l)
+	s.mutex.Unlock()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.ctx.Err() == nil {
+				log.Printf("%s listener stopped: %v", s.name, err)
+			}
+			return
+		}
+		s.mutex.Lock()
+		if s.ctx.Err() != nil {
+			s.mutex.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mutex.Unlock()
+
+		go func() {
+			defer s.wg.Done()
+			defer func() {
+				s.mutex.Lock()
+				delete(s.conns, conn)
+				s.mutex.Unlock()
+				conn.Close()
+			}()
+			s.handle(s.ctx, conn)
+		}()
+	}
+}
+
+// close stops the listeners, drops the connections and waits until their
+// handlers return.
+func (s *connServer) close() {
+	s.mutex.Lock()
+	s.cancel()
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mutex.Unlock()
+	s.wg.Wait()
+}
@@ -1,25 +1,58 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"flag"
+	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/dk872/architecture-lab5/datastore"
 	"github.com/dk872/architecture-lab5/httptools"
+	"github.com/dk872/architecture-lab5/raft"
 	"github.com/dk872/architecture-lab5/signal"
 )
 
 var (
-	port        = flag.Int("port", 8083, "server port")
-	dbDir       = flag.String("dir", "./data", "path to db directory")
-	segmentSize = flag.Int64("segmentSize", 1024, "max segment size in bytes")
+	port          = flag.Int("port", 8083, "server port")
+	dbDir         = flag.String("dir", "./data", "path to db directory")
+	segmentSize   = flag.Int64("segmentSize", 1024, "max segment size in bytes")
+	closeTimeout  = flag.Duration("closeTimeout", 10*time.Second, "how long shutdown waits for queued writes and merges")
+	writeQueue    = flag.Int("writeQueue", 100, "number of writes that may wait for the writer")
+	failWhenBusy  = flag.Bool("failWhenBusy", false, "reject writes with 503 instead of waiting when the write queue is full")
+	compression   = flag.String("compression", "none", "value compression: none, flate or zlib")
+	compressMin   = flag.Int("compressThreshold", 256, "smallest value in bytes that gets compressed")
+	scrubEvery    = flag.Duration("scrubInterval", 0, "how often the scrubber verifies the sealed segments, 0 to disable")
+	scrubRate     = flag.Int64("scrubRate", 1<<20, "bytes per second the scrubber reads")
+	strictReads   = flag.Bool("checksumErrors", false, "fail reads of damaged records with 500 instead of 404")
+	role          = flag.String("role", "leader", "replication role: leader accepts writes, follower replicates the leader, raft joins a raft cluster")
+	leaderURL     = flag.String("leader", "", "base URL of the leader a follower replicates, e.g. http://db:8083")
+	raftID        = flag.String("raftID", "", "ID of this node in the raft cluster")
+	raftAddr      = flag.String("raftAddr", "", "base URL the other raft members reach this node at")
+	raftMembers   = flag.String("raftMembers", "", "initial raft members as id=url,id=url; empty to join an existing cluster")
+	repairPeers   = flag.String("repairPeers", "", "comma-separated base URLs of the replicas anti-entropy repairs against")
+	repairEvery   = flag.Duration("repairInterval", time.Minute, "how often to repair against the peers, 0 to only repair on request")
+	respPort      = flag.Int("respPort", 0, "port of the Redis protocol (RESP2) listener, 0 to disable")
+	memcachedPort = flag.Int("memcachedPort", 0, "port of the memcached text protocol listener, 0 to disable; not with -role=raft")
+	binaryPort    = flag.Int("binaryPort", 0, "port of the kvwire binary protocol listener, 0 to disable")
+	maxValueSize  = flag.Int64("maxValueSize", datastore.DefaultMaxValueSize, "length in bytes of the longest value")
+	maxBodySize   = flag.Int64("maxBodySize", 2*datastore.DefaultMaxValueSize, "length in bytes of the longest request body of the /db API")
+	keyFile       = flag.String("keyFile", "", "file with the AES keys values are encrypted with, one \"<id> <hex key>\" per line")
 )
 
+// octetStream requests and responses carry the raw value, streamed without
+// being buffered, instead of a JSON document.
+const octetStream = "application/octet-stream"
+
 type jsonResponse struct {
 	Key   string `json:"key"`
 	Value string `json:"value"`
@@ -36,29 +69,188 @@ func main() {
 		log.Fatalf("Failed to create db directory: %v", err)
 	}
 
-	db, err := datastore.Open(*dbDir, *segmentSize)
+	opts := []datastore.Option{
+		datastore.WithEventListener(logListener{}),
+		datastore.WithTimestamps(),
+		datastore.WithWriteQueueLength(*writeQueue),
+		datastore.WithMaxValueSize(*maxValueSize),
+	}
+	if *failWhenBusy {
+		opts = append(opts, datastore.WithFailWhenBusy())
+	}
+	switch *compression {
+	case "none":
+	case "flate":
+		opts = append(opts, datastore.WithCompression(datastore.Flate, *compressMin))
+	case "zlib":
+		opts = append(opts, datastore.WithCompression(datastore.Zlib, *compressMin))
+	default:
+		log.Fatalf("Unknown compression %q", *compression)
+	}
+	if *scrubEvery > 0 {
+		opts = append(opts, datastore.WithScrubber(*scrubEvery, *scrubRate))
+	}
+	if *strictReads {
+		opts = append(opts, datastore.WithChecksumErrors())
+	}
+	if *keyFile != "" {
+		keys, err := loadKeys(*keyFile)
+		if err != nil {
+			log.Fatalf("Failed to load encryption keys: %v", err)
+		}
+		opts = append(opts, datastore.WithEncryption(keys))
+	}
+	db, err := datastore.Open(*dbDir, *segmentSize, opts...)
 	if err != nil {
 		log.Fatalf("Failed to open datastore: %v", err)
 	}
-	defer db.Close()
 
 	mux := http.NewServeMux()
+	metrics := newRequestMetrics()
+	sources := []metricsSource{metrics}
+
+	var replica *follower
+	var raftCluster *cluster
+	replicaCtx, stopReplica := context.WithCancel(context.Background())
+	replicaDone := make(chan struct{})
+	switch *role {
+	case "leader":
+		close(replicaDone)
+	case "follower":
+		if *leaderURL == "" {
+			log.Fatal("A follower needs -leader")
+		}
+		replica = newFollower(db, *dbDir, *leaderURL)
+		sources = append(sources, replica)
+		go func() {
+			defer close(replicaDone)
+			replica.run(replicaCtx)
+		}()
+	case "raft":
+		close(replicaDone)
+		if *raftID == "" || *raftAddr == "" {
+			log.Fatal("A raft node needs -raftID and -raftAddr")
+		}
+		raftOpts := []raft.Option{raft.WithAddress(*raftAddr)}
+		if *raftMembers != "" {
+			members, err := parseMembers(*raftMembers)
+			if err != nil {
+				log.Fatal(err)
+			}
+			raftOpts = append(raftOpts, raft.WithMembers(members))
+		}
+		node, err := raft.Start(*raftID, filepath.Join(*dbDir, "raft"), newDBMachine(db, *dbDir), raftOpts...)
+		if err != nil {
+			log.Fatalf("Failed to start raft: %v", err)
+		}
+		raftCluster = &cluster{node: node}
+		sources = append(sources, raftCluster)
+		mux.Handle("/raft/", node.Handler())
+		mux.HandleFunc("/raft/status", raftCluster.statusHandler)
+		mux.HandleFunc("/raft/members", raftCluster.membersHandler)
+	default:
+		log.Fatalf("Unknown role %q", *role)
+	}
+
+	var peers []string
+	for _, peer := range strings.Split(*repairPeers, ",") {
+		if peer = strings.TrimSuffix(strings.TrimSpace(peer), "/"); peer != "" {
+			peers = append(peers, peer)
+		}
+	}
+	repairs := newAntiEntropy(db, peers)
+	sources = append(sources, repairs)
+	repairCtx, stopRepairs := context.WithCancel(context.Background())
+	repairsDone := make(chan struct{})
+	go func() {
+		defer close(repairsDone)
+		if len(peers) > 0 && *repairEvery > 0 {
+			repairs.run(repairCtx, *repairEvery)
+		}
+	}()
+	mux.Handle("/db/_merkle", metrics.instrument("merkle", treeHandler(db)))
+	mux.Handle("/db/_merkle/keys", metrics.instrument("merkle_keys", stampsHandler(db)))
+	mux.Handle("/db/_merkle/put", metrics.instrument("merkle_put", limitBody(*maxBodySize, repairPutHandler(db))))
+	mux.Handle("/db/_repair", metrics.instrument("repair", http.HandlerFunc(repairs.repairHandler)))
+
+	mux.Handle("/metrics", metricsHandler(db, sources...))
+	mux.Handle("/db/_watch", metrics.instrument("watch", watchHandler(db)))
+	mux.Handle("/db/_log", metrics.instrument("log", logHandler(db)))
+	mux.Handle("/db/_snapshot", metrics.instrument("snapshot", snapshotHandler(db)))
 
-	mux.HandleFunc("/db/", func(w http.ResponseWriter, r *http.Request) {
-		key := strings.TrimPrefix(r.URL.Path, "/db/")
-		if key == "" {
-			http.Error(w, "missing key", http.StatusBadRequest)
+	// redirect sends writes that this node does not take to the leader.
+	redirect := func(w http.ResponseWriter, r *http.Request) bool {
+		switch {
+		case replica != nil:
+			// 307 keeps the method and body.
+			http.Redirect(w, r, replica.leader+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+			return true
+		case raftCluster != nil:
+			return raftCluster.redirect(w, r)
+		}
+		return false
+	}
+	apply := func(ctx context.Context, cmd command) error {
+		return applyCommand(ctx, db, cmd)
+	}
+	if raftCluster != nil {
+		apply = raftCluster.apply
+	}
+	mux.Handle("/db/_batch", metrics.instrument("batch", limitBody(*maxBodySize, batchHandler(apply, redirect))))
+	mux.Handle("/db/_scan", metrics.instrument("scan", scanHandler(db)))
+	mux.Handle("/db/_mget", metrics.instrument("mget", limitBody(*maxBodySize, mgetHandler(db))))
+
+	// tooLarge replies 413 to a value raft would only reject once it is in
+	// the log.
+	tooLarge := func(w http.ResponseWriter, value string) bool {
+		if int64(len(value)) <= *maxValueSize {
+			return false
+		}
+		writeError(w, &datastore.ValueTooLargeError{Limit: *maxValueSize}, "")
+		return true
+	}
+
+	mux.Handle("/db/", metrics.instrument("key", limitBody(*maxBodySize, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, err := keyFromPath(r)
+		if err != nil {
+			writeError(w, err, "")
+			return
+		}
+
+		if replica != nil && r.Method != http.MethodGet {
+			redirect(w, r)
 			return
 		}
 
-		switch r.Method {
-		case http.MethodGet:
-			value, err := db.Get(key)
+		raw := strings.HasPrefix(r.Header.Get("Content-Type"), octetStream) ||
+			strings.Contains(r.Header.Get("Accept"), octetStream)
+
+		switch {
+		case r.Method == http.MethodGet && raw:
+			value, size, err := db.GetReader(r.Context(), key)
 			if err != nil {
 				if errors.Is(err, datastore.ErrNotFound) {
 					http.Error(w, "not found", http.StatusNotFound)
 				} else {
-					http.Error(w, "internal error", http.StatusInternalServerError)
+					writeError(w, err, "internal error")
+				}
+				return
+			}
+			defer value.Close()
+
+			w.Header().Set("Content-Type", octetStream)
+			w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+			if _, err := io.Copy(w, value); err != nil {
+				log.Printf("Failed to stream %q: %v", key, err)
+			}
+
+		case r.Method == http.MethodGet:
+			value, err := db.GetContext(r.Context(), key)
+			if err != nil {
+				if errors.Is(err, datastore.ErrNotFound) {
+					http.Error(w, "not found", http.StatusNotFound)
+				} else {
+					writeError(w, err, "internal error")
 				}
 				return
 			}
@@ -67,15 +259,56 @@ func main() {
 			w.Header().Set("Content-Type", "application/json")
 			_ = json.NewEncoder(w).Encode(resp)
 
-		case http.MethodPost:
+		case (r.Method == http.MethodPost || r.Method == http.MethodPut) && raw && raftCluster != nil:
+			// Raft entries hold the whole value.
+			value, err := io.ReadAll(io.LimitReader(r.Body, *maxValueSize+1))
+			if err != nil {
+				writeError(w, err, "failed to read value")
+				return
+			}
+			if tooLarge(w, string(value)) {
+				return
+			}
+			raftCluster.propose(w, r, command{Op: datastore.OpPut.String(), Key: key, Value: string(value)})
+
+		case (r.Method == http.MethodPost || r.Method == http.MethodPut) && raw:
+			if err := db.PutReader(r.Context(), key, r.Body); err != nil {
+				writeError(w, err, "failed to store value")
+				return
+			}
+
+			w.WriteHeader(http.StatusOK)
+
+		case r.Method == http.MethodPost:
 			var req jsonRequest
-			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Value == "" {
+			if !decodeJSON(w, r, &req) {
+				return
+			}
+			if req.Value == "" {
 				http.Error(w, "invalid JSON body", http.StatusBadRequest)
 				return
 			}
+			if raftCluster != nil {
+				if tooLarge(w, req.Value) {
+					return
+				}
+				raftCluster.propose(w, r, command{Op: datastore.OpPut.String(), Key: key, Value: req.Value})
+				return
+			}
 
-			if err := db.Put(key, req.Value); err != nil {
-				http.Error(w, "failed to store value", http.StatusInternalServerError)
+			if err := db.PutContext(r.Context(), key, req.Value); err != nil {
+				writeError(w, err, "failed to store value")
+				return
+			}
+
+			w.WriteHeader(http.StatusOK)
+
+		case r.Method == http.MethodDelete && raftCluster != nil:
+			raftCluster.propose(w, r, command{Op: datastore.OpDelete.String(), Key: key})
+
+		case r.Method == http.MethodDelete:
+			if err := db.DeleteContext(r.Context(), key); err != nil {
+				writeError(w, err, "failed to delete value")
 				return
 			}
 
@@ -84,9 +317,88 @@ func main() {
 		default:
 			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		}
-	})
+	}))))
+
+	var connServers []*connServer
+	listen := func(name string, port int, handle func(context.Context, net.Conn)) {
+		if port <= 0 {
+			return
+		}
+		l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+		if err != nil {
+			log.Fatalf("Failed to start the %s listener: %v", name, err)
+		}
+		s := newConnServer(name, handle)
+		connServers = append(connServers, s)
+		go s.serve(l)
+	}
+	listen("RESP", *respPort, (&respServer{db: db, cluster: raftCluster, readOnly: replica != nil}).handle)
+	if *memcachedPort > 0 && raftCluster != nil {
+		// cas compares timestamps, which every raft node stamps on its own.
+		log.Fatal("The memcached listener is not supported with -role=raft")
+	}
+	listen("memcached", *memcachedPort, (&memcachedServer{db: db, readOnly: replica != nil}).handle)
+	listen("binary", *binaryPort, (&binaryServer{db: db, apply: apply, readOnly: replica != nil}).handle)
 
 	server := httptools.CreateServer(*port, mux)
 	server.Start()
 	signal.WaitForTerminationSignal()
+
+	for _, s := range connServers {
+		s.close()
+	}
+
+	stopReplica()
+	<-replicaDone
+	stopRepairs()
+	<-repairsDone
+	if raftCluster != nil {
+		raftCluster.node.Stop()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *closeTimeout)
+	defer cancel()
+	if err := db.CloseContext(ctx); err != nil {
+		log.Printf("Failed to close datastore cleanly: %v", err)
+	}
+}
+
+// writeError maps the errors shared by all handlers to a response, falling
+// back to a 500 with the given message.
+func writeError(w http.ResponseWriter, err error, message string) {
+	if errors.Is(err, context.Canceled) {
+		// The client has gone away, nobody reads the response.
+		return
+	}
+	if errors.Is(err, datastore.ErrBusy) {
+		w.Header().Set("Retry-After", "1")
+	}
+	status, text := errorStatus(err, message)
+	http.Error(w, text, status)
+}
+
+func errorStatus(err error, message string) (int, string) {
+	switch {
+	case errors.Is(err, datastore.ErrNotFound):
+		return http.StatusNotFound, "not found"
+	case errors.Is(err, errUnknownOp), errors.Is(err, errNotInteger), errors.Is(err, errOverflow):
+		return http.StatusBadRequest, err.Error()
+	case errors.Is(err, datastore.ErrInvalidKey), errors.Is(err, datastore.ErrKeyTooLarge):
+		return http.StatusBadRequest, err.Error()
+	case errors.Is(err, datastore.ErrValueTooLarge), errors.As(err, new(*http.MaxBytesError)):
+		return http.StatusRequestEntityTooLarge, err.Error()
+	case errors.Is(err, datastore.ErrConflict):
+		return http.StatusConflict, err.Error()
+	case errors.Is(err, datastore.ErrClosed):
+		return http.StatusServiceUnavailable, "shutting down"
+	case errors.Is(err, datastore.ErrBusy):
+		return http.StatusServiceUnavailable, "write queue is full"
+	case errors.Is(err, raft.ErrNotLeader), errors.Is(err, raft.ErrLeadershipLost), errors.Is(err, raft.ErrStopped):
+		return http.StatusServiceUnavailable, err.Error()
+	case errors.Is(err, datastore.ErrChecksumMismatch):
+		return http.StatusInternalServerError, "record is corrupted"
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout, "request timed out"
+	default:
+		return http.StatusInternalServerError, message
+	}
 }
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"log"
+
+	"github.com/dk872/architecture-lab5/datastore"
+)
+
+// logListener reports datastore failures in the process log.
+type logListener struct {
+	datastore.NoopEventListener
+}
+
+func (logListener) MergeFinished(info datastore.MergeInfo) {
+	if info.Err != nil {
+		log.Printf("Merge of %v into %v failed after %s: %v", info.Inputs, info.Outputs, info.Duration, info.Err)
+		return
+	}
+	log.Printf("Merged %d segments (%d bytes) into %d (%d bytes) in %s",
+		len(info.Inputs), info.BytesIn, len(info.Outputs), info.BytesOut, info.Duration)
+}
+
+func (logListener) ChecksumMismatch(info datastore.ChecksumInfo) {
+	if info.Blob != "" {
+		log.Printf("Checksum mismatch in blob %s referenced from %s at offset %d (key %q)", info.Blob, info.Segment, info.Offset, info.Key)
+		return
+	}
+	log.Printf("Checksum mismatch in %s at offset %d (key %q)", info.Segment, info.Offset, info.Key)
+}
+
+func (logListener) ScrubFinished(info datastore.ScrubInfo) {
+	if info.Err != nil || info.Corrupt > 0 {
+		log.Printf("Scrubbed %d records in %d segments in %s: %d corrupt, error %v",
+			info.Records, info.Segments, info.Duration, info.Corrupt, info.Err)
+	}
+}
+
+func (logListener) RecoveryCompleted(info datastore.RecoveryInfo) {
+	log.Printf("Recovered %d keys from %d segments in %s, truncated %d bytes",
+		info.Keys, info.Segments, info.Duration, info.TruncatedBytes)
+}
+
+func (logListener) WriteFailed(info datastore.WriteErrorInfo) {
+	log.Printf("Write of key %q failed: %v", info.Key, info.Err)
+}
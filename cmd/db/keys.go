@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/dk872/architecture-lab5/datastore"
+)
+
+// loadKeys reads encryption keys from a file with one "<id> <hex key>" pair
+// per line. The key with the highest ID encrypts new records; to rotate, add
+// a key with a higher ID and restart, then drop the old key once merges have
+// rewritten the records under the new one.
+func loadKeys(path string) (datastore.StaticKeys, error) {
+	keys := datastore.StaticKeys{Keys: make(map[uint32][]byte)}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return keys, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return keys, fmt.Errorf("%s:%d: expected \"<id> <hex key>\"", path, line)
+		}
+		id, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			return keys, fmt.Errorf("%s:%d: bad key id: %w", path, line, err)
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return keys, fmt.Errorf("%s:%d: bad key: %w", path, line, err)
+		}
+		if n := len(key); n != 16 && n != 24 && n != 32 {
+			return keys, fmt.Errorf("%s:%d: key must be 16, 24 or 32 bytes, got %d", path, line, n)
+		}
+		keys.Keys[uint32(id)] = key
+		if uint32(id) > keys.Current || len(keys.Keys) == 1 {
+			keys.Current = uint32(id)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return keys, err
+	}
+	if len(keys.Keys) == 0 {
+		return keys, fmt.Errorf("%s: no keys", path)
+	}
+	return keys, nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	content := "# rotated on deploy\n" +
+		"1 " + strings.Repeat("01", 32) + "\n" +
+		"\n" +
+		"2 " + strings.Repeat("02", 16) + "\n"
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := loadKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys.Current != 2 || len(keys.Keys) != 2 || len(keys.Keys[1]) != 32 || len(keys.Keys[2]) != 16 {
+		t.Errorf("Unexpected keys: current %d, %d keys", keys.Current, len(keys.Keys))
+	}
+
+	if err := os.WriteFile(path, []byte("1 abcd\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadKeys(path); err == nil {
+		t.Error("Expected a short key to be rejected")
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/dk872/architecture-lab5/datastore"
+)
+
+// reservedPrefix starts the paths of the endpoints under /db/, such as
+// /db/_batch, so the HTTP API takes no key that starts with it. The RESP,
+// memcached and kvwire listeners have no such paths and take those keys.
+const reservedPrefix = "_"
+
+// keyFromPath returns the key of a /db/{key} request, which follows the
+// rules of validateKey. It is decoded from the escaped path, so keys with
+// '/', '?', '%' or any other byte are addressed percent-encoded, as
+// url.PathEscape does.
+func keyFromPath(r *http.Request) (string, error) {
+	key, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/db/"))
+	if err != nil {
+		return "", &datastore.KeyError{Key: key, Reason: "invalid percent-encoding"}
+	}
+	return key, validateKey(key)
+}
+
+// validateKey checks a key of the HTTP API: the rules of
+// datastore.ValidateKey, and that it does not start with reservedPrefix.
+func validateKey(key string) error {
+	if strings.HasPrefix(key, reservedPrefix) {
+		return &datastore.KeyError{Key: key, Reason: fmt.Sprintf("starts with %q, which is reserved for the endpoints", reservedPrefix)}
+	}
+	return datastore.ValidateKey(key)
+}
+
+// limitBody makes reading more than n bytes of a request body fail with an
+// *http.MaxBytesError, which writeError turns into a 413.
+func limitBody(n int64, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, n)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// decodeJSON decodes the request body into v. It replies 413 to a body over
+// the limit and 400 to one that is not valid JSON, and returns false then.
+func decodeJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	err := json.NewDecoder(r.Body).Decode(v)
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		writeError(w, err, "")
+	case err != nil:
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+	}
+	return err == nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dk872/architecture-lab5/datastore"
+)
+
+func TestKeyFromPath(t *testing.T) {
+	for _, c := range []struct {
+		path, key string
+		err       error
+	}{
+		{"/db/plain", "plain", nil},
+		{"/db/a%2Fb", "a/b", nil},
+		{"/db/a/b", "a/b", nil},
+		{"/db/a%3Fb", "a?b", nil},
+		{"/db/100%25", "100%", nil},
+		{"/db/%D0%BA%D0%BB%D1%8E%D1%87", "ключ", nil},
+		{"/db/", "", datastore.ErrInvalidKey},
+		{"/db/%FF", "", datastore.ErrInvalidKey},
+		{"/db/_unknown", "", datastore.ErrInvalidKey},
+		{"/db/" + strings.Repeat("k", datastore.MaxKeySize+1), "", datastore.ErrKeyTooLarge},
+	} {
+		key, err := keyFromPath(httptest.NewRequest(http.MethodGet, c.path, nil))
+		if c.err != nil {
+			if !errors.Is(err, c.err) {
+				t.Errorf("keyFromPath(%.30q) returned %v, wanted %v", c.path, err, c.err)
+			}
+			continue
+		}
+		if err != nil || key != c.key {
+			t.Errorf("keyFromPath(%q) = %q, %v, wanted %q", c.path, key, err, c.key)
+		}
+	}
+}
+
+func TestBodyLimits(t *testing.T) {
+	db, err := datastore.Open(t.TempDir(), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	h := limitBody(32, mgetHandler(db))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/db/_mget", strings.NewReader(`{"keys": ["a", "b"]}`)))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Small body returned %d: %s", rec.Code, rec.Body)
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/db/_mget", strings.NewReader(`{"keys": ["`+strings.Repeat("a", 100)+`"]}`)))
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Large body returned %d: %s", rec.Code, rec.Body)
+	}
+
+	if status, _ := errorStatus(&datastore.ValueTooLargeError{Limit: 10}, ""); status != http.StatusRequestEntityTooLarge {
+		t.Errorf("ValueTooLargeError maps to %d", status)
+	}
+	if status, _ := errorStatus(datastore.ValidateKey(""), ""); status != http.StatusBadRequest {
+		t.Errorf("KeyError maps to %d", status)
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dk872/architecture-lab5/datastore"
+)
+
+const (
+	maxMemcachedKey   = 250
+	maxMemcachedValue = 1 << 20
+	// maxRelativeExptime is the largest exptime taken as seconds from now,
+	// larger ones are Unix times.
+	maxRelativeExptime = 60 * 60 * 24 * 30
+)
+
+// memcachedServer serves the datastore over the memcached text protocol.
+// The cas unique of a value is its timestamp, so cas needs WithTimestamps.
+type memcachedServer struct {
+	db       *datastore.Db
+	readOnly bool
+}
+
+func (s *memcachedServer) handle(ctx context.Context, conn net.Conn) {
+	r := bufio.NewReaderSize(conn, 64<<10)
+	w := bufio.NewWriterSize(conn, 64<<10)
+	for {
+		line, err := r.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			w.WriteString("CLIENT_ERROR line too long\r\n")
+			w.Flush()
+			return
+		}
+		if err != nil {
+			return
+		}
+		args := strings.Fields(string(line))
+		if len(args) > 0 && !s.exec(ctx, args, r, w) {
+			w.Flush()
+			return
+		}
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// exec runs a command and writes its reply. It returns false when the
+// connection should be closed.
+func (s *memcachedServer) exec(ctx context.Context, args []string, r *bufio.Reader, w *bufio.Writer) bool {
+	name := args[0]
+	args = args[1:]
+	// noreply is the optional last argument of every command that writes.
+	noreply := false
+	reply := func(s string) {
+		if !noreply || strings.HasPrefix(s, "CLIENT_ERROR") || strings.HasPrefix(s, "SERVER_ERROR") {
+			w.WriteString(s + "\r\n")
+		}
+	}
+	replyErr := func(err error) {
+		status, text := errorStatus(err, "internal error")
+		if status == http.StatusBadRequest || status == http.StatusRequestEntityTooLarge {
+			reply("CLIENT_ERROR " + text)
+			return
+		}
+		reply("SERVER_ERROR " + text)
+	}
+	optional := func(n int) bool {
+		switch {
+		case len(args) == n:
+			return true
+		case len(args) == n+1 && args[n] == "noreply":
+			noreply = true
+			return true
+		}
+		return false
+	}
+
+	switch name {
+	case "get", "gets":
+		if len(args) == 0 {
+			reply("ERROR")
+			return true
+		}
+		for _, key := range args {
+			if !validMemcachedKey(key) {
+				reply("CLIENT_ERROR bad command line format")
+				return true
+			}
+		}
+		for _, key := range args {
+			item, err := s.db.GetItem(ctx, key)
+			if errors.Is(err, datastore.ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				replyErr(err)
+				return true
+			}
+			w.WriteString("VALUE " + key + " " + strconv.FormatUint(uint64(item.Flags), 10) + " " + strconv.Itoa(len(item.Value)))
+			if name == "gets" {
+				w.WriteString(" " + strconv.FormatUint(item.Timestamp, 10))
+			}
+			w.WriteString("\r\n" + item.Value + "\r\n")
+		}
+		reply("END")
+
+	case "set", "cas":
+		n := 4
+		if name == "cas" {
+			n = 5
+		}
+		if len(args) < n {
+			reply("ERROR")
+			return true
+		}
+		size, err := strconv.Atoi(args[3])
+		if err != nil || size < 0 {
+			reply("CLIENT_ERROR bad command line format")
+			return true
+		}
+		flags, errFlags := strconv.ParseUint(args[1], 10, 32)
+		exptime, errExptime := strconv.ParseInt(args[2], 10, 64)
+		var unique uint64
+		if name == "cas" {
+			unique, err = strconv.ParseUint(args[4], 10, 64)
+		}
+		invalid := !optional(n) || errFlags != nil || errExptime != nil || err != nil || !validMemcachedKey(args[0])
+		if invalid || size > maxMemcachedValue {
+			// The data is skipped so that it is not read as commands.
+			if _, err := io.CopyN(io.Discard, r, int64(size)+2); err != nil {
+				return false
+			}
+			if invalid {
+				reply("CLIENT_ERROR bad command line format")
+			} else {
+				reply("SERVER_ERROR object too large for cache")
+			}
+			return true
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return false
+		}
+		if string(data[size:]) != "\r\n" {
+			reply("CLIENT_ERROR bad data chunk")
+			return true
+		}
+		if s.readOnly {
+			reply("SERVER_ERROR this node is a read-only follower")
+			return true
+		}
+		opts := datastore.WriteOptions{Expires: fromExptime(exptime), Flags: uint32(flags)}
+		if name == "cas" {
+			opts.IfTimestamp, opts.IfPresent = unique, true
+		}
+		if name == "cas" && unique == 0 {
+			// No value has cas unique 0, and IfTimestamp would ignore it.
+			err = datastore.ErrConflict
+		} else {
+			err = s.db.PutWith(ctx, args[0], strings.NewReader(string(data[:size])), opts)
+		}
+		switch {
+		case errors.Is(err, datastore.ErrConflict):
+			if _, err := s.db.Stat(args[0]); errors.Is(err, datastore.ErrNotFound) {
+				reply("NOT_FOUND")
+			} else {
+				reply("EXISTS")
+			}
+		case err != nil:
+			replyErr(err)
+		default:
+			reply("STORED")
+		}
+
+	case "delete":
+		switch {
+		case len(args) == 0:
+			reply("ERROR")
+			return true
+		case !optional(1), !validMemcachedKey(args[0]):
+			reply("CLIENT_ERROR bad command line format")
+			return true
+		case s.readOnly:
+			reply("SERVER_ERROR this node is a read-only follower")
+			return true
+		}
+		err := s.db.DeleteContext(ctx, args[0])
+		switch {
+		case errors.Is(err, datastore.ErrNotFound):
+			reply("NOT_FOUND")
+		case err != nil:
+			replyErr(err)
+		default:
+			reply("DELETED")
+		}
+
+	case "incr":
+		if len(args) < 2 {
+			reply("ERROR")
+			return true
+		}
+		by, err := strconv.ParseUint(args[1], 10, 64)
+		switch {
+		case !optional(2), !validMemcachedKey(args[0]):
+			reply("CLIENT_ERROR bad command line format")
+			return true
+		case err != nil:
+			reply("CLIENT_ERROR invalid numeric delta argument")
+			return true
+		case s.readOnly:
+			reply("SERVER_ERROR this node is a read-only follower")
+			return true
+		}
+		n, err := memcachedIncr(ctx, s.db, args[0], by)
+		switch {
+		case errors.Is(err, datastore.ErrNotFound):
+			reply("NOT_FOUND")
+		case errors.Is(err, errNotInteger):
+			reply("CLIENT_ERROR cannot increment or decrement non-numeric value")
+		case err != nil:
+			replyErr(err)
+		default:
+			reply(strconv.FormatUint(n, 10))
+		}
+
+	case "touch":
+		if len(args) < 2 {
+			reply("ERROR")
+			return true
+		}
+		exptime, err := strconv.ParseInt(args[1], 10, 64)
+		switch {
+		case !optional(2), err != nil, !validMemcachedKey(args[0]):
+			reply("CLIENT_ERROR bad command line format")
+			return true
+		case s.readOnly:
+			reply("SERVER_ERROR this node is a read-only follower")
+			return true
+		}
+		err = s.db.Expire(ctx, args[0], fromExptime(exptime))
+		switch {
+		case errors.Is(err, datastore.ErrNotFound):
+			reply("NOT_FOUND")
+		case err != nil:
+			replyErr(err)
+		default:
+			reply("TOUCHED")
+		}
+
+	case "version":
+		reply("VERSION 1.6.0")
+	case "quit":
+		return false
+	default:
+		reply("ERROR")
+	}
+	return true
+}
+
+// memcachedIncr adds by to the value of key, an unsigned 64-bit integer
+// that wraps around, and keeps its flags and expiry. Unlike incr, a missing
+// key is ErrNotFound.
+func memcachedIncr(ctx context.Context, db *datastore.Db, key string, by uint64) (uint64, error) {
+	for {
+		item, err := db.GetItem(ctx, key)
+		if err != nil {
+			return 0, err
+		}
+		n, err := strconv.ParseUint(item.Value, 10, 64)
+		if err != nil {
+			return 0, errNotInteger
+		}
+		n += by
+
+		opts := datastore.WriteOptions{IfTimestamp: item.Timestamp, IfPresent: true, Expires: item.Expires, Flags: item.Flags}
+		err = db.PutWith(ctx, key, strings.NewReader(strconv.FormatUint(n, 10)), opts)
+		if errors.Is(err, datastore.ErrConflict) {
+			continue
+		}
+		return n, err
+	}
+}
+
+// fromExptime converts a memcached exptime: 0 for never, up to 30 days in
+// seconds from now, otherwise a Unix time. Negative ones have expired.
+func fromExptime(exptime int64) time.Time {
+	switch {
+	case exptime == 0:
+		return time.Time{}
+	case exptime < 0:
+		return time.Now().Add(-time.Second)
+	case exptime <= maxRelativeExptime:
+		return time.Now().Add(time.Duration(exptime) * time.Second)
+	default:
+		return time.Unix(exptime, 0)
+	}
+}
+
+func validMemcachedKey(key string) bool {
+	if len(key) > maxMemcachedKey {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
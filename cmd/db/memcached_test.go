@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dk872/architecture-lab5/datastore"
+)
+
+func startMemcached(t *testing.T, readOnly bool) (*datastore.Db, net.Conn) {
+	t.Helper()
+	db, err := datastore.Open(t.TempDir(), 1024, datastore.WithTimestamps())
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newConnServer("memcached", (&memcachedServer{db: db, readOnly: readOnly}).handle)
+	go s.serve(l)
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		s.close()
+		db.Close()
+	})
+	return db, conn
+}
+
+// memcachedExchange sends the requests at once and reads the given number of
+// reply lines.
+func memcachedExchange(t *testing.T, conn net.Conn, r *bufio.Reader, request string, lines int) []string {
+	t.Helper()
+	if _, err := conn.Write([]byte(request)); err != nil {
+		t.Fatal(err)
+	}
+	replies := make([]string, lines)
+	for i := range replies {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		replies[i] = strings.TrimSuffix(line, "\r\n")
+	}
+	return replies
+}
+
+func TestMemcached(t *testing.T) {
+	db, conn := startMemcached(t, false)
+	r := bufio.NewReader(conn)
+
+	// All commands are sent before any reply is read.
+	commands := []struct {
+		request string
+		reply   []string
+	}{
+		{"set key 42 0 5\r\nvalue\r\n", []string{"STORED"}},
+		{"get key missing\r\n", []string{"VALUE key 42 5", "value", "END"}},
+		{"set quiet 0 0 1 noreply\r\nx\r\n", nil},
+		{"get quiet\r\n", []string{"VALUE quiet 0 1", "x", "END"}},
+		{"cas key 1 0 3 1\r\nnew\r\n", []string{"EXISTS"}},
+		{"cas missing 1 0 3 1\r\nnew\r\n", []string{"NOT_FOUND"}},
+		{"set counter 3 100 2\r\n10\r\n", []string{"STORED"}},
+		{"incr counter 5\r\n", []string{"15"}},
+		{"incr counter 18446744073709551615\r\n", []string{"14"}},
+		{"get counter\r\n", []string{"VALUE counter 3 2", "14", "END"}},
+		{"incr key 1\r\n", []string{"CLIENT_ERROR cannot increment or decrement non-numeric value"}},
+		{"incr missing 1\r\n", []string{"NOT_FOUND"}},
+		{"touch key 0\r\n", []string{"TOUCHED"}},
+		{"touch missing 10\r\n", []string{"NOT_FOUND"}},
+		{"delete quiet\r\n", []string{"DELETED"}},
+		{"delete quiet\r\n", []string{"NOT_FOUND"}},
+		{"set expired 0 -1 1\r\nx\r\n", []string{"STORED"}},
+		{"get expired\r\n", []string{"END"}},
+		{"set bad 0 0 1\r\nxyz\r\n", []string{"CLIENT_ERROR bad data chunk"}},
+		{"set bad x 0 1\r\nx\r\n", []string{"CLIENT_ERROR bad command line format"}},
+		{"flush_all\r\n", []string{"ERROR"}},
+	}
+	var pipeline strings.Builder
+	var want []string
+	for _, c := range commands {
+		pipeline.WriteString(c.request)
+		want = append(want, c.reply...)
+	}
+	got := memcachedExchange(t, conn, r, pipeline.String(), len(want))
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Reply line %d = %q, wanted %q", i, got[i], want[i])
+		}
+	}
+
+	if expires, err := db.Expires("counter"); err != nil || time.Until(expires) < 90*time.Second {
+		t.Errorf("incr did not keep the expiry: %v, %v", expires, err)
+	}
+
+	// gets returns the cas unique that cas takes.
+	reply := memcachedExchange(t, conn, r, "gets key\r\n", 3)
+	fields := strings.Fields(reply[0])
+	if len(fields) != 5 || fields[2] != "42" {
+		t.Fatalf("gets replied %q", reply)
+	}
+	reply = memcachedExchange(t, conn, r, "cas key 9 0 3 "+fields[4]+"\r\nnew\r\ncas key 9 0 3 "+fields[4]+"\r\nold\r\n", 2)
+	if reply[0] != "STORED" || reply[1] != "EXISTS" {
+		t.Errorf("cas replied %q", reply)
+	}
+	if item, err := db.GetItem(t.Context(), "key"); err != nil || item.Value != "new" || item.Flags != 9 {
+		t.Errorf("GetItem after cas = %+v, %v", item, err)
+	}
+}
+
+func TestMemcachedReadOnly(t *testing.T) {
+	_, conn := startMemcached(t, true)
+	r := bufio.NewReader(conn)
+	reply := memcachedExchange(t, conn, r, "set key 0 0 5\r\nvalue\r\nget key\r\n", 2)
+	if !strings.HasPrefix(reply[0], "SERVER_ERROR") || reply[1] != "END" {
+		t.Errorf("Writing to a follower replied %q", reply)
+	}
+}
+
+func TestFromExptime(t *testing.T) {
+	if !fromExptime(0).IsZero() {
+		t.Error("exptime 0 expires")
+	}
+	if d := time.Until(fromExptime(60)); d < 59*time.Second || d > 60*time.Second {
+		t.Errorf("exptime 60 expires in %v", d)
+	}
+	if got := fromExptime(maxRelativeExptime + 1); !got.Equal(time.Unix(maxRelativeExptime+1, 0)) {
+		t.Errorf("Large exptime expires at %v", got)
+	}
+	if !fromExptime(-1).Before(time.Now()) {
+		t.Error("Negative exptime has not expired")
+	}
+}
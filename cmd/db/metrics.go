@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dk872/architecture-lab5/datastore"
+)
+
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// requestKey labels the requests of an endpoint, "key" for the values under
+// /db/ and the name of the others, such as "batch" for /db/_batch.
+type requestKey struct {
+	endpoint string
+	method   string
+	code     int
+}
+
+type latencyKey struct {
+	endpoint string
+	method   string
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	total  uint64
+}
+
+// requestMetrics counts HTTP requests and their latencies for /metrics.
+type requestMetrics struct {
+	mutex    sync.Mutex
+	requests map[requestKey]uint64
+	latency  map[latencyKey]*histogram
+}
+
+func newRequestMetrics() *requestMetrics {
+	return &requestMetrics{
+		requests: make(map[requestKey]uint64),
+		latency:  make(map[latencyKey]*histogram),
+	}
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap lets http.ResponseController flush the streams of _watch and _log.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// instrument counts the requests to an endpoint under its name.
+func (m *requestMetrics) instrument(endpoint string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		m.observe(endpoint, r.Method, rec.code, time.Since(start))
+	})
+}
+
+func (m *requestMetrics) observe(endpoint, method string, code int, elapsed time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.requests[requestKey{endpoint: endpoint, method: method, code: code}]++
+
+	lk := latencyKey{endpoint: endpoint, method: method}
+	h, ok := m.latency[lk]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		m.latency[lk] = h
+	}
+	seconds := elapsed.Seconds()
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += seconds
+	h.total++
+}
+
+func (m *requestMetrics) writeTo(w io.Writer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	keys := make([]requestKey, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].endpoint != keys[j].endpoint {
+			return keys[i].endpoint < keys[j].endpoint
+		}
+		if keys[i].method != keys[j].method {
+			return keys[i].method < keys[j].method
+		}
+		return keys[i].code < keys[j].code
+	})
+
+	writeHeader(w, "db_http_requests_total", "counter", "HTTP requests served by the db API.")
+	for _, k := range keys {
+		fmt.Fprintf(w, "db_http_requests_total{endpoint=%q,method=%q,code=\"%d\"} %d\n", k.endpoint, k.method, k.code, m.requests[k])
+	}
+
+	latencies := make([]latencyKey, 0, len(m.latency))
+	for lk := range m.latency {
+		latencies = append(latencies, lk)
+	}
+	sort.Slice(latencies, func(i, j int) bool {
+		if latencies[i].endpoint != latencies[j].endpoint {
+			return latencies[i].endpoint < latencies[j].endpoint
+		}
+		return latencies[i].method < latencies[j].method
+	})
+
+	writeHeader(w, "db_http_request_duration_seconds", "histogram", "Latency of db API requests.")
+	for _, lk := range latencies {
+		h := m.latency[lk]
+		labels := fmt.Sprintf("endpoint=%q,method=%q", lk.endpoint, lk.method)
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(w, "db_http_request_duration_seconds_bucket{%s,le=%q} %d\n",
+				labels, strconv.FormatFloat(bound, 'g', -1, 64), h.counts[i])
+		}
+		fmt.Fprintf(w, "db_http_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, h.total)
+		fmt.Fprintf(w, "db_http_request_duration_seconds_sum{%s} %g\n", labels, h.sum)
+		fmt.Fprintf(w, "db_http_request_duration_seconds_count{%s} %d\n", labels, h.total)
+	}
+}
+
+func writeHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeStats(w io.Writer, stats datastore.Stats) {
+	writeHeader(w, "datastore_segments", "gauge", "Number of segment files.")
+	fmt.Fprintf(w, "datastore_segments %d\n", len(stats.Segments))
+
+	writeHeader(w, "datastore_segment_bytes", "gauge", "Size of each segment file.")
+	for _, seg := range stats.Segments {
+		fmt.Fprintf(w, "datastore_segment_bytes{segment=%q} %d\n", seg.Name, seg.Bytes)
+	}
+
+	writeHeader(w, "datastore_live_bytes", "gauge", "Bytes of records reachable through the index.")
+	fmt.Fprintf(w, "datastore_live_bytes %d\n", stats.LiveBytes)
+	writeHeader(w, "datastore_dead_bytes", "gauge", "Bytes of overwritten records awaiting compaction.")
+	fmt.Fprintf(w, "datastore_dead_bytes %d\n", stats.DeadBytes)
+	writeHeader(w, "datastore_keys", "gauge", "Number of distinct keys.")
+	fmt.Fprintf(w, "datastore_keys %d\n", stats.Keys)
+
+	writeHeader(w, "datastore_merges_total", "counter", "Segment merges run.")
+	fmt.Fprintf(w, "datastore_merges_total %d\n", stats.Merges)
+	writeHeader(w, "datastore_merge_duration_seconds_total", "counter", "Time spent merging segments.")
+	fmt.Fprintf(w, "datastore_merge_duration_seconds_total %g\n", stats.MergeDuration.Seconds())
+	writeHeader(w, "datastore_last_merge_duration_seconds", "gauge", "Duration of the last merge.")
+	fmt.Fprintf(w, "datastore_last_merge_duration_seconds %g\n", stats.LastMergeTime.Seconds())
+	writeHeader(w, "datastore_last_merge_failed", "gauge", "Whether the last merge returned an error.")
+	failed := 0
+	if stats.LastMergeError != nil {
+		failed = 1
+	}
+	fmt.Fprintf(w, "datastore_last_merge_failed %d\n", failed)
+
+	writeHeader(w, "datastore_write_queue_depth", "gauge", "Writes waiting for the writer goroutine.")
+	fmt.Fprintf(w, "datastore_write_queue_depth %d\n", stats.WriteQueueDepth)
+	writeHeader(w, "datastore_checksum_failures_total", "counter", "Records that failed checksum verification.")
+	fmt.Fprintf(w, "datastore_checksum_failures_total %d\n", stats.ChecksumFailures)
+
+	writeHeader(w, "datastore_scrubs_total", "counter", "Scrubber passes over the sealed segments.")
+	fmt.Fprintf(w, "datastore_scrubs_total %d\n", stats.Scrubs)
+	writeHeader(w, "datastore_scrubbed_bytes_total", "counter", "Bytes verified by the scrubber.")
+	fmt.Fprintf(w, "datastore_scrubbed_bytes_total %d\n", stats.ScrubbedBytes)
+	writeHeader(w, "datastore_scrub_corruptions_total", "counter", "Damaged records found by the scrubber.")
+	fmt.Fprintf(w, "datastore_scrub_corruptions_total %d\n", stats.ScrubCorruptions)
+
+	writeHeader(w, "datastore_value_bytes_total", "counter", "Bytes of values written to segments, before compression.")
+	fmt.Fprintf(w, "datastore_value_bytes_total %d\n", stats.ValueBytes)
+	writeHeader(w, "datastore_stored_value_bytes_total", "counter", "Bytes of values written to segments, after compression.")
+	fmt.Fprintf(w, "datastore_stored_value_bytes_total %d\n", stats.StoredValueBytes)
+	writeHeader(w, "datastore_compression_ratio", "gauge", "Ratio of value bytes before and after compression.")
+	fmt.Fprintf(w, "datastore_compression_ratio %g\n", stats.CompressionRatio)
+}
+
+type metricsSource interface {
+	writeTo(w io.Writer)
+}
+
+func metricsHandler(db *datastore.Db, sources ...metricsSource) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeStats(w, db.Stats())
+		for _, source := range sources {
+			source.writeTo(w)
+		}
+	}
+}
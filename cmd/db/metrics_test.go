@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dk872/architecture-lab5/datastore"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	db, err := datastore.Open(t.TempDir(), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	metrics := newRequestMetrics()
+	handler := metrics.instrument("key", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "not found", http.StatusNotFound)
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/db/missing", nil))
+	batch := metrics.instrument("batch", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Streaming endpoints flush through the recorder.
+		if err := http.NewResponseController(w).Flush(); err != nil {
+			t.Errorf("Expected the instrumented writer to flush, got %v", err)
+		}
+	}))
+	batch.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/db/_batch", nil))
+
+	rec := httptest.NewRecorder()
+	metricsHandler(db, metrics).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+
+	for _, line := range []string{
+		"datastore_keys 1\n",
+		"datastore_segments 1\n",
+		`db_http_requests_total{endpoint="key",method="GET",code="404"} 1`,
+		`db_http_request_duration_seconds_count{endpoint="key",method="GET"} 1`,
+		`db_http_requests_total{endpoint="batch",method="POST",code="200"} 1`,
+		"# TYPE datastore_merges_total counter\n",
+		"# TYPE datastore_compression_ratio gauge\n",
+		"# TYPE datastore_scrub_corruptions_total counter\n",
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", line, body)
+		}
+	}
+}
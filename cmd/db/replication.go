@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dk872/architecture-lab5/datastore"
+)
+
+const (
+	// logPollInterval is how often a log stream that reached the end of the
+	// log looks for new records.
+	logPollInterval = 50 * time.Millisecond
+	// logHeartbeat is how often an idle log stream tells the follower it is
+	// caught up.
+	logHeartbeat = time.Second
+
+	positionFileName = "REPLICATION"
+	retryDelay       = time.Second
+	savePeriod       = time.Second
+)
+
+// logRecord is a line of the log and snapshot streams. Lines without an op
+// only carry the position the leader's log ends at.
+type logRecord struct {
+	Op        string `json:"op,omitempty"`
+	Key       string `json:"key,omitempty"`
+	Value     string `json:"value,omitempty"`
+	Blob      bool   `json:"blob,omitempty"`
+	Timestamp uint64 `json:"timestamp,omitempty"`
+	// Expires is in Unix nanoseconds, 0 for values that do not expire.
+	Expires  int64  `json:"expires,omitempty"`
+	Flags    uint32 `json:"flags,omitempty"`
+	Position string `json:"position"`
+}
+
+// logHandler streams the log from the position in the from parameter as
+// JSON lines, following new writes until the client goes away. Each record
+// carries the position the next one starts at. It answers 410 Gone once
+// that part of the log has been merged away.
+func logHandler(db *datastore.Db) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		from, err := datastore.ParsePosition(r.URL.Query().Get("from"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		it, err := db.Tail(from)
+		if errors.Is(err, datastore.ErrCompacted) {
+			http.Error(w, "log position has been compacted", http.StatusGone)
+			return
+		}
+		if err != nil {
+			writeError(w, err, "failed to read the log")
+			return
+		}
+		defer it.Close()
+
+		rc := http.NewResponseController(w)
+		// The stream outlives the server's write timeout.
+		_ = rc.SetWriteDeadline(time.Time{})
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		enc := json.NewEncoder(w)
+		poll := time.NewTicker(logPollInterval)
+		defer poll.Stop()
+		var lastHeartbeat time.Time
+		for {
+			sent := false
+			for it.Next() {
+				event := it.Event()
+				record := logRecord{Op: event.Op.String(), Key: event.Key, Value: event.Value, Blob: event.Blob, Timestamp: event.Timestamp, Expires: unixNano(event.Expires), Flags: event.Flags, Position: it.Position().String()}
+				if err := enc.Encode(record); err != nil {
+					return
+				}
+				sent = true
+			}
+			if err := it.Err(); err != nil {
+				log.Printf("Log stream from %s stopped: %v", from, err)
+				return
+			}
+			if sent || time.Since(lastHeartbeat) >= logHeartbeat {
+				if err := enc.Encode(logRecord{Position: it.Position().String()}); err != nil {
+					return
+				}
+				lastHeartbeat = time.Now()
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+
+			select {
+			case <-poll.C:
+			case <-r.Context().Done():
+				return
+			}
+		}
+	})
+}
+
+// snapshotHandler writes the end of the log followed by every key and its
+// value, then the deleted keys, as JSON lines. Writes that land while the
+// snapshot is taken may or may not be in it, so a follower replays the log
+// from that position.
+func snapshotHandler(db *datastore.Db) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		enc := json.NewEncoder(w)
+		if err := enc.Encode(logRecord{Position: db.End().String()}); err != nil {
+			return
+		}
+		for _, key := range db.Keys() {
+			item, err := db.GetItem(r.Context(), key)
+			if errors.Is(err, datastore.ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				log.Printf("Snapshot stopped at %q: %v", key, err)
+				return
+			}
+			record := logRecord{Op: datastore.OpPut.String(), Key: key, Value: item.Value, Timestamp: item.Timestamp, Expires: unixNano(item.Expires), Flags: item.Flags}
+			if err := enc.Encode(record); err != nil {
+				return
+			}
+		}
+		// Tombstones keep older values on the follower from coming back.
+		for _, key := range db.DeletedKeys() {
+			timestamp, err := db.Timestamp(key)
+			if err != nil {
+				continue
+			}
+			if err := enc.Encode(logRecord{Op: datastore.OpDelete.String(), Key: key, Timestamp: timestamp}); err != nil {
+				return
+			}
+		}
+	})
+}
+
+var errCompacted = errors.New("leader has compacted the log")
+
+// follower applies the leader's log to the local datastore. The position it
+// has applied up to is kept next to the datastore, so a restart resumes
+// where it stopped.
+type follower struct {
+	db      *datastore.Db
+	leader  string
+	client  *http.Client
+	posPath string
+
+	mutex     sync.Mutex
+	position  datastore.Position
+	synced    bool
+	caughtUp  time.Time
+	saved     time.Time
+	applied   uint64
+	resyncs   uint64
+	stale     uint64
+	connected bool
+}
+
+func newFollower(db *datastore.Db, dir, leader string) *follower {
+	return &follower{
+		db:      db,
+		leader:  strings.TrimSuffix(leader, "/"),
+		client:  &http.Client{},
+		posPath: filepath.Join(dir, positionFileName),
+	}
+}
+
+// run replicates until ctx is done, reconnecting after failures and
+// starting over from a snapshot when the leader no longer has the log at
+// the follower's position.
+func (f *follower) run(ctx context.Context) {
+	data, err := os.ReadFile(f.posPath)
+	if err == nil {
+		f.position, err = datastore.ParsePosition(strings.TrimSpace(string(data)))
+		f.synced = err == nil
+	}
+
+	for ctx.Err() == nil {
+		if !f.synced {
+			err = f.resync(ctx)
+		} else if err = f.stream(ctx); errors.Is(err, errCompacted) {
+			f.synced = false
+			continue
+		}
+		f.setConnected(false)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Replication from %s failed: %v", f.leader, err)
+			select {
+			case <-time.After(retryDelay):
+			case <-ctx.Done():
+			}
+		}
+	}
+	f.save(true)
+}
+
+func (f *follower) resync(ctx context.Context) error {
+	resp, err := f.get(ctx, "/db/_snapshot")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	var head logRecord
+	if err := dec.Decode(&head); err != nil {
+		return fmt.Errorf("reading snapshot: %w", err)
+	}
+	position, err := datastore.ParsePosition(head.Position)
+	if err != nil {
+		return err
+	}
+	inSnapshot := make(map[string]bool)
+	for {
+		var record logRecord
+		if err := dec.Decode(&record); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return fmt.Errorf("reading snapshot: %w", err)
+		}
+		if err := f.apply(ctx, record); err != nil {
+			return err
+		}
+		inSnapshot[record.Key] = true
+	}
+	// Keys deleted on the leader whose tombstones are gone. The tombstone
+	// comes right after the value the leader deleted, the leader stamped its
+	// own tombstone and every later write after that value too.
+	for _, key := range f.db.Keys() {
+		if inSnapshot[key] {
+			continue
+		}
+		timestamp, err := f.db.Timestamp(key)
+		if errors.Is(err, datastore.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := f.delete(ctx, logRecord{Op: datastore.OpDelete.String(), Key: key, Timestamp: timestamp + 1}); err != nil {
+			return err
+		}
+	}
+
+	f.mutex.Lock()
+	f.position = position
+	f.resyncs++
+	f.mutex.Unlock()
+	f.synced = true
+	f.save(true)
+	log.Printf("Resynced from a snapshot of %s at %s", f.leader, position)
+	return nil
+}
+
+func (f *follower) stream(ctx context.Context) error {
+	resp, err := f.get(ctx, "/db/_log?from="+url.QueryEscape(f.currentPosition().String()))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	f.setConnected(true)
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(nil, 64<<20)
+	for scanner.Scan() {
+		var record logRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return fmt.Errorf("reading log: %w", err)
+		}
+		position, err := datastore.ParsePosition(record.Position)
+		if err != nil {
+			return err
+		}
+		if record.Op == "" {
+			// Every record before the end of the leader's log is applied.
+			f.mutex.Lock()
+			f.position = position
+			f.caughtUp = time.Now()
+			f.mutex.Unlock()
+			f.save(false)
+			continue
+		}
+		if err := f.apply(ctx, record); err != nil {
+			return err
+		}
+
+		f.mutex.Lock()
+		f.position = position
+		f.applied++
+		f.mutex.Unlock()
+		f.save(false)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return io.ErrUnexpectedEOF
+}
+
+// apply writes a record of the leader's log. Values kept in blob files on
+// the leader are not in the log and are fetched on their own.
+func (f *follower) apply(ctx context.Context, record logRecord) error {
+	if record.Op == datastore.OpDelete.String() {
+		return f.delete(ctx, record)
+	}
+	if !record.Blob {
+		return f.put(ctx, record, strings.NewReader(record.Value))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.leader+"/db/"+url.PathEscape(record.Key), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", octetStream)
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching %q: status %d", record.Key, resp.StatusCode)
+	}
+	return f.put(ctx, record, resp.Body)
+}
+
+// put keeps the timestamp the leader wrote the value with, so replicas agree
+// on which value is the newest.
+func (f *follower) put(ctx context.Context, record logRecord, value io.Reader) error {
+	err := f.db.PutWith(ctx, record.Key, value, datastore.WriteOptions{Timestamp: record.Timestamp, Expires: fromUnixNano(record.Expires), Flags: record.Flags})
+	return f.skipStale(record, err)
+}
+
+func (f *follower) delete(ctx context.Context, record logRecord) error {
+	err := f.db.DeleteAt(ctx, record.Key, record.Timestamp)
+	if errors.Is(err, datastore.ErrNotFound) {
+		return nil
+	}
+	return f.skipStale(record, err)
+}
+
+// skipStale counts and logs a record that lost to a newer local value: one
+// applied before a restart, repaired with a newer value, or written with a
+// clock ahead of the leader's.
+func (f *follower) skipStale(record logRecord, err error) error {
+	if !errors.Is(err, datastore.ErrStale) {
+		return err
+	}
+	f.mutex.Lock()
+	f.stale++
+	f.mutex.Unlock()
+	log.Printf("Skipped %s of %q at %d from %s: a newer value is stored", record.Op, record.Key, record.Timestamp, f.leader)
+	return nil
+}
+
+func (f *follower) get(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.leader+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusGone {
+		resp.Body.Close()
+		return nil, errCompacted
+	}
+	if resp.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: status %d: %s", path, resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	return resp, nil
+}
+
+func (f *follower) currentPosition() datastore.Position {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.position
+}
+
+func (f *follower) setConnected(connected bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.connected = connected
+}
+
+// save writes the applied position, at most once per savePeriod unless
+// forced. Records applied after the last save are applied again after a
+// restart, which leaves the same values behind.
+func (f *follower) save(force bool) {
+	f.mutex.Lock()
+	if !force && time.Since(f.saved) < savePeriod {
+		f.mutex.Unlock()
+		return
+	}
+	f.saved = time.Now()
+	position := f.position
+	f.mutex.Unlock()
+
+	tmp := f.posPath + ".tmp"
+	err := os.WriteFile(tmp, []byte(position.String()+"\n"), 0600)
+	if err == nil {
+		err = os.Rename(tmp, f.posPath)
+	}
+	if err != nil {
+		log.Printf("Failed to save the replication position: %v", err)
+	}
+}
+
+func (f *follower) writeTo(w io.Writer) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	lag := 0.0
+	if !f.caughtUp.IsZero() {
+		lag = time.Since(f.caughtUp).Seconds()
+	}
+	connected := 0
+	if f.connected {
+		connected = 1
+	}
+	writeHeader(w, "db_replication_lag_seconds", "gauge", "Time since the follower last caught up with the leader.")
+	fmt.Fprintf(w, "db_replication_lag_seconds %g\n", lag)
+	writeHeader(w, "db_replication_connected", "gauge", "Whether the follower is streaming the leader's log.")
+	fmt.Fprintf(w, "db_replication_connected %d\n", connected)
+	writeHeader(w, "db_replication_applied_total", "counter", "Records of the leader's log applied.")
+	fmt.Fprintf(w, "db_replication_applied_total %d\n", f.applied)
+	writeHeader(w, "db_replication_resyncs_total", "counter", "Snapshots loaded after falling behind the leader's merges.")
+	fmt.Fprintf(w, "db_replication_resyncs_total %d\n", f.resyncs)
+	writeHeader(w, "db_replication_stale_total", "counter", "Records of the leader's log skipped for a newer local value.")
+	fmt.Fprintf(w, "db_replication_stale_total %d\n", f.stale)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dk872/architecture-lab5/datastore"
+)
+
+func startLeader(t *testing.T, segmentSize int64) (*datastore.Db, *httptest.Server) {
+	t.Helper()
+	db, err := datastore.Open(t.TempDir(), segmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	mux := http.NewServeMux()
+	mux.Handle("/db/_log", logHandler(db))
+	mux.Handle("/db/_snapshot", snapshotHandler(db))
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return db, server
+}
+
+func startFollower(t *testing.T, dir, leader string) (*datastore.Db, *follower, func()) {
+	t.Helper()
+	db, err := datastore.Open(dir, 1024, datastore.WithTimestamps())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := newFollower(db, dir, leader)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f.run(ctx)
+	}()
+	return db, f, func() {
+		cancel()
+		<-done
+		db.Close()
+	}
+}
+
+func waitForValue(t *testing.T, db *datastore.Db, key, want string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if value, err := db.Get(key); err == nil && value == want {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	value, err := db.Get(key)
+	t.Fatalf("Follower has %q = %q, %v, wanted %q", key, value, err, want)
+}
+
+func waitForDelete(t *testing.T, db *datastore.Db, key string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := db.Get(key); errors.Is(err, datastore.ErrNotFound) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Follower still has %q", key)
+}
+
+func TestReplication(t *testing.T) {
+	leader, server := startLeader(t, 1024)
+	for _, key := range []string{"a", "b", "c"} {
+		if err := leader.Put(key, "value of "+key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dir := t.TempDir()
+	replica, f, stop := startFollower(t, dir, server.URL)
+	waitForValue(t, replica, "c", "value of c")
+	if err := leader.Put("d", "value of d"); err != nil {
+		t.Fatal(err)
+	}
+	waitForValue(t, replica, "d", "value of d")
+	if err := leader.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	waitForDelete(t, replica, "a")
+
+	rec := httptest.NewRecorder()
+	metricsHandler(replica, f).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range []string{"db_replication_resyncs_total 1\n", "db_replication_applied_total 2\n"} {
+		if !strings.Contains(rec.Body.String(), line) {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", line, rec.Body.String())
+		}
+	}
+	stop()
+
+	// A restarted follower resumes from the saved position instead of
+	// loading another snapshot.
+	data, err := os.ReadFile(filepath.Join(dir, positionFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(string(data)); got != leader.End().String() {
+		t.Errorf("Saved position %s, the leader's log ends at %s", got, leader.End())
+	}
+	if err := leader.Put("e", "value of e"); err != nil {
+		t.Fatal(err)
+	}
+	replica, f, stop = startFollower(t, dir, server.URL)
+	defer stop()
+	waitForValue(t, replica, "e", "value of e")
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.resyncs != 0 {
+		t.Errorf("Restarted follower loaded %d snapshots", f.resyncs)
+	}
+}
+
+func TestReplicationResync(t *testing.T) {
+	leader, server := startLeader(t, 64)
+	for i := 0; i < 20; i++ {
+		if err := leader.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for leader.Stats().Merges == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, positionFileName), []byte("0:0\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	replica, f, stop := startFollower(t, dir, server.URL)
+	defer stop()
+	for i := 0; i < 20; i++ {
+		waitForValue(t, replica, fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i))
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.resyncs != 1 {
+		t.Errorf("Follower behind the leader's merges loaded %d snapshots, wanted 1", f.resyncs)
+	}
+}
+
+func TestReplicationResyncKeepsLeaderOrder(t *testing.T) {
+	ctx := context.Background()
+	leader, server := startLeader(t, 1024)
+	if err := leader.PutAt(ctx, "kept", strings.NewReader("leader"), 100); err != nil {
+		t.Fatal(err)
+	}
+
+	// The follower has a key the leader has deleted since, and a value
+	// stamped by a clock ahead of the leader's.
+	dir := t.TempDir()
+	db, err := datastore.Open(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutAt(ctx, "gone", strings.NewReader("old"), 500); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutAt(ctx, "kept", strings.NewReader("follower"), 2000); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	replica, f, stop := startFollower(t, dir, server.URL)
+	defer stop()
+	waitForDelete(t, replica, "gone")
+	if err := leader.PutAt(ctx, "gone", strings.NewReader("new"), 1000); err != nil {
+		t.Fatal(err)
+	}
+	waitForValue(t, replica, "gone", "new")
+
+	rec := httptest.NewRecorder()
+	metricsHandler(replica, f).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(rec.Body.String(), "db_replication_stale_total 1\n") {
+		t.Errorf("Expected the stale value of kept to be counted, got:\n%s", rec.Body.String())
+	}
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dk872/architecture-lab5/datastore"
+	"github.com/dk872/architecture-lab5/raft"
+)
+
+const (
+	maxRESPArgs     = 1 << 16
+	maxRESPBulk     = 64 << 20
+	defaultScanSize = 10
+)
+
+var errProtocol = errors.New("Protocol error")
+
+// respArity is the number of arguments of each command, or -n for at least
+// n-1 of them.
+var respArity = map[string]int{
+	"PING": -1, "QUIT": 0,
+	"GET": 1, "SET": -3, "DEL": -2, "EXISTS": -2, "INCR": 1,
+	"EXPIRE": 2, "TTL": 1, "SCAN": -2,
+}
+
+// respServer serves the datastore over the Redis protocol, RESP2. Clients
+// may pipeline commands: replies are written in order and flushed once no
+// more commands are waiting to be read.
+type respServer struct {
+	db *datastore.Db
+	// cluster is set in raft mode, where writes go through the log.
+	cluster  *cluster
+	readOnly bool
+}
+
+func (s *respServer) handle(ctx context.Context, conn net.Conn) {
+	r := bufio.NewReaderSize(conn, 64<<10)
+	w := respWriter{bufio.NewWriterSize(conn, 64<<10)}
+	for {
+		args, err := readRESPCommand(r)
+		if errors.Is(err, errProtocol) {
+			w.error("ERR " + err.Error())
+			w.Flush()
+			return
+		}
+		if err != nil {
+			return
+		}
+		if len(args) > 0 && !s.exec(ctx, args, w) {
+			w.Flush()
+			return
+		}
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readRESPCommand reads an array of bulk strings, or an inline command
+// split on spaces as typed in telnet.
+func readRESPCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readRESPLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 || n > maxRESPArgs {
+		return nil, fmt.Errorf("%w: invalid multibulk length", errProtocol)
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := readRESPLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, fmt.Errorf("%w: expected '$', got %q", errProtocol, line)
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > maxRESPBulk {
+			return nil, fmt.Errorf("%w: invalid bulk length", errProtocol)
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		if string(buf[size:]) != "\r\n" {
+			return nil, fmt.Errorf("%w: bulk string not terminated by CRLF", errProtocol)
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func readRESPLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return "", fmt.Errorf("%w: line too long", errProtocol)
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+type respWriter struct {
+	*bufio.Writer
+}
+
+func (w respWriter) simple(s string) {
+	w.WriteString("+" + s + "\r\n")
+}
+
+func (w respWriter) error(s string) {
+	w.WriteString("-" + s + "\r\n")
+}
+
+func (w respWriter) integer(n int64) {
+	w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+func (w respWriter) bulk(s string) {
+	w.WriteString("$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n")
+}
+
+func (w respWriter) null() {
+	w.WriteString("$-1\r\n")
+}
+
+func (w respWriter) array(n int) {
+	w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
+
+func (w respWriter) err(err error) {
+	switch {
+	case errors.Is(err, errNotInteger), errors.Is(err, errOverflow):
+		w.error("ERR " + err.Error())
+	case errors.Is(err, raft.ErrNotLeader):
+		w.error("READONLY this node is not the raft leader")
+	default:
+		_, text := errorStatus(err, "internal error")
+		w.error("ERR " + text)
+	}
+}
+
+// exec runs a command and writes its reply. It returns false when the
+// connection should be closed.
+func (s *respServer) exec(ctx context.Context, args []string, w respWriter) bool {
+	name := strings.ToUpper(args[0])
+	args = args[1:]
+	n, ok := respArity[name]
+	switch {
+	case !ok:
+		w.error(fmt.Sprintf("ERR unknown command '%.128s'", name))
+		return true
+	case (n >= 0 && len(args) != n) || (n < 0 && len(args) < -n-1):
+		w.error(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+		return true
+	case s.readOnly && (name == "SET" || name == "DEL" || name == "INCR" || name == "EXPIRE"):
+		w.error("READONLY You can't write against a read only replica.")
+		return true
+	}
+
+	switch name {
+	case "PING":
+		if len(args) > 0 {
+			w.bulk(args[0])
+		} else {
+			w.simple("PONG")
+		}
+	case "QUIT":
+		w.simple("OK")
+		return false
+	case "GET":
+		value, err := s.db.GetContext(ctx, args[0])
+		switch {
+		case errors.Is(err, datastore.ErrNotFound):
+			w.null()
+		case err != nil:
+			w.err(err)
+		default:
+			w.bulk(value)
+		}
+	case "SET":
+		s.set(ctx, args, w)
+	case "DEL":
+		var deleted int64
+		for _, key := range args {
+			err := s.write(ctx, command{Op: datastore.OpDelete.String(), Key: key})
+			if errors.Is(err, datastore.ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				w.err(err)
+				return true
+			}
+			deleted++
+		}
+		w.integer(deleted)
+	case "EXISTS":
+		var found int64
+		for _, key := range args {
+			if _, err := s.db.Expires(key); err == nil {
+				found++
+			}
+		}
+		w.integer(found)
+	case "INCR":
+		n, err := s.incr(ctx, args[0])
+		if err != nil {
+			w.err(err)
+		} else {
+			w.integer(n)
+		}
+	case "EXPIRE":
+		seconds, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			w.err(errNotInteger)
+			return true
+		}
+		expires := time.Now().Add(time.Duration(seconds) * time.Second)
+		err = s.write(ctx, command{Op: opExpire, Key: args[0], Expires: expires.UnixNano()})
+		switch {
+		case errors.Is(err, datastore.ErrNotFound):
+			w.integer(0)
+		case err != nil:
+			w.err(err)
+		default:
+			w.integer(1)
+		}
+	case "TTL":
+		expires, err := s.db.Expires(args[0])
+		switch {
+		case errors.Is(err, datastore.ErrNotFound):
+			w.integer(-2)
+		case err != nil:
+			w.err(err)
+		case expires.IsZero():
+			w.integer(-1)
+		default:
+			w.integer(int64((time.Until(expires) + time.Second/2) / time.Second))
+		}
+	case "SCAN":
+		s.scan(args, w)
+	}
+	return true
+}
+
+// set serves SET key value [EX seconds | PX milliseconds] [NX | XX].
+func (s *respServer) set(ctx context.Context, args []string, w respWriter) {
+	cmd := command{Op: datastore.OpPut.String(), Key: args[0], Value: args[1]}
+	for i := 2; i < len(args); i++ {
+		switch opt := strings.ToUpper(args[i]); {
+		case opt == "NX" && !cmd.IfPresent:
+			cmd.IfAbsent = true
+		case opt == "XX" && !cmd.IfAbsent:
+			cmd.IfPresent = true
+		case (opt == "EX" || opt == "PX") && cmd.Expires == 0 && i+1 < len(args):
+			n, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil || n <= 0 {
+				w.error("ERR invalid expire time in 'set' command")
+				return
+			}
+			unit := time.Second
+			if opt == "PX" {
+				unit = time.Millisecond
+			}
+			cmd.Expires = time.Now().Add(time.Duration(n) * unit).UnixNano()
+			i++
+		default:
+			w.error("ERR syntax error")
+			return
+		}
+	}
+
+	err := s.write(ctx, cmd)
+	switch {
+	case errors.Is(err, datastore.ErrConflict):
+		w.null()
+	case err != nil:
+		w.err(err)
+	default:
+		w.simple("OK")
+	}
+}
+
+// write applies a write locally, or through the raft log in raft mode.
+func (s *respServer) write(ctx context.Context, cmd command) error {
+	if s.cluster != nil {
+		return s.cluster.apply(ctx, cmd)
+	}
+	return applyCommand(ctx, s.db, cmd)
+}
+
+// incr returns the incremented value. In raft mode it is read back once the
+// increment has been applied, so a concurrent increment may already be
+// included.
+func (s *respServer) incr(ctx context.Context, key string) (int64, error) {
+	if s.cluster == nil {
+		return incr(ctx, s.db, key, 1)
+	}
+	if err := s.cluster.apply(ctx, command{Op: opIncr, Key: key, Value: "1"}); err != nil {
+		return 0, err
+	}
+	value, err := s.db.GetContext(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+// scan serves SCAN cursor [MATCH pattern] [COUNT count]. Keys are visited
+// in the order of their hash and the cursor is the hash to continue from,
+// so keys that exist during the whole scan are returned once however the
+// others change.
+func (s *respServer) scan(args []string, w respWriter) {
+	cursor, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		w.error("ERR invalid cursor")
+		return
+	}
+	pattern, count := "*", defaultScanSize
+	for i := 1; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			w.error("ERR syntax error")
+			return
+		}
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			if count, err = strconv.Atoi(args[i+1]); err != nil || count < 1 {
+				w.error("ERR syntax error")
+				return
+			}
+		default:
+			w.error("ERR syntax error")
+			return
+		}
+	}
+
+	type hashedKey struct {
+		hash uint64
+		key  string
+	}
+	var keys []hashedKey
+	for _, key := range s.db.Keys() {
+		if h := scanHash(key); h >= cursor {
+			keys = append(keys, hashedKey{h, key})
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].hash != keys[j].hash {
+			return keys[i].hash < keys[j].hash
+		}
+		return keys[i].key < keys[j].key
+	})
+
+	// Keys with the same hash go on the same page, the cursor cannot point
+	// between them.
+	end := min(count, len(keys))
+	for end < len(keys) && keys[end].hash == keys[end-1].hash {
+		end++
+	}
+	var next uint64
+	if end < len(keys) {
+		next = keys[end].hash
+	}
+	var matched []string
+	for _, k := range keys[:end] {
+		if globMatch(pattern, k.key) {
+			matched = append(matched, k.key)
+		}
+	}
+
+	w.array(2)
+	w.bulk(strconv.FormatUint(next, 10))
+	w.array(len(matched))
+	for _, key := range matched {
+		w.bulk(key)
+	}
+}
+
+// scanHash is never 0, the cursor that starts and ends a scan.
+func scanHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64() | 1
+}
+
+// globMatch matches Redis glob patterns: * and ? wildcards, [abc], [^abc]
+// and [a-z] classes, and \ to escape.
+func globMatch(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if pattern == "" {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if globMatch(pattern, s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if s == "" {
+				return false
+			}
+		case '[':
+			if s == "" {
+				return false
+			}
+			end := strings.IndexByte(pattern[1:], ']')
+			if end < 0 {
+				return pattern == s
+			}
+			class := pattern[1 : end+1]
+			pattern = pattern[end+1:]
+			negate := strings.HasPrefix(class, "^")
+			if negate {
+				class = class[1:]
+			}
+			found := false
+			for i := 0; i < len(class); i++ {
+				if i+2 < len(class) && class[i+1] == '-' {
+					found = found || (class[i] <= s[0] && s[0] <= class[i+2])
+					i += 2
+				} else {
+					found = found || class[i] == s[0]
+				}
+			}
+			if found == negate {
+				return false
+			}
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if s == "" || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return s == ""
+}
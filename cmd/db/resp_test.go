@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/dk872/architecture-lab5/datastore"
+)
+
+func startRESP(t *testing.T, readOnly bool) (*datastore.Db, net.Conn) {
+	t.Helper()
+	db, err := datastore.Open(t.TempDir(), 1024, datastore.WithTimestamps())
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newConnServer("RESP", (&respServer{db: db, readOnly: readOnly}).handle)
+	go s.serve(l)
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		s.close()
+		db.Close()
+	})
+	return db, conn
+}
+
+func respCommand(args ...string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return b.String()
+}
+
+// readReply reads a reply as a string: arrays as their elements in
+// brackets and the null bulk string as "(nil)".
+func readReply(t *testing.T, r *bufio.Reader) string {
+	t.Helper()
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	switch line[0] {
+	case '$':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return "(nil)"
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	case '*':
+		n, _ := strconv.Atoi(line[1:])
+		items := make([]string, n)
+		for i := range items {
+			items[i] = readReply(t, r)
+		}
+		return "[" + strings.Join(items, " ") + "]"
+	default:
+		return line
+	}
+}
+
+func TestRESP(t *testing.T) {
+	db, conn := startRESP(t, false)
+	r := bufio.NewReader(conn)
+
+	// All commands are sent before any reply is read.
+	commands := []struct {
+		args  []string
+		reply string
+	}{
+		{[]string{"PING"}, "+PONG"},
+		{[]string{"SET", "key", "value"}, "+OK"},
+		{[]string{"GET", "key"}, "value"},
+		{[]string{"GET", "missing"}, "(nil)"},
+		{[]string{"SET", "key", "other", "NX"}, "(nil)"},
+		{[]string{"SET", "new", "value", "XX"}, "(nil)"},
+		{[]string{"EXISTS", "key", "new", "key"}, ":2"},
+		{[]string{"INCR", "counter"}, ":1"},
+		{[]string{"INCR", "counter"}, ":2"},
+		{[]string{"INCR", "key"}, "-ERR value is not an integer or out of range"},
+		{[]string{"TTL", "counter"}, ":-1"},
+		{[]string{"EXPIRE", "counter", "100"}, ":1"},
+		{[]string{"TTL", "counter"}, ":100"},
+		{[]string{"INCR", "counter"}, ":3"},
+		{[]string{"TTL", "counter"}, ":100"},
+		{[]string{"EXPIRE", "missing", "100"}, ":0"},
+		{[]string{"TTL", "missing"}, ":-2"},
+		{[]string{"SET", "short", "value", "PX", "100000"}, "+OK"},
+		{[]string{"TTL", "short"}, ":100"},
+		{[]string{"EXPIRE", "short", "0"}, ":1"},
+		{[]string{"GET", "short"}, "(nil)"},
+		{[]string{"DEL", "key", "missing"}, ":1"},
+		{[]string{"GET", "key"}, "(nil)"},
+		// Only the HTTP API reserves the prefix.
+		{[]string{"SET", "_session", "value"}, "+OK"},
+		{[]string{"DEL", "_session"}, ":1"},
+		{[]string{"GET"}, "-ERR wrong number of arguments for 'get' command"},
+		{[]string{"FLUSHALL"}, "-ERR unknown command 'FLUSHALL'"},
+	}
+	var pipeline strings.Builder
+	for _, c := range commands {
+		pipeline.WriteString(respCommand(c.args...))
+	}
+	if _, err := conn.Write([]byte(pipeline.String())); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range commands {
+		if reply := readReply(t, r); reply != c.reply {
+			t.Errorf("%v replied %q, wanted %q", c.args, reply, c.reply)
+		}
+	}
+	if value, _ := db.Get("counter"); value != "3" {
+		t.Errorf("counter = %q", value)
+	}
+
+	// Inline commands as typed in telnet.
+	if _, err := conn.Write([]byte("PING hello\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if reply := readReply(t, r); reply != "hello" {
+		t.Errorf("Inline PING replied %q", reply)
+	}
+}
+
+func TestRESPScan(t *testing.T) {
+	db, conn := startRESP(t, false)
+	r := bufio.NewReader(conn)
+	want := make([]string, 0, 25)
+	for i := range 25 {
+		key := fmt.Sprintf("user:%d", i)
+		want = append(want, key)
+		if err := db.Put(key, "value"); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put(fmt.Sprintf("other:%d", i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var got []string
+	cursor := "0"
+	for pages := 0; ; pages++ {
+		if pages > 50 {
+			t.Fatal("Scan does not end")
+		}
+		if _, err := conn.Write([]byte(respCommand("SCAN", cursor, "MATCH", "user:*", "COUNT", "7"))); err != nil {
+			t.Fatal(err)
+		}
+		reply := strings.Trim(readReply(t, r), "[]")
+		fields := strings.Fields(strings.NewReplacer("[", "", "]", "").Replace(reply))
+		cursor, got = fields[0], append(got, fields[1:]...)
+		if cursor == "0" {
+			break
+		}
+	}
+	sort.Strings(got)
+	sort.Strings(want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Scanned %v, wanted %v", got, want)
+	}
+}
+
+func TestRESPReadOnly(t *testing.T) {
+	_, conn := startRESP(t, true)
+	r := bufio.NewReader(conn)
+	if _, err := conn.Write([]byte(respCommand("SET", "key", "value") + respCommand("GET", "key"))); err != nil {
+		t.Fatal(err)
+	}
+	if reply := readReply(t, r); !strings.HasPrefix(reply, "-READONLY") {
+		t.Errorf("SET on a follower replied %q", reply)
+	}
+	if reply := readReply(t, r); reply != "(nil)" {
+		t.Errorf("GET on a follower replied %q", reply)
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	for _, c := range []struct {
+		pattern, s string
+		match      bool
+	}{
+		{"*", "anything", true},
+		{"user:*", "user:1", true},
+		{"user:*", "other:1", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{"*:*:end", "a:b:c:end", true},
+	} {
+		if got := globMatch(c.pattern, c.s); got != c.match {
+			t.Errorf("globMatch(%q, %q) = %v", c.pattern, c.s, got)
+		}
+	}
+}
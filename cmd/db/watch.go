@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/dk872/architecture-lab5/datastore"
+)
+
+// watchKeepAlive is how often an idle event stream gets a comment line, so
+// proxies do not time it out.
+const watchKeepAlive = 15 * time.Second
+
+type changeEvent struct {
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+	Blob  bool   `json:"blob,omitempty"`
+}
+
+// watchHandler streams the changes of the keys starting with the prefix
+// parameter as Server-Sent Events. Each event is named after the operation
+// and carries the log position as its id. A stream resumes after the
+// position in Last-Event-ID, or at the one in the from parameter.
+func watchHandler(db *datastore.Db) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		prefix := r.URL.Query().Get("prefix")
+		var (
+			watcher *datastore.Watcher
+			skip    *datastore.Position
+			err     error
+		)
+		switch {
+		case r.Header.Get("Last-Event-ID") != "":
+			var last datastore.Position
+			if last, err = datastore.ParsePosition(r.Header.Get("Last-Event-ID")); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			skip = &last
+			watcher, err = db.WatchFrom(prefix, last)
+		case r.URL.Query().Has("from"):
+			var from datastore.Position
+			if from, err = datastore.ParsePosition(r.URL.Query().Get("from")); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			watcher, err = db.WatchFrom(prefix, from)
+		default:
+			watcher, err = db.Watch(prefix)
+		}
+		if errors.Is(err, datastore.ErrCompacted) {
+			http.Error(w, "log position has been compacted", http.StatusGone)
+			return
+		}
+		if err != nil {
+			writeError(w, err, "failed to watch")
+			return
+		}
+		defer watcher.Close()
+
+		rc := http.NewResponseController(w)
+		// The stream outlives the server's write timeout.
+		_ = rc.SetWriteDeadline(time.Time{})
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		_ = rc.Flush()
+
+		keepAlive := time.NewTicker(watchKeepAlive)
+		defer keepAlive.Stop()
+		for {
+			select {
+			case event, ok := <-watcher.C:
+				if !ok {
+					if err := watcher.Err(); err != nil {
+						fmt.Fprintf(w, "event: error\ndata: %s\n\n", err)
+						_ = rc.Flush()
+					}
+					return
+				}
+				if skip != nil && event.Version == *skip {
+					continue
+				}
+				data, _ := json.Marshal(changeEvent{Key: event.Key, Value: event.Value, Blob: event.Blob})
+				if _, err := fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.Version, event.Op, data); err != nil {
+					return
+				}
+			case <-keepAlive.C:
+				if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+					return
+				}
+			case <-r.Context().Done():
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				log.Printf("Failed to flush the change stream: %v", err)
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dk872/architecture-lab5/datastore"
+)
+
+// readEvent returns the fields of the next event on an SSE stream.
+func readEvent(t *testing.T, r *bufio.Reader) map[string]string {
+	t.Helper()
+	fields := make(map[string]string)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Stream ended: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			if len(fields) > 0 {
+				return fields
+			}
+			continue
+		}
+		if name, value, ok := strings.Cut(line, ": "); ok && name != "" {
+			fields[name] = value
+		}
+	}
+}
+
+func TestWatchHandler(t *testing.T) {
+	db, err := datastore.Open(t.TempDir(), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	server := httptest.NewServer(watchHandler(db))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/db/_watch?prefix=user/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+
+	for _, key := range []string{"other", "user/1", "user/2"} {
+		if err := db.Put(key, "value of "+key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stream := bufio.NewReader(resp.Body)
+	first := readEvent(t, stream)
+	if first["event"] != "put" || first["data"] != `{"key":"user/1","value":"value of user/1"}` {
+		t.Errorf("Unexpected first event %v", first)
+	}
+	second := readEvent(t, stream)
+	if !strings.Contains(second["data"], `"user/2"`) {
+		t.Errorf("Unexpected second event %v", second)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/db/_watch?prefix=user/", nil)
+	req.Header.Set("Last-Event-ID", first["id"])
+	resumed, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resumed.Body.Close()
+	if event := readEvent(t, bufio.NewReader(resumed.Body)); event["id"] != second["id"] {
+		t.Errorf("Resumed stream started at %v, wanted %v", event, second)
+	}
+
+	bad, err := http.Get(server.URL + "/db/_watch?from=bad")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad.Body.Close()
+	if bad.StatusCode != http.StatusBadRequest {
+		t.Errorf("Invalid from returned status %d", bad.StatusCode)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/dk872/architecture-lab5/httptools"
+	"github.com/dk872/architecture-lab5/shard"
+	"github.com/dk872/architecture-lab5/signal"
+)
+
+var (
+	port   = flag.Int("port", 8084, "router port")
+	nodes  = flag.String("nodes", "http://db:8083", "comma-separated base URLs of the db nodes")
+	vnodes = flag.Int("vnodes", 128, "points every node has on the hash ring")
+	state  = flag.String("state", "", "file that keeps the ring and a running migration across restarts; once it exists, -nodes is ignored")
+)
+
+type nodeRequest struct {
+	Address string `json:"address"`
+}
+
+// nodesHandler reports the ring with GET, adds a node with POST
+// {"address"} and removes one with DELETE ?address=.
+func nodesHandler(router *shard.Router, store *ringStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(router.Status())
+			return
+		case http.MethodPost:
+			var req nodeRequest
+			if decodeErr := json.NewDecoder(r.Body).Decode(&req); decodeErr != nil || req.Address == "" {
+				http.Error(w, "invalid JSON body", http.StatusBadRequest)
+				return
+			}
+			err = store.addNode(strings.TrimSuffix(req.Address, "/"))
+		case http.MethodDelete:
+			err = store.removeNode(strings.TrimSuffix(r.URL.Query().Get("address"), "/"))
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		switch {
+		case err == nil:
+			w.WriteHeader(http.StatusAccepted)
+		case errors.Is(err, shard.ErrUnknownNode):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, shard.ErrMigrating), errors.Is(err, shard.ErrNodeExists), errors.Is(err, shard.ErrLastNode):
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+func main() {
+	flag.Parse()
+
+	var addrs []string
+	for _, node := range strings.Split(*nodes, ",") {
+		if node = strings.TrimSuffix(strings.TrimSpace(node), "/"); node != "" {
+			addrs = append(addrs, node)
+		}
+	}
+	ring := ringState{Nodes: addrs}
+	if *state != "" {
+		saved, ok, err := loadState(*state)
+		if err != nil {
+			log.Fatalf("Failed to read the ring: %v", err)
+		}
+		if ok {
+			ring = saved
+		}
+	}
+	if len(ring.Nodes) == 0 {
+		log.Fatal("No db nodes given")
+	}
+	router, err := startRouter(ring, shard.WithVirtualNodes(*vnodes))
+	if err != nil {
+		log.Fatalf("Failed to resume the migration from %v: %v", ring.From, err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	store := &ringStore{path: *state, router: router, ctx: ctx}
+	if ring.From != nil {
+		store.resumed(ring.From)
+		log.Printf("Resuming the migration from %v", ring.From)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/db/", router)
+	mux.HandleFunc("/router/nodes", nodesHandler(router, store))
+
+	server := httptools.CreateServer(*port, mux)
+	server.Start()
+	log.Printf("Routing keys across %v", ring.Nodes)
+	signal.WaitForTerminationSignal()
+	cancel()
+	router.Close()
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"slices"
+	"sync"
+
+	"github.com/dk872/architecture-lab5/shard"
+)
+
+// ringState is what the -state file holds: the nodes of the ring and, while
+// a migration runs, the nodes it migrates from.
+type ringState struct {
+	Nodes []string `json:"nodes"`
+	From  []string `json:"from,omitempty"`
+}
+
+// loadState reads the state file, reporting false when there is none yet.
+func loadState(path string) (ringState, bool, error) {
+	var state ringState
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, false, nil
+	}
+	if err != nil {
+		return state, false, err
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, false, err
+	}
+	return state, true, nil
+}
+
+// startRouter builds the router of state. A migration that was running is
+// started again from the nodes it migrates from: keys copied already are
+// not on the old nodes any more, and a copy never replaces a newer value.
+func startRouter(state ringState, opts ...shard.Option) (*shard.Router, error) {
+	if state.From == nil {
+		return shard.NewRouter(state.Nodes, opts...), nil
+	}
+	router := shard.NewRouter(state.From, opts...)
+	var err error
+	for _, node := range state.Nodes {
+		if !slices.Contains(state.From, node) {
+			err = errors.Join(err, router.AddNode(node))
+		}
+	}
+	for _, node := range state.From {
+		if !slices.Contains(state.Nodes, node) {
+			err = errors.Join(err, router.RemoveNode(node))
+		}
+	}
+	if err != nil {
+		router.Close()
+		return nil, err
+	}
+	return router, nil
+}
+
+// ringStore makes the changes to the ring of the router and saves the ring
+// to the state file whenever a migration starts or ends. Without a path it
+// saves nothing, and a router restarted during a migration leaves it
+// unfinished.
+type ringStore struct {
+	path   string
+	router *shard.Router
+	ctx    context.Context
+
+	// mutex is held over every change, so the ring does not change between
+	// a change and its save.
+	mutex sync.Mutex
+	// migration counts the migrations started, so the end of one is not
+	// saved over the start of the next.
+	migration int
+}
+
+func (s *ringStore) addNode(node string) error {
+	return s.change(node, s.router.AddNode)
+}
+
+func (s *ringStore) removeNode(node string) error {
+	return s.change(node, s.router.RemoveNode)
+}
+
+func (s *ringStore) change(node string, fn func(string) error) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	from := s.router.Status().Nodes
+	if err := fn(node); err != nil {
+		return err
+	}
+	s.started(from)
+	return nil
+}
+
+// resumed saves the migration startRouter started again.
+func (s *ringStore) resumed(from []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.started(from)
+}
+
+// started saves a migration from the nodes from to the current ring, and
+// the ring alone once it is done. The caller holds the mutex.
+func (s *ringStore) started(from []string) {
+	next := s.router.Status().Nodes
+	s.migration++
+	migration := s.migration
+	s.save(ringState{Nodes: next, From: from})
+
+	go func() {
+		if s.router.Wait(s.ctx) != nil {
+			return
+		}
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		if s.migration == migration {
+			s.save(ringState{Nodes: next})
+		}
+	}()
+}
+
+// save writes state to the file. The caller holds the mutex.
+func (s *ringStore) save(state ringState) {
+	if s.path == "" {
+		return
+	}
+	data, err := json.Marshal(state)
+	if err == nil {
+		tmp := s.path + ".tmp"
+		if err = os.WriteFile(tmp, append(data, '\n'), 0600); err == nil {
+			err = os.Rename(tmp, s.path)
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to save the ring: %v", err)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestRingStoreResumesMigration(t *testing.T) {
+	// The snapshots wait for release, which keeps the migration running.
+	release := make(chan struct{})
+	serve := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/db/_snapshot" {
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+		}
+	})
+	old, added := httptest.NewServer(serve), httptest.NewServer(serve)
+	defer old.Close()
+	defer added.Close()
+	path := filepath.Join(t.TempDir(), "ring.json")
+	both := []string{old.URL, added.URL}
+	sort.Strings(both)
+
+	load := func() ringState {
+		t.Helper()
+		state, ok, err := loadState(path)
+		if err != nil || !ok {
+			t.Fatalf("Loading the ring returned %v, %v", ok, err)
+		}
+		sort.Strings(state.Nodes)
+		return state
+	}
+
+	router, err := startRouter(ringState{Nodes: []string{old.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopped, stop := context.WithCancel(context.Background())
+	store := &ringStore{path: path, router: router, ctx: stopped}
+	if err := store.addNode(added.URL); err != nil {
+		t.Fatal(err)
+	}
+	want := ringState{Nodes: both, From: []string{old.URL}}
+	if state := load(); !reflect.DeepEqual(state, want) {
+		t.Errorf("Saved %+v during the migration, wanted %+v", state, want)
+	}
+	stop()
+	router.Close()
+
+	// A restart picks the migration up again.
+	router, err = startRouter(load())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	store = &ringStore{path: path, router: router, ctx: ctx}
+	store.resumed(want.From)
+	if status := router.Status(); !status.Migrating || len(status.Nodes) != 2 {
+		t.Errorf("Status after the restart: %+v", status)
+	}
+
+	close(release)
+	if err := router.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for load().From != nil {
+		if ctx.Err() != nil {
+			t.Fatal("The end of the migration was not saved")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if state := load(); !reflect.DeepEqual(state.Nodes, both) {
+		t.Errorf("Saved %v after the migration, wanted %v", state.Nodes, both)
+	}
+}
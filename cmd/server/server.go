@@ -1,51 +1,35 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"os"
+	"slices"
 	"strconv"
-	"strings"
 	"time"
 
+	"github.com/dk872/architecture-lab5/dbclient"
 	"github.com/dk872/architecture-lab5/httptools"
 	"github.com/dk872/architecture-lab5/signal"
 )
 
-var port = flag.Int("port", 8080, "server port")
+var (
+	port  = flag.Int("port", 8080, "server port")
+	dbURL = flag.String("db", "http://db:8083", "base URL of the db node or of a dbrouter")
+)
 
 const confResponseDelaySec = "CONF_RESPONSE_DELAY_SEC"
 const confHealthFailure = "CONF_HEALTH_FAILURE"
-const dbServiceURL = "http://db:8083/db"
 
-func postCurrentDate(key string) error {
+func waitForDBAndPostDate(client *dbclient.Client, key string, retries int, delay time.Duration) error {
 	value := time.Now().Format("2006-01-02")
-
-	body := fmt.Sprintf(`{"value":"%s"}`, value)
-	resp, err := http.DefaultClient.Post(
-		fmt.Sprintf("%s/%s", dbServiceURL, key),
-		"application/json",
-		strings.NewReader(body),
-	)
-	if err != nil {
-		return fmt.Errorf("failed to POST to db: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		data, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("POST failed with status %d: %s", resp.StatusCode, data)
-	}
-	return nil
-}
-
-func waitForDBAndPostDate(key string, retries int, delay time.Duration) error {
 	for i := 0; i < retries; i++ {
-		err := postCurrentDate(key)
+		err := client.Put(context.Background(), key, value)
 		if err == nil {
 			return nil
 		}
@@ -58,7 +42,8 @@ func waitForDBAndPostDate(key string, retries int, delay time.Duration) error {
 func main() {
 	flag.Parse()
 
-	if err := waitForDBAndPostDate("gitpushforce", 10, 1*time.Second); err != nil {
+	client := dbclient.New(*dbURL)
+	if err := waitForDBAndPostDate(client, "gitpushforce", 10, 1*time.Second); err != nil {
 		log.Fatalf("Failed to initialize DB value: %v", err)
 	}
 
@@ -86,34 +71,42 @@ func main() {
 
 		report.Process(r)
 
-		key := r.URL.Query().Get("key")
-		if key == "" {
+		keys := r.URL.Query()["key"]
+		if len(keys) == 0 || slices.Contains(keys, "") {
 			http.Error(rw, "missing key parameter", http.StatusBadRequest)
 			return
 		}
 
-		resp, err := http.DefaultClient.Get(fmt.Sprintf("%s/%s", dbServiceURL, key))
-		if err != nil {
-			http.Error(rw, "failed to query DB", http.StatusInternalServerError)
-			return
+		// Several keys are read in one request to the db; the found values
+		// come back together with the keys that are missing.
+		var result any
+		var err error
+		if len(keys) == 1 {
+			var value string
+			value, err = client.Get(r.Context(), keys[0])
+			result = struct {
+				Key   string `json:"key"`
+				Value string `json:"value"`
+			}{Key: keys[0], Value: value}
+		} else {
+			var values map[string]string
+			var missing []string
+			values, missing, err = client.GetMany(r.Context(), keys...)
+			result = struct {
+				Values  map[string]string `json:"values"`
+				Missing []string          `json:"missing"`
+			}{Values: values, Missing: missing}
 		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode == http.StatusNotFound {
+		var statusErr *dbclient.StatusError
+		switch {
+		case errors.Is(err, dbclient.ErrNotFound):
 			rw.WriteHeader(http.StatusNotFound)
 			return
-		} else if resp.StatusCode != http.StatusOK {
-			data, _ := io.ReadAll(resp.Body)
-			http.Error(rw, string(data), resp.StatusCode)
+		case errors.As(err, &statusErr):
+			http.Error(rw, statusErr.Message, statusErr.StatusCode)
 			return
-		}
-
-		var result struct {
-			Key   string `json:"key"`
-			Value string `json:"value"`
-		}
-		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-			http.Error(rw, "invalid response from DB", http.StatusInternalServerError)
+		case err != nil:
+			http.Error(rw, "failed to query DB", http.StatusInternalServerError)
 			return
 		}
 
@@ -0,0 +1,297 @@
+package datastore
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/dk872/architecture-lab5/datastore/vfs"
+)
+
+const blobFilePrefix = "blob-"
+
+// blobRef is the value of a record whose value is kept in a blob file of its
+// own, so that large values neither overflow segments nor get copied by
+// merges.
+type blobRef struct {
+	name string
+	size int64
+	hash [20]byte
+}
+
+// 0      8      28      <-- offset
+// (size) (hash) (name)
+// 8      20     ....    <-- length
+
+func (r blobRef) encode() string {
+	buf := make([]byte, 28+len(r.name))
+	binary.LittleEndian.PutUint64(buf, uint64(r.size))
+	copy(buf[8:], r.hash[:])
+	copy(buf[28:], r.name)
+	return string(buf)
+}
+
+func decodeBlobRef(value string) (blobRef, error) {
+	var ref blobRef
+	if len(value) <= 28 {
+		return ref, errors.New("malformed blob reference")
+	}
+	ref.size = int64(binary.LittleEndian.Uint64([]byte(value[:8])))
+	copy(ref.hash[:], value[8:28])
+	ref.name = value[28:]
+	if _, ok := parseBlobName(ref.name); !ok {
+		return ref, fmt.Errorf("malformed blob reference to %q", ref.name)
+	}
+	return ref, nil
+}
+
+// recordBlobRef decodes the reference held by a blob record as stored. The
+// reference holds no user data and stays in clear, so segments can track
+// their blobs without the keys; an encrypted blob record only prefixes it
+// with the ID of the key the content is encrypted under.
+func recordBlobRef(e *entry) (blobRef, error) {
+	value := e.value
+	if e.flags&flagEncrypted != 0 {
+		if len(value) < 4 {
+			return blobRef{}, errors.New("malformed blob reference")
+		}
+		value = value[4:]
+	}
+	return decodeBlobRef(value)
+}
+
+func parseBlobName(name string) (int, bool) {
+	rest, ok := strings.CutPrefix(name, blobFilePrefix)
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.Atoi(rest)
+	return n, err == nil && n >= 0
+}
+
+// blobReader streams a blob and verifies its size and hash once the end is
+// reached, so a damaged blob fails with a ChecksumError instead of a clean
+// EOF.
+type blobReader struct {
+	f          vfs.File
+	ref        blobRef
+	hash       hash.Hash
+	n          int64
+	mismatch   *ChecksumError
+	onMismatch func()
+}
+
+func (r *blobReader) Read(p []byte) (int, error) {
+	n, err := r.f.Read(p)
+	r.hash.Write(p[:n])
+	r.n += int64(n)
+	if errors.Is(err, io.EOF) && (r.n != r.ref.size || !bytes.Equal(r.hash.Sum(nil), r.ref.hash[:])) {
+		r.onMismatch()
+		return n, r.mismatch
+	}
+	return n, err
+}
+
+func (r *blobReader) Close() error {
+	return r.f.Close()
+}
+
+// blobValue is the content of a blob, decrypted if it was stored encrypted.
+type blobValue struct {
+	io.ReadCloser
+	size int64
+}
+
+// openBlob opens the blob a record refers to, decrypting its content if
+// needed. The caller holds segmentsMutex, so the blob cannot be collected
+// before it is open.
+func (db *Db) openBlob(seg *FileSegment, pos recordPos, record entry) (*blobValue, error) {
+	ref, err := recordBlobRef(&record)
+	if err != nil {
+		return nil, err
+	}
+	f, err := vfs.Open(db.opts.fs, filepath.Join(db.dir, ref.name))
+	if err != nil {
+		return nil, err
+	}
+	mismatch := &ChecksumError{
+		Segment: seg.id.fileName(),
+		Offset:  pos.offset,
+		Blob:    ref.name,
+	}
+	r := &blobReader{
+		f:        f,
+		ref:      ref,
+		hash:     sha1.New(),
+		mismatch: mismatch,
+		onMismatch: func() {
+			db.checksumMismatch(mismatch, record.key)
+		},
+	}
+	if record.flags&flagEncrypted == 0 {
+		return &blobValue{ReadCloser: r, size: ref.size}, nil
+	}
+
+	if db.opts.keys == nil {
+		f.Close()
+		return nil, fmt.Errorf("%w %q: no key provider", ErrDecrypt, record.key)
+	}
+	key, err := db.opts.keys.Key(keyID(record))
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%w %q: %w", ErrDecrypt, record.key, err)
+	}
+	cr, err := newChunkReader(r, key, chunkLabel(ref.name, record.key))
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%w %q: %w", ErrDecrypt, record.key, err)
+	}
+	return &blobValue{ReadCloser: cr, size: plainBlobSize(ref.size)}, nil
+}
+
+// putBlob streams r into a new blob file and appends a record referring to
+// it. The blob stays pending, and safe from collection, until the writer has
+// either indexed the record or failed it.
+func (db *Db) putBlob(ctx context.Context, key string, r io.Reader, opts WriteOptions) error {
+	name := db.reserveBlob()
+	record, err := db.writeBlob(key, name, r)
+	if err != nil {
+		db.blobDone(name, err)
+		return err
+	}
+
+	opts.apply(&record)
+	return db.put(ctx, record, func(err error) {
+		db.blobDone(name, err)
+	})
+}
+
+// reserveBlob returns the name of a new blob, pending until blobDone.
+func (db *Db) reserveBlob() string {
+	db.blobMutex.Lock()
+	defer db.blobMutex.Unlock()
+	name := fmt.Sprintf("%s%d", blobFilePrefix, db.blobNumber)
+	db.blobNumber++
+	db.pendingBlobs[name] = struct{}{}
+	return name
+}
+
+// writeBlob copies r into the named blob file and returns the record
+// referring to it. With encryption on, the content is encrypted.
+func (db *Db) writeBlob(key, name string, r io.Reader) (entry, error) {
+	var (
+		keyID   uint32
+		aesKey  []byte
+		record  = entry{key: key, flags: flagBlob}
+		chunked *chunkWriter
+	)
+	if db.opts.keys != nil {
+		var err error
+		if keyID, aesKey, err = db.opts.keys.CurrentKey(); err != nil {
+			return record, err
+		}
+	}
+
+	f, err := db.opts.fs.OpenFile(filepath.Join(db.dir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return record, err
+	}
+	defer f.Close()
+
+	h := sha1.New()
+	var w io.Writer = io.MultiWriter(f, h)
+	if aesKey != nil {
+		if chunked, err = newChunkWriter(w, aesKey, chunkLabel(name, key)); err != nil {
+			return record, err
+		}
+		w = chunked
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		return record, err
+	}
+	if chunked != nil {
+		if err := chunked.Close(); err != nil {
+			return record, err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		return record, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return record, err
+	}
+
+	ref := blobRef{name: name, size: info.Size()}
+	copy(ref.hash[:], h.Sum(nil))
+	record.value = ref.encode()
+	if aesKey != nil {
+		prefix := binary.LittleEndian.AppendUint32(nil, keyID)
+		record.value = string(prefix) + record.value
+		record.flags |= flagEncrypted
+	}
+	return record, nil
+}
+
+// blobDone settles a pending blob once its record has been written or has
+// failed; a blob without a record is removed right away.
+func (db *Db) blobDone(name string, err error) {
+	if err != nil {
+		_ = db.opts.fs.Remove(filepath.Join(db.dir, name))
+	}
+	db.blobMutex.Lock()
+	delete(db.pendingBlobs, name)
+	db.blobMutex.Unlock()
+}
+
+// collectBlobs removes the blob files no segment refers to any more: those of
+// records dropped by a merge and those left behind by a crash before their
+// record was written.
+func (db *Db) collectBlobs() error {
+	names, err := db.opts.fs.ReadDir(db.dir)
+	if err != nil {
+		return err
+	}
+
+	// Pending blobs are read before the segments: a blob leaves the pending
+	// set only after a segment refers to it.
+	db.blobMutex.Lock()
+	live := make(map[string]struct{}, len(db.pendingBlobs))
+	for name := range db.pendingBlobs {
+		live[name] = struct{}{}
+	}
+	db.blobMutex.Unlock()
+
+	db.segmentsMutex.RLock()
+	for _, seg := range db.segments {
+		seg.mutex.RLock()
+		for name := range seg.blobs {
+			live[name] = struct{}{}
+		}
+		seg.mutex.RUnlock()
+	}
+	db.segmentsMutex.RUnlock()
+
+	var errs []error
+	for _, name := range names {
+		if _, ok := parseBlobName(name); !ok {
+			continue
+		}
+		if _, ok := live[name]; ok {
+			continue
+		}
+		if err := db.opts.fs.Remove(filepath.Join(db.dir, name)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
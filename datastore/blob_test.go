@@ -0,0 +1,158 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/dk872/architecture-lab5/datastore/vfs"
+)
+
+func countBlobs(t *testing.T, fs vfs.FS, dir string) int {
+	t.Helper()
+	names, err := fs.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for _, name := range names {
+		if _, ok := parseBlobName(name); ok {
+			n++
+		}
+	}
+	return n
+}
+
+func TestBlobValues(t *testing.T) {
+	fs := vfs.NewMem()
+	db, err := Open("/data", 256, WithFS(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	large := strings.Repeat("large value ", 100)
+	if err := db.Put("large", large); err != nil {
+		t.Fatal(err)
+	}
+	streamed := strings.Repeat("streamed ", 1000)
+	if err := db.PutReader(context.Background(), "streamed", strings.NewReader(streamed)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutReader(context.Background(), "small", strings.NewReader("small")); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := countBlobs(t, fs, "/data"); n != 2 {
+		t.Errorf("Expected 2 blob files, found %d", n)
+	}
+	if size, _ := db.Size(); size > 256 {
+		t.Errorf("Blob references overflowed the segment: %d bytes", size)
+	}
+
+	check := func(db *Db) {
+		t.Helper()
+		for key, want := range map[string]string{"large": large, "streamed": streamed, "small": "small"} {
+			if value, err := db.Get(key); err != nil || value != want {
+				t.Errorf("Get(%q) returned %d bytes, %v", key, len(value), err)
+			}
+
+			r, size, err := db.GetReader(context.Background(), key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := io.ReadAll(r)
+			r.Close()
+			if err != nil || string(data) != want || size != int64(len(want)) {
+				t.Errorf("GetReader(%q) returned %d of %d bytes, %v", key, len(data), size, err)
+			}
+		}
+	}
+	check(db)
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open("/data", 256, WithFS(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check(db)
+}
+
+func TestBlobGarbageCollection(t *testing.T) {
+	fs := vfs.NewMem()
+	policy := &switchPolicy{}
+	db, err := Open("/data", 128, WithFS(fs), WithCompactionPolicy(policy), WithBlobThreshold(32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	orphan, err := fs.OpenFile("/data/blob-1000", os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	orphan.Close()
+
+	var last string
+	for i := 0; i < 10; i++ {
+		last = strings.Repeat(string(rune('a'+i)), 100)
+		if err := db.Put("key", last); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put("small", "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := countBlobs(t, fs, "/data"); n != 11 {
+		t.Fatalf("Expected 11 blob files before the merge, found %d", n)
+	}
+
+	policy.enabled.Store(true)
+	db.scheduleCompaction()
+	db.mergeWg.Wait()
+
+	if n := countBlobs(t, fs, "/data"); n != 1 {
+		t.Errorf("Expected only the live blob to survive the merge, found %d", n)
+	}
+	if value, err := db.Get("key"); err != nil || value != last {
+		t.Errorf("Get after merge returned %d bytes, %v", len(value), err)
+	}
+}
+
+func TestBlobCorruption(t *testing.T) {
+	fs := vfs.NewFault(vfs.NewMem())
+	db, err := Open("/data", 256, WithFS(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Put("key", strings.Repeat("x", 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Corrupt("/data/blob-0", 500); err != nil {
+		t.Fatal(err)
+	}
+
+	r, _, err := db.GetReader(context.Background(), "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	_, err = io.ReadAll(r)
+	var checksumErr *ChecksumError
+	if !errors.As(err, &checksumErr) || checksumErr.Blob != "blob-0" || checksumErr.Segment != "current-data0" {
+		t.Errorf("Expected the stream to end with a ChecksumError for blob-0, got %v", err)
+	}
+	if _, err := db.Get("key"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for a damaged blob, got %v", err)
+	}
+	if failures := db.Stats().ChecksumFailures; failures != 2 {
+		t.Errorf("Expected 2 checksum failures, got %d", failures)
+	}
+}
@@ -0,0 +1,113 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCloseDrainsWrites(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		wg    sync.WaitGroup
+		mutex sync.Mutex
+		acked = make(map[string]string)
+	)
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				key, value := fmt.Sprintf("w%d-%d", w, i), fmt.Sprintf("value-%d", i)
+				err := db.Put(key, value)
+				if errors.Is(err, ErrClosed) {
+					return
+				}
+				if err != nil {
+					t.Errorf("Put(%q) failed: %v", key, err)
+					return
+				}
+				mutex.Lock()
+				acked[key] = value
+				mutex.Unlock()
+			}
+		}(w)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	if err := db.Close(); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected a second Close to return ErrClosed, got %v", err)
+	}
+	if err := db.Put("key", "value"); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected Put after Close to return ErrClosed, got %v", err)
+	}
+	if _, err := db.Get("key"); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected Get after Close to return ErrClosed, got %v", err)
+	}
+
+	db, err = Open(dir, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if len(acked) == 0 {
+		t.Fatal("Expected some writes to be acknowledged before Close")
+	}
+	for key, value := range acked {
+		if got, err := db.Get(key); err != nil || got != value {
+			t.Errorf("Acknowledged write %q = %q lost after Close: got %q, %v", key, value, got, err)
+		}
+	}
+}
+
+func TestCloseContextAbortsMerge(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir, 256, WithCompactionPolicy(&switchPolicy{}), WithCompactionRateLimit(512))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), "some value to merge"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db.opts.compactionPolicy.(*switchPolicy).enabled.Store(true)
+	db.scheduleCompaction()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := db.CloseContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the deadline to interrupt the merge, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("CloseContext took %s despite the deadline", elapsed)
+	}
+
+	db, err = Open(dir, 256, WithCompactionPolicy(&switchPolicy{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if value, err := db.Get(key); err != nil || value != "some value to merge" {
+			t.Errorf("Get(%q) = %q, %v", key, value, err)
+		}
+	}
+}
@@ -0,0 +1,619 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dk872/architecture-lab5/datastore/vfs"
+)
+
+// SegmentInfo describes a sealed segment for a CompactionPolicy.
+type SegmentInfo struct {
+	Name string
+	// Run groups segments written by the same merge; a plain segment is a run
+	// of its own.
+	Run       string
+	Size      int64
+	LiveBytes int64
+}
+
+func (s SegmentInfo) GarbageRatio() float64 {
+	if s.Size == 0 {
+		return 0
+	}
+	return float64(s.Size-s.LiveBytes) / float64(s.Size)
+}
+
+// CompactionPolicy decides which sealed segments get merged. Plan receives the
+// sealed segments from oldest to newest and returns the indexes of those to
+// merge; an empty result means there is nothing to do.
+type CompactionPolicy interface {
+	Plan(sealed []SegmentInfo) []int
+}
+
+// MergeAllPolicy merges every sealed segment once the store holds at least
+// MinSegments segments, the active one included. This is the original
+// behaviour of the datastore.
+type MergeAllPolicy struct {
+	MinSegments int
+}
+
+func (p MergeAllPolicy) Plan(sealed []SegmentInfo) []int {
+	if len(sealed)+1 < p.MinSegments || countRuns(sealed) < 2 {
+		return nil
+	}
+	picked := make([]int, len(sealed))
+	for i := range sealed {
+		picked[i] = i
+	}
+	return picked
+}
+
+// GarbageRatioPolicy rewrites only the segments whose share of overwritten
+// records reaches MinRatio, the dirtiest first, at most MaxSegments at a time.
+type GarbageRatioPolicy struct {
+	MinRatio    float64
+	MaxSegments int
+}
+
+func (p GarbageRatioPolicy) Plan(sealed []SegmentInfo) []int {
+	var picked []int
+	for i, s := range sealed {
+		if s.Size > 0 && s.GarbageRatio() >= p.MinRatio {
+			picked = append(picked, i)
+		}
+	}
+	sort.SliceStable(picked, func(i, j int) bool {
+		return sealed[picked[i]].GarbageRatio() > sealed[picked[j]].GarbageRatio()
+	})
+	if p.MaxSegments > 0 && len(picked) > p.MaxSegments {
+		picked = picked[:p.MaxSegments]
+	}
+	sort.Ints(picked)
+	return picked
+}
+
+// SizeTieredPolicy buckets runs of similar total size together and merges a
+// bucket once it holds MinRuns runs, so every record is rewritten a
+// logarithmic number of times. A run belongs to a bucket when its size lies
+// within [BucketLow, BucketHigh] times the bucket average.
+type SizeTieredPolicy struct {
+	MinRuns    int
+	BucketLow  float64
+	BucketHigh float64
+}
+
+func (p SizeTieredPolicy) Plan(sealed []SegmentInfo) []int {
+	minRuns, low, high := p.MinRuns, p.BucketLow, p.BucketHigh
+	if minRuns < 2 {
+		minRuns = 4
+	}
+	if low <= 0 {
+		low = 0.5
+	}
+	if high <= 0 {
+		high = 1.5
+	}
+
+	type run struct {
+		name    string
+		size    int64
+		members []int
+	}
+	var runs []*run
+	byName := make(map[string]*run)
+	for i, s := range sealed {
+		r, ok := byName[s.Run]
+		if !ok {
+			r = &run{name: s.Run}
+			byName[s.Run] = r
+			runs = append(runs, r)
+		}
+		r.size += s.Size
+		r.members = append(r.members, i)
+	}
+	sort.SliceStable(runs, func(i, j int) bool { return runs[i].size < runs[j].size })
+
+	var bucket []*run
+	var total int64
+	flush := func() []int {
+		if len(bucket) < minRuns {
+			return nil
+		}
+		var picked []int
+		for _, r := range bucket {
+			picked = append(picked, r.members...)
+		}
+		sort.Ints(picked)
+		return picked
+	}
+	for _, r := range runs {
+		if len(bucket) > 0 {
+			avg := float64(total) / float64(len(bucket))
+			if float64(r.size) < avg*low || float64(r.size) > avg*high {
+				if picked := flush(); picked != nil {
+					return picked
+				}
+				bucket, total = nil, 0
+			}
+		}
+		bucket = append(bucket, r)
+		total += r.size
+	}
+	return flush()
+}
+
+func countRuns(sealed []SegmentInfo) int {
+	runs := make(map[string]struct{})
+	for _, s := range sealed {
+		runs[s.Run] = struct{}{}
+	}
+	return len(runs)
+}
+
+// rateLimiter paces merge I/O to a number of bytes per second.
+type rateLimiter struct {
+	rate  int64
+	mutex sync.Mutex
+	next  time.Time
+}
+
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: bytesPerSecond}
+}
+
+func (l *rateLimiter) wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+	l.mutex.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+	delay := l.next.Sub(now)
+	l.mutex.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+func (db *Db) scheduleCompaction() {
+	db.compactMutex.Lock()
+	defer db.compactMutex.Unlock()
+	if db.compactPending {
+		return
+	}
+	db.compactPending = true
+	db.mergeWg.Add(1)
+	db.compactCh <- struct{}{}
+}
+
+func (db *Db) compactor() {
+	defer close(db.compactorDone)
+	var tick <-chan time.Time
+	if db.opts.compactionInterval > 0 {
+		ticker := time.NewTicker(db.opts.compactionInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-db.compactCh:
+			db.compactMutex.Lock()
+			db.compactPending = false
+			db.compactMutex.Unlock()
+			db.runCompaction()
+			db.mergeWg.Done()
+		case <-tick:
+			db.runCompaction()
+		case <-db.stopCh:
+			return
+		}
+	}
+}
+
+func (db *Db) runCompaction() {
+	for {
+		select {
+		case <-db.stopCh:
+			return
+		default:
+		}
+
+		inputs := db.planCompaction()
+		if len(inputs) == 0 {
+			return
+		}
+		info := MergeInfo{}
+		for _, seg := range inputs {
+			info.Inputs = append(info.Inputs, seg.id.fileName())
+			info.BytesIn += seg.size
+		}
+		db.opts.listener.MergeStarted(info)
+
+		start := time.Now()
+		outputs, err := db.mergeSegments(inputs)
+		info.Duration = time.Since(start)
+		info.Err = err
+		for _, seg := range outputs {
+			info.Outputs = append(info.Outputs, seg.id.fileName())
+			info.BytesOut += seg.size
+		}
+		db.metrics.mergeDone(info.Duration, err)
+		db.opts.listener.MergeFinished(info)
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (db *Db) planCompaction() []*FileSegment {
+	db.segmentsMutex.RLock()
+	defer db.segmentsMutex.RUnlock()
+
+	if len(db.segments) < 2 {
+		return nil
+	}
+	sealed := db.segments[:len(db.segments)-1]
+	live, _ := db.liveBytes()
+
+	infos := make([]SegmentInfo, len(sealed))
+	for i, seg := range sealed {
+		infos[i] = SegmentInfo{
+			Name:      seg.id.fileName(),
+			Run:       seg.id.run(),
+			Size:      seg.size,
+			LiveBytes: live[seg],
+		}
+	}
+
+	var inputs []*FileSegment
+	for _, i := range db.opts.compactionPolicy.Plan(infos) {
+		if i >= 0 && i < len(sealed) {
+			inputs = append(inputs, sealed[i])
+		}
+	}
+	return inputs
+}
+
+// liveBytes returns the bytes of records in each segment that are not
+// shadowed by a newer write, and the number of keys that have a value: a
+// tombstone or an expired value is live until a merge drops it, but its key
+// is not counted. The caller holds segmentsMutex.
+func (db *Db) liveBytes() (map[*FileSegment]int64, int) {
+	live := make(map[*FileSegment]int64, len(db.segments))
+	seen := make(map[string]struct{})
+	keys := 0
+	now := time.Now()
+	for i := len(db.segments) - 1; i >= 0; i-- {
+		seg := db.segments[i]
+		seg.mutex.RLock()
+		for key, pos := range seg.index {
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+			live[seg] += pos.size
+			if !pos.dead(now) {
+				keys++
+			}
+		}
+		seg.mutex.RUnlock()
+	}
+	return live, keys
+}
+
+type liveRecord struct {
+	seg *FileSegment
+	key string
+	pos recordPos
+}
+
+func (db *Db) mergeSegments(inputs []*FileSegment) ([]*FileSegment, error) {
+	isInput := make(map[*FileSegment]bool, len(inputs))
+	for _, seg := range inputs {
+		isInput[seg] = true
+	}
+
+	db.segmentsMutex.RLock()
+	var records []liveRecord
+	seen := make(map[string]struct{})
+	now := time.Now()
+	for i := len(db.segments) - 1; i >= 0; i-- {
+		seg := db.segments[i]
+		seg.mutex.RLock()
+		for key, pos := range seg.index {
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+			if isInput[seg] && (!pos.dead(now) || db.olderCopy(key, i, isInput)) {
+				records = append(records, liveRecord{seg: seg, key: key, pos: pos})
+			}
+		}
+		seg.mutex.RUnlock()
+	}
+	newest := inputs[len(inputs)-1].id
+	gen := db.mergeGen
+	db.mergeGen++
+	db.segmentsMutex.RUnlock()
+
+	order := make(map[*FileSegment]int, len(inputs))
+	for i, seg := range inputs {
+		order[seg] = i
+	}
+	sort.Slice(records, func(i, j int) bool {
+		a, b := records[i], records[j]
+		if a.seg != b.seg {
+			return order[a.seg] < order[b.seg]
+		}
+		return a.pos.offset < b.pos.offset
+	})
+
+	written, err := db.writeMergeOutputs(records, isInput, segmentID{seq: newest.seq, gen: gen})
+	if err != nil {
+		for _, seg := range written.segments {
+			_ = db.opts.fs.Remove(seg.outPath)
+		}
+		for _, name := range written.blobs {
+			db.blobDone(name, err)
+		}
+		return nil, err
+	}
+	outputs := written.segments
+
+	db.segmentsMutex.Lock()
+	merged := make([]*FileSegment, 0, len(db.segments)-len(inputs)+len(outputs))
+	for _, seg := range db.segments {
+		if !isInput[seg] {
+			merged = append(merged, seg)
+			continue
+		}
+		if seg == inputs[len(inputs)-1] {
+			merged = append(merged, outputs...)
+		}
+	}
+	db.segments = merged
+	db.segmentsMutex.Unlock()
+	for _, name := range written.blobs {
+		db.blobDone(name, nil)
+	}
+
+	// The records the merge dropped may be shadowed by ones the active
+	// segment has not synced yet; until it is, the inputs stay on disk.
+	if err := db.syncActive(); err != nil {
+		return outputs, errors.Join(append(written.problems, err)...)
+	}
+	var errs []error
+	for _, seg := range inputs {
+		if err := db.opts.fs.Remove(seg.outPath); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	// Blobs are only collected once no input file is left on disk to refer
+	// to them after a restart.
+	if len(errs) == 0 {
+		if err := db.collectBlobs(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return outputs, errors.Join(append(written.problems, errs...)...)
+}
+
+// syncActive syncs the segment the writer appends to through a handle of
+// its own, as the writer may rotate it at any time. Every sealed segment was
+// synced by its rotation.
+func (db *Db) syncActive() error {
+	db.segmentsMutex.RLock()
+	active := db.segments[len(db.segments)-1]
+	db.segmentsMutex.RUnlock()
+
+	f, err := vfs.Open(db.opts.fs, active.outPath)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// olderCopy reports whether a segment before the i-th one that stays after
+// the merge holds key. A tombstone or an expired value is dropped once there
+// is none left for it to shadow. The caller holds segmentsMutex.
+func (db *Db) olderCopy(key string, i int, isInput map[*FileSegment]bool) bool {
+	for _, seg := range db.segments[:i] {
+		if isInput[seg] {
+			continue
+		}
+		seg.mutex.RLock()
+		_, ok := seg.index[key]
+		seg.mutex.RUnlock()
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeOutput is what writeMergeOutputs wrote.
+type mergeOutput struct {
+	segments []*FileSegment
+	// blobs are the blobs written for blob records moved to the current
+	// key. They stay pending until the segments replace the inputs.
+	blobs []string
+	// problems are the records that were not copied as they were: damaged
+	// ones, replaced by older copies, and those left under an old key.
+	problems []error
+}
+
+// writeMergeOutputs copies the live records into new segment files, starting a
+// new part whenever the next record would overflow segmentSize. A damaged
+// record is replaced by an older copy of its key; the merge fails when there
+// is none, as it does on any other read error, so that the inputs are kept.
+func (db *Db) writeMergeOutputs(records []liveRecord, isInput map[*FileSegment]bool, id segmentID) (mergeOutput, error) {
+	var (
+		written mergeOutput
+		cur     *FileSegment
+		out     vfs.File
+	)
+	sources := make(map[*FileSegment]vfs.File)
+	open := func(seg *FileSegment) (vfs.File, error) {
+		if f, ok := sources[seg]; ok {
+			return f, nil
+		}
+		f, err := vfs.Open(db.opts.fs, seg.outPath)
+		if err != nil {
+			return nil, err
+		}
+		sources[seg] = f
+		return f, nil
+	}
+	defer func() {
+		for _, f := range sources {
+			f.Close()
+		}
+		if out != nil {
+			out.Close()
+		}
+	}()
+
+	seal := func() error {
+		if out == nil {
+			return nil
+		}
+		err := out.Sync()
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		out = nil
+		return err
+	}
+
+	for _, rec := range records {
+		select {
+		case <-db.stopCh:
+			return written, ErrClosed
+		default:
+		}
+
+		src, err := open(rec.seg)
+		if err != nil {
+			return written, err
+		}
+
+		db.opts.limiter.wait(int(rec.pos.size))
+		ent, err := rec.seg.readRecord(src, rec.pos)
+		var checksumErr *ChecksumError
+		if errors.As(err, &checksumErr) {
+			db.checksumMismatch(checksumErr, rec.key)
+			var kept bool
+			rec, ent, kept, err = db.olderRecord(rec, checksumErr, isInput, open)
+			if err == nil {
+				written.problems = append(written.problems, fmt.Errorf("key %q: %w", rec.key, checksumErr))
+			}
+			if kept {
+				continue
+			}
+		}
+		if err != nil {
+			return written, err
+		}
+
+		if ent.flags&flagBlob != 0 {
+			var blob string
+			ent, blob, err = db.rotateBlob(rec.seg, rec.pos, ent)
+			if blob != "" {
+				written.blobs = append(written.blobs, blob)
+			}
+		} else {
+			ent, err = db.rotateKey(ent)
+		}
+		if err != nil {
+			written.problems = append(written.problems, fmt.Errorf("key %q left under its old encryption key: %w", rec.key, err))
+		}
+		data := ent.Encode()
+
+		if cur == nil || (cur.size > 0 && cur.size+int64(len(data)) > db.segmentSize) {
+			if err := seal(); err != nil {
+				return written, err
+			}
+			cur = newFileSegment(db.opts.fs, db.dir, segmentID{seq: id.seq, gen: id.gen, part: len(written.segments)})
+			f, err := db.opts.fs.OpenFile(cur.outPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+			if err != nil {
+				return written, fmt.Errorf("create merge output: %w", err)
+			}
+			out = f
+			written.segments = append(written.segments, cur)
+		}
+
+		db.opts.limiter.wait(len(data))
+		n, err := out.Write(data)
+		if err != nil {
+			return written, err
+		}
+		cur.put(&ent, recordPos{offset: cur.size, size: int64(n)})
+		cur.size += int64(n)
+	}
+
+	return written, seal()
+}
+
+// olderRecord finds what a merge writes in place of a damaged record: the
+// copy of its key that comes before it, returned with where it was read.
+// kept is set when that copy is in a segment the merge keeps, where it stays
+// readable without being copied. Without an older copy damaged is returned.
+// A damaged tombstone is written anew instead, so the values it deletes do
+// not come back.
+func (db *Db) olderRecord(rec liveRecord, damaged *ChecksumError, isInput map[*FileSegment]bool, open func(*FileSegment) (vfs.File, error)) (liveRecord, entry, bool, error) {
+	if rec.pos.tombstone {
+		return rec, entry{key: rec.key, flags: flagTombstone}, false, nil
+	}
+
+	db.segmentsMutex.RLock()
+	var older []*FileSegment
+	for i, seg := range db.segments {
+		if seg == rec.seg {
+			older = db.segments[:i:i]
+			break
+		}
+	}
+	db.segmentsMutex.RUnlock()
+
+	for i := len(older) - 1; i >= 0; i-- {
+		seg := older[i]
+		seg.mutex.RLock()
+		pos, ok := seg.index[rec.key]
+		seg.mutex.RUnlock()
+		if !ok {
+			continue
+		}
+		if !isInput[seg] {
+			return rec, entry{}, true, nil
+		}
+		f, err := open(seg)
+		if err != nil {
+			return rec, entry{}, false, err
+		}
+		db.opts.limiter.wait(int(pos.size))
+		ent, err := seg.readRecord(f, pos)
+		var checksumErr *ChecksumError
+		if !errors.As(err, &checksumErr) {
+			return liveRecord{seg: seg, key: rec.key, pos: pos}, ent, false, err
+		}
+		db.checksumMismatch(checksumErr, rec.key)
+	}
+	return rec, entry{}, false, damaged
+}
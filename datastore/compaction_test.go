@@ -0,0 +1,272 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dk872/architecture-lab5/datastore/vfs"
+)
+
+func TestMergeAllPolicy(t *testing.T) {
+	p := MergeAllPolicy{MinSegments: 3}
+
+	if got := p.Plan([]SegmentInfo{{Run: "0"}}); got != nil {
+		t.Errorf("Expected no merge below MinSegments, got %v", got)
+	}
+	if got := p.Plan([]SegmentInfo{{Run: "0.1"}, {Run: "0.1"}}); got != nil {
+		t.Errorf("Expected no merge of a single run, got %v", got)
+	}
+	got := p.Plan([]SegmentInfo{{Run: "0.1"}, {Run: "0.1"}, {Run: "1"}})
+	if !reflect.DeepEqual(got, []int{0, 1, 2}) {
+		t.Errorf("Expected all sealed segments to be merged, got %v", got)
+	}
+}
+
+func TestGarbageRatioPolicy(t *testing.T) {
+	p := GarbageRatioPolicy{MinRatio: 0.5, MaxSegments: 2}
+	sealed := []SegmentInfo{
+		{Run: "0", Size: 100, LiveBytes: 90},
+		{Run: "1", Size: 100, LiveBytes: 40},
+		{Run: "2", Size: 100, LiveBytes: 0},
+		{Run: "3", Size: 100, LiveBytes: 30},
+	}
+
+	got := p.Plan(sealed)
+	if !reflect.DeepEqual(got, []int{2, 3}) {
+		t.Errorf("Expected the two dirtiest segments, got %v", got)
+	}
+}
+
+func TestSizeTieredPolicy(t *testing.T) {
+	p := SizeTieredPolicy{MinRuns: 3}
+	sealed := []SegmentInfo{
+		{Run: "0.1", Size: 1000},
+		{Run: "0.1", Size: 1000},
+		{Run: "1", Size: 100},
+		{Run: "2", Size: 110},
+		{Run: "3", Size: 90},
+	}
+
+	got := p.Plan(sealed)
+	if !reflect.DeepEqual(got, []int{2, 3, 4}) {
+		t.Errorf("Expected the small runs to be merged, got %v", got)
+	}
+
+	if got := p.Plan(sealed[:4]); got != nil {
+		t.Errorf("Expected no merge with too few similar runs, got %v", got)
+	}
+}
+
+func TestGarbageRatioCompactionKeepsCleanSegments(t *testing.T) {
+	tempDir := t.TempDir()
+	db, err := Open(tempDir, 60, WithCompactionPolicy(GarbageRatioPolicy{MinRatio: 0.5}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, key := range []string{"a1", "a2", "b1", "b2", "a1", "a2", "c1"} {
+		if err := db.Put(key, "value-"+key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.mergeWg.Wait()
+
+	db.segmentsMutex.RLock()
+	var names []string
+	for _, seg := range db.segments {
+		names = append(names, seg.id.fileName())
+	}
+	db.segmentsMutex.RUnlock()
+
+	if names[0] != "current-data1" {
+		t.Errorf("Expected the clean segment current-data1 to stay untouched, got %v", names)
+	}
+	for _, seg := range names {
+		if seg == "current-data0" {
+			t.Errorf("Expected the overwritten segment current-data0 to be compacted away, got %v", names)
+		}
+	}
+
+	for _, key := range []string{"a1", "a2", "b1", "b2", "c1"} {
+		if value, err := db.Get(key); err != nil || value != "value-"+key {
+			t.Errorf("Get(%q) = %q, %v", key, value, err)
+		}
+	}
+}
+
+func TestRecoverAfterMerge(t *testing.T) {
+	tempDir := t.TempDir()
+	db, err := Open(tempDir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := make(map[string]string)
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("key%d", i%7)
+		value := fmt.Sprintf("value%d", i)
+		if err := db.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+		expected[key] = value
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(tempDir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for key, value := range expected {
+		if got, err := db.Get(key); err != nil || got != value {
+			t.Errorf("Get(%q) = %q, %v; wanted %q", key, got, err, value)
+		}
+	}
+
+	if err := db.Put("key0", "fresh"); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := db.Get("key0"); got != "fresh" {
+		t.Errorf("Expected a write after reopen to win over merged data, got %q", got)
+	}
+}
+
+func TestMergeKeepsInputsOnReadError(t *testing.T) {
+	fs := vfs.NewFault(vfs.NewMem())
+	policy := &switchPolicy{}
+	db, err := Open("/data", 60, WithFS(fs), WithCompactionPolicy(policy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, key := range []string{"k1", "k2", "k3", "k4", "k5"} {
+		if err := db.Put(key, "value-"+key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	segments := len(db.segments)
+
+	fs.FailReads(true)
+	policy.enabled.Store(true)
+	db.scheduleCompaction()
+	db.mergeWg.Wait()
+	fs.FailReads(false)
+
+	if len(db.segments) != segments {
+		t.Errorf("Expected the failed merge to keep all %d segments, got %d", segments, len(db.segments))
+	}
+	for _, key := range []string{"k1", "k2", "k3", "k4", "k5"} {
+		if value, err := db.Get(key); err != nil || value != "value-"+key {
+			t.Errorf("Get(%q) = %q, %v", key, value, err)
+		}
+	}
+}
+
+func TestMergeReplacesDamagedRecords(t *testing.T) {
+	fs := vfs.NewFault(vfs.NewMem())
+	policy := &switchPolicy{}
+	db, err := Open("/data", 60, WithFS(fs), WithCompactionPolicy(policy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, put := range [][2]string{{"k1", "old"}, {"k2", "v2"}, {"k3", "v3"}, {"k1", "new"}, {"k4", "v4"}, {"k5", "v5"}} {
+		if err := db.Put(put[0], put[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete("k2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("k6", "v6"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The newest k1 and the tombstone of k2 are damaged, both have an older
+	// copy in the sealed segments.
+	db.segmentsMutex.RLock()
+	for _, key := range []string{"k1", "k2"} {
+		for i := len(db.segments) - 2; i >= 0; i-- {
+			if pos, ok := db.segments[i].index[key]; ok {
+				if err := fs.Corrupt(db.segments[i].outPath, pos.offset+pos.size-1); err != nil {
+					t.Fatal(err)
+				}
+				break
+			}
+		}
+	}
+	db.segmentsMutex.RUnlock()
+
+	policy.enabled.Store(true)
+	db.scheduleCompaction()
+	db.mergeWg.Wait()
+
+	if value, err := db.Get("k1"); err != nil || value != "old" {
+		t.Errorf("Expected k1 to fall back to its older value, got %q, %v", value, err)
+	}
+	if _, err := db.Get("k2"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected k2 to stay deleted, got %v", err)
+	}
+	if stats := db.Stats(); !errors.Is(stats.LastMergeError, ErrChecksumMismatch) {
+		t.Errorf("Expected the damaged records in the merge error, got %v", stats.LastMergeError)
+	}
+}
+
+func TestMergeKeepsDamagedRecordWithoutOlderCopy(t *testing.T) {
+	fs := vfs.NewFault(vfs.NewMem())
+	policy := &switchPolicy{}
+	db, err := Open("/data", 60, WithFS(fs), WithCompactionPolicy(policy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, key := range []string{"k1", "k2", "k3", "k4", "k5"} {
+		if err := db.Put(key, "value-"+key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	seg := db.segments[0]
+	pos := seg.index["k1"]
+	if err := fs.Corrupt(seg.outPath, pos.offset+pos.size-1); err != nil {
+		t.Fatal(err)
+	}
+
+	policy.enabled.Store(true)
+	db.scheduleCompaction()
+	db.mergeWg.Wait()
+
+	if db.segments[0] != seg {
+		t.Error("Expected the segment with the only copy of k1 to be kept")
+	}
+	if stats := db.Stats(); !errors.Is(stats.LastMergeError, ErrChecksumMismatch) {
+		t.Errorf("Expected the merge to fail on the damaged record, got %v", stats.LastMergeError)
+	}
+	for _, key := range []string{"k2", "k3", "k4", "k5"} {
+		if value, err := db.Get(key); err != nil || value != "value-"+key {
+			t.Errorf("Get(%q) = %q, %v", key, value, err)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(1000)
+	start := time.Now()
+	l.wait(100)
+	l.wait(100)
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("Expected 200 bytes at 1000 B/s to take about 200ms, took %s", elapsed)
+	}
+
+	var unlimited *rateLimiter
+	unlimited.wait(1 << 30)
+}
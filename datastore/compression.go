@@ -0,0 +1,95 @@
+package datastore
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Compression selects how values are compressed before they are written.
+type Compression int
+
+const (
+	NoCompression Compression = iota
+	Flate
+	Zlib
+)
+
+const (
+	flagFlate byte = 1 << 1
+	flagZlib  byte = 1 << 2
+
+	compressionFlags = flagFlate | flagZlib
+)
+
+// WithCompression compresses values of at least threshold bytes. A value is
+// stored compressed only when that makes it smaller; records of either kind
+// stay readable whatever the option is set to.
+func WithCompression(c Compression, threshold int) Option {
+	return func(o *options) {
+		o.compression = c
+		o.compressThreshold = threshold
+	}
+}
+
+// compress returns the stored form of e, compressed if that is worth it.
+func (o *options) compress(e entry) entry {
+	if o.compression == NoCompression || len(e.value) < o.compressThreshold {
+		return e
+	}
+
+	var (
+		buf  bytes.Buffer
+		w    io.WriteCloser
+		flag byte
+	)
+	switch o.compression {
+	case Flate:
+		w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+		flag = flagFlate
+	case Zlib:
+		w = zlib.NewWriter(&buf)
+		flag = flagZlib
+	default:
+		return e
+	}
+	_, _ = io.WriteString(w, e.value)
+	if err := w.Close(); err != nil || buf.Len() >= len(e.value) {
+		return e
+	}
+
+	e.value = buf.String()
+	e.flags |= flag
+	return e
+}
+
+// decompress restores the value of a record written by compress.
+func decompress(e entry) (entry, error) {
+	var (
+		r   io.ReadCloser
+		err error
+	)
+	switch {
+	case e.flags&flagFlate != 0:
+		r = flate.NewReader(strings.NewReader(e.value))
+	case e.flags&flagZlib != 0:
+		r, err = zlib.NewReader(strings.NewReader(e.value))
+	default:
+		return e, nil
+	}
+	if err != nil {
+		return e, fmt.Errorf("decompress %q: %w", e.key, err)
+	}
+	defer r.Close()
+
+	value, err := io.ReadAll(r)
+	if err != nil {
+		return e, fmt.Errorf("decompress %q: %w", e.key, err)
+	}
+	e.value = string(value)
+	e.flags &^= compressionFlags
+	return e, nil
+}
@@ -0,0 +1,98 @@
+package datastore
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/dk872/architecture-lab5/datastore/vfs"
+)
+
+func TestCompression(t *testing.T) {
+	value := strings.Repeat(`{"team":"lab5","status":"ok","items":[1,2,3]},`, 20)
+	random := make([]byte, 200)
+	_, _ = rand.Read(random)
+
+	for name, c := range map[string]Compression{"flate": Flate, "zlib": Zlib} {
+		t.Run(name, func(t *testing.T) {
+			fs := vfs.NewMem()
+			db, err := Open("/data", 4096, WithFS(fs), WithCompression(c, 64))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			values := map[string]string{
+				"json":   value,
+				"small":  "short value",
+				"random": string(random),
+			}
+			for key, v := range values {
+				if err := db.Put(key, v); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			db.segmentsMutex.RLock()
+			seg := db.segments[len(db.segments)-1]
+			for key, want := range map[string]bool{"json": true, "small": false, "random": false} {
+				record, err := seg.getRecord(seg.index[key])
+				if err != nil {
+					t.Fatal(err)
+				}
+				if compressed := record.flags&compressionFlags != 0; compressed != want {
+					t.Errorf("Record %q compressed = %v, wanted %v", key, compressed, want)
+				}
+			}
+			db.segmentsMutex.RUnlock()
+
+			stats := db.Stats()
+			if stats.CompressionRatio <= 1 || stats.StoredValueBytes >= stats.ValueBytes {
+				t.Errorf("Expected a compression ratio above 1, got %g (%d/%d)",
+					stats.CompressionRatio, stats.ValueBytes, stats.StoredValueBytes)
+			}
+
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// Compressed records stay readable with compression turned off.
+			db, err = Open("/data", 4096, WithFS(fs))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			for key, want := range values {
+				if got, err := db.Get(key); err != nil || got != want {
+					t.Errorf("Get(%q) = %q, %v", key, got, err)
+				}
+			}
+		})
+	}
+}
+
+func TestCompressedRecordsSurviveMerge(t *testing.T) {
+	fs := vfs.NewMem()
+	db, err := Open("/data", 256, WithFS(fs), WithCompression(Zlib, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 50; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i%10), strings.Repeat(fmt.Sprintf("value%d ", i), 20)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.mergeWg.Wait()
+
+	for i := 40; i < 50; i++ {
+		key, want := fmt.Sprintf("key%d", i%10), strings.Repeat(fmt.Sprintf("value%d ", i), 20)
+		if got, err := db.Get(key); err != nil || got != want {
+			t.Errorf("Get(%q) = %q, %v", key, got, err)
+		}
+	}
+	if stats := db.Stats(); stats.Merges == 0 {
+		t.Error("Expected the writes to trigger a merge")
+	}
+}
@@ -0,0 +1,147 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dk872/architecture-lab5/datastore/vfs"
+)
+
+// gatedFS holds every write until the gate is opened.
+type gatedFS struct {
+	vfs.FS
+	mutex   sync.Mutex
+	gate    chan struct{}
+	writing chan struct{}
+}
+
+func newGatedFS() *gatedFS {
+	return &gatedFS{FS: vfs.NewMem(), writing: make(chan struct{}, 100)}
+}
+
+func (fs *gatedFS) close() {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.gate = make(chan struct{})
+}
+
+func (fs *gatedFS) open() {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	close(fs.gate)
+}
+
+func (fs *gatedFS) OpenFile(name string, flag int, perm os.FileMode) (vfs.File, error) {
+	f, err := fs.FS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &gatedFile{File: f, fs: fs}, nil
+}
+
+type gatedFile struct {
+	vfs.File
+	fs *gatedFS
+}
+
+func (f *gatedFile) Write(p []byte) (int, error) {
+	f.fs.mutex.Lock()
+	gate := f.fs.gate
+	f.fs.mutex.Unlock()
+	if gate != nil {
+		f.fs.writing <- struct{}{}
+		<-gate
+	}
+	return f.File.Write(p)
+}
+
+func TestPutContext(t *testing.T) {
+	fs := newGatedFS()
+	db, err := Open("/data", segSize, WithFS(fs), WithWriteQueueLength(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := db.PutContext(canceled, "key", "value"); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+
+	fs.close()
+	inFlight := make(chan error, 1)
+	go func() { inFlight <- db.Put("in-flight", "value") }()
+	<-fs.writing
+
+	queuedCtx, cancelQueued := context.WithCancel(context.Background())
+	queued := make(chan error, 1)
+	go func() { queued <- db.PutContext(queuedCtx, "queued", "value") }()
+	for len(db.writeCh) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancelWait := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancelWait()
+	if err := db.PutContext(ctx, "waiting", "value"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected a full queue to time out, got %v", err)
+	}
+
+	cancelQueued()
+	if err := <-queued; !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the queued write to be canceled, got %v", err)
+	}
+
+	fs.open()
+	if err := <-inFlight; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("after", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, want := range map[string]error{"in-flight": nil, "after": nil, "queued": ErrNotFound, "waiting": ErrNotFound, "key": ErrNotFound} {
+		if _, err := db.GetContext(context.Background(), key); !errors.Is(err, want) {
+			t.Errorf("GetContext(%q) error = %v, wanted %v", key, err, want)
+		}
+	}
+	if _, err := db.GetContext(canceled, "after"); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected GetContext to honour cancellation, got %v", err)
+	}
+}
+
+func TestFailWhenBusy(t *testing.T) {
+	fs := newGatedFS()
+	db, err := Open("/data", segSize, WithFS(fs), WithWriteQueueLength(1), WithFailWhenBusy())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	fs.close()
+	results := make(chan error, 2)
+	go func() { results <- db.Put("in-flight", "value") }()
+	<-fs.writing
+	go func() { results <- db.Put("queued", "value") }()
+	for len(db.writeCh) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := db.Put("rejected", "value"); !errors.Is(err, ErrBusy) {
+		t.Errorf("Expected ErrBusy from a saturated writer, got %v", err)
+	}
+
+	fs.open()
+	for i := 0; i < 2; i++ {
+		if err := <-results; err != nil {
+			t.Error(err)
+		}
+	}
+	if err := db.Put("accepted", "value"); err != nil {
+		t.Errorf("Expected writes to be accepted again, got %v", err)
+	}
+}
@@ -0,0 +1,246 @@
+package datastore
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"slices"
+	"testing"
+
+	"github.com/dk872/architecture-lab5/datastore/vfs"
+)
+
+var (
+	crashSeed = flag.Int64("crash.seed", 0, "run the crash harness for this seed only")
+	crashRuns = flag.Int("crash.runs", 200, "number of random seeds the crash harness tries")
+)
+
+// keyState is what the harness knows about a key: the last acknowledged value
+// and the values of writes that failed after it, which may or may not have
+// reached the disk. An empty value stands for a missing key, so a delete
+// writes "".
+type keyState struct {
+	acked   string
+	pending []string
+	// durable is the value at the last clean close, and written holds the
+	// values of every write since: a power loss may leave any of them.
+	durable string
+	written []string
+}
+
+func (s *keyState) allows(value string) bool {
+	return value == s.acked || slices.Contains(s.pending, value)
+}
+
+// write records the result of a write of value.
+func (s *keyState) write(value string, err error) {
+	s.written = append(s.written, value)
+	if err != nil {
+		s.pending = append(s.pending, value)
+		return
+	}
+	s.acked, s.pending = value, nil
+}
+
+type crashRun struct {
+	t     *testing.T
+	seed  int64
+	rnd   *rand.Rand
+	fs    *vfs.FaultFS
+	model map[string]*keyState
+}
+
+func (r *crashRun) fatalf(format string, args ...any) {
+	r.t.Helper()
+	r.t.Fatalf("seed %d (rerun with -run TestCrashConsistency -crash.seed=%d): %s",
+		r.seed, r.seed, fmt.Sprintf(format, args...))
+}
+
+func (r *crashRun) open() *Db {
+	r.t.Helper()
+	db, err := Open("/data", 200, WithFS(r.fs))
+	if err != nil {
+		r.fatalf("reopen failed: %v", err)
+	}
+	return db
+}
+
+func (r *crashRun) state(key string) *keyState {
+	state, ok := r.model[key]
+	if !ok {
+		state = &keyState{}
+		r.model[key] = state
+	}
+	return state
+}
+
+// put writes a random value, or deletes the key one time in five.
+func (r *crashRun) put(db *Db) {
+	key := fmt.Sprintf("key%d", r.rnd.Intn(16))
+	if r.rnd.Intn(5) == 0 {
+		err := db.Delete(key)
+		if errors.Is(err, ErrNotFound) {
+			err = nil
+		}
+		r.state(key).write("", err)
+		return
+	}
+	value := fmt.Sprintf("%d-%x", r.rnd.Int63(), r.rnd.Int63n(1<<uint(r.rnd.Intn(60)+1)))
+	r.state(key).write(value, db.Put(key, value))
+}
+
+// closeCleanly closes db, which syncs it, and makes what it holds the
+// durable state.
+func (r *crashRun) closeCleanly(db *Db) {
+	r.t.Helper()
+	if err := db.Close(); err != nil {
+		r.fatalf("close failed: %v", err)
+	}
+	for _, state := range r.model {
+		state.durable, state.written = state.acked, nil
+	}
+}
+
+// powerLoss stops db where it is and drops what it has not synced: every
+// key may be back to its durable value or hold any value written since.
+func (r *crashRun) powerLoss(db *Db) {
+	r.t.Helper()
+	r.fs.CrashAfter(0)
+	_ = db.Close()
+	if err := r.fs.DropUnsynced(); err != nil {
+		r.fatalf("dropping unsynced data failed: %v", err)
+	}
+	r.fs.Reset()
+	for _, state := range r.model {
+		state.pending = append(state.written, state.pending...)
+		state.acked, state.written = state.durable, nil
+	}
+}
+
+func (r *crashRun) verify(db *Db) {
+	r.t.Helper()
+	for key, state := range r.model {
+		value, err := db.Get(key)
+		if errors.Is(err, ErrNotFound) {
+			err = nil
+		}
+		switch {
+		case err != nil:
+			r.fatalf("Get(%q) failed: %v (acknowledged %q)", key, err, state.acked)
+		case !state.allows(value):
+			r.fatalf("Get(%q) = %q, wanted %q or one of the failed writes %q", key, value, state.acked, state.pending)
+		}
+	}
+	if failures := db.Stats().ChecksumFailures; failures != 0 {
+		r.fatalf("%d records failed checksum verification", failures)
+	}
+}
+
+// run executes a random workload of puts and deletes with occasional failed
+// and short writes, crashes the file system after a random number of bytes,
+// either in the middle of regular writes or while a merge is running, and
+// checks what a fresh Db recovers. That crash models a process crash: every
+// byte handed to the file system before it survives. The run then loses
+// power after more writes, dropping every byte that was not synced.
+func (r *crashRun) run() {
+	db := r.open()
+
+	ops := 100 + r.rnd.Intn(300)
+	crashAt := r.rnd.Intn(ops)
+	duringMerge := r.rnd.Intn(2) == 0
+
+	for i := 0; i < ops; i++ {
+		if i == crashAt {
+			if duringMerge {
+				db.mergeWg.Wait()
+				r.fs.CrashAfter(r.rnd.Int63n(2000))
+				db.scheduleCompaction()
+				db.mergeWg.Wait()
+			} else {
+				r.fs.CrashAfter(r.rnd.Int63n(500))
+			}
+		}
+
+		if r.rnd.Intn(20) == 0 {
+			db.mergeWg.Wait()
+		}
+
+		if r.rnd.Intn(4) == 0 {
+			key := fmt.Sprintf("key%d", r.rnd.Intn(16))
+			if state, ok := r.model[key]; ok && !r.fs.Crashed() && len(state.pending) == 0 {
+				value, err := db.Get(key)
+				if errors.Is(err, ErrNotFound) {
+					err = nil
+				}
+				if err != nil || value != state.acked {
+					r.fatalf("before crash Get(%q) = %q, %v; wanted %q", key, value, err, state.acked)
+				}
+			}
+			continue
+		}
+		switch r.rnd.Intn(30) {
+		case 0:
+			r.fs.ShortWrites(true)
+			r.put(db)
+			r.fs.ShortWrites(false)
+		case 1:
+			r.fs.FailWrites(true)
+			r.put(db)
+			r.fs.FailWrites(false)
+		default:
+			r.put(db)
+		}
+	}
+
+	_ = db.Close()
+	r.fs.Reset()
+
+	db = r.open()
+	r.verify(db)
+
+	for i := 0; i < 20; i++ {
+		r.put(db)
+	}
+	db.mergeWg.Wait()
+	r.verify(db)
+	r.closeCleanly(db)
+
+	db = r.open()
+	for i := r.rnd.Intn(100); i > 0; i-- {
+		r.put(db)
+		if r.rnd.Intn(20) == 0 {
+			db.mergeWg.Wait()
+		}
+	}
+	r.powerLoss(db)
+
+	db = r.open()
+	defer db.Close()
+	r.verify(db)
+}
+
+func TestCrashConsistency(t *testing.T) {
+	seeds := []int64{*crashSeed}
+	if *crashSeed == 0 {
+		runs := *crashRuns
+		if testing.Short() {
+			runs = 20
+		}
+		seeds = seeds[:0]
+		for i := 1; i <= runs; i++ {
+			seeds = append(seeds, int64(i))
+		}
+	}
+
+	for _, seed := range seeds {
+		run := &crashRun{
+			t:     t,
+			seed:  seed,
+			rnd:   rand.New(rand.NewSource(seed)),
+			fs:    vfs.NewFault(vfs.NewMem()),
+			model: make(map[string]*keyState),
+		}
+		run.run()
+	}
+}
@@ -1,128 +1,326 @@
 package datastore
 
 import (
-	"bufio"
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
-)
-
-const outFileName = "current-data"
+	"time"
 
-var ErrNotFound = fmt.Errorf("record does not exist")
+	"github.com/dk872/architecture-lab5/datastore/vfs"
+)
 
-type hashIndex map[string]int64
+const (
+	outFileName  = "current-data"
+	lockFileName = "LOCK"
+)
 
-type FileSegment struct {
-	index   hashIndex
-	outPath string
-	mutex   sync.RWMutex
-}
+var (
+	ErrNotFound = fmt.Errorf("record does not exist")
+	ErrLocked   = errors.New("datastore directory is locked by another process")
+	ErrReadOnly = errors.New("datastore is opened read-only")
+	ErrClosed   = errors.New("datastore is closed")
+	ErrBusy     = errors.New("datastore write queue is full")
+)
 
 type writeRequest struct {
+	ctx    context.Context
 	entry  entry
 	doneCh chan error
+	// onDone, if set, runs in the writer before the result is delivered.
+	onDone func(error)
+}
+
+func (req writeRequest) finish(err error) {
+	if req.onDone != nil {
+		req.onDone(err)
+	}
+	req.doneCh <- err
 }
 
 type Db struct {
-	out           *os.File
+	out           vfs.File
 	outOffset     int64
 	dir           string
 	segmentSize   int64
 	segmentNumber int
+	mergeGen      int
 	segments      []*FileSegment
 	segmentsMutex sync.RWMutex
-	mergeMutex    sync.RWMutex
+	opts          options
+	metrics       dbMetrics
+	lock          io.Closer
+	readOnly      bool
+
+	writeCh        chan writeRequest
+	stopCh         chan struct{}
+	writerDone     chan struct{}
+	compactorDone  chan struct{}
+	scrubberDone   chan struct{}
+	closeMutex     sync.RWMutex
+	closed         bool
+	compactCh      chan struct{}
+	compactMutex   sync.Mutex
+	compactPending bool
+	mergeWg        sync.WaitGroup
+
+	blobMutex    sync.Mutex
+	blobNumber   int
+	pendingBlobs map[string]struct{}
+
+	watchMutex sync.Mutex
+	watchers   map[*Watcher]struct{}
+
+	// lastTimestamp is the newest timestamp written, owned by the writer.
+	lastTimestamp uint64
+}
+
+type options struct {
+	compactionPolicy   CompactionPolicy
+	compactionInterval time.Duration
+	limiter            *rateLimiter
+	listener           EventListener
+	fs                 vfs.FS
+	writeQueueLength   int
+	failWhenBusy       bool
+	blobThreshold      int64
+	maxValueSize       int64
+	compression        Compression
+	compressThreshold  int
+	keys               KeyProvider
+	scrubInterval      time.Duration
+	scrubLimiter       *rateLimiter
+	checksumErrors     bool
+	timestamps         bool
+}
 
-	writeCh chan writeRequest
-	stopCh  chan struct{}
-	mergeWg sync.WaitGroup
+type Option func(*options)
+
+// WithCompactionPolicy replaces the default MergeAllPolicy{MinSegments: 3}.
+func WithCompactionPolicy(policy CompactionPolicy) Option {
+	return func(o *options) {
+		o.compactionPolicy = policy
+	}
+}
+
+// WithCompactionInterval makes the scheduler also consult the policy
+// periodically, not only when a segment is rotated.
+func WithCompactionInterval(interval time.Duration) Option {
+	return func(o *options) {
+		o.compactionInterval = interval
+	}
+}
+
+// WithCompactionRateLimit caps the bytes per second merges read and write.
+func WithCompactionRateLimit(bytesPerSecond int64) Option {
+	return func(o *options) {
+		o.limiter = newRateLimiter(bytesPerSecond)
+	}
+}
+
+// WithWriteQueueLength sets how many writes may wait for the writer goroutine;
+// the default is 100.
+func WithWriteQueueLength(length int) Option {
+	return func(o *options) {
+		o.writeQueueLength = length
+	}
+}
+
+// WithFailWhenBusy makes writes fail with ErrBusy instead of waiting when the
+// write queue is full.
+func WithFailWhenBusy() Option {
+	return func(o *options) {
+		o.failWhenBusy = true
+	}
+}
+
+// WithBlobThreshold sets the value length above which values are kept in
+// blob files instead of the segments; the default is the segment size.
+func WithBlobThreshold(bytes int64) Option {
+	return func(o *options) {
+		o.blobThreshold = bytes
+	}
 }
 
-func Open(dir string, segmentSize int64) (*Db, error) {
+// WithFS makes the datastore keep its files on fs instead of the OS file
+// system.
+func WithFS(fs vfs.FS) Option {
+	return func(o *options) {
+		o.fs = fs
+	}
+}
+
+func Open(dir string, segmentSize int64, opts ...Option) (*Db, error) {
+	db, err := open(dir, segmentSize, false, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	go db.writer()
+	go db.compactor()
+	go db.scrubber()
+	db.scheduleCompaction()
+
+	return db, nil
+}
+
+// OpenReadOnly opens dir for reading under a shared lock, so any number of
+// tools can inspect a store while no writer holds it. Nothing on disk is
+// modified, not even a torn record left by a crash.
+func OpenReadOnly(dir string, opts ...Option) (*Db, error) {
+	return open(dir, 0, true, opts)
+}
+
+func open(dir string, segmentSize int64, readOnly bool, opts []Option) (*Db, error) {
 	db := &Db{
 		segments:      make([]*FileSegment, 0),
 		dir:           dir,
 		segmentSize:   segmentSize,
 		segmentNumber: 0,
-		writeCh:       make(chan writeRequest, 100),
+		mergeGen:      1,
+		readOnly:      readOnly,
+		opts: options{
+			compactionPolicy: MergeAllPolicy{MinSegments: 3},
+			listener:         NoopEventListener{},
+			fs:               vfs.OS,
+			writeQueueLength: 100,
+			maxValueSize:     DefaultMaxValueSize,
+		},
 		stopCh:        make(chan struct{}),
+		writerDone:    make(chan struct{}),
+		compactorDone: make(chan struct{}),
+		scrubberDone:  make(chan struct{}),
+		compactCh:     make(chan struct{}, 1),
+		pendingBlobs:  make(map[string]struct{}),
+		watchers:      make(map[*Watcher]struct{}),
 	}
+	for _, opt := range opts {
+		opt(&db.opts)
+	}
+	if db.opts.blobThreshold <= 0 {
+		db.opts.blobThreshold = segmentSize
+	}
+	db.writeCh = make(chan writeRequest, max(db.opts.writeQueueLength, 0))
 
-	err := db.newSegment()
+	lock, err := db.opts.fs.Lock(filepath.Join(dir, lockFileName), !readOnly)
 	if err != nil {
+		if errors.Is(err, vfs.ErrLocked) {
+			return nil, fmt.Errorf("%w: %s", ErrLocked, dir)
+		}
 		return nil, err
 	}
+	db.lock = lock
 
 	err = db.recover()
 	if err != nil && !errors.Is(err, io.EOF) {
+		if db.out != nil {
+			db.out.Close()
+		}
+		lock.Close()
 		return nil, err
 	}
 
-	go db.writer()
-
 	return db, nil
 }
 
+// writer appends queued records until Close closes writeCh, or fails what is
+// left in the queue with ErrClosed once stopCh is closed.
 func (db *Db) writer() {
+	defer close(db.writerDone)
 	for {
 		select {
-		case req := <-db.writeCh:
-			encoded := req.entry.Encode()
-			entrySize := int64(len(encoded))
+		case req, ok := <-db.writeCh:
+			if !ok {
+				return
+			}
+			if err := req.ctx.Err(); err != nil {
+				req.finish(err)
+				continue
+			}
 
-			stat, err := db.out.Stat()
-			if err != nil {
-				req.doneCh <- err
+			if err := db.prepare(&req.entry); err != nil {
+				req.finish(err)
 				continue
 			}
 
-			if stat.Size()+entrySize > db.segmentSize {
+			encoded := req.entry.Encode()
+			entrySize := int64(len(encoded))
+
+			if db.outOffset > 0 && db.outOffset+entrySize > db.segmentSize {
 				if err := db.newSegment(); err != nil {
-					req.doneCh <- err
+					db.writeFailed(req, err)
 					continue
 				}
 			}
 
 			n, err := db.out.Write(encoded)
 			if err != nil {
-				req.doneCh <- err
+				db.discardPartialWrite()
+				db.writeFailed(req, err)
 				continue
 			}
 
 			db.segmentsMutex.RLock()
 			currentSegment := db.segments[len(db.segments)-1]
 			currentSegment.mutex.Lock()
-			currentSegment.index[req.entry.key] = db.outOffset
+			currentSegment.put(&req.entry, recordPos{offset: db.outOffset, size: int64(n)})
+			currentSegment.size = db.outOffset + int64(n)
 			currentSegment.mutex.Unlock()
 			db.segmentsMutex.RUnlock()
 
+			db.publish(req.entry, Position{Segment: currentSegment.id.seq, Offset: db.outOffset})
 			db.outOffset += int64(n)
-			req.doneCh <- nil
+			req.finish(nil)
 
 		case <-db.stopCh:
+			for req := range db.writeCh {
+				req.finish(ErrClosed)
+			}
 			return
 		}
 	}
 }
 
-func (db *Db) newSegment() error {
-	outFile := fmt.Sprintf("%s%d", outFileName, db.segmentNumber)
-	outFilePath := filepath.Join(db.dir, outFile)
-	db.segmentNumber++
+func (db *Db) writeFailed(req writeRequest, err error) {
+	db.opts.listener.WriteFailed(WriteErrorInfo{Key: req.entry.key, Err: err})
+	req.finish(err)
+}
 
-	f, err := os.OpenFile(outFilePath, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
-	if err != nil {
-		return err
+// discardPartialWrite cuts a torn record off the active segment so later
+// appends do not land behind it. If that fails, writing moves on to a fresh
+// segment and recovery truncates the torn tail instead.
+func (db *Db) discardPartialWrite() {
+	db.segmentsMutex.RLock()
+	active := db.segments[len(db.segments)-1]
+	db.segmentsMutex.RUnlock()
+
+	if err := db.opts.fs.Truncate(active.outPath, db.outOffset); err != nil {
+		_ = db.newSegment()
 	}
+}
 
-	newFileSegment := &FileSegment{
-		outPath: outFilePath,
-		index:   make(hashIndex),
+func (db *Db) newSegment() error {
+	// Close syncs only the active segment, so the one sealed here has to be
+	// synced now.
+	if db.out != nil {
+		if err := db.out.Sync(); err != nil {
+			return err
+		}
 	}
+	seg := newFileSegment(db.opts.fs, db.dir, segmentID{seq: db.segmentNumber})
+	f, err := db.opts.fs.OpenFile(seg.outPath, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	// The number is taken only now, as Tail counts on segments being
+	// numbered without gaps.
+	db.segmentNumber++
 
 	if db.out != nil {
 		db.out.Close()
@@ -130,187 +328,423 @@ func (db *Db) newSegment() error {
 
 	db.out = f
 	db.outOffset = 0
-	db.segments = append(db.segments, newFileSegment)
 
-	if len(db.segments) >= 3 {
-		db.mergeSegments()
+	db.segmentsMutex.Lock()
+	var sealed *FileSegment
+	if len(db.segments) > 0 {
+		sealed = db.segments[len(db.segments)-1]
+	}
+	db.segments = append(db.segments, seg)
+	db.segmentsMutex.Unlock()
+
+	if sealed != nil {
+		db.opts.listener.SegmentRotated(RotateInfo{
+			Sealed: sealed.id.fileName(),
+			Active: seg.id.fileName(),
+		})
+		db.scheduleCompaction()
 	}
 
 	return nil
 }
 
-func (s *FileSegment) getValue(position int64) (string, error) {
-	f, err := os.Open(s.outPath)
+func (db *Db) recover() error {
+	start := time.Now()
+	ids, err := listSegments(db.opts.fs, db.dir)
 	if err != nil {
-		return "", err
+		return err
 	}
-	defer f.Close()
 
-	reader := bufio.NewReader(f)
-	_, err = reader.Discard(int(position))
+	names, err := db.opts.fs.ReadDir(db.dir)
 	if err != nil {
-		return "", err
+		return err
 	}
-
-	var record entry
-	_, err = record.DecodeFromReader(reader)
-	if err != nil {
-		if errors.Is(err, ErrChecksumMismatch) {
-			return "", ErrNotFound
+	for _, name := range names {
+		if n, ok := parseBlobName(name); ok && n >= db.blobNumber {
+			db.blobNumber = n + 1
 		}
-		return "", err
 	}
 
-	return record.value, nil
-}
-
-func (db *Db) mergeSegments() {
-	db.mergeWg.Add(1)
-	go func() {
-		defer db.mergeWg.Done()
-
-		db.segmentsMutex.RLock()
-		segmentsToMerge := make([]*FileSegment, len(db.segments))
-		copy(segmentsToMerge, db.segments)
-		db.segmentsMutex.RUnlock()
-
-		db.mergeMutex.Lock()
-		defer db.mergeMutex.Unlock()
-
-		newOutFile := fmt.Sprintf("%s%d", outFileName, db.segmentNumber)
-		newPath := filepath.Join(db.dir, newOutFile)
-		db.segmentNumber++
-
-		newSeg := &FileSegment{
-			outPath: newPath,
-			index:   make(hashIndex),
-		}
-		var offset int64
-
-		f, err := os.OpenFile(newPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	var truncated int64
+	for _, id := range ids {
+		segment := newFileSegment(db.opts.fs, db.dir, id)
+		n, err := segment.load(!db.readOnly)
 		if err != nil {
-			return
+			return err
 		}
-		defer f.Close()
+		truncated += n
+		db.segments = append(db.segments, segment)
+		db.lastTimestamp = max(db.lastTimestamp, segment.maxTimestamp)
 
-		seen := make(map[string]bool)
-
-		for i := len(db.segments) - 1; i >= 0; i-- {
-			seg := db.segments[i]
-			seg.mutex.RLock()
-			for key, pos := range seg.index {
-				if seen[key] {
-					continue
-				}
-
-				val, err := seg.getValue(pos)
-				if err != nil {
-					continue
-				}
+		if id.seq >= db.segmentNumber {
+			db.segmentNumber = id.seq + 1
+		}
+		if id.gen >= db.mergeGen {
+			db.mergeGen = id.gen + 1
+		}
+	}
 
-				ent := entry{key: key, value: val}
-				data := ent.Encode()
-				n, err := f.Write(data)
-				if err == nil {
-					newSeg.index[key] = offset
-					offset += int64(n)
-					seen[key] = true
-				}
-			}
-			seg.mutex.RUnlock()
+	if !db.readOnly {
+		if err := db.openActive(); err != nil {
+			return err
 		}
+	}
 
-		db.segmentsMutex.Lock()
-		db.segments = []*FileSegment{newSeg, db.segments[len(db.segments)-1]}
-		db.segmentsMutex.Unlock()
-	}()
+	_, keys := db.liveBytes()
+	db.opts.listener.RecoveryCompleted(RecoveryInfo{
+		Segments:       len(db.segments),
+		Keys:           keys,
+		TruncatedBytes: truncated,
+		Duration:       time.Since(start),
+	})
+	return nil
 }
 
-func (db *Db) recover() error {
-	for i, segment := range db.segments {
-		f, err := os.Open(segment.outPath)
+// openActive reopens the newest plain segment for appending, or starts a new
+// one when the newest segment is a merge output.
+func (db *Db) openActive() error {
+	if n := len(db.segments); n > 0 && !db.segments[n-1].id.merged() {
+		last := db.segments[n-1]
+		f, err := db.opts.fs.OpenFile(last.outPath, os.O_APPEND|os.O_RDWR, 0600)
 		if err != nil {
 			return err
 		}
+		db.out = f
+		db.outOffset = last.size
+		return nil
+	}
+	return db.newSegment()
+}
 
-		if i == len(db.segments)-1 {
-			info, err := f.Stat()
-			if err != nil {
-				f.Close()
-				return err
-			}
-			db.outOffset = info.Size()
-		}
+func (db *Db) Close() error {
+	return db.CloseContext(context.Background())
+}
 
-		reader := bufio.NewReader(f)
-		var offset int64 = 0
+// CloseContext stops accepting writes, lets the writer drain and acknowledge
+// the queued ones, waits for running merges and syncs the active segment.
+// When ctx expires first, merges are aborted, writes still queued fail with
+// ErrClosed and ctx.Err() is returned; the files and the directory lock are
+// released either way.
+func (db *Db) CloseContext(ctx context.Context) error {
+	db.closeMutex.Lock()
+	if db.closed {
+		db.closeMutex.Unlock()
+		return ErrClosed
+	}
+	db.closed = true
+	db.closeMutex.Unlock()
 
-		for {
-			var record entry
-			n, err := record.DecodeFromReader(reader)
-			if err != nil {
-				if errors.Is(err, io.EOF) {
-					break
-				}
-				f.Close()
-				return err
-			}
+	if db.readOnly {
+		db.closeWatchers()
+		return db.lock.Close()
+	}
 
-			segment.mutex.Lock()
-			segment.index[record.key] = offset
-			segment.mutex.Unlock()
+	close(db.writeCh)
+	err := waitContext(ctx, func() { <-db.writerDone })
+	if err == nil {
+		err = waitContext(ctx, db.mergeWg.Wait)
+	}
+	close(db.stopCh)
+	<-db.writerDone
+	db.closeWatchers()
+	<-db.compactorDone
+	<-db.scrubberDone
 
-			offset += int64(n)
-		}
+	if syncErr := db.out.Sync(); err == nil {
+		err = syncErr
+	}
+	if closeErr := db.out.Close(); err == nil {
+		err = closeErr
+	}
+	if lockErr := db.lock.Close(); err == nil {
+		err = lockErr
+	}
+	return err
+}
 
-		f.Close()
+func waitContext(ctx context.Context, wait func()) error {
+	done := make(chan struct{})
+	go func() {
+		wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
+}
 
-	return nil
+func (db *Db) isClosed() bool {
+	db.closeMutex.RLock()
+	defer db.closeMutex.RUnlock()
+	return db.closed
 }
 
-func (db *Db) Close() error {
-	db.mergeWg.Wait()
-	close(db.stopCh)
-	if db.out != nil {
-		return db.out.Close()
+func (db *Db) Get(key string) (string, error) {
+	return db.GetContext(context.Background(), key)
+}
+
+func (db *Db) GetContext(ctx context.Context, key string) (string, error) {
+	item, err := db.GetItem(ctx, key)
+	return item.Value, err
+}
+
+// GetReader streams the value of key, returning it along with its length.
+// Large values are read straight from their blob file; a damaged blob makes
+// the final Read fail with ErrChecksumMismatch.
+func (db *Db) GetReader(ctx context.Context, key string) (io.ReadCloser, int64, error) {
+	record, blob, err := db.read(ctx, key)
+	if err != nil {
+		return nil, 0, err
 	}
-	return nil
+	if blob == nil {
+		return io.NopCloser(strings.NewReader(record.value)), int64(len(record.value)), nil
+	}
+	return blob, blob.size, nil
 }
 
-func (db *Db) Get(key string) (string, error) {
+// read finds the newest record for key and, when its value lives in a blob,
+// opens the blob.
+func (db *Db) read(ctx context.Context, key string) (entry, *blobValue, error) {
+	if db.isClosed() {
+		return entry{}, nil, ErrClosed
+	}
+	if err := ctx.Err(); err != nil {
+		return entry{}, nil, err
+	}
+
 	db.segmentsMutex.RLock()
 	defer db.segmentsMutex.RUnlock()
 
+	segment, position, stored, err := db.newest(key)
+	var checksumErr *ChecksumError
+	if errors.As(err, &checksumErr) {
+		db.checksumMismatch(checksumErr, key)
+		return entry{}, nil, db.unreadable(err)
+	}
+	if err != nil {
+		return entry{}, nil, err
+	}
+	if stored.flags&flagTombstone != 0 || stored.expired(time.Now()) {
+		return entry{}, nil, ErrNotFound
+	}
+	if stored.flags&flagBlob != 0 {
+		blob, err := db.openBlob(segment, position, stored)
+		return stored, blob, err
+	}
+	record, err := decrypt(db.opts.keys, stored)
+	if err == nil {
+		record, err = decompress(record)
+	}
+	return record, nil, err
+}
+
+// newest reads the newest record for key as it is stored. The caller holds
+// segmentsMutex.
+func (db *Db) newest(key string) (*FileSegment, recordPos, entry, error) {
 	for i := range db.segments {
 		segment := db.segments[len(db.segments)-i-1]
 		segment.mutex.RLock()
 		position, ok := segment.index[key]
 		segment.mutex.RUnlock()
-		if ok {
-			return segment.getValue(position)
+		if !ok {
+			continue
 		}
+
+		stored, err := segment.getRecord(position)
+		return segment, position, stored, err
 	}
+	return nil, recordPos{}, entry{}, ErrNotFound
+}
 
-	return "", ErrNotFound
+// unreadable is what reads of a damaged record return: ErrNotFound, as if
+// the record had never been written, or with WithChecksumErrors the
+// ChecksumError itself.
+func (db *Db) unreadable(err error) error {
+	if db.opts.checksumErrors {
+		return err
+	}
+	return ErrNotFound
 }
 
+// Put stores value under key. Like the other puts it fails with a KeyError
+// for keys that break the rules of ValidateKey and a ValueTooLargeError for
+// values over the limit of WithMaxValueSize.
 func (db *Db) Put(key, value string) error {
-	db.mergeMutex.RLock()
-	defer db.mergeMutex.RUnlock()
+	return db.PutContext(context.Background(), key, value)
+}
 
-	done := make(chan error)
-	db.writeCh <- writeRequest{
-		entry:  entry{key: key, value: value},
-		doneCh: done,
+// PutContext gives up once ctx is done, both while waiting for room in the
+// write queue and for the writer to acknowledge. Queued writes whose context
+// is done by the time the writer reaches them are skipped, but a write that
+// returned ctx.Err() may still have been applied.
+func (db *Db) PutContext(ctx context.Context, key, value string) error {
+	if err := ValidateKey(key); err != nil {
+		return err
+	}
+	if int64(len(value)) > db.opts.maxValueSize {
+		return &ValueTooLargeError{Limit: db.opts.maxValueSize}
+	}
+	if int64(len(value)) > db.opts.blobThreshold {
+		return db.PutReader(ctx, key, strings.NewReader(value))
 	}
-	return <-done
+	return db.putValue(ctx, key, value, WriteOptions{})
 }
 
-func (db *Db) Size() (int64, error) {
-	info, err := db.out.Stat()
+// PutReader stores the value read from r. Values longer than the blob
+// threshold are streamed into a blob file instead of being held in memory,
+// and only a reference to the blob is appended to the log.
+func (db *Db) PutReader(ctx context.Context, key string, r io.Reader) error {
+	return db.putReader(ctx, key, r, WriteOptions{})
+}
+
+func (db *Db) putReader(ctx context.Context, key string, r io.Reader, opts WriteOptions) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := ValidateKey(key); err != nil {
+		return err
+	}
+	r = newMaxReader(r, db.opts.maxValueSize)
+
+	head, err := io.ReadAll(io.LimitReader(r, db.opts.blobThreshold+1))
 	if err != nil {
-		return 0, err
+		return err
+	}
+	if int64(len(head)) <= db.opts.blobThreshold {
+		return db.putValue(ctx, key, string(head), opts)
+	}
+	return db.putBlob(ctx, key, io.MultiReader(bytes.NewReader(head), r), opts)
+}
+
+// putValue writes a value that is kept in the segment itself.
+func (db *Db) putValue(ctx context.Context, key, value string, opts WriteOptions) error {
+	record := entry{key: key, value: value}
+	opts.apply(&record)
+	record = db.opts.compress(record)
+	stored := len(record.value)
+	if db.opts.keys != nil {
+		id, k, err := db.opts.keys.CurrentKey()
+		if err != nil {
+			return err
+		}
+		if record, err = encrypt(id, k, record); err != nil {
+			return err
+		}
+	}
+	if err := db.put(ctx, record, nil); err != nil {
+		return err
+	}
+	db.metrics.valueBytes.Add(uint64(len(value)))
+	db.metrics.storedValueBytes.Add(uint64(stored))
+	return nil
+}
+
+// put queues a record for the writer. Once the record is queued, onDone is
+// called with the outcome of the write even if ctx ends first.
+func (db *Db) put(ctx context.Context, e entry, onDone func(error)) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	if err := ctx.Err(); err != nil {
+		if onDone != nil {
+			onDone(err)
+		}
+		return err
+	}
+
+	req := writeRequest{
+		ctx:    ctx,
+		entry:  e,
+		doneCh: make(chan error, 1),
+		onDone: onDone,
+	}
+	if err := db.enqueue(req); err != nil {
+		if onDone != nil {
+			onDone(err)
+		}
+		return err
+	}
+
+	select {
+	case err := <-req.doneCh:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (db *Db) enqueue(req writeRequest) error {
+	db.closeMutex.RLock()
+	defer db.closeMutex.RUnlock()
+	if db.closed {
+		return ErrClosed
+	}
+
+	if db.opts.failWhenBusy {
+		select {
+		case db.writeCh <- req:
+			return nil
+		default:
+			return ErrBusy
+		}
+	}
+
+	select {
+	case db.writeCh <- req:
+		return nil
+	case <-req.ctx.Done():
+		return req.ctx.Err()
+	}
+}
+
+func (db *Db) Size() (int64, error) {
+	db.segmentsMutex.RLock()
+	defer db.segmentsMutex.RUnlock()
+	if len(db.segments) == 0 {
+		return 0, nil
+	}
+
+	active := db.segments[len(db.segments)-1]
+	active.mutex.RLock()
+	defer active.mutex.RUnlock()
+	return active.size, nil
+}
+
+// Keys returns the stored keys in sorted order.
+func (db *Db) Keys() []string {
+	return db.keys(false)
+}
+
+// keys returns the keys whose newest record is a value that has not
+// expired or, with deleted set, a tombstone.
+func (db *Db) keys(deleted bool) []string {
+	db.segmentsMutex.RLock()
+	seen := make(map[string]recordPos)
+	for i := len(db.segments) - 1; i >= 0; i-- {
+		seg := db.segments[i]
+		seg.mutex.RLock()
+		for key, pos := range seg.index {
+			if _, ok := seen[key]; !ok {
+				seen[key] = pos
+			}
+		}
+		seg.mutex.RUnlock()
+	}
+	db.segmentsMutex.RUnlock()
+
+	now := time.Now()
+	keys := make([]string, 0, len(seen))
+	for key, pos := range seen {
+		if pos.tombstone == deleted && (deleted || !pos.dead(now)) {
+			keys = append(keys, key)
+		}
 	}
-	return info.Size(), nil
+	sort.Strings(keys)
+	return keys
 }
@@ -1,9 +1,12 @@
 package datastore
 
 import (
+	"errors"
 	"fmt"
 	"path/filepath"
 	"testing"
+
+	"github.com/dk872/architecture-lab5/datastore/vfs"
 )
 
 var segSize int64 = 8192
@@ -195,17 +198,25 @@ func TestSegmentMerge(t *testing.T) {
 	}
 
 	db.segmentsMutex.RLock()
-	segmentsAfterMerge := len(db.segments)
-	db.segmentsMutex.RUnlock()
+	defer db.segmentsMutex.RUnlock()
 
-	if segmentsAfterMerge != 2 {
-		t.Errorf("Expected 2 segments after merge, but got %d", segmentsAfterMerge)
+	sealed := db.segments[:len(db.segments)-1]
+	if len(sealed) == 0 {
+		t.Fatal("Expected merged segments, but only the active one is left")
+	}
+	for _, seg := range sealed {
+		if seg.id.run() != sealed[0].id.run() {
+			t.Errorf("Expected sealed segments from a single merge, got %s and %s", sealed[0].id.fileName(), seg.id.fileName())
+		}
+		if seg.size > 100 {
+			t.Errorf("Merged segment %s is %d bytes, larger than the segment size", seg.id.fileName(), seg.size)
+		}
 	}
 }
 
 func TestDuplicateHandlingDuringMerge(t *testing.T) {
 	tempDir := t.TempDir()
-	db, err := Open(tempDir, 100)
+	db, err := Open(tempDir, 60)
 	if err != nil {
 		t.Fatalf("Failed to open database: %v", err)
 	}
@@ -258,21 +269,68 @@ func TestDuplicateHandlingDuringMerge(t *testing.T) {
 	}
 
 	db.segmentsMutex.RLock()
-	segmentsAfterMerge := len(db.segments)
-	db.segmentsMutex.RUnlock()
+	defer db.segmentsMutex.RUnlock()
 
-	if segmentsAfterMerge != 2 {
-		t.Errorf("Expected 2 segments after merge, but got %d", segmentsAfterMerge)
+	copies := make(map[string]int)
+	for _, seg := range db.segments {
+		seg.mutex.RLock()
+		for key := range seg.index {
+			copies[key]++
+		}
+		seg.mutex.RUnlock()
 	}
 
-	seg := db.segments[0]
-	seg.mutex.RLock()
-	defer seg.mutex.RUnlock()
-
 	for key := range expected {
-		_, exists := seg.index[key]
-		if !exists {
-			t.Errorf("Key %s not found in merged segment index", key)
+		if copies[key] != 1 {
+			t.Errorf("Expected exactly one record for key %s after merge, found %d", key, copies[key])
+		}
+	}
+}
+
+func TestDbOnFaultyFS(t *testing.T) {
+	fs := vfs.NewFault(vfs.NewMem())
+	db, err := Open("/data", 100, WithFS(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Put("k1", "v1"); err != nil {
+		t.Fatal(err)
+	}
+
+	fs.ShortWrites(true)
+	if err := db.Put("k2", "v2"); err == nil {
+		t.Error("Expected a short write to fail the put")
+	}
+	fs.ShortWrites(false)
+
+	fs.FailWrites(true)
+	if err := db.Put("k3", "v3"); !errors.Is(err, vfs.ErrInjected) {
+		t.Errorf("Expected an injected write error, got %v", err)
+	}
+	fs.FailWrites(false)
+
+	if err := db.Put("k4", "v4"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open("/data", 100, WithFS(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for key, expected := range map[string]string{"k1": "v1", "k4": "v4"} {
+		if value, err := db.Get(key); err != nil || value != expected {
+			t.Errorf("Get(%q) = %q, %v; wanted %q", key, value, err, expected)
+		}
+	}
+	for _, key := range []string{"k2", "k3"} {
+		if _, err := db.Get(key); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected failed write of %s to be absent, got %v", key, err)
 		}
 	}
 }
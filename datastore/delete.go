@@ -0,0 +1,30 @@
+package datastore
+
+import "context"
+
+// flagTombstone marks a record that deletes its key. It has no value.
+const flagTombstone byte = 1 << 5
+
+func (db *Db) Delete(key string) error {
+	return db.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext appends a tombstone for key, or returns ErrNotFound when
+// there is no value to delete. Merges drop the tombstone together with the
+// values it shadows.
+func (db *Db) DeleteContext(ctx context.Context, key string) error {
+	return db.put(ctx, entry{key: key, flags: flagTombstone}, nil)
+}
+
+// DeleteAt deletes key with the given timestamp, taken from another replica,
+// like PutAt writes a value. The tombstone is written even if there is no
+// value, so an older value arriving later does not bring the key back.
+func (db *Db) DeleteAt(ctx context.Context, key string, timestamp uint64) error {
+	return db.put(ctx, entry{key: key, flags: flagTombstone, timestamp: timestamp}, nil)
+}
+
+// DeletedKeys returns the deleted keys whose tombstones have not been merged
+// away yet, in sorted order.
+func (db *Db) DeletedKeys() []string {
+	return db.keys(true)
+}
@@ -0,0 +1,146 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dk872/architecture-lab5/datastore/vfs"
+)
+
+func TestDelete(t *testing.T) {
+	fs := vfs.NewMem()
+	db, err := Open("/data", 1024, WithFS(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		if err := db.Put(key, "value of "+key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w, err := db.Watch("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("b"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Deleting a deleted key returned %v", err)
+	}
+	if err := db.Delete("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Deleting a missing key returned %v", err)
+	}
+	if event := nextChange(t, w); event.Op != OpDelete || event.Key != "b" || event.Value != "" {
+		t.Errorf("Watched %+v", event)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open("/data", 1024, WithFS(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Get("b"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get of a deleted key after reopen returned %v", err)
+	}
+	if keys := db.Keys(); !reflect.DeepEqual(keys, []string{"a", "c"}) {
+		t.Errorf("Keys() = %v", keys)
+	}
+	if keys := db.DeletedKeys(); !reflect.DeepEqual(keys, []string{"b"}) {
+		t.Errorf("DeletedKeys() = %v", keys)
+	}
+
+	if err := db.Put("b", "again"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.Get("b"); err != nil || value != "again" {
+		t.Errorf("Get after writing a deleted key again = %q, %v", value, err)
+	}
+}
+
+func TestDeleteAt(t *testing.T) {
+	db, err := Open("/data", 1024, WithFS(vfs.NewMem()), WithTimestamps())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	ctx := context.Background()
+
+	// A delete of a key never seen still shadows older values.
+	if err := db.DeleteAt(ctx, "key", 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutAt(ctx, "key", strings.NewReader("old"), 50); !errors.Is(err, ErrStale) {
+		t.Errorf("Writing a value older than the delete returned %v", err)
+	}
+	if ts, err := db.Timestamp("key"); err != nil || ts != 100 {
+		t.Errorf("Timestamp of the tombstone = %d, %v", ts, err)
+	}
+	if err := db.PutAt(ctx, "key", strings.NewReader("new"), 150); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteAt(ctx, "key", 120); !errors.Is(err, ErrStale) {
+		t.Errorf("Deleting with an older timestamp returned %v", err)
+	}
+	if value, _ := db.Get("key"); value != "new" {
+		t.Errorf("Got %q", value)
+	}
+}
+
+func TestMergeDropsTombstones(t *testing.T) {
+	db, err := Open("/data", 64, WithFS(vfs.NewMem()), WithCompactionPolicy(MergeAllPolicy{MinSegments: 1000}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, key := range []string{"a", "b", "c", "d"} {
+		if err := db.Put(key, "value of "+key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	// Move the tombstone out of the active segment.
+	for _, key := range []string{"e", "f", "g"} {
+		if err := db.Put(key, "value of "+key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db.segmentsMutex.RLock()
+	sealed := append([]*FileSegment(nil), db.segments[:len(db.segments)-1]...)
+	db.segmentsMutex.RUnlock()
+	if len(sealed) < 2 {
+		t.Fatalf("Expected several sealed segments, got %d", len(sealed))
+	}
+
+	// Merging the newer segments keeps the tombstone, as the oldest one
+	// still holds the value.
+	if _, err := db.mergeSegments(sealed[1:]); err != nil {
+		t.Fatal(err)
+	}
+	if keys := db.DeletedKeys(); !reflect.DeepEqual(keys, []string{"a"}) {
+		t.Fatalf("DeletedKeys() after a partial merge = %v", keys)
+	}
+
+	db.segmentsMutex.RLock()
+	sealed = append([]*FileSegment(nil), db.segments[:len(db.segments)-1]...)
+	db.segmentsMutex.RUnlock()
+	if _, err := db.mergeSegments(sealed); err != nil {
+		t.Fatal(err)
+	}
+	if keys := db.DeletedKeys(); len(keys) != 0 {
+		t.Errorf("DeletedKeys() after a full merge = %v", keys)
+	}
+	if _, err := db.Get("a"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get of a deleted key after merging = %v", err)
+	}
+}
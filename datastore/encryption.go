@@ -0,0 +1,347 @@
+package datastore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrDecrypt is returned for records that pass their checksum but cannot be
+// decrypted: the key is unknown or wrong, or the ciphertext was tampered with.
+var ErrDecrypt = errors.New("cannot decrypt record")
+
+const flagEncrypted byte = 1 << 3
+
+// KeyProvider supplies the AES keys values are encrypted with. New records
+// use CurrentKey; Key finds the keys of records written before a rotation,
+// so those have to stay available until every record has been merged.
+type KeyProvider interface {
+	CurrentKey() (id uint32, key []byte, err error)
+	Key(id uint32) ([]byte, error)
+}
+
+// StaticKeys is a KeyProvider over a fixed set of 16, 24 or 32 byte keys.
+type StaticKeys struct {
+	Current uint32
+	Keys    map[uint32][]byte
+}
+
+func (k StaticKeys) CurrentKey() (uint32, []byte, error) {
+	key, err := k.Key(k.Current)
+	return k.Current, key, err
+}
+
+func (k StaticKeys) Key(id uint32) ([]byte, error) {
+	key, ok := k.Keys[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %d", id)
+	}
+	return key, nil
+}
+
+// WithEncryption encrypts values with AES-GCM under keys from the provider.
+// Record keys stay in clear, as the index is rebuilt from them. Merges
+// rewrite older records and blobs under the current key, so an old key can
+// be retired once every segment has been merged without MergeInfo.Err
+// reporting a record that could not be rewritten.
+func WithEncryption(keys KeyProvider) Option {
+	return func(o *options) {
+		o.keys = keys
+	}
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// recordAAD binds the ciphertext to the key and to the other flags of the
+// record, so neither can be swapped without failing decryption.
+func recordAAD(e entry) []byte {
+	return append([]byte{e.flags &^ flagEncrypted}, e.key...)
+}
+
+// 0    4       16           <-- offset
+// (id) (nonce) (ciphertext)
+// 4    12      ....         <-- length
+
+func encrypt(id uint32, key []byte, e entry) (entry, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return e, err
+	}
+
+	buf := make([]byte, 4+aead.NonceSize(), 4+aead.NonceSize()+len(e.value)+aead.Overhead())
+	binary.LittleEndian.PutUint32(buf, id)
+	nonce := buf[4:]
+	if _, err := rand.Read(nonce); err != nil {
+		return e, err
+	}
+	buf = aead.Seal(buf, nonce, []byte(e.value), recordAAD(e))
+
+	e.value = string(buf)
+	e.flags |= flagEncrypted
+	return e, nil
+}
+
+func keyID(e entry) uint32 {
+	if len(e.value) < 4 {
+		return 0
+	}
+	return binary.LittleEndian.Uint32([]byte(e.value[:4]))
+}
+
+// decrypt restores the value of a record written by encrypt. Blob records
+// are returned as they are: their content is decrypted as it is read.
+func decrypt(keys KeyProvider, e entry) (entry, error) {
+	if e.flags&flagEncrypted == 0 || e.flags&flagBlob != 0 {
+		return e, nil
+	}
+	if keys == nil {
+		return e, fmt.Errorf("%w %q: no key provider", ErrDecrypt, e.key)
+	}
+
+	id := keyID(e)
+	key, err := keys.Key(id)
+	if err != nil {
+		return e, fmt.Errorf("%w %q: %w", ErrDecrypt, e.key, err)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return e, fmt.Errorf("%w %q: %w", ErrDecrypt, e.key, err)
+	}
+	if len(e.value) < 4+aead.NonceSize() {
+		return e, fmt.Errorf("%w %q: value too short", ErrDecrypt, e.key)
+	}
+
+	nonce := []byte(e.value[4 : 4+aead.NonceSize()])
+	plain, err := aead.Open(nil, nonce, []byte(e.value[4+aead.NonceSize():]), recordAAD(e))
+	if err != nil {
+		return e, fmt.Errorf("%w %q: %w", ErrDecrypt, e.key, err)
+	}
+	e.value = string(plain)
+	e.flags &^= flagEncrypted
+	return e, nil
+}
+
+// rotateKey re-encrypts a record under the current key if it was written
+// under an older one or in clear. Tombstones are left as they are, and so is
+// a record that cannot be re-encrypted, which is returned with the error.
+func (db *Db) rotateKey(e entry) (entry, error) {
+	if db.opts.keys == nil || e.flags&(flagBlob|flagTombstone) != 0 {
+		return e, nil
+	}
+	id, key, err := db.opts.keys.CurrentKey()
+	if err != nil {
+		return e, err
+	}
+	if e.flags&flagEncrypted != 0 && keyID(e) == id {
+		return e, nil
+	}
+	plain, err := decrypt(db.opts.keys, e)
+	if err != nil {
+		return e, err
+	}
+	rotated, err := encrypt(id, key, plain)
+	if err != nil {
+		return e, err
+	}
+	return rotated, nil
+}
+
+// rotateBlob copies the content of a blob record written under an older key,
+// or in clear, into a new blob under the current key and returns the record
+// referring to it together with the name of the blob, which stays pending
+// until the caller settles it with blobDone. A record whose blob cannot be
+// copied is returned as it is with the error.
+func (db *Db) rotateBlob(seg *FileSegment, pos recordPos, e entry) (entry, string, error) {
+	if db.opts.keys == nil || e.flags&flagBlob == 0 {
+		return e, "", nil
+	}
+	id, _, err := db.opts.keys.CurrentKey()
+	if err != nil {
+		return e, "", err
+	}
+	if e.flags&flagEncrypted != 0 && keyID(e) == id {
+		return e, "", nil
+	}
+	content, err := db.openBlob(seg, pos, e)
+	if err != nil {
+		return e, "", err
+	}
+	defer content.Close()
+
+	db.opts.limiter.wait(int(content.size))
+	name := db.reserveBlob()
+	rotated, err := db.writeBlob(e.key, name, content)
+	if err != nil {
+		db.blobDone(name, err)
+		return e, "", err
+	}
+	rotated.timestamp, rotated.expires, rotated.clientFlags = e.timestamp, e.expires, e.clientFlags
+	return rotated, name, nil
+}
+
+// Blob contents are encrypted in chunks of blobChunkSize bytes, each sealed
+// with its index, whether it is the last one and a label naming the blob and
+// the record key, so chunks can neither be reordered, cut off nor moved to
+// another blob or key. The last chunk is shorter than blobChunkSize and may
+// be empty.
+//
+// 0     4       16           <-- offset
+// (len) (nonce) (ciphertext)
+// 4     12      ....         <-- length
+const (
+	blobChunkSize     = 64 << 10
+	blobChunkOverhead = 4 + 12 + 16
+)
+
+func chunkLabel(name, key string) string {
+	return name + "\x00" + key
+}
+
+func chunkAAD(label string, index uint64, last bool) []byte {
+	aad := make([]byte, 9, 9+len(label))
+	binary.LittleEndian.PutUint64(aad, index)
+	if last {
+		aad[8] = 1
+	}
+	return append(aad, label...)
+}
+
+// plainBlobSize returns the length of the content of an encrypted blob of
+// the given size.
+func plainBlobSize(size int64) int64 {
+	chunks := (size-blobChunkOverhead)/(blobChunkSize+blobChunkOverhead) + 1
+	return size - chunks*blobChunkOverhead
+}
+
+type chunkWriter struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	label string
+	index uint64
+	buf   []byte
+}
+
+func newChunkWriter(w io.Writer, key []byte, label string) (*chunkWriter, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &chunkWriter{w: w, aead: aead, label: label, buf: make([]byte, 0, blobChunkSize)}, nil
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(w.buf[len(w.buf):blobChunkSize], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+		if len(w.buf) == blobChunkSize {
+			if err := w.seal(false); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Close writes the last chunk; it does not close the underlying writer.
+func (w *chunkWriter) Close() error {
+	return w.seal(true)
+}
+
+func (w *chunkWriter) seal(last bool) error {
+	chunk := make([]byte, 4+w.aead.NonceSize(), blobChunkOverhead+len(w.buf))
+	nonce := chunk[4:]
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	chunk = w.aead.Seal(chunk, nonce, w.buf, chunkAAD(w.label, w.index, last))
+	binary.LittleEndian.PutUint32(chunk, uint32(len(chunk)-4-w.aead.NonceSize()))
+
+	w.index++
+	w.buf = w.buf[:0]
+	_, err := w.w.Write(chunk)
+	return err
+}
+
+type chunkReader struct {
+	r     io.ReadCloser
+	aead  cipher.AEAD
+	label string
+	index uint64
+	plain []byte
+	done  bool
+}
+
+func newChunkReader(r io.ReadCloser, key []byte, label string) (*chunkReader, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &chunkReader{r: r, aead: aead, label: label}, nil
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.done {
+			// Let the underlying reader verify the blob hash at its end.
+			if _, err := r.r.Read(make([]byte, 1)); err != nil {
+				return 0, err
+			}
+			return 0, fmt.Errorf("%w %q: data after the last chunk", ErrDecrypt, r.label)
+		}
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+func (r *chunkReader) next() error {
+	header := make([]byte, 4+r.aead.NonceSize())
+	if _, err := io.ReadFull(r.r, header); err != nil {
+		return r.truncated(err)
+	}
+	size := binary.LittleEndian.Uint32(header)
+	if size < uint32(r.aead.Overhead()) || size > blobChunkSize+uint32(r.aead.Overhead()) {
+		return fmt.Errorf("%w %q: bad chunk length %d", ErrDecrypt, r.label, size)
+	}
+	sealed := make([]byte, size)
+	if _, err := io.ReadFull(r.r, sealed); err != nil {
+		return r.truncated(err)
+	}
+
+	last := size-uint32(r.aead.Overhead()) < blobChunkSize
+	plain, err := r.aead.Open(sealed[:0], header[4:], sealed, chunkAAD(r.label, r.index, last))
+	if err != nil {
+		return fmt.Errorf("%w %q: chunk %d: %w", ErrDecrypt, r.label, r.index, err)
+	}
+	r.index++
+	r.plain = plain
+	r.done = last
+	return nil
+}
+
+func (r *chunkReader) truncated(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w %q: truncated after chunk %d", ErrDecrypt, r.label, r.index)
+	}
+	return err
+}
+
+func (r *chunkReader) Close() error {
+	return r.r.Close()
+}
@@ -0,0 +1,229 @@
+package datastore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dk872/architecture-lab5/datastore/vfs"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+func TestEncryption(t *testing.T) {
+	fs := vfs.NewMem()
+	keys := StaticKeys{Current: 1, Keys: map[uint32][]byte{1: testKey(1)}}
+	values := map[string]string{
+		"small":   "secret value",
+		"chunks":  strings.Repeat("secret blob ", 20000),
+		"aligned": strings.Repeat("s", 2*blobChunkSize),
+		"empty":   "",
+	}
+
+	db, err := Open("/data", 1024, WithFS(fs), WithEncryption(keys), WithCompression(Flate, 64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range values {
+		if err := db.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	names, _ := fs.ReadDir("/data")
+	for _, name := range names {
+		f, err := vfs.Open(fs, filepath.Join("/data", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(f)
+		f.Close()
+		if bytes.Contains(data, []byte("secret")) || bytes.Contains(data, []byte("ssssssss")) {
+			t.Errorf("File %s holds plain text", name)
+		}
+	}
+
+	db, err = Open("/data", 1024, WithFS(fs), WithEncryption(keys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range values {
+		r, size, err := db.GetReader(context.Background(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(r)
+		r.Close()
+		if err != nil || string(data) != want || size != int64(len(want)) {
+			t.Errorf("GetReader(%q) returned %d of %d bytes, wanted %d: %v", key, len(data), size, len(want), err)
+		}
+	}
+	db.Close()
+
+	for name, opts := range map[string][]Option{
+		"no keys":   nil,
+		"wrong key": {WithEncryption(StaticKeys{Current: 1, Keys: map[uint32][]byte{1: testKey(2)}})},
+	} {
+		db, err := Open("/data", 1024, append(opts, WithFS(fs))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range []string{"small", "chunks"} {
+			if _, err := db.Get(key); !errors.Is(err, ErrDecrypt) || errors.Is(err, ErrChecksumMismatch) {
+				t.Errorf("%s: Get(%q) error = %v, wanted ErrDecrypt", name, key, err)
+			}
+		}
+		db.Close()
+	}
+}
+
+func TestKeyRotationDuringMerge(t *testing.T) {
+	fs := vfs.NewMem()
+	db, err := Open("/data", 128, WithFS(fs), WithCompactionPolicy(&switchPolicy{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("plain value %d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	blobs := map[string]string{
+		"plain blob": strings.Repeat("plain blob ", 30),
+		"old blob":   strings.Repeat("old blob ", 30),
+	}
+	if err := db.Put("plain blob", blobs["plain blob"]); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	old := StaticKeys{Current: 1, Keys: map[uint32][]byte{1: testKey(1)}}
+	db, err = Open("/data", 128, WithFS(fs), WithEncryption(old), WithCompactionPolicy(&switchPolicy{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 20; i < 40; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value %d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Put("old blob", blobs["old blob"]); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	policy := &switchPolicy{}
+	rotated := StaticKeys{Current: 2, Keys: map[uint32][]byte{1: testKey(1), 2: testKey(2)}}
+	db, err = Open("/data", 128, WithFS(fs), WithEncryption(rotated), WithCompactionPolicy(policy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Seal the active segment so every record takes part in the merge.
+	if err := db.Put("last", strings.Repeat("x", 100)); err != nil {
+		t.Fatal(err)
+	}
+	policy.enabled.Store(true)
+	db.scheduleCompaction()
+	db.mergeWg.Wait()
+	if err := db.Stats().LastMergeError; err != nil {
+		t.Fatalf("Expected every record to be rotated, got %v", err)
+	}
+
+	db.segmentsMutex.RLock()
+	for _, seg := range db.segments[:len(db.segments)-1] {
+		for key, pos := range seg.index {
+			record, err := seg.getRecord(pos)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if record.flags&flagEncrypted == 0 || keyID(record) != 2 {
+				t.Errorf("Record %q in %s is not under the new key", key, seg.id.fileName())
+			}
+		}
+	}
+	db.segmentsMutex.RUnlock()
+	db.Close()
+
+	db, err = Open("/data", 128, WithFS(fs),
+		WithEncryption(StaticKeys{Current: 2, Keys: map[uint32][]byte{2: testKey(2)}}),
+		WithCompactionPolicy(&switchPolicy{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 40; i++ {
+		want := fmt.Sprintf("value %d", i)
+		if i < 20 {
+			want = "plain " + want
+		}
+		if got, err := db.Get(fmt.Sprintf("key%d", i)); err != nil || got != want {
+			t.Errorf("Get(key%d) = %q, %v", i, got, err)
+		}
+	}
+	for key, want := range blobs {
+		if got, err := db.Get(key); err != nil || got != want {
+			t.Errorf("Get(%q) returned %d bytes, wanted %d: %v", key, len(got), len(want), err)
+		}
+	}
+}
+
+func TestKeyRotationReportsRecordsItCannotRotate(t *testing.T) {
+	fs := vfs.NewMem()
+	old := StaticKeys{Current: 1, Keys: map[uint32][]byte{1: testKey(1)}}
+	db, err := Open("/data", 128, WithFS(fs), WithEncryption(old), WithCompactionPolicy(&switchPolicy{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value %d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Put("blob", strings.Repeat("blob ", 60)); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// Key 1 is dropped before the records under it have been rotated.
+	policy := &switchPolicy{}
+	db, err = Open("/data", 128, WithFS(fs),
+		WithEncryption(StaticKeys{Current: 2, Keys: map[uint32][]byte{2: testKey(2)}}),
+		WithCompactionPolicy(policy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("last", strings.Repeat("x", 100)); err != nil {
+		t.Fatal(err)
+	}
+	policy.enabled.Store(true)
+	db.scheduleCompaction()
+	db.mergeWg.Wait()
+	if err := db.Stats().LastMergeError; !errors.Is(err, ErrDecrypt) {
+		t.Errorf("Expected the records left under key 1 to be reported, got %v", err)
+	}
+	db.Close()
+
+	db, err = Open("/data", 128, WithFS(fs), WithEncryption(old))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 10; i++ {
+		if got, err := db.Get(fmt.Sprintf("key%d", i)); err != nil || got != fmt.Sprintf("value %d", i) {
+			t.Errorf("Get(key%d) = %q, %v", i, got, err)
+		}
+	}
+	if got, err := db.Get("blob"); err != nil || got != strings.Repeat("blob ", 60) {
+		t.Errorf("Get(blob) = %q, %v", got, err)
+	}
+}
@@ -6,50 +6,187 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 )
 
 var ErrChecksumMismatch = errors.New("checksum mismatch")
 
+// ChecksumError locates a record that failed verification. It matches
+// ErrChecksumMismatch.
+type ChecksumError struct {
+	Segment string
+	Offset  int64
+	// Blob is set when the record is intact but the blob it refers to is not.
+	Blob string
+}
+
+func (e *ChecksumError) Error() string {
+	if e.Blob != "" {
+		return fmt.Sprintf("checksum mismatch in blob %s referenced from segment %s at offset %d", e.Blob, e.Segment, e.Offset)
+	}
+	return fmt.Sprintf("checksum mismatch in segment %s at offset %d", e.Segment, e.Offset)
+}
+
+func (e *ChecksumError) Unwrap() error {
+	return ErrChecksumMismatch
+}
+
 type entry struct {
 	key, value string
-	hash       [20]byte
+	flags      byte
+	// timestamp orders the writes of a key across replicas. The writer
+	// stamps records that come without one.
+	timestamp uint64
+	// expires is the time in Unix nanoseconds the value reads as missing
+	// from, 0 if it never does.
+	expires int64
+	// clientFlags are stored for the client, see WriteOptions.Flags.
+	clientFlags uint32
+	checksum    uint32
+	// cond is checked by the writer and not stored.
+	cond *condition
+}
+
+const (
+	// crcFormat is set in the size word of every record written now.
+	crcFormat = 1 << 30
+	// extendedFormat is set in the size word of legacy SHA1 records that
+	// carry a flags byte.
+	extendedFormat = 1 << 31
+
+	// flagBlob marks a record whose value is a blobRef.
+	flagBlob byte = 1 << 0
+	// flagTimestamp marks a record with a timestamp after the value. It is
+	// never kept in entry.flags.
+	flagTimestamp byte = 1 << 4
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// 0      4       5    9     kl+9  kl+13   kl+vl+13    kl+vl+21  kl+vl+29       kl+vl+33  <-- offset
+// (size) (flags) (kl) (key) (vl)  (value) (timestamp) (expires) (client flags) (crc32c)
+// 4      1       4    ....  4     .....   8           8         4              4         <-- length
+//
+// The CRC32C covers everything before it, the size word included. The
+// timestamp is only there when flagTimestamp is set, the expiry when
+// flagExpires is and the client flags when flagClientFlags is; records
+// without them read as 0.
+//
+// Legacy records have no flags byte, unless extendedFormat is set, and end
+// with a SHA1 of the value instead:
+//
+// 0      4    8     kl+8  kl+12   kl+vl+12   <-- offset
+// (size) (kl) (key) (vl)  (value) (sha1)
+// 4      4    ....  4     .....   20         <-- length
+
+func recordSize(sizeWord uint32) int {
+	return int(sizeWord &^ (crcFormat | extendedFormat))
 }
 
-// 0           4    8     kl+8  kl+12	kl+vl+12     <-- offset
-// (full size) (kl) (key) (vl)  (value)	(hash)
-// 4           4    ....  4     .....	20		     <-- length
+// recordLayout returns the header and trailer lengths of a record.
+func recordLayout(buf []byte) (header, trailer int) {
+	sizeWord := binary.LittleEndian.Uint32(buf)
+	switch {
+	case sizeWord&crcFormat != 0:
+		trailer = 4
+		if buf[4]&flagTimestamp != 0 {
+			trailer += 8
+		}
+		if buf[4]&flagExpires != 0 {
+			trailer += 8
+		}
+		if buf[4]&flagClientFlags != 0 {
+			trailer += 4
+		}
+		return 5, trailer
+	case sizeWord&extendedFormat != 0:
+		return 5, sha1.Size
+	default:
+		return 4, sha1.Size
+	}
+}
 
 func (e *entry) Encode() []byte {
 	kl, vl := len(e.key), len(e.value)
-	hash := sha1.Sum([]byte(e.value))
-	e.hash = hash
 
-	size := kl + vl + 12 + len(hash)
+	size := 5 + kl + vl + 8 + 4
+	if e.timestamp != 0 {
+		size += 8
+	}
+	if e.expires != 0 {
+		size += 8
+	}
+	if e.clientFlags != 0 {
+		size += 4
+	}
 	res := make([]byte, size)
 
-	binary.LittleEndian.PutUint32(res, uint32(size))
-	binary.LittleEndian.PutUint32(res[4:], uint32(kl))
-	copy(res[8:], e.key)
-	binary.LittleEndian.PutUint32(res[kl+8:], uint32(vl))
-	copy(res[kl+12:], e.value)
-	copy(res[kl+12+vl:], hash[:])
+	binary.LittleEndian.PutUint32(res, uint32(size)|crcFormat)
+	res[4] = e.flags
+	binary.LittleEndian.PutUint32(res[5:], uint32(kl))
+	copy(res[9:], e.key)
+	binary.LittleEndian.PutUint32(res[kl+9:], uint32(vl))
+	copy(res[kl+13:], e.value)
+	trailer := res[kl+vl+13:]
+	if e.timestamp != 0 {
+		res[4] |= flagTimestamp
+		binary.LittleEndian.PutUint64(trailer, e.timestamp)
+		trailer = trailer[8:]
+	}
+	if e.expires != 0 {
+		res[4] |= flagExpires
+		binary.LittleEndian.PutUint64(trailer, uint64(e.expires))
+		trailer = trailer[8:]
+	}
+	if e.clientFlags != 0 {
+		res[4] |= flagClientFlags
+		binary.LittleEndian.PutUint32(trailer, e.clientFlags)
+	}
+
+	e.checksum = crc32.Checksum(res[:size-4], castagnoli)
+	binary.LittleEndian.PutUint32(res[size-4:], e.checksum)
 
 	return res
 }
 
 func (e *entry) Decode(input []byte) {
-	e.key = decodeString(input[4:])
+	sizeWord := binary.LittleEndian.Uint32(input)
+	hl, _ := recordLayout(input)
+	e.flags = 0
+	var stored byte
+	if hl == 5 {
+		stored = input[4]
+		e.flags = stored &^ (flagTimestamp | flagExpires | flagClientFlags)
+	}
+
+	e.key = decodeString(input[hl:])
 
-	kl := binary.LittleEndian.Uint32(input[4:])
-	keyEnd := 8 + int(kl)
+	kl := binary.LittleEndian.Uint32(input[hl:])
+	keyEnd := hl + 4 + int(kl)
 
 	e.value = decodeString(input[keyEnd:])
 
 	vl := binary.LittleEndian.Uint32(input[keyEnd:])
 	valEnd := keyEnd + 4 + int(vl)
 
-	copy(e.hash[:], input[valEnd:])
+	e.timestamp, e.expires, e.clientFlags = 0, 0, 0
+	if sizeWord&crcFormat != 0 && stored&flagTimestamp != 0 {
+		e.timestamp = binary.LittleEndian.Uint64(input[valEnd:])
+		valEnd += 8
+	}
+	if sizeWord&crcFormat != 0 && stored&flagExpires != 0 {
+		e.expires = int64(binary.LittleEndian.Uint64(input[valEnd:]))
+		valEnd += 8
+	}
+	if sizeWord&crcFormat != 0 && stored&flagClientFlags != 0 {
+		e.clientFlags = binary.LittleEndian.Uint32(input[valEnd:])
+		valEnd += 4
+	}
+	e.checksum = 0
+	if sizeWord&crcFormat != 0 {
+		e.checksum = binary.LittleEndian.Uint32(input[valEnd:])
+	}
 }
 
 func decodeString(v []byte) string {
@@ -63,24 +200,66 @@ func (e *entry) DecodeFromReader(in *bufio.Reader) (int, error) {
 	sizeBuf, err := in.Peek(4)
 	if err != nil {
 		if errors.Is(err, io.EOF) {
+			if len(sizeBuf) > 0 {
+				return 0, io.ErrUnexpectedEOF
+			}
 			return 0, err
 		}
 		return 0, fmt.Errorf("DecodeFromReader, cannot read size: %w", err)
 	}
-	size := int(binary.LittleEndian.Uint32(sizeBuf))
+	size := recordSize(binary.LittleEndian.Uint32(sizeBuf))
 	buf := make([]byte, size)
 
-	n, err := in.Read(buf)
+	n, err := io.ReadFull(in, buf)
 	if err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
 		return n, fmt.Errorf("DecodeFromReader, cannot read record: %w", err)
 	}
 
-	e.Decode(buf)
-
-	expectedHash := sha1.Sum([]byte(e.value))
-	if e.hash != expectedHash {
-		return n, ErrChecksumMismatch
+	record, err := decodeRecord(buf)
+	if err != nil {
+		return n, err
 	}
+	*e = record
 
 	return n, nil
 }
+
+func decodeRecord(buf []byte) (entry, error) {
+	var e entry
+	if len(buf) < 5 {
+		return e, ErrChecksumMismatch
+	}
+	sizeWord := binary.LittleEndian.Uint32(buf)
+	hl, tl := recordLayout(buf)
+	if recordSize(sizeWord) != len(buf) || len(buf) < hl+8+tl {
+		return e, ErrChecksumMismatch
+	}
+
+	if sizeWord&crcFormat != 0 {
+		sum := binary.LittleEndian.Uint32(buf[len(buf)-4:])
+		if crc32.Checksum(buf[:len(buf)-4], castagnoli) != sum {
+			return e, ErrChecksumMismatch
+		}
+	}
+
+	kl := int(binary.LittleEndian.Uint32(buf[hl:]))
+	if kl > len(buf)-hl-8-tl {
+		return e, ErrChecksumMismatch
+	}
+	vl := int(binary.LittleEndian.Uint32(buf[hl+kl+4:]))
+	if hl+kl+vl+8+tl != len(buf) {
+		return e, ErrChecksumMismatch
+	}
+
+	e.Decode(buf)
+
+	if sizeWord&crcFormat == 0 {
+		if sha1.Sum([]byte(e.value)) != [sha1.Size]byte(buf[len(buf)-sha1.Size:]) {
+			return e, ErrChecksumMismatch
+		}
+	}
+	return e, nil
+}
@@ -4,7 +4,14 @@ import (
 	"bufio"
 	"bytes"
 	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
 	"testing"
+
+	"github.com/dk872/architecture-lab5/datastore/vfs"
 )
 
 func TestEntry_Encode(t *testing.T) {
@@ -51,7 +58,7 @@ func TestReadValue(t *testing.T) {
 	}
 }
 
-func TestSHA1IntegrityDuringPutGet(t *testing.T) {
+func TestChecksumIntegrityDuringPutGet(t *testing.T) {
 	tmp := t.TempDir()
 	db, err := Open(tmp, 1024)
 	if err != nil {
@@ -84,7 +91,7 @@ func TestSHA1IntegrityDuringPutGet(t *testing.T) {
 	}
 }
 
-func TestSHA1IntegrityDuringEncodingDecoding(t *testing.T) {
+func TestChecksumDuringEncodingDecoding(t *testing.T) {
 	original := entry{
 		key:   "alpha",
 		value: "bravo",
@@ -104,50 +111,177 @@ func TestSHA1IntegrityDuringEncodingDecoding(t *testing.T) {
 		t.Errorf("Value mismatch: expected %s, got %s", original.value, decoded.value)
 	}
 
-	expectedHash := sha1.Sum([]byte(original.value))
-	if decoded.hash != expectedHash {
-		t.Errorf("SHA-1 hash mismatch: expected %x, got %x", expectedHash, decoded.hash)
+	expected := crc32.Checksum(encoded[:len(encoded)-4], crc32.MakeTable(crc32.Castagnoli))
+	if decoded.checksum != expected {
+		t.Errorf("CRC32C mismatch: expected %x, got %x", expected, decoded.checksum)
 	}
 }
 
-func TestSHA1HashMismatch(t *testing.T) {
+func TestChecksumCoversWholeRecord(t *testing.T) {
 	original := entry{
 		key:   "alpha",
 		value: "bravo",
 	}
 	encoded := original.Encode()
 
-	var decoded entry
-	_, err := decoded.DecodeFromReader(bufio.NewReader(bytes.NewReader(encoded)))
+	for i := range encoded {
+		corrupted := bytes.Clone(encoded)
+		corrupted[i] ^= 0x01
+		if _, err := decodeRecord(corrupted); !errors.Is(err, ErrChecksumMismatch) {
+			t.Errorf("Flipping a bit at offset %d went undetected: %v", i, err)
+		}
+	}
+}
+
+func TestChecksumChangeOnValueModification(t *testing.T) {
+	original := entry{
+		key:   "alpha",
+		value: "bravo",
+	}
+	original.Encode()
+	before := original.checksum
+
+	original.value = "new value"
+	original.Encode()
+	if original.checksum == before {
+		t.Errorf("Checksum should change when the value changes, got %x twice", before)
+	}
+}
+
+func TestRecordFlags(t *testing.T) {
+	a := entry{key: "key", value: "value", flags: flagBlob}
+	data := a.Encode()
+	if len(data) != 25 {
+		t.Errorf("Expected a 25 byte record, got %d", len(data))
+	}
+
+	b, err := decodeRecord(data)
 	if err != nil {
-		t.Fatalf("DecodeFromReader failed: %v", err)
+		t.Fatal(err)
+	}
+	if a != b {
+		t.Errorf("Record mismatch: %+v != %+v", a, b)
+	}
+
+	n, err := b.DecodeFromReader(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil || n != len(data) || a != b {
+		t.Errorf("DecodeFromReader() = %d, %v; %+v", n, err, b)
 	}
+}
 
-	decoded.hash[0]++
+// encodeLegacy builds a record in the SHA1 formats written before records
+// carried a CRC32C.
+func encodeLegacy(e entry) []byte {
+	hl := 4
+	if e.flags != 0 {
+		hl = 5
+	}
+	kl, vl := len(e.key), len(e.value)
+	size := hl + kl + vl + 8 + sha1.Size
+	res := make([]byte, size)
 
-	expectedHash := sha1.Sum([]byte(original.value))
-	if decoded.hash == expectedHash {
-		t.Errorf("SHA-1 hash should not match. Expected %x, got %x", expectedHash, decoded.hash)
+	sizeWord := uint32(size)
+	if e.flags != 0 {
+		sizeWord |= extendedFormat
+		res[4] = e.flags
 	}
+	binary.LittleEndian.PutUint32(res, sizeWord)
+	binary.LittleEndian.PutUint32(res[hl:], uint32(kl))
+	copy(res[hl+4:], e.key)
+	binary.LittleEndian.PutUint32(res[hl+kl+4:], uint32(vl))
+	copy(res[hl+kl+8:], e.value)
+	hash := sha1.Sum([]byte(e.value))
+	copy(res[hl+kl+8+vl:], hash[:])
+	return res
 }
 
-func TestSHA1HashChangeOnValueModification(t *testing.T) {
-	original := entry{
-		key:   "alpha",
-		value: "bravo",
+func TestLegacyRecords(t *testing.T) {
+	for _, original := range []entry{
+		{key: "key", value: "value"},
+		{key: "key", value: "value", flags: flagBlob},
+	} {
+		data := encodeLegacy(original)
+		decoded, err := decodeRecord(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded != original {
+			t.Errorf("Legacy record mismatch: %+v != %+v", decoded, original)
+		}
+
+		data[len(data)-sha1.Size-1] ^= 0x01
+		if _, err := decodeRecord(data); !errors.Is(err, ErrChecksumMismatch) {
+			t.Errorf("Expected a damaged legacy value to fail its SHA1, got %v", err)
+		}
 	}
-	encoded := original.Encode()
+}
 
-	var decoded entry
-	_, err := decoded.DecodeFromReader(bufio.NewReader(bytes.NewReader(encoded)))
+func TestLegacySegments(t *testing.T) {
+	fs := vfs.NewMem()
+	f, err := fs.OpenFile("/data/current-data0", os.O_CREATE|os.O_WRONLY, 0600)
 	if err != nil {
-		t.Fatalf("DecodeFromReader failed: %v", err)
+		t.Fatal(err)
 	}
+	for i := 0; i < 10; i++ {
+		record := encodeLegacy(entry{key: fmt.Sprintf("key%d", i), value: fmt.Sprintf("value%d", i)})
+		if _, err := f.Write(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Close()
 
-	original.value = "new value"
+	policy := &switchPolicy{}
+	db, err := Open("/data", 100, WithFS(fs), WithCompactionPolicy(policy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := db.Put(fmt.Sprintf("new%d", i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	policy.enabled.Store(true)
+	db.scheduleCompaction()
+	db.mergeWg.Wait()
+
+	for i := 0; i < 10; i++ {
+		key, want := fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)
+		if value, err := db.Get(key); err != nil || value != want {
+			t.Errorf("Get(%q) = %q, %v", key, value, err)
+		}
+	}
+	if stats := db.Stats(); stats.Merges == 0 || stats.Segments[0].Name == "current-data0" {
+		t.Errorf("Expected the legacy segment to be merged, got %+v", stats.Segments)
+	}
+}
+
+func TestChecksumErrorLocation(t *testing.T) {
+	fs := vfs.NewFault(vfs.NewMem())
+	db, err := Open("/data", 1024, WithFS(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"first", "second", "third"} {
+		if err := db.Put(key, "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	offset := db.segments[0].index["second"].offset
+	db.Close()
 
-	expectedHash := sha1.Sum([]byte(original.value))
-	if decoded.hash == expectedHash {
-		t.Errorf("SHA-1 hash should change when the value changes. Expected %x, got %x", expectedHash, decoded.hash)
+	// Damage the key, which a value hash would not have noticed.
+	if err := fs.Corrupt("/data/current-data0", offset+10); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Open("/data", 1024, WithFS(fs))
+	var checksumErr *ChecksumError
+	if !errors.As(err, &checksumErr) || !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("Expected a ChecksumError, got %v", err)
+	}
+	if checksumErr.Segment != "current-data0" || checksumErr.Offset != offset {
+		t.Errorf("ChecksumError points at %s:%d, wanted current-data0:%d", checksumErr.Segment, checksumErr.Offset, offset)
 	}
 }
@@ -0,0 +1,89 @@
+package datastore
+
+import "time"
+
+type RotateInfo struct {
+	Sealed string
+	Active string
+}
+
+type MergeInfo struct {
+	Inputs   []string
+	Outputs  []string
+	BytesIn  int64
+	BytesOut int64
+	Duration time.Duration
+	// Err is set when the merge failed, the inputs being kept, and when it
+	// replaced damaged records with older copies or left inputs on disk.
+	Err error
+}
+
+type ChecksumInfo struct {
+	Segment string
+	Offset  int64
+	Key     string
+	// Blob is set when the damage is in the blob the record refers to.
+	Blob string
+}
+
+type ScrubInfo struct {
+	Segments int
+	Records  int
+	Bytes    int64
+	Corrupt  int
+	Duration time.Duration
+	Err      error
+}
+
+type RecoveryInfo struct {
+	Segments       int
+	Keys           int
+	TruncatedBytes int64
+	Duration       time.Duration
+}
+
+type WriteErrorInfo struct {
+	Key string
+	Err error
+}
+
+// EventListener is notified about datastore lifecycle events. Callbacks run
+// synchronously on the goroutine that produced the event, so they should not
+// block or call back into the Db. Embed NoopEventListener to implement only a
+// subset of the callbacks.
+type EventListener interface {
+	SegmentRotated(RotateInfo)
+	MergeStarted(MergeInfo)
+	MergeFinished(MergeInfo)
+	ChecksumMismatch(ChecksumInfo)
+	RecoveryCompleted(RecoveryInfo)
+	WriteFailed(WriteErrorInfo)
+	ScrubFinished(ScrubInfo)
+}
+
+type NoopEventListener struct{}
+
+func (NoopEventListener) SegmentRotated(RotateInfo)      {}
+func (NoopEventListener) MergeStarted(MergeInfo)         {}
+func (NoopEventListener) MergeFinished(MergeInfo)        {}
+func (NoopEventListener) ChecksumMismatch(ChecksumInfo)  {}
+func (NoopEventListener) RecoveryCompleted(RecoveryInfo) {}
+func (NoopEventListener) WriteFailed(WriteErrorInfo)     {}
+func (NoopEventListener) ScrubFinished(ScrubInfo)        {}
+
+// WithEventListener registers a listener for lifecycle events.
+func WithEventListener(listener EventListener) Option {
+	return func(o *options) {
+		o.listener = listener
+	}
+}
+
+func (db *Db) checksumMismatch(err *ChecksumError, key string) {
+	db.metrics.checksumFailures.Add(1)
+	db.opts.listener.ChecksumMismatch(ChecksumInfo{
+		Segment: err.Segment,
+		Offset:  err.Offset,
+		Key:     key,
+		Blob:    err.Blob,
+	})
+}
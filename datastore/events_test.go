@@ -0,0 +1,174 @@
+package datastore
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/dk872/architecture-lab5/datastore/vfs"
+)
+
+type recordingListener struct {
+	NoopEventListener
+	mutex     sync.Mutex
+	rotations []RotateInfo
+	merges    []MergeInfo
+	started   int
+	recovery  []RecoveryInfo
+	writes    []WriteErrorInfo
+	checksums []ChecksumInfo
+	scrubs    []ScrubInfo
+}
+
+func (l *recordingListener) SegmentRotated(info RotateInfo) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.rotations = append(l.rotations, info)
+}
+
+func (l *recordingListener) MergeStarted(MergeInfo) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.started++
+}
+
+func (l *recordingListener) MergeFinished(info MergeInfo) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.merges = append(l.merges, info)
+}
+
+func (l *recordingListener) RecoveryCompleted(info RecoveryInfo) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.recovery = append(l.recovery, info)
+}
+
+func (l *recordingListener) WriteFailed(info WriteErrorInfo) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.writes = append(l.writes, info)
+}
+
+func (l *recordingListener) ChecksumMismatch(info ChecksumInfo) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.checksums = append(l.checksums, info)
+}
+
+func (l *recordingListener) ScrubFinished(info ScrubInfo) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.scrubs = append(l.scrubs, info)
+}
+
+type switchPolicy struct {
+	enabled atomic.Bool
+}
+
+func (p *switchPolicy) Plan(sealed []SegmentInfo) []int {
+	if !p.enabled.Load() {
+		return nil
+	}
+	return MergeAllPolicy{MinSegments: 3}.Plan(sealed)
+}
+
+func TestEventListener(t *testing.T) {
+	listener := &recordingListener{}
+	db, err := Open(t.TempDir(), 60, WithEventListener(listener))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, key := range []string{"k1", "k2", "k3", "k4", "k5"} {
+		if err := db.Put(key, "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.mergeWg.Wait()
+
+	listener.mutex.Lock()
+	defer listener.mutex.Unlock()
+
+	if len(listener.recovery) != 1 || listener.recovery[0].Segments != 1 {
+		t.Errorf("Expected one recovery of a fresh segment, got %+v", listener.recovery)
+	}
+	if len(listener.rotations) != 2 || listener.rotations[0].Sealed != "current-data0" || listener.rotations[0].Active != "current-data1" {
+		t.Errorf("Unexpected rotations %+v", listener.rotations)
+	}
+	if listener.started == 0 || listener.started != len(listener.merges) {
+		t.Fatalf("Expected every started merge to finish, got %d started and %d finished", listener.started, len(listener.merges))
+	}
+	last := listener.merges[len(listener.merges)-1]
+	if last.Err != nil || len(last.Inputs) != 2 || last.BytesIn == 0 || last.BytesOut == 0 {
+		t.Errorf("Unexpected merge %+v", last)
+	}
+}
+
+func TestEventListenerReportsFailures(t *testing.T) {
+	listener := &recordingListener{}
+	policy := &switchPolicy{}
+	db, err := Open(t.TempDir(), 60, WithEventListener(listener), WithCompactionPolicy(policy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, key := range []string{"k1", "k2", "k3", "k4", "k5"} {
+		if err := db.Put(key, "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.mergeWg.Wait()
+
+	if err := os.Remove(db.segments[0].outPath); err != nil {
+		t.Fatal(err)
+	}
+	policy.enabled.Store(true)
+	db.scheduleCompaction()
+	db.mergeWg.Wait()
+
+	listener.mutex.Lock()
+	if len(listener.merges) != 1 || listener.merges[0].Err == nil {
+		t.Errorf("Expected a failed merge to be reported, got %+v", listener.merges)
+	}
+	listener.mutex.Unlock()
+	if stats := db.Stats(); stats.LastMergeError == nil {
+		t.Error("Expected the merge error in stats")
+	}
+}
+
+func TestEventListenerReportsMergeReadErrors(t *testing.T) {
+	fs := vfs.NewFault(vfs.NewMem())
+	listener := &recordingListener{}
+	policy := &switchPolicy{}
+	db, err := Open("/data", 60, WithFS(fs), WithEventListener(listener), WithCompactionPolicy(policy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, key := range []string{"k1", "k2", "k3", "k4", "k5"} {
+		if err := db.Put(key, "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fs.FailReads(true)
+	policy.enabled.Store(true)
+	db.scheduleCompaction()
+	db.mergeWg.Wait()
+	fs.FailReads(false)
+
+	listener.mutex.Lock()
+	defer listener.mutex.Unlock()
+	if len(listener.merges) != 1 || !errors.Is(listener.merges[0].Err, vfs.ErrInjected) || len(listener.merges[0].Outputs) != 0 {
+		t.Errorf("Expected the read error to fail the merge, got %+v", listener.merges)
+	}
+	if len(listener.checksums) != 0 {
+		t.Errorf("Expected a read error not to be reported as a checksum mismatch, got %+v", listener.checksums)
+	}
+}
@@ -0,0 +1,119 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"time"
+)
+
+// flagExpires marks a record with an expiry time after the timestamp. Like
+// flagTimestamp it is never kept in entry.flags.
+const flagExpires byte = 1 << 6
+
+// ErrConflict is returned by a conditional PutWith when the stored value is
+// not the one the condition expects.
+var ErrConflict = errors.New("stored value does not match the condition")
+
+// WriteOptions set what PutWith stores besides the value and when it
+// writes at all.
+type WriteOptions struct {
+	// Timestamp is the one the value was written with on another replica,
+	// as for PutAt. Zero lets the writer stamp the value.
+	Timestamp uint64
+	// Expires is when the value starts reading as missing; zero for never.
+	Expires time.Time
+	// Flags are kept for the client, like the flags of memcached, and mean
+	// nothing to the datastore.
+	Flags uint32
+	// IfTimestamp makes the write fail with ErrConflict unless the stored
+	// value has this timestamp, so a value read together with its Timestamp
+	// can be replaced only if nobody wrote it in between. It needs
+	// WithTimestamps.
+	IfTimestamp uint64
+	// IfAbsent makes the write fail with ErrConflict when the key has a
+	// value, IfPresent when it has none.
+	IfAbsent  bool
+	IfPresent bool
+}
+
+// condition is what the writer checks against the stored value before a
+// record is appended.
+type condition struct {
+	ifTimestamp uint64
+	ifAbsent    bool
+	ifPresent   bool
+	// touch copies the stored value and client flags into the record,
+	// which only changes the expiry.
+	touch bool
+}
+
+func (o WriteOptions) apply(e *entry) {
+	e.timestamp = o.Timestamp
+	if !o.Expires.IsZero() {
+		e.expires = o.Expires.UnixNano()
+	}
+	e.clientFlags = o.Flags
+	if o.IfTimestamp != 0 || o.IfAbsent || o.IfPresent {
+		e.cond = &condition{ifTimestamp: o.IfTimestamp, ifAbsent: o.IfAbsent, ifPresent: o.IfPresent}
+	}
+}
+
+func (e entry) expired(now time.Time) bool {
+	return e.expires != 0 && now.UnixNano() >= e.expires
+}
+
+// PutWith stores the value read from r like PutReader, with the metadata
+// and under the conditions of opts.
+func (db *Db) PutWith(ctx context.Context, key string, r io.Reader, opts WriteOptions) error {
+	return db.putReader(ctx, key, r, opts)
+}
+
+// PutExpiring stores a value that reads as missing from expires on.
+func (db *Db) PutExpiring(ctx context.Context, key, value string, expires time.Time) error {
+	return db.PutWith(ctx, key, strings.NewReader(value), WriteOptions{Expires: expires})
+}
+
+// Expire changes when the value of key expires, or makes it permanent with
+// a zero time, keeping the value. It returns ErrNotFound when key has no
+// value.
+func (db *Db) Expire(ctx context.Context, key string, expires time.Time) error {
+	e := entry{key: key, cond: &condition{touch: true}}
+	if !expires.IsZero() {
+		e.expires = expires.UnixNano()
+	}
+	return db.put(ctx, e, nil)
+}
+
+// Expires returns when the value of key expires, the zero time if it never
+// does.
+func (db *Db) Expires(key string) (time.Time, error) {
+	item, err := db.Stat(key)
+	return item.Expires, err
+}
+
+// check runs in the writer and fails a conditional write whose condition
+// does not hold for the stored value.
+func (db *Db) check(e *entry) error {
+	db.segmentsMutex.RLock()
+	_, _, stored, err := db.newest(e.key)
+	db.segmentsMutex.RUnlock()
+	if err != nil && !errors.Is(err, ErrNotFound) && !errors.Is(err, ErrChecksumMismatch) {
+		return err
+	}
+	live := err == nil && stored.flags&flagTombstone == 0 && !stored.expired(time.Now())
+
+	switch c := e.cond; {
+	case c.touch:
+		if !live {
+			return ErrNotFound
+		}
+		e.value, e.flags, e.clientFlags = stored.value, stored.flags, stored.clientFlags
+	case c.ifAbsent && live, c.ifPresent && !live:
+		return ErrConflict
+	case c.ifTimestamp != 0 && (!live || stored.timestamp != c.ifTimestamp):
+		return ErrConflict
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dk872/architecture-lab5/datastore/vfs"
+)
+
+func TestExpiry(t *testing.T) {
+	fs := vfs.NewMem()
+	db, err := Open("/data", 1024, WithFS(fs), WithBlobThreshold(64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	later := time.Now().Add(time.Hour).Truncate(time.Nanosecond)
+
+	if err := db.PutExpiring(ctx, "later", "value", later); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutExpiring(ctx, "gone", "value", time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("blob", strings.Repeat("x", 100)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open("/data", 1024, WithFS(fs), WithBlobThreshold(64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if value, err := db.Get("later"); err != nil || value != "value" {
+		t.Errorf("Get of a value that expires later = %q, %v", value, err)
+	}
+	if expires, err := db.Expires("later"); err != nil || !expires.Equal(later) {
+		t.Errorf("Expires = %v, %v, wanted %v", expires, err, later)
+	}
+	if _, err := db.Get("gone"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get of an expired value returned %v", err)
+	}
+	if keys := db.Keys(); !reflect.DeepEqual(keys, []string{"blob", "later"}) {
+		t.Errorf("Keys() = %v", keys)
+	}
+
+	// Expire keeps the value, blobs included.
+	if err := db.Expire(ctx, "later", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if expires, err := db.Expires("later"); err != nil || !expires.IsZero() {
+		t.Errorf("Expires after making the value permanent = %v, %v", expires, err)
+	}
+	if err := db.Expire(ctx, "blob", time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get("blob"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get of an expired blob returned %v", err)
+	}
+	if err := db.Expire(ctx, "gone", later); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expire of an expired value returned %v", err)
+	}
+	if err := db.Expire(ctx, "missing", later); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expire of a missing key returned %v", err)
+	}
+}
+
+func TestConditionalPut(t *testing.T) {
+	db, err := Open("/data", 1024, WithFS(vfs.NewMem()), WithTimestamps())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	ctx := context.Background()
+
+	if err := db.PutWith(ctx, "key", strings.NewReader("first"), WriteOptions{IfAbsent: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutWith(ctx, "key", strings.NewReader("again"), WriteOptions{IfAbsent: true}); !errors.Is(err, ErrConflict) {
+		t.Errorf("IfAbsent write over a value returned %v", err)
+	}
+
+	ts, err := db.Timestamp("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutWith(ctx, "key", strings.NewReader("second"), WriteOptions{IfTimestamp: ts}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutWith(ctx, "key", strings.NewReader("third"), WriteOptions{IfTimestamp: ts}); !errors.Is(err, ErrConflict) {
+		t.Errorf("Write with an outdated timestamp returned %v", err)
+	}
+	if value, _ := db.Get("key"); value != "second" {
+		t.Errorf("Got %q", value)
+	}
+
+	// An expired value counts as absent.
+	if err := db.PutExpiring(ctx, "key", "short", time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutWith(ctx, "key", strings.NewReader("new"), WriteOptions{IfAbsent: true}); err != nil {
+		t.Errorf("IfAbsent write over an expired value returned %v", err)
+	}
+}
+
+func TestMergeDropsExpired(t *testing.T) {
+	db, err := Open("/data", 64, WithFS(vfs.NewMem()), WithCompactionPolicy(MergeAllPolicy{MinSegments: 1000}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	ctx := context.Background()
+	if err := db.PutExpiring(ctx, "a", "value of a", time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"b", "c", "d"} {
+		if err := db.Put(key, "value of "+key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db.segmentsMutex.RLock()
+	sealed := append([]*FileSegment(nil), db.segments[:len(db.segments)-1]...)
+	db.segmentsMutex.RUnlock()
+	outputs, err := db.mergeSegments(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, seg := range outputs {
+		if _, ok := seg.index["a"]; ok {
+			t.Error("Merge kept the expired value")
+		}
+	}
+}
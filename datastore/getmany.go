@@ -0,0 +1,145 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/dk872/architecture-lab5/datastore/vfs"
+)
+
+// lookup is where GetMany finds the newest record of a key.
+type lookup struct {
+	key      string
+	position recordPos
+}
+
+// GetMany reads the values of keys, leaving out the keys that have none.
+// The keys are looked up under a single lock, so the values are those of
+// one moment, and the records are read a segment at a time in file order.
+func (db *Db) GetMany(keys []string) (map[string]string, error) {
+	return db.GetManyContext(context.Background(), keys)
+}
+
+func (db *Db) GetManyContext(ctx context.Context, keys []string) (map[string]string, error) {
+	if db.isClosed() {
+		return nil, ErrClosed
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string, len(keys))
+	blobs := make(map[string]*blobValue)
+	defer func() {
+		for _, blob := range blobs {
+			blob.Close()
+		}
+	}()
+	if err := db.readMany(keys, values, blobs); err != nil {
+		return nil, err
+	}
+
+	// Blobs were opened under the lock and are read without holding it.
+	for key, blob := range blobs {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		value, err := io.ReadAll(blob)
+		if errors.Is(err, ErrChecksumMismatch) {
+			if err := db.unreadable(err); !errors.Is(err, ErrNotFound) {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		values[key] = string(value)
+	}
+	return values, nil
+}
+
+// readMany fills values with the keys stored in the log and opens the blobs
+// of the others.
+func (db *Db) readMany(keys []string, values map[string]string, blobs map[string]*blobValue) error {
+	db.segmentsMutex.RLock()
+	defer db.segmentsMutex.RUnlock()
+
+	now := time.Now()
+	bySegment := make(map[*FileSegment][]lookup)
+	seen := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		for i := range db.segments {
+			segment := db.segments[len(db.segments)-i-1]
+			segment.mutex.RLock()
+			position, ok := segment.index[key]
+			segment.mutex.RUnlock()
+			if !ok {
+				continue
+			}
+			// The index knows about deletes and expiry, those records need
+			// not be read.
+			if !position.dead(now) {
+				bySegment[segment] = append(bySegment[segment], lookup{key, position})
+			}
+			break
+		}
+	}
+
+	for segment, lookups := range bySegment {
+		sort.Slice(lookups, func(i, j int) bool {
+			return lookups[i].position.offset < lookups[j].position.offset
+		})
+		if err := db.readSegment(segment, lookups, values, blobs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *Db) readSegment(segment *FileSegment, lookups []lookup, values map[string]string, blobs map[string]*blobValue) error {
+	f, err := vfs.Open(segment.fs, segment.outPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for _, l := range lookups {
+		stored, err := segment.readRecord(f, l.position)
+		var checksumErr *ChecksumError
+		if errors.As(err, &checksumErr) {
+			db.checksumMismatch(checksumErr, l.key)
+			if err := db.unreadable(err); !errors.Is(err, ErrNotFound) {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if stored.flags&flagBlob != 0 {
+			blob, err := db.openBlob(segment, l.position, stored)
+			if err != nil {
+				return err
+			}
+			blobs[l.key] = blob
+			continue
+		}
+		record, err := decrypt(db.opts.keys, stored)
+		if err == nil {
+			record, err = decompress(record)
+		}
+		if err != nil {
+			return err
+		}
+		values[l.key] = record.value
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dk872/architecture-lab5/datastore/vfs"
+)
+
+func TestGetMany(t *testing.T) {
+	// Small segments spread the keys over several of them.
+	db, err := Open("/data", 128, WithFS(vfs.NewMem()), WithBlobThreshold(64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	ctx := context.Background()
+
+	want := make(map[string]string)
+	var keys []string
+	for i := range 20 {
+		key, value := fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)
+		if err := db.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+		want[key] = value
+		keys = append(keys, key)
+	}
+	// The newest value of a key wins over the older segments.
+	if err := db.Put("key0", "new"); err != nil {
+		t.Fatal(err)
+	}
+	want["key0"] = "new"
+	blob := strings.Repeat("x", 100)
+	if err := db.Put("blob", blob); err != nil {
+		t.Fatal(err)
+	}
+	want["blob"] = blob
+	if err := db.Delete("key1"); err != nil {
+		t.Fatal(err)
+	}
+	delete(want, "key1")
+	if err := db.PutExpiring(ctx, "expired", "value", time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	keys = append(keys, "blob", "expired", "missing", "key0")
+	values, err := db.GetMany(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("GetMany = %v, wanted %v", values, want)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := db.GetManyContext(canceled, keys); !errors.Is(err, context.Canceled) {
+		t.Errorf("GetManyContext with a canceled context returned %v", err)
+	}
+}
@@ -0,0 +1,74 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// flagClientFlags marks a record with client flags after the expiry. Like
+// flagTimestamp it is never kept in entry.flags.
+const flagClientFlags byte = 1 << 7
+
+// Item is a value together with what was stored along with it.
+type Item struct {
+	Value     string
+	Timestamp uint64
+	// Expires is zero for values that do not expire.
+	Expires time.Time
+	Flags   uint32
+}
+
+// GetItem reads the value of key and its metadata from the same record.
+func (db *Db) GetItem(ctx context.Context, key string) (Item, error) {
+	record, blob, err := db.read(ctx, key)
+	if err != nil {
+		return Item{}, err
+	}
+	item := Item{Value: record.value, Timestamp: record.timestamp, Flags: record.clientFlags}
+	if record.expires != 0 {
+		item.Expires = time.Unix(0, record.expires)
+	}
+	if blob == nil {
+		return item, nil
+	}
+	defer blob.Close()
+
+	value, err := io.ReadAll(blob)
+	if errors.Is(err, ErrChecksumMismatch) {
+		return Item{}, db.unreadable(err)
+	}
+	if err != nil {
+		return Item{}, err
+	}
+	item.Value = string(value)
+	return item, nil
+}
+
+// Stat returns the metadata of the value of key, leaving Item.Value empty,
+// without reading the value.
+func (db *Db) Stat(key string) (Item, error) {
+	if db.isClosed() {
+		return Item{}, ErrClosed
+	}
+	db.segmentsMutex.RLock()
+	defer db.segmentsMutex.RUnlock()
+
+	_, _, stored, err := db.newest(key)
+	var checksumErr *ChecksumError
+	switch {
+	case errors.As(err, &checksumErr):
+		db.checksumMismatch(checksumErr, key)
+		return Item{}, db.unreadable(err)
+	case err != nil:
+		return Item{}, err
+	case stored.flags&flagTombstone != 0, stored.expired(time.Now()):
+		return Item{}, ErrNotFound
+	}
+	item := Item{Timestamp: stored.timestamp, Flags: stored.clientFlags}
+	if stored.expires != 0 {
+		item.Expires = time.Unix(0, stored.expires)
+	}
+	return item, nil
+}
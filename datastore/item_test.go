@@ -0,0 +1,63 @@
+package datastore
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dk872/architecture-lab5/datastore/vfs"
+)
+
+func TestItem(t *testing.T) {
+	fs := vfs.NewMem()
+	opts := []Option{WithFS(fs), WithBlobThreshold(64), WithTimestamps()}
+	db, err := Open("/data", 1024, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	later := time.Now().Add(time.Hour).Truncate(time.Nanosecond)
+
+	if err := db.PutWith(ctx, "small", strings.NewReader("value"), WriteOptions{Flags: 42, Expires: later}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutWith(ctx, "blob", strings.NewReader(strings.Repeat("x", 100)), WriteOptions{Flags: 7}); err != nil {
+		t.Fatal(err)
+	}
+	// Touching keeps the flags.
+	if err := db.Expire(ctx, "blob", later); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open("/data", 1024, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, c := range []struct {
+		key, value string
+		flags      uint32
+	}{
+		{"small", "value", 42},
+		{"blob", strings.Repeat("x", 100), 7},
+	} {
+		item, err := db.GetItem(ctx, c.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if item.Value != c.value || item.Flags != c.flags || !item.Expires.Equal(later) || item.Timestamp == 0 {
+			t.Errorf("GetItem(%q) = %+v", c.key, item)
+		}
+		stat, err := db.Stat(c.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stat.Value != "" || stat.Flags != c.flags || stat.Timestamp != item.Timestamp || !stat.Expires.Equal(later) {
+			t.Errorf("Stat(%q) = %+v, wanted the metadata of %+v", c.key, stat, item)
+		}
+	}
+}
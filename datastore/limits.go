@@ -0,0 +1,102 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+const (
+	// MaxKeySize is the length in bytes of the longest key.
+	MaxKeySize = 1024
+	// DefaultMaxValueSize is the length of the longest value unless
+	// WithMaxValueSize sets another.
+	DefaultMaxValueSize = 64 << 20
+)
+
+var (
+	ErrInvalidKey    = errors.New("invalid key")
+	ErrKeyTooLarge   = errors.New("key is too large")
+	ErrValueTooLarge = errors.New("value is too large")
+)
+
+// KeyError is returned for a key that breaks the key rules of ValidateKey.
+// It wraps ErrKeyTooLarge for keys longer than MaxKeySize and ErrInvalidKey
+// for the others.
+type KeyError struct {
+	Key    string
+	Reason string
+}
+
+func (e *KeyError) Error() string {
+	return fmt.Sprintf("invalid key %.64q: %s", e.Key, e.Reason)
+}
+
+func (e *KeyError) Unwrap() error {
+	if len(e.Key) > MaxKeySize {
+		return ErrKeyTooLarge
+	}
+	return ErrInvalidKey
+}
+
+// ValueTooLargeError is returned for a value longer than the limit set
+// with WithMaxValueSize. It wraps ErrValueTooLarge.
+type ValueTooLargeError struct {
+	Limit int64
+}
+
+func (e *ValueTooLargeError) Error() string {
+	return fmt.Sprintf("value is longer than %d bytes", e.Limit)
+}
+
+func (e *ValueTooLargeError) Unwrap() error {
+	return ErrValueTooLarge
+}
+
+// WithMaxValueSize sets the length in bytes of the longest value; the
+// default is DefaultMaxValueSize.
+func WithMaxValueSize(bytes int64) Option {
+	return func(o *options) {
+		o.maxValueSize = bytes
+	}
+}
+
+// ValidateKey checks the key rules, which every put follows: a key is
+// valid UTF-8, so it survives JSON, and between 1 and MaxKeySize bytes
+// long. Any other byte, '/' and '%' included, may be part of a key.
+func ValidateKey(key string) error {
+	switch {
+	case key == "":
+		return &KeyError{Key: key, Reason: "empty"}
+	case len(key) > MaxKeySize:
+		return &KeyError{Key: key, Reason: fmt.Sprintf("longer than %d bytes", MaxKeySize)}
+	case !utf8.ValidString(key):
+		return &KeyError{Key: key, Reason: "not valid UTF-8"}
+	}
+	return nil
+}
+
+// maxReader fails with a ValueTooLargeError once more than limit bytes
+// have been read, so that values being streamed are cut off.
+type maxReader struct {
+	r     io.Reader
+	left  int64
+	limit int64
+}
+
+func newMaxReader(r io.Reader, limit int64) *maxReader {
+	return &maxReader{r: r, left: limit, limit: limit}
+}
+
+func (m *maxReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > m.left+1 {
+		p = p[:m.left+1]
+	}
+	n, err := m.r.Read(p)
+	m.left -= int64(n)
+	if m.left < 0 {
+		return n, &ValueTooLargeError{Limit: m.limit}
+	}
+	return n, err
+}
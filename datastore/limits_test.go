@@ -0,0 +1,67 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/dk872/architecture-lab5/datastore/vfs"
+)
+
+func TestValidateKey(t *testing.T) {
+	for _, c := range []struct {
+		key  string
+		want error
+	}{
+		{"user/1?x=%20", nil},
+		{"ключ", nil},
+		{"_session", nil},
+		{strings.Repeat("k", MaxKeySize), nil},
+		{"", ErrInvalidKey},
+		{"\xff", ErrInvalidKey},
+		{strings.Repeat("k", MaxKeySize+1), ErrKeyTooLarge},
+	} {
+		err := ValidateKey(c.key)
+		if !errors.Is(err, c.want) || (c.want == nil && err != nil) {
+			t.Errorf("ValidateKey(%.20q) = %v, wanted %v", c.key, err, c.want)
+		}
+		var keyErr *KeyError
+		if c.want != nil && !errors.As(err, &keyErr) {
+			t.Errorf("ValidateKey(%.20q) returned %T", c.key, err)
+		}
+	}
+}
+
+func TestPutLimits(t *testing.T) {
+	fs := vfs.NewMem()
+	db, err := Open("/data", 1024, WithFS(fs), WithBlobThreshold(16), WithMaxValueSize(64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	ctx := context.Background()
+
+	if err := db.Put("\xff", "value"); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Put with an invalid key returned %v", err)
+	}
+	if err := db.Put(strings.Repeat("k", MaxKeySize+1), "value"); !errors.Is(err, ErrKeyTooLarge) {
+		t.Errorf("Put with a long key returned %v", err)
+	}
+
+	var tooLarge *ValueTooLargeError
+	if err := db.Put("key", strings.Repeat("x", 65)); !errors.As(err, &tooLarge) || tooLarge.Limit != 64 {
+		t.Errorf("Put of a long value returned %v", err)
+	}
+	// Streamed values are cut off at the limit, blobs included.
+	if err := db.PutReader(ctx, "key", strings.NewReader(strings.Repeat("x", 1000))); !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("PutReader of a long value returned %v", err)
+	}
+	if _, err := db.Get("key"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get of a rejected value returned %v", err)
+	}
+
+	if err := db.PutReader(ctx, "key", strings.NewReader(strings.Repeat("x", 64))); err != nil {
+		t.Errorf("PutReader of a value at the limit returned %v", err)
+	}
+}
@@ -0,0 +1,125 @@
+package datastore
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dk872/architecture-lab5/datastore/vfs"
+)
+
+func TestDirectoryLock(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir, segSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Open(dir, segSize); !errors.Is(err, ErrLocked) {
+		t.Errorf("Expected a second Open to fail with ErrLocked, got %v", err)
+	}
+	if _, err := OpenReadOnly(dir); !errors.Is(err, ErrLocked) {
+		t.Errorf("Expected OpenReadOnly of a locked directory to fail with ErrLocked, got %v", err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reader1, err := OpenReadOnly(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader2, err := OpenReadOnly(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if value, err := reader2.Get("key"); err != nil || value != "value" {
+		t.Errorf("Get = %q, %v", value, err)
+	}
+	if err := reader2.Put("key", "other"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Expected ErrReadOnly, got %v", err)
+	}
+	if _, err := Open(dir, segSize); !errors.Is(err, ErrLocked) {
+		t.Errorf("Expected Open to fail while readers hold the directory, got %v", err)
+	}
+	if err := reader2.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := reader1.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(dir, segSize)
+	if err != nil {
+		t.Fatalf("Expected Open to succeed once every reader is closed, got %v", err)
+	}
+	db.Close()
+}
+
+func TestReadOnlyKeepsTornTail(t *testing.T) {
+	fs := vfs.NewFault(vfs.NewMem())
+	db, err := Open("/data", segSize, WithFS(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	fs.CrashAfter(5)
+	_ = db.Put("torn", "value")
+	db.Close()
+	fs.Reset()
+
+	reader, err := OpenReadOnly("/data", WithFS(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	if value, err := reader.Get("key"); err != nil || value != "value" {
+		t.Errorf("Get = %q, %v", value, err)
+	}
+	f, err := vfs.Open(fs, "/data/current-data0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	info, _ := f.Stat()
+	if want := int64(len((&entry{key: "key", value: "value"}).Encode())) + 5; info.Size() != want {
+		t.Errorf("Expected the read-only open to leave %d bytes on disk, found %d", want, info.Size())
+	}
+}
+
+func TestReadOnlyLeavesDirectoryUntouched(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir, segSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	// A store copied without its lock file.
+	if err := os.Remove(filepath.Join(dir, lockFileName)); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := OpenReadOnly(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if value, err := reader.Get("key"); err != nil || value != "value" {
+		t.Errorf("Get = %q, %v", value, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, lockFileName)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected OpenReadOnly not to create the lock file, got %v", err)
+	}
+}
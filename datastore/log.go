@@ -0,0 +1,209 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strconv"
+	"strings"
+
+	"github.com/dk872/architecture-lab5/datastore/vfs"
+)
+
+// ErrCompacted is returned when the log at a requested position has been
+// merged away.
+var ErrCompacted = errors.New("log position has been compacted")
+
+// Position locates a record in the log written by the writer: the number of
+// the segment it was appended to and its offset there. Positions grow with
+// every write and survive restarts, but not merges of their segment.
+type Position struct {
+	Segment int
+	Offset  int64
+}
+
+func (p Position) less(other Position) bool {
+	if p.Segment != other.Segment {
+		return p.Segment < other.Segment
+	}
+	return p.Offset < other.Offset
+}
+
+func (p Position) String() string {
+	return fmt.Sprintf("%d:%d", p.Segment, p.Offset)
+}
+
+// ParsePosition parses the form returned by Position.String.
+func ParsePosition(s string) (Position, error) {
+	seg, offset, ok := strings.Cut(s, ":")
+	if ok {
+		n, segErr := strconv.Atoi(seg)
+		o, offsetErr := strconv.ParseInt(offset, 10, 64)
+		if segErr == nil && offsetErr == nil && n >= 0 && o >= 0 {
+			return Position{Segment: n, Offset: o}, nil
+		}
+	}
+	return Position{}, fmt.Errorf("invalid log position %q", s)
+}
+
+// End returns the position the log currently ends at. Tail from it yields
+// only the records written afterwards.
+func (db *Db) End() Position {
+	db.segmentsMutex.RLock()
+	defer db.segmentsMutex.RUnlock()
+	if len(db.segments) == 0 {
+		return Position{}
+	}
+	active := db.segments[len(db.segments)-1]
+	active.mutex.RLock()
+	defer active.mutex.RUnlock()
+	return Position{Segment: active.id.seq, Offset: active.size}
+}
+
+// LogIterator walks the log in write order, moving on to the next segment
+// as the writer rotates them. Next returns false once it reaches the end of
+// the log; if Err is nil then, calling Next again later picks up the records
+// written in between.
+type LogIterator struct {
+	db     *Db
+	pos    Position
+	seg    *FileSegment
+	f      vfs.File
+	change storedChange
+	event  ChangeEvent
+	err    error
+}
+
+// Tail returns an iterator over the log from the record at from on. It
+// fails with ErrCompacted if the segment of from has been merged away; an
+// iterator that runs into a merged segment later stops with ErrCompacted
+// too.
+func (db *Db) Tail(from Position) (*LogIterator, error) {
+	if db.isClosed() {
+		return nil, ErrClosed
+	}
+	it := &LogIterator{db: db, pos: from}
+	if err := it.open(from.Segment); err != nil {
+		return nil, err
+	}
+	return it, nil
+}
+
+// Next advances to the next record. It returns false at the end of the log
+// or when the iterator fails.
+func (it *LogIterator) Next() bool {
+	if !it.next() {
+		return false
+	}
+	it.event, it.err = it.db.changeEvent(it.change)
+	return it.err == nil
+}
+
+// Event returns the record Next advanced to.
+func (it *LogIterator) Event() ChangeEvent {
+	return it.event
+}
+
+// Position returns where the record after the current one starts, the
+// position to resume from.
+func (it *LogIterator) Position() Position {
+	return it.pos
+}
+
+func (it *LogIterator) Err() error {
+	return it.err
+}
+
+func (it *LogIterator) Close() error {
+	if it.f == nil {
+		return nil
+	}
+	err := it.f.Close()
+	it.f = nil
+	return err
+}
+
+// next reads the next record without decoding its value.
+func (it *LogIterator) next() bool {
+	for it.err == nil {
+		if it.seg == nil {
+			if it.err = it.open(it.pos.Segment); it.err != nil || it.seg == nil {
+				return false
+			}
+		}
+
+		it.db.segmentsMutex.RLock()
+		active := it.db.segments[len(it.db.segments)-1] == it.seg
+		it.db.segmentsMutex.RUnlock()
+		it.seg.mutex.RLock()
+		size := it.seg.size
+		it.seg.mutex.RUnlock()
+
+		if it.pos.Offset < size {
+			it.err = it.read(size)
+			return it.err == nil
+		}
+		if active {
+			return false
+		}
+		// The segment is sealed and read to its end.
+		it.Close()
+		it.seg = nil
+		it.pos = Position{Segment: it.pos.Segment + 1}
+	}
+	return false
+}
+
+// open finds the segment the writer numbered seq. It leaves it.seg unset if
+// the writer has not got that far yet.
+func (it *LogIterator) open(seq int) error {
+	it.db.segmentsMutex.RLock()
+	var seg *FileSegment
+	later := false
+	for _, s := range it.db.segments {
+		if s.id.seq == seq && !s.id.merged() {
+			seg = s
+		} else if s.id.seq >= seq {
+			later = true
+		}
+	}
+	it.db.segmentsMutex.RUnlock()
+
+	if seg == nil {
+		// Segments are numbered without gaps, so one missing below a later
+		// segment has been merged.
+		if later {
+			return fmt.Errorf("%w: %s", ErrCompacted, it.pos)
+		}
+		return nil
+	}
+
+	f, err := vfs.Open(it.db.opts.fs, seg.outPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%w: %s", ErrCompacted, it.pos)
+	}
+	if err != nil {
+		return err
+	}
+	it.seg, it.f = seg, f
+	return nil
+}
+
+func (it *LogIterator) read(size int64) error {
+	var sizeWord [4]byte
+	if _, err := it.f.ReadAt(sizeWord[:], it.pos.Offset); err != nil {
+		return err
+	}
+	pos := recordPos{offset: it.pos.Offset, size: int64(recordSize(binary.LittleEndian.Uint32(sizeWord[:])))}
+	if pos.size < 4 || pos.offset+pos.size > size {
+		return &ChecksumError{Segment: it.seg.id.fileName(), Offset: pos.offset}
+	}
+	record, err := it.seg.readRecord(it.f, pos)
+	if err != nil {
+		return err
+	}
+	it.change = storedChange{record: record, pos: it.pos}
+	it.pos.Offset += pos.size
+	return nil
+}
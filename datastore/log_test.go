@@ -0,0 +1,131 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/dk872/architecture-lab5/datastore/vfs"
+)
+
+func TestTail(t *testing.T) {
+	fs := vfs.NewMem()
+	policy := &switchPolicy{}
+	db, err := Open("/data", 64, WithFS(fs), WithCompactionPolicy(policy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	it, err := db.Tail(Position{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	var versions []Position
+	for it.Next() {
+		event := it.Event()
+		if want := fmt.Sprintf("key%d", len(versions)); event.Key != want || event.Value != "value"+want[3:] {
+			t.Errorf("Record %d is %q = %q, wanted %s", len(versions), event.Key, event.Value, want)
+		}
+		if len(versions) > 0 && !versions[len(versions)-1].less(event.Version) {
+			t.Errorf("Position %v follows %v", event.Version, versions[len(versions)-1])
+		}
+		versions = append(versions, event.Version)
+	}
+	if it.Err() != nil || len(versions) != 10 {
+		t.Fatalf("Tail stopped after %d records: %v", len(versions), it.Err())
+	}
+	if versions[9].Segment == 0 {
+		t.Fatal("Expected the log to span several segments")
+	}
+
+	// The iterator picks up writes made after it reached the end, across a
+	// rotation.
+	for i := 10; i < 13; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 10; i < 13; i++ {
+		if !it.Next() || it.Event().Key != fmt.Sprintf("key%d", i) {
+			t.Fatalf("Expected key%d after catching up, got %v: %v", i, it.Event(), it.Err())
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Positions survive a restart.
+	db, err = Open("/data", 64, WithFS(fs), WithCompactionPolicy(policy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	resumed, err := db.Tail(versions[5])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resumed.Close()
+	if !resumed.Next() || resumed.Event().Key != "key5" {
+		t.Errorf("Tail(%v) after a restart started at %v: %v", versions[5], resumed.Event(), resumed.Err())
+	}
+
+	policy.enabled.Store(true)
+	db.scheduleCompaction()
+	db.mergeWg.Wait()
+
+	if _, err := db.Tail(versions[0]); !errors.Is(err, ErrCompacted) {
+		t.Errorf("Tail of a merged segment returned %v, wanted ErrCompacted", err)
+	}
+	for resumed.Next() {
+	}
+	if !errors.Is(resumed.Err(), ErrCompacted) {
+		t.Errorf("Iterator that ran into a merged segment stopped with %v", resumed.Err())
+	}
+}
+
+func TestTailAfterFailedRotation(t *testing.T) {
+	fs := vfs.NewFault(vfs.NewMem())
+	db, err := Open("/data", 64, WithFS(fs), WithCompactionPolicy(&switchPolicy{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	put := func(i int) error { return db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)) }
+	if err := put(0); err != nil {
+		t.Fatal(err)
+	}
+	// The put that needs a new segment fails to create it.
+	fs.FailCreates(true)
+	failed := 1
+	for ; failed < 10 && put(failed) == nil; failed++ {
+	}
+	fs.FailCreates(false)
+	if failed == 10 {
+		t.Fatal("No put needed a new segment")
+	}
+	for i := failed + 1; i < failed+4; i++ {
+		if err := put(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	it, err := db.Tail(Position{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	n := 0
+	for it.Next() {
+		n++
+	}
+	if it.Err() != nil || n != failed+3 {
+		t.Errorf("Tail read %d records of %d: %v", n, failed+3, it.Err())
+	}
+}
@@ -0,0 +1,192 @@
+package datastore
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"time"
+
+	"github.com/dk872/architecture-lab5/datastore/vfs"
+)
+
+// WithScrubber verifies the checksum of every record in the sealed segments,
+// and of the blobs their records refer to, once per interval, reading at
+// most bytesPerSecond so the scrubber does not compete with clients.
+// Damaged records are reported through ChecksumMismatch events and Stats
+// before a client runs into them.
+func WithScrubber(interval time.Duration, bytesPerSecond int64) Option {
+	return func(o *options) {
+		o.scrubInterval = interval
+		o.scrubLimiter = newRateLimiter(bytesPerSecond)
+	}
+}
+
+// WithChecksumErrors makes reads of a damaged record fail with a
+// ChecksumError instead of ErrNotFound, so corrupted keys are unreadable
+// rather than silently missing.
+func WithChecksumErrors() Option {
+	return func(o *options) {
+		o.checksumErrors = true
+	}
+}
+
+func (db *Db) scrubber() {
+	defer close(db.scrubberDone)
+	if db.opts.scrubInterval <= 0 {
+		<-db.stopCh
+		return
+	}
+
+	ticker := time.NewTicker(db.opts.scrubInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			_, _ = db.Scrub(context.Background())
+		case <-db.stopCh:
+			return
+		}
+	}
+}
+
+// Scrub makes one pass over the sealed segments, as the background scrubber
+// does, and returns what it found. It stops early when ctx is done or the Db
+// is closed.
+func (db *Db) Scrub(ctx context.Context) (ScrubInfo, error) {
+	start := time.Now()
+	var info ScrubInfo
+
+	db.segmentsMutex.RLock()
+	sealed := append([]*FileSegment(nil), db.segments...)
+	if !db.readOnly && len(sealed) > 0 {
+		sealed = sealed[:len(sealed)-1]
+	}
+	db.segmentsMutex.RUnlock()
+
+	for _, seg := range sealed {
+		if info.Err = db.scrubSegment(ctx, seg, &info); info.Err != nil {
+			break
+		}
+		info.Segments++
+	}
+
+	info.Duration = time.Since(start)
+	db.metrics.scrubDone(info)
+	db.opts.listener.ScrubFinished(info)
+	return info, info.Err
+}
+
+func (db *Db) scrubSegment(ctx context.Context, seg *FileSegment, info *ScrubInfo) error {
+	f, err := vfs.Open(db.opts.fs, seg.outPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		// Merged away since the pass started.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	seg.mutex.RLock()
+	size := seg.size
+	keys := make(map[int64]string, len(seg.index))
+	for key, pos := range seg.index {
+		keys[pos.offset] = key
+	}
+	seg.mutex.RUnlock()
+
+	var offset int64
+	for offset < size {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-db.stopCh:
+			return ErrClosed
+		default:
+		}
+
+		var sizeWord [4]byte
+		if _, err := f.ReadAt(sizeWord[:], offset); err != nil {
+			return err
+		}
+		n := int64(recordSize(binary.LittleEndian.Uint32(sizeWord[:])))
+		if n < 4 || offset+n > size {
+			// The size itself is damaged, so the rest of the segment
+			// cannot be walked.
+			db.scrubFound(&ChecksumError{Segment: seg.id.fileName(), Offset: offset}, keys[offset], info)
+			return nil
+		}
+
+		pos := recordPos{offset: offset, size: n}
+		db.opts.scrubLimiter.wait(int(n))
+		record, err := seg.readRecord(f, pos)
+		var checksumErr *ChecksumError
+		switch {
+		case errors.As(err, &checksumErr):
+			db.scrubFound(checksumErr, keys[offset], info)
+		case err != nil:
+			return err
+		case record.flags&flagBlob != 0 && keys[offset] == record.key:
+			if err := db.scrubBlob(seg, pos, record, info); err != nil {
+				return err
+			}
+		}
+
+		info.Records++
+		info.Bytes += n
+		offset += n
+	}
+	return nil
+}
+
+// scrubBlob verifies the content of a blob referred to by a record in seg.
+func (db *Db) scrubBlob(seg *FileSegment, pos recordPos, record entry, info *ScrubInfo) error {
+	ref, err := recordBlobRef(&record)
+	if err != nil {
+		return nil
+	}
+
+	// Open the blob under segmentsMutex, so it is not collected in between,
+	// and only if seg has not been merged away since the pass started.
+	db.segmentsMutex.RLock()
+	var f vfs.File
+	for _, s := range db.segments {
+		if s == seg {
+			f, err = vfs.Open(db.opts.fs, filepath.Join(db.dir, ref.name))
+			break
+		}
+	}
+	db.segmentsMutex.RUnlock()
+	if f == nil || err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	mismatch := &ChecksumError{Segment: seg.id.fileName(), Offset: pos.offset, Blob: ref.name}
+	r := &blobReader{f: f, ref: ref, hash: sha1.New(), mismatch: mismatch, onMismatch: func() {}}
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := r.Read(buf)
+		db.opts.scrubLimiter.wait(n)
+		info.Bytes += int64(n)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if errors.Is(err, ErrChecksumMismatch) {
+			db.scrubFound(mismatch, record.key, info)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (db *Db) scrubFound(err *ChecksumError, key string, info *ScrubInfo) {
+	info.Corrupt++
+	db.checksumMismatch(err, key)
+}
@@ -0,0 +1,126 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dk872/architecture-lab5/datastore/vfs"
+)
+
+// corruptStore writes records over a few segments, a blob among them, and
+// damages the value of key2 and the content of the blob.
+func corruptStore(t *testing.T, opts ...Option) (*Db, *recordingListener) {
+	t.Helper()
+	fs := vfs.NewFault(vfs.NewMem())
+	listener := &recordingListener{}
+	opts = append([]Option{WithFS(fs), WithEventListener(listener), WithCompactionPolicy(&switchPolicy{})}, opts...)
+	db, err := Open("/data", 100, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Put("blob", strings.Repeat("b", 200)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, seg := range db.segments {
+		if pos, ok := seg.index["key2"]; ok {
+			if err := fs.Corrupt(seg.outPath, pos.offset+pos.size-6); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := fs.Corrupt("/data/blob-0", 100); err != nil {
+		t.Fatal(err)
+	}
+	return db, listener
+}
+
+func TestScrub(t *testing.T) {
+	db, listener := corruptStore(t)
+	defer db.Close()
+
+	info, err := db.Scrub(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed := db.segments[:len(db.segments)-1]
+	records := 0
+	for _, seg := range sealed {
+		records += len(seg.index)
+	}
+	if info.Corrupt != 2 || info.Records != records || info.Segments != len(sealed) {
+		t.Errorf("Unexpected scrub result %+v", info)
+	}
+
+	listener.mutex.Lock()
+	found := make(map[string]ChecksumInfo)
+	for _, c := range listener.checksums {
+		found[c.Key] = c
+	}
+	if len(listener.scrubs) != 1 || len(found) != 2 || found["key2"].Segment != "current-data1" || found["blob"].Blob != "blob-0" {
+		t.Errorf("Unexpected events: %+v, scrubs %+v", listener.checksums, listener.scrubs)
+	}
+	listener.mutex.Unlock()
+
+	stats := db.Stats()
+	if stats.Scrubs != 1 || stats.ScrubCorruptions != 2 || stats.ScrubbedBytes == 0 || stats.ChecksumFailures != 2 {
+		t.Errorf("Unexpected stats: %d scrubs, %d corruptions, %d bytes, %d failures",
+			stats.Scrubs, stats.ScrubCorruptions, stats.ScrubbedBytes, stats.ChecksumFailures)
+	}
+
+	for _, key := range []string{"key2", "blob"} {
+		if _, err := db.Get(key); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Get(%q) error = %v, wanted ErrNotFound", key, err)
+		}
+	}
+}
+
+func TestChecksumErrors(t *testing.T) {
+	db, _ := corruptStore(t, WithChecksumErrors())
+	defer db.Close()
+
+	for key, blob := range map[string]string{"key2": "", "blob": "blob-0"} {
+		_, err := db.Get(key)
+		var checksumErr *ChecksumError
+		if !errors.As(err, &checksumErr) || checksumErr.Blob != blob {
+			t.Errorf("Get(%q) error = %v, wanted a ChecksumError", key, err)
+		}
+	}
+	if value, err := db.Get("key3"); err != nil || value != "value3" {
+		t.Errorf("Get(key3) = %q, %v", value, err)
+	}
+}
+
+func TestBackgroundScrubber(t *testing.T) {
+	db, listener := corruptStore(t, WithScrubber(5*time.Millisecond, 1<<20))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for db.Stats().Scrubs < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := db.Stats()
+	if stats.Scrubs < 2 || stats.ScrubCorruptions < 4 {
+		t.Errorf("Expected repeated scrubs to report the damage, got %d scrubs and %d corruptions", stats.Scrubs, stats.ScrubCorruptions)
+	}
+	listener.mutex.Lock()
+	defer listener.mutex.Unlock()
+	for _, scrub := range listener.scrubs {
+		if scrub.Err != nil && !errors.Is(scrub.Err, ErrClosed) {
+			t.Errorf("Scrub failed: %v", scrub.Err)
+		}
+	}
+}
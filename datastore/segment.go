@@ -0,0 +1,209 @@
+package datastore
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dk872/architecture-lab5/datastore/vfs"
+)
+
+type recordPos struct {
+	offset int64
+	size   int64
+	// tombstone is set for a record that deletes its key.
+	tombstone bool
+	// expires is the expiry of the value, see entry.expires.
+	expires int64
+}
+
+// dead reports whether the record deletes its key or its value has expired.
+func (pos recordPos) dead(now time.Time) bool {
+	return pos.tombstone || (pos.expires != 0 && now.UnixNano() >= pos.expires)
+}
+
+type hashIndex map[string]recordPos
+
+// segmentID orders segment files. Plain segments written by the writer have
+// gen == 0; merge outputs take the seq of the newest merged segment, a unique
+// merge generation and a part number, so they sort right after their inputs
+// and before any segment created later.
+type segmentID struct {
+	seq, gen, part int
+}
+
+func (id segmentID) merged() bool {
+	return id.gen > 0
+}
+
+func (id segmentID) less(other segmentID) bool {
+	if id.seq != other.seq {
+		return id.seq < other.seq
+	}
+	if id.gen != other.gen {
+		return id.gen < other.gen
+	}
+	return id.part < other.part
+}
+
+func (id segmentID) run() string {
+	if !id.merged() {
+		return strconv.Itoa(id.seq)
+	}
+	return fmt.Sprintf("%d.%d", id.seq, id.gen)
+}
+
+func (id segmentID) fileName() string {
+	if !id.merged() {
+		return fmt.Sprintf("%s%d", outFileName, id.seq)
+	}
+	return fmt.Sprintf("%s%d.%d.%d", outFileName, id.seq, id.gen, id.part)
+}
+
+func parseSegmentName(name string) (segmentID, bool) {
+	rest, ok := strings.CutPrefix(name, outFileName)
+	if !ok {
+		return segmentID{}, false
+	}
+	parts := strings.Split(rest, ".")
+	if len(parts) != 1 && len(parts) != 3 {
+		return segmentID{}, false
+	}
+	nums := make([]int, 3)
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return segmentID{}, false
+		}
+		nums[i] = n
+	}
+	id := segmentID{seq: nums[0], gen: nums[1], part: nums[2]}
+	if len(parts) == 3 && id.gen == 0 {
+		return segmentID{}, false
+	}
+	return id, true
+}
+
+func listSegments(fs vfs.FS, dir string) ([]segmentID, error) {
+	names, err := fs.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []segmentID
+	for _, name := range names {
+		if id, ok := parseSegmentName(name); ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i].less(ids[j]) })
+	return ids, nil
+}
+
+type FileSegment struct {
+	fs      vfs.FS
+	id      segmentID
+	index   hashIndex
+	blobs   map[string]struct{}
+	outPath string
+	size    int64
+	mutex   sync.RWMutex
+	// maxTimestamp is the newest timestamp of the records in the segment.
+	maxTimestamp uint64
+}
+
+func newFileSegment(fs vfs.FS, dir string, id segmentID) *FileSegment {
+	return &FileSegment{
+		fs:      fs,
+		id:      id,
+		outPath: filepath.Join(dir, id.fileName()),
+		index:   make(hashIndex),
+		blobs:   make(map[string]struct{}),
+	}
+}
+
+// put indexes a record written at pos. The blobs of shadowed records stay
+// referenced until the segment is merged away.
+func (s *FileSegment) put(e *entry, pos recordPos) {
+	pos.tombstone = e.flags&flagTombstone != 0
+	pos.expires = e.expires
+	s.index[e.key] = pos
+	s.maxTimestamp = max(s.maxTimestamp, e.timestamp)
+	if e.flags&flagBlob != 0 {
+		if ref, err := recordBlobRef(e); err == nil {
+			s.blobs[ref.name] = struct{}{}
+		}
+	}
+}
+
+// load rebuilds the segment index from disk. A torn record at the end of the
+// file, left by a crash in the middle of an append, is ignored and, with
+// repair set, truncated away. The number of bytes past the last whole record
+// is returned.
+func (s *FileSegment) load(repair bool) (int64, error) {
+	f, err := vfs.Open(s.fs, s.outPath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	reader := bufio.NewReader(f)
+	var offset int64
+	for {
+		var record entry
+		n, err := record.DecodeFromReader(reader)
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				break
+			}
+			if errors.Is(err, ErrChecksumMismatch) {
+				return 0, &ChecksumError{Segment: s.id.fileName(), Offset: offset}
+			}
+			return 0, fmt.Errorf("segment %s at offset %d: %w", s.id.fileName(), offset, err)
+		}
+
+		s.put(&record, recordPos{offset: offset, size: int64(n)})
+		offset += int64(n)
+	}
+
+	if repair && offset < info.Size() {
+		if err := s.fs.Truncate(s.outPath, offset); err != nil {
+			return 0, err
+		}
+	}
+	s.size = offset
+	return info.Size() - offset, nil
+}
+
+func (s *FileSegment) readRecord(f vfs.File, pos recordPos) (entry, error) {
+	buf := make([]byte, pos.size)
+	if _, err := f.ReadAt(buf, pos.offset); err != nil {
+		return entry{}, err
+	}
+	record, err := decodeRecord(buf)
+	if err != nil {
+		return record, &ChecksumError{Segment: s.id.fileName(), Offset: pos.offset}
+	}
+	return record, nil
+}
+
+func (s *FileSegment) getRecord(pos recordPos) (entry, error) {
+	f, err := vfs.Open(s.fs, s.outPath)
+	if err != nil {
+		return entry{}, err
+	}
+	defer f.Close()
+
+	return s.readRecord(f, pos)
+}
@@ -0,0 +1,114 @@
+package datastore
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type SegmentStats struct {
+	Name      string
+	Bytes     int64
+	LiveBytes int64
+}
+
+type Stats struct {
+	Segments         []SegmentStats
+	LiveBytes        int64
+	DeadBytes        int64
+	Keys             int
+	Merges           uint64
+	MergeDuration    time.Duration
+	LastMergeTime    time.Duration
+	LastMergeError   error
+	WriteQueueDepth  int
+	ChecksumFailures uint64
+	// ValueBytes and StoredValueBytes count the values written to segments
+	// since Open before and after compression; CompressionRatio is their
+	// quotient.
+	ValueBytes       uint64
+	StoredValueBytes uint64
+	CompressionRatio float64
+	// Scrubs counts the scrubber passes, ScrubbedBytes what they read and
+	// ScrubCorruptions the damaged records they found.
+	Scrubs           uint64
+	ScrubbedBytes    uint64
+	ScrubCorruptions uint64
+}
+
+type dbMetrics struct {
+	checksumFailures atomic.Uint64
+	valueBytes       atomic.Uint64
+	storedValueBytes atomic.Uint64
+	scrubs           atomic.Uint64
+	scrubbedBytes    atomic.Uint64
+	scrubCorruptions atomic.Uint64
+
+	mutex          sync.Mutex
+	merges         uint64
+	mergeDuration  time.Duration
+	lastMergeTime  time.Duration
+	lastMergeError error
+}
+
+func (m *dbMetrics) mergeDone(elapsed time.Duration, err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.merges++
+	m.mergeDuration += elapsed
+	m.lastMergeTime = elapsed
+	m.lastMergeError = err
+}
+
+func (m *dbMetrics) scrubDone(info ScrubInfo) {
+	m.scrubs.Add(1)
+	m.scrubbedBytes.Add(uint64(info.Bytes))
+	m.scrubCorruptions.Add(uint64(info.Corrupt))
+}
+
+// Stats returns a snapshot of the store layout and counters. Live bytes are
+// the records still reachable through the index; everything else in the
+// segment files is garbage waiting for compaction.
+func (db *Db) Stats() Stats {
+	db.segmentsMutex.RLock()
+	live, keys := db.liveBytes()
+	segments := make([]SegmentStats, len(db.segments))
+	var stats Stats
+	for i, seg := range db.segments {
+		seg.mutex.RLock()
+		size := seg.size
+		seg.mutex.RUnlock()
+
+		segments[i] = SegmentStats{
+			Name:      seg.id.fileName(),
+			Bytes:     size,
+			LiveBytes: live[seg],
+		}
+		stats.LiveBytes += live[seg]
+		stats.DeadBytes += size - live[seg]
+	}
+	db.segmentsMutex.RUnlock()
+
+	stats.Segments = segments
+	stats.Keys = keys
+	stats.WriteQueueDepth = len(db.writeCh)
+	stats.ChecksumFailures = db.metrics.checksumFailures.Load()
+	stats.Scrubs = db.metrics.scrubs.Load()
+	stats.ScrubbedBytes = db.metrics.scrubbedBytes.Load()
+	stats.ScrubCorruptions = db.metrics.scrubCorruptions.Load()
+	stats.ValueBytes = db.metrics.valueBytes.Load()
+	stats.StoredValueBytes = db.metrics.storedValueBytes.Load()
+	stats.CompressionRatio = 1
+	if stats.StoredValueBytes > 0 {
+		stats.CompressionRatio = float64(stats.ValueBytes) / float64(stats.StoredValueBytes)
+	}
+
+	db.metrics.mutex.Lock()
+	stats.Merges = db.metrics.merges
+	stats.MergeDuration = db.metrics.mergeDuration
+	stats.LastMergeTime = db.metrics.lastMergeTime
+	stats.LastMergeError = db.metrics.lastMergeError
+	db.metrics.mutex.Unlock()
+
+	return stats
+}
@@ -0,0 +1,61 @@
+package datastore
+
+import "testing"
+
+func TestStats(t *testing.T) {
+	db, err := Open(t.TempDir(), 60, WithCompactionPolicy(MergeAllPolicy{MinSegments: 100}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, key := range []string{"k1", "k2", "k1", "k3"} {
+		if err := db.Put(key, "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats := db.Stats()
+	if stats.Keys != 3 {
+		t.Errorf("Expected 3 keys, got %d", stats.Keys)
+	}
+	if len(stats.Segments) != 2 {
+		t.Errorf("Expected 2 segments, got %d", len(stats.Segments))
+	}
+
+	var total int64
+	for _, seg := range stats.Segments {
+		total += seg.Bytes
+	}
+	if stats.LiveBytes+stats.DeadBytes != total {
+		t.Errorf("Live %d and dead %d bytes do not add up to %d", stats.LiveBytes, stats.DeadBytes, total)
+	}
+	record := int64(len((&entry{key: "k1", value: "value"}).Encode()))
+	if stats.DeadBytes != record {
+		t.Errorf("Expected one overwritten record of %d dead bytes, got %d", record, stats.DeadBytes)
+	}
+	if stats.Merges != 0 || stats.LastMergeError != nil {
+		t.Errorf("Expected no merges, got %d (%v)", stats.Merges, stats.LastMergeError)
+	}
+}
+
+func TestStatsKeysAfterDelete(t *testing.T) {
+	db, err := Open(t.TempDir(), 60, WithCompactionPolicy(MergeAllPolicy{MinSegments: 100}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, key := range []string{"k1", "k2", "k3"} {
+		if err := db.Put(key, "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete("k2"); err != nil {
+		t.Fatal(err)
+	}
+
+	if keys := db.Stats().Keys; keys != 2 {
+		t.Errorf("Expected 2 keys after deleting one of 3, got %d", keys)
+	}
+}
@@ -0,0 +1,91 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrStale is returned by PutAt when the stored value is as new as the one
+// being written or newer.
+var ErrStale = errors.New("a newer value is stored")
+
+// WithTimestamps makes the writer stamp every record with the time it was
+// written, in nanoseconds and increasing with every write. Replicas compare
+// the timestamps to tell which of two values of a key is the newer one.
+func WithTimestamps() Option {
+	return func(o *options) {
+		o.timestamps = true
+	}
+}
+
+// Timestamp returns the timestamp the value of key was written with, or it
+// was deleted with while the tombstone is kept. It is 0 for records written
+// without WithTimestamps.
+func (db *Db) Timestamp(key string) (uint64, error) {
+	if db.isClosed() {
+		return 0, ErrClosed
+	}
+	db.segmentsMutex.RLock()
+	defer db.segmentsMutex.RUnlock()
+
+	_, _, stored, err := db.newest(key)
+	var checksumErr *ChecksumError
+	if errors.As(err, &checksumErr) {
+		db.checksumMismatch(checksumErr, key)
+		return 0, db.unreadable(err)
+	}
+	return stored.timestamp, err
+}
+
+// PutAt stores the value read from r with the given timestamp, taken from
+// another replica, unless the stored value has the same timestamp or a
+// newer one; then it returns ErrStale. Later writes are stamped after it.
+func (db *Db) PutAt(ctx context.Context, key string, r io.Reader, timestamp uint64) error {
+	return db.putReader(ctx, key, r, WriteOptions{Timestamp: timestamp})
+}
+
+// prepare runs in the writer before a record is appended. Records that
+// carry a timestamp are only written if they are newer than the stored
+// value, the others are stamped. A delete without a timestamp needs a value
+// to delete.
+func (db *Db) prepare(e *entry) error {
+	if e.cond != nil {
+		if err := db.check(e); err != nil {
+			return err
+		}
+	}
+	if e.timestamp == 0 {
+		if e.flags&flagTombstone != 0 {
+			db.segmentsMutex.RLock()
+			_, _, stored, err := db.newest(e.key)
+			db.segmentsMutex.RUnlock()
+			if err == nil && stored.flags&flagTombstone != 0 {
+				err = ErrNotFound
+			}
+			if err != nil && !errors.Is(err, ErrChecksumMismatch) {
+				return err
+			}
+		}
+		if db.opts.timestamps {
+			db.lastTimestamp = max(uint64(time.Now().UnixNano()), db.lastTimestamp+1)
+			e.timestamp = db.lastTimestamp
+		}
+		return nil
+	}
+
+	db.segmentsMutex.RLock()
+	_, _, stored, err := db.newest(e.key)
+	db.segmentsMutex.RUnlock()
+	switch {
+	case errors.Is(err, ErrNotFound), errors.Is(err, ErrChecksumMismatch):
+		// A damaged value is as good as a missing one.
+	case err != nil:
+		return err
+	case stored.timestamp >= e.timestamp:
+		return ErrStale
+	}
+	db.lastTimestamp = max(db.lastTimestamp, e.timestamp)
+	return nil
+}
@@ -0,0 +1,98 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/dk872/architecture-lab5/datastore/vfs"
+)
+
+func TestTimestamps(t *testing.T) {
+	fs := vfs.NewMem()
+	db, err := Open("/data", 256, WithFS(fs), WithTimestamps())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var last uint64
+	for _, key := range []string{"a", "b", "a"} {
+		if err := db.Put(key, "value"); err != nil {
+			t.Fatal(err)
+		}
+		ts, err := db.Timestamp(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ts <= last {
+			t.Errorf("Timestamp of %s is %d, after %d", key, ts, last)
+		}
+		last = ts
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Timestamps keep growing after a reopen.
+	db, err = Open("/data", 256, WithFS(fs), WithTimestamps())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if ts, err := db.Timestamp("a"); err != nil || ts != last {
+		t.Errorf("Timestamp after reopen is %d, %v, wanted %d", ts, err, last)
+	}
+	if ts, err := db.Timestamp("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Timestamp of a missing key is %d, %v", ts, err)
+	}
+	if db.lastTimestamp != last {
+		t.Errorf("Recovered the last timestamp %d, wanted %d", db.lastTimestamp, last)
+	}
+}
+
+func TestPutAt(t *testing.T) {
+	db, err := Open("/data", 256, WithFS(vfs.NewMem()), WithTimestamps(), WithBlobThreshold(64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	ctx := context.Background()
+
+	if err := db.PutAt(ctx, "key", strings.NewReader("first"), 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutAt(ctx, "key", strings.NewReader("older"), 50); !errors.Is(err, ErrStale) {
+		t.Errorf("Writing an older value returned %v", err)
+	}
+	if err := db.PutAt(ctx, "key", strings.NewReader("same"), 100); !errors.Is(err, ErrStale) {
+		t.Errorf("Writing a value with the same timestamp returned %v", err)
+	}
+	if value, _ := db.Get("key"); value != "first" {
+		t.Errorf("Got %q after stale writes", value)
+	}
+
+	// Values in blob files follow the same rule.
+	large := strings.Repeat("x", 200)
+	if err := db.PutAt(ctx, "key", strings.NewReader(large), 200); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutAt(ctx, "key", strings.NewReader(large+"y"), 150); !errors.Is(err, ErrStale) {
+		t.Errorf("Writing an older blob returned %v", err)
+	}
+	if value, _ := db.Get("key"); value != large {
+		t.Errorf("Got a %d byte value, wanted the newer blob", len(value))
+	}
+
+	// A write from a replica whose clock is ahead moves the local clock.
+	future := uint64(1) << 62
+	if err := db.PutAt(ctx, "future", strings.NewReader("value"), future); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key", "local"); err != nil {
+		t.Fatal(err)
+	}
+	if ts, _ := db.Timestamp("key"); ts <= future {
+		t.Errorf("A local write was stamped %d, before %d", ts, future)
+	}
+}
@@ -0,0 +1,271 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var ErrInjected = errors.New("vfs: injected fault")
+
+// FaultFS wraps another FS and injects failures on demand. It also tracks how
+// much of every file it wrote has been synced, so DropUnsynced can emulate a
+// power loss for append-only files.
+type FaultFS struct {
+	fs FS
+
+	mutex       sync.Mutex
+	budget      int64
+	crashed     bool
+	failWrites  bool
+	failReads   bool
+	failCreates bool
+	shortWrites bool
+	synced      map[string]int64
+}
+
+func NewFault(fs FS) *FaultFS {
+	return &FaultFS{fs: fs, budget: -1, synced: make(map[string]int64)}
+}
+
+// CrashAfter lets n more bytes reach the files. The write crossing the limit
+// is cut short, and from then on every write, sync, create, truncate and
+// remove fails with ErrInjected, as if the process died mid-write.
+func (f *FaultFS) CrashAfter(n int64) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.budget = n
+	f.crashed = n == 0
+}
+
+// Crashed reports whether a CrashAfter limit was hit.
+func (f *FaultFS) Crashed() bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.crashed
+}
+
+// FailWrites makes writes fail with ErrInjected without writing anything.
+func (f *FaultFS) FailWrites(fail bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.failWrites = fail
+}
+
+// FailReads makes reads fail with ErrInjected.
+func (f *FaultFS) FailReads(fail bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.failReads = fail
+}
+
+// FailCreates makes opening a file with os.O_CREATE fail with ErrInjected.
+func (f *FaultFS) FailCreates(fail bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.failCreates = fail
+}
+
+// ShortWrites makes writes store only the first half of the buffer and report
+// io.ErrShortWrite.
+func (f *FaultFS) ShortWrites(short bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.shortWrites = short
+}
+
+// Reset clears every injected fault. Sync tracking is kept.
+func (f *FaultFS) Reset() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.budget = -1
+	f.crashed = false
+	f.failWrites = false
+	f.failReads = false
+	f.failCreates = false
+	f.shortWrites = false
+}
+
+// DropUnsynced truncates every file written through f back to the size it had
+// when it was last synced, or opened if it was never synced.
+func (f *FaultFS) DropUnsynced() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for name, size := range f.synced {
+		file, err := Open(f.fs, name)
+		if err != nil {
+			delete(f.synced, name)
+			continue
+		}
+		info, err := file.Stat()
+		file.Close()
+		if err != nil {
+			return err
+		}
+		if info.Size() > size {
+			if err := f.fs.Truncate(name, size); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Corrupt flips every bit of the byte at offset in the named file.
+func (f *FaultFS) Corrupt(name string, offset int64) error {
+	file, err := f.fs.OpenFile(filepath.Clean(name), os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer, ok := file.(io.WriterAt)
+	if !ok {
+		return errors.New("vfs: file does not support WriteAt")
+	}
+	b := make([]byte, 1)
+	if _, err := file.ReadAt(b, offset); err != nil {
+		return err
+	}
+	b[0] ^= 0xff
+	_, err = writer.WriteAt(b, offset)
+	return err
+}
+
+func (f *FaultFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	name = filepath.Clean(name)
+	writable := flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) != 0
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if (writable && f.crashed) || (flag&os.O_CREATE != 0 && f.failCreates) {
+		return nil, ErrInjected
+	}
+
+	file, err := f.fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	if writable {
+		_, tracked := f.synced[name]
+		switch {
+		case flag&os.O_TRUNC != 0:
+			f.synced[name] = 0
+		case !tracked:
+			info, err := file.Stat()
+			if err != nil {
+				file.Close()
+				return nil, err
+			}
+			f.synced[name] = info.Size()
+		}
+	}
+	return &faultFile{File: file, fs: f, name: name}, nil
+}
+
+func (f *FaultFS) Remove(name string) error {
+	name = filepath.Clean(name)
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.crashed {
+		return ErrInjected
+	}
+	delete(f.synced, name)
+	return f.fs.Remove(name)
+}
+
+func (f *FaultFS) Truncate(name string, size int64) error {
+	name = filepath.Clean(name)
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.crashed {
+		return ErrInjected
+	}
+	if synced, ok := f.synced[name]; ok && synced > size {
+		f.synced[name] = size
+	}
+	return f.fs.Truncate(name, size)
+}
+
+func (f *FaultFS) ReadDir(dir string) ([]string, error) {
+	return f.fs.ReadDir(dir)
+}
+
+func (f *FaultFS) Lock(name string, exclusive bool) (io.Closer, error) {
+	return f.fs.Lock(name, exclusive)
+}
+
+type faultFile struct {
+	File
+	fs   *FaultFS
+	name string
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+
+	switch {
+	case f.fs.crashed || f.fs.failWrites:
+		return 0, ErrInjected
+	case f.fs.budget >= 0 && int64(len(p)) > f.fs.budget:
+		n, _ := f.File.Write(p[:f.fs.budget])
+		f.fs.budget = 0
+		f.fs.crashed = true
+		return n, ErrInjected
+	case f.fs.shortWrites:
+		n, err := f.File.Write(p[:len(p)/2])
+		if err == nil {
+			err = io.ErrShortWrite
+		}
+		return n, err
+	}
+
+	n, err := f.File.Write(p)
+	if f.fs.budget >= 0 {
+		f.fs.budget -= int64(n)
+	}
+	return n, err
+}
+
+func (f *faultFile) Read(p []byte) (int, error) {
+	if f.fs.readsFail() {
+		return 0, ErrInjected
+	}
+	return f.File.Read(p)
+}
+
+func (f *faultFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.fs.readsFail() {
+		return 0, ErrInjected
+	}
+	return f.File.ReadAt(p, off)
+}
+
+func (f *FaultFS) readsFail() bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.failReads
+}
+
+func (f *faultFile) Sync() error {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+	if f.fs.crashed {
+		return ErrInjected
+	}
+	if err := f.File.Sync(); err != nil {
+		return err
+	}
+	info, err := f.File.Stat()
+	if err != nil {
+		return err
+	}
+	f.fs.synced[f.name] = info.Size()
+	return nil
+}
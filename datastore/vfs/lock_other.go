@@ -0,0 +1,26 @@
+//go:build !unix
+
+package vfs
+
+import (
+	"io"
+	"os"
+)
+
+type fileLock struct {
+	f *os.File
+}
+
+func (l fileLock) Close() error {
+	return l.f.Close()
+}
+
+// Lock only opens the lock file on platforms without flock; it does not
+// keep other processes out.
+func (osFS) Lock(name string, exclusive bool) (io.Closer, error) {
+	f, err := openLockFile(name, exclusive)
+	if err != nil || f == nil {
+		return noLock{}, err
+	}
+	return fileLock{f: f}, nil
+}
@@ -0,0 +1,42 @@
+//go:build unix
+
+package vfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+)
+
+type fileLock struct {
+	f *os.File
+}
+
+func (l fileLock) Close() error {
+	err := syscall.Flock(int(l.f.Fd()), syscall.LOCK_UN)
+	if closeErr := l.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (osFS) Lock(name string, exclusive bool) (io.Closer, error) {
+	f, err := openLockFile(name, exclusive)
+	if err != nil || f == nil {
+		return noLock{}, err
+	}
+
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	if err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, ErrLocked
+		}
+		return nil, err
+	}
+	return fileLock{f: f}, nil
+}
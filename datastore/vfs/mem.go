@@ -0,0 +1,273 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemFS keeps files in memory. Directories are implicit: any path can hold
+// files. Removing a file leaves open handles usable, as on Unix.
+type MemFS struct {
+	mutex sync.Mutex
+	files map[string]*memData
+	locks map[string]*memLock
+}
+
+type memLock struct {
+	exclusive bool
+	holders   int
+}
+
+type memData struct {
+	mutex   sync.RWMutex
+	data    []byte
+	modTime time.Time
+}
+
+func NewMem() *MemFS {
+	return &MemFS{files: make(map[string]*memData), locks: make(map[string]*memLock)}
+}
+
+func (m *MemFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	name = filepath.Clean(name)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	d, ok := m.files[name]
+	switch {
+	case ok && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	case !ok:
+		d = &memData{modTime: time.Now()}
+		m.files[name] = d
+	}
+
+	if flag&os.O_TRUNC != 0 && flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		d.mutex.Lock()
+		d.data = nil
+		d.mutex.Unlock()
+	}
+
+	return &memFile{name: name, data: d, flag: flag}, nil
+}
+
+func (m *MemFS) Remove(name string) error {
+	name = filepath.Clean(name)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.files[name]; !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	delete(m.files, name)
+	return nil
+}
+
+func (m *MemFS) Truncate(name string, size int64) error {
+	name = filepath.Clean(name)
+
+	m.mutex.Lock()
+	d, ok := m.files[name]
+	m.mutex.Unlock()
+	if !ok {
+		return &fs.PathError{Op: "truncate", Path: name, Err: fs.ErrNotExist}
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if size < int64(len(d.data)) {
+		d.data = d.data[:size]
+	} else {
+		d.data = append(d.data, make([]byte, size-int64(len(d.data)))...)
+	}
+	return nil
+}
+
+func (m *MemFS) ReadDir(dir string) ([]string, error) {
+	dir = filepath.Clean(dir)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var names []string
+	for name := range m.files {
+		if filepath.Dir(name) == dir {
+			names = append(names, filepath.Base(name))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (m *MemFS) Lock(name string, exclusive bool) (io.Closer, error) {
+	name = filepath.Clean(name)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.files[name]; !ok && exclusive {
+		m.files[name] = &memData{modTime: time.Now()}
+	}
+	l, ok := m.locks[name]
+	if ok && (l.exclusive || exclusive) {
+		return nil, ErrLocked
+	}
+	if !ok {
+		l = &memLock{exclusive: exclusive}
+		m.locks[name] = l
+	}
+	l.holders++
+	return &memUnlocker{fs: m, name: name}, nil
+}
+
+type memUnlocker struct {
+	fs   *MemFS
+	name string
+	once sync.Once
+}
+
+func (u *memUnlocker) Close() error {
+	u.once.Do(func() {
+		u.fs.mutex.Lock()
+		defer u.fs.mutex.Unlock()
+		if l := u.fs.locks[u.name]; l != nil {
+			l.holders--
+			if l.holders == 0 {
+				delete(u.fs.locks, u.name)
+			}
+		}
+	})
+	return nil
+}
+
+type memFile struct {
+	name   string
+	data   *memData
+	flag   int
+	pos    int64
+	closed bool
+}
+
+var errClosed = errors.New("file already closed")
+
+func (f *memFile) readable() bool {
+	return f.flag&os.O_WRONLY == 0
+}
+
+func (f *memFile) writable() bool {
+	return f.flag&(os.O_WRONLY|os.O_RDWR) != 0
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.pos)
+	f.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: errClosed}
+	}
+	if !f.readable() {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrPermission}
+	}
+
+	f.data.mutex.RLock()
+	defer f.data.mutex.RUnlock()
+	if off >= int64(len(f.data.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.data.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	if f.closed {
+		return 0, &fs.PathError{Op: "write", Path: f.name, Err: errClosed}
+	}
+	if !f.writable() {
+		return 0, &fs.PathError{Op: "write", Path: f.name, Err: fs.ErrPermission}
+	}
+
+	f.data.mutex.Lock()
+	defer f.data.mutex.Unlock()
+	if f.flag&os.O_APPEND != 0 {
+		f.pos = int64(len(f.data.data))
+	}
+	if gap := f.pos - int64(len(f.data.data)); gap > 0 {
+		f.data.data = append(f.data.data, make([]byte, gap)...)
+	}
+	end := f.pos + int64(len(p))
+	if end > int64(len(f.data.data)) {
+		f.data.data = append(f.data.data[:f.pos], p...)
+	} else {
+		copy(f.data.data[f.pos:], p)
+	}
+	f.pos = end
+	f.data.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	if f.flag&os.O_APPEND != 0 {
+		return 0, &fs.PathError{Op: "writeat", Path: f.name, Err: errors.New("file opened with O_APPEND")}
+	}
+	pos := f.pos
+	f.pos = off
+	n, err := f.Write(p)
+	f.pos = pos
+	return n, err
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	if f.closed {
+		return nil, &fs.PathError{Op: "stat", Path: f.name, Err: errClosed}
+	}
+	f.data.mutex.RLock()
+	defer f.data.mutex.RUnlock()
+	return memFileInfo{name: filepath.Base(f.name), size: int64(len(f.data.data)), modTime: f.data.modTime}, nil
+}
+
+func (f *memFile) Sync() error {
+	if f.closed {
+		return &fs.PathError{Op: "sync", Path: f.name, Err: errClosed}
+	}
+	return nil
+}
+
+func (f *memFile) Close() error {
+	if f.closed {
+		return &fs.PathError{Op: "close", Path: f.name, Err: errClosed}
+	}
+	f.closed = true
+	return nil
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (i memFileInfo) Name() string       { return i.name }
+func (i memFileInfo) Size() int64        { return i.size }
+func (i memFileInfo) Mode() os.FileMode  { return 0600 }
+func (i memFileInfo) ModTime() time.Time { return i.modTime }
+func (i memFileInfo) IsDir() bool        { return false }
+func (i memFileInfo) Sys() any           { return nil }
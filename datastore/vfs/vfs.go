@@ -0,0 +1,90 @@
+// Package vfs abstracts the file system operations of the datastore so that it
+// can run on top of the OS, in memory, or with injected faults.
+package vfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sort"
+)
+
+var ErrLocked = errors.New("vfs: file is locked")
+
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.Closer
+	Stat() (os.FileInfo, error)
+	Sync() error
+}
+
+type FS interface {
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Remove(name string) error
+	Truncate(name string, size int64) error
+	// ReadDir returns the sorted names of the regular files in dir.
+	ReadDir(dir string) ([]string, error)
+	// Lock takes an advisory lock on the named file. An exclusive lock
+	// creates the file if needed; a shared one only reads it, so that a
+	// read-only directory can be locked, and holds nothing when the file
+	// does not exist, as no writer has locked it yet. Any number of shared
+	// locks may be held at once, but an exclusive lock excludes every other
+	// lock. Lock does not wait: a conflicting lock fails with ErrLocked.
+	Lock(name string, exclusive bool) (io.Closer, error)
+}
+
+// noLock is the shared lock of a lock file that does not exist.
+type noLock struct{}
+
+func (noLock) Close() error { return nil }
+
+// openLockFile opens the named lock file for an exclusive or a shared
+// lock. It returns a nil file when a shared lock finds none.
+func openLockFile(name string, exclusive bool) (*os.File, error) {
+	if exclusive {
+		return os.OpenFile(name, os.O_CREATE|os.O_RDWR, 0600)
+	}
+	f, err := os.Open(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return f, err
+}
+
+func Open(fs FS, name string) (File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// OS is the FS backed by the operating system.
+var OS FS = osFS{}
+
+type osFS struct{}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	return os.OpenFile(name, flag, perm)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) Truncate(name string, size int64) error {
+	return os.Truncate(name, size)
+}
+
+func (osFS) ReadDir(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if e.Type().IsRegular() {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
@@ -0,0 +1,259 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func readAll(t *testing.T, fs FS, name string) string {
+	t.Helper()
+	f, err := Open(fs, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestFileSystems(t *testing.T) {
+	for name, tc := range map[string]struct {
+		fs  FS
+		dir string
+	}{
+		"os":    {fs: OS, dir: t.TempDir()},
+		"mem":   {fs: NewMem(), dir: "/data"},
+		"fault": {fs: NewFault(NewMem()), dir: "/data"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			fs, path := tc.fs, filepath.Join(tc.dir, "file")
+
+			if _, err := Open(fs, path); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("Expected ErrNotExist, got %v", err)
+			}
+
+			f, err := fs.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, chunk := range []string{"hello", " ", "world"} {
+				if _, err := f.Write([]byte(chunk)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := f.Sync(); err != nil {
+				t.Fatal(err)
+			}
+
+			buf := make([]byte, 5)
+			if _, err := f.ReadAt(buf, 6); err != nil || string(buf) != "world" {
+				t.Errorf("ReadAt = %q, %v", buf, err)
+			}
+			if info, err := f.Stat(); err != nil || info.Size() != 11 {
+				t.Errorf("Stat = %v, %v", info, err)
+			}
+			f.Close()
+
+			if err := fs.Truncate(path, 5); err != nil {
+				t.Fatal(err)
+			}
+			if got := readAll(t, fs, path); got != "hello" {
+				t.Errorf("Expected truncated content, got %q", got)
+			}
+
+			other, err := fs.OpenFile(filepath.Join(tc.dir, "other"), os.O_CREATE|os.O_WRONLY, 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			other.Close()
+			names, err := fs.ReadDir(tc.dir)
+			if err != nil || !reflect.DeepEqual(names, []string{"file", "other"}) {
+				t.Errorf("ReadDir = %v, %v", names, err)
+			}
+
+			if err := fs.Remove(path); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := Open(fs, path); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("Expected removed file to be gone, got %v", err)
+			}
+		})
+	}
+}
+
+func TestFaultCrashAfter(t *testing.T) {
+	fs := NewFault(NewMem())
+	f, err := fs.OpenFile("/f", os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs.CrashAfter(7)
+	if _, err := f.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	n, err := f.Write([]byte("world"))
+	if n != 2 || !errors.Is(err, ErrInjected) {
+		t.Errorf("Expected a short write of 2 bytes, got %d, %v", n, err)
+	}
+	if !fs.Crashed() {
+		t.Error("Expected the file system to be crashed")
+	}
+	if _, err := f.Write([]byte("!")); !errors.Is(err, ErrInjected) {
+		t.Errorf("Expected writes after the crash to fail, got %v", err)
+	}
+	if _, err := fs.OpenFile("/g", os.O_CREATE|os.O_WRONLY, 0600); !errors.Is(err, ErrInjected) {
+		t.Errorf("Expected creates after the crash to fail, got %v", err)
+	}
+	if got := readAll(t, fs, "/f"); got != "hellowo" {
+		t.Errorf("Expected the bytes before the crash to persist, got %q", got)
+	}
+
+	fs.Reset()
+	if _, err := f.Write([]byte("!")); err != nil {
+		t.Errorf("Expected writes to work after Reset, got %v", err)
+	}
+}
+
+func TestFaultDropUnsynced(t *testing.T) {
+	fs := NewFault(NewMem())
+	f, err := fs.OpenFile("/f", os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("durable"))
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte(" lost"))
+
+	g, err := fs.OpenFile("/g", os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.Write([]byte("never synced"))
+
+	if err := fs.DropUnsynced(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, fs, "/f"); got != "durable" {
+		t.Errorf("Expected only synced data, got %q", got)
+	}
+	if got := readAll(t, fs, "/g"); got != "" {
+		t.Errorf("Expected an empty file, got %q", got)
+	}
+}
+
+func TestFaultWritesAndCorruption(t *testing.T) {
+	fs := NewFault(NewMem())
+	f, err := fs.OpenFile("/f", os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs.FailWrites(true)
+	if n, err := f.Write([]byte("abcd")); n != 0 || !errors.Is(err, ErrInjected) {
+		t.Errorf("Expected a failed write, got %d, %v", n, err)
+	}
+	fs.FailWrites(false)
+
+	fs.ShortWrites(true)
+	if n, err := f.Write([]byte("abcd")); n != 2 || !errors.Is(err, io.ErrShortWrite) {
+		t.Errorf("Expected a short write, got %d, %v", n, err)
+	}
+	fs.ShortWrites(false)
+
+	if err := fs.Corrupt("/f", 1); err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, fs, "/f"); got[1] != 'b'^0xff {
+		t.Errorf("Expected the second byte to be flipped, got %q", got)
+	}
+
+	r, err := Open(fs, "/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	fs.FailReads(true)
+	if n, err := r.ReadAt(make([]byte, 2), 0); n != 0 || !errors.Is(err, ErrInjected) {
+		t.Errorf("Expected a failed read, got %d, %v", n, err)
+	}
+	fs.FailReads(false)
+	if _, err := r.ReadAt(make([]byte, 2), 0); err != nil {
+		t.Errorf("Expected reads to work again, got %v", err)
+	}
+
+	fs.FailCreates(true)
+	if _, err := fs.OpenFile("/g", os.O_CREATE|os.O_WRONLY, 0600); !errors.Is(err, ErrInjected) {
+		t.Errorf("Expected a failed create, got %v", err)
+	}
+	if _, err := Open(fs, "/f"); err != nil {
+		t.Errorf("Expected opening an existing file to work, got %v", err)
+	}
+	fs.FailCreates(false)
+}
+
+func TestLock(t *testing.T) {
+	for name, tc := range map[string]struct {
+		fs  FS
+		dir string
+	}{
+		"os":  {fs: OS, dir: t.TempDir()},
+		"mem": {fs: NewMem(), dir: "/data"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(tc.dir, "LOCK")
+
+			none, err := tc.fs.Lock(path, false)
+			if err != nil {
+				t.Fatalf("Expected a shared lock without a lock file, got %v", err)
+			}
+			none.Close()
+			if _, err := Open(tc.fs, path); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("Expected a shared lock not to create the file, got %v", err)
+			}
+			created, err := tc.fs.Lock(path, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			created.Close()
+
+			shared1, err := tc.fs.Lock(path, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			shared2, err := tc.fs.Lock(path, false)
+			if err != nil {
+				t.Fatalf("Expected shared locks to coexist, got %v", err)
+			}
+			if _, err := tc.fs.Lock(path, true); !errors.Is(err, ErrLocked) {
+				t.Errorf("Expected ErrLocked while shared locks are held, got %v", err)
+			}
+			shared1.Close()
+			shared2.Close()
+
+			exclusive, err := tc.fs.Lock(path, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tc.fs.Lock(path, false); !errors.Is(err, ErrLocked) {
+				t.Errorf("Expected ErrLocked while an exclusive lock is held, got %v", err)
+			}
+			exclusive.Close()
+
+			again, err := tc.fs.Lock(path, true)
+			if err != nil {
+				t.Fatalf("Expected the lock to be free after Close, got %v", err)
+			}
+			again.Close()
+		})
+	}
+}
@@ -0,0 +1,261 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrWatchOverflow ends a watch whose consumer fell too far behind the
+// writer.
+var ErrWatchOverflow = errors.New("watcher fell behind")
+
+// watchBuffer is how many changes may wait for a watcher before it is
+// dropped with ErrWatchOverflow.
+const watchBuffer = 1024
+
+type Op byte
+
+const (
+	OpPut Op = iota + 1
+	OpDelete
+)
+
+func (op Op) String() string {
+	switch op {
+	case OpPut:
+		return "put"
+	case OpDelete:
+		return "delete"
+	default:
+		return fmt.Sprintf("Op(%d)", byte(op))
+	}
+}
+
+// ChangeEvent describes one write. Values kept in blob files are not carried
+// along: Value is empty and Blob is set, GetReader returns them. Deletes
+// carry no value either.
+type ChangeEvent struct {
+	Op    Op
+	Key   string
+	Value string
+	Blob  bool
+	// Version is the position of the record in the log.
+	Version Position
+	// Timestamp is the one the value was written with, see WithTimestamps.
+	Timestamp uint64
+	// Expires is when the value expires, zero for never.
+	Expires time.Time
+	// Flags are the client flags, see WriteOptions.Flags.
+	Flags uint32
+}
+
+type storedChange struct {
+	record entry
+	pos    Position
+}
+
+// Watcher delivers the changes of the keys with a prefix on C, in write
+// order. C is closed when the watch ends; Err tells why.
+type Watcher struct {
+	C <-chan ChangeEvent
+
+	db     *Db
+	prefix string
+	from   Position
+	in     chan storedChange
+	out    chan ChangeEvent
+	stopCh chan struct{}
+
+	mutex   sync.Mutex
+	err     error
+	stopped bool
+}
+
+// Watch follows the writes of keys starting with prefix from now on.
+func (db *Db) Watch(prefix string) (*Watcher, error) {
+	return db.watch(prefix, Position{}, false)
+}
+
+// WatchFrom first replays the writes logged at or after from, then follows
+// new ones like Watch. Pass the Version of the last change handled to
+// resume a watch; that change is delivered again. It fails with
+// ErrCompacted once the log at from has been merged away.
+func (db *Db) WatchFrom(prefix string, from Position) (*Watcher, error) {
+	return db.watch(prefix, from, true)
+}
+
+func (db *Db) watch(prefix string, from Position, replay bool) (*Watcher, error) {
+	out := make(chan ChangeEvent)
+	w := &Watcher{
+		C:      out,
+		db:     db,
+		prefix: prefix,
+		from:   from,
+		in:     make(chan storedChange, watchBuffer),
+		out:    out,
+		stopCh: make(chan struct{}),
+	}
+
+	db.watchMutex.Lock()
+	if db.watchers == nil {
+		db.watchMutex.Unlock()
+		return nil, ErrClosed
+	}
+	db.watchers[w] = struct{}{}
+	db.watchMutex.Unlock()
+
+	// The log is read only once w is registered, so every write is either
+	// replayed or delivered live, possibly both.
+	var log *LogIterator
+	if replay {
+		var err error
+		if log, err = db.Tail(from); err != nil {
+			db.unwatch(w, nil)
+			return nil, err
+		}
+	}
+
+	go w.run(log)
+	return w, nil
+}
+
+// Err returns why C was closed: nil after Close, ErrClosed when the Db was
+// closed, ErrWatchOverflow, or the error that stopped a replay.
+func (w *Watcher) Err() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.err
+}
+
+// Close ends the watch. Changes not yet received are dropped.
+func (w *Watcher) Close() {
+	w.db.unwatch(w, nil)
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if !w.stopped {
+		w.stopped = true
+		close(w.stopCh)
+	}
+}
+
+func (w *Watcher) fail(err error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.err == nil {
+		w.err = err
+	}
+}
+
+func (w *Watcher) run(log *LogIterator) {
+	defer close(w.out)
+
+	next := w.from
+	deliver := func(change storedChange) bool {
+		if change.pos.less(next) || !strings.HasPrefix(change.record.key, w.prefix) {
+			return true
+		}
+		event, err := w.db.changeEvent(change)
+		if err != nil {
+			w.fail(err)
+			w.db.unwatch(w, err)
+			return false
+		}
+		select {
+		case w.out <- event:
+		case <-w.stopCh:
+			return false
+		}
+		// Any later record starts at least a byte further.
+		next = Position{Segment: change.pos.Segment, Offset: change.pos.Offset + 1}
+		return true
+	}
+
+	if log != nil {
+		defer log.Close()
+		for log.next() {
+			if !deliver(log.change) {
+				return
+			}
+		}
+		if err := log.Err(); err != nil {
+			w.db.unwatch(w, err)
+			w.fail(err)
+			return
+		}
+	}
+
+	for change := range w.in {
+		if !deliver(change) {
+			return
+		}
+	}
+}
+
+// unwatch stops delivering writes to w; the changes already queued are still
+// delivered before C is closed.
+func (db *Db) unwatch(w *Watcher, err error) {
+	db.watchMutex.Lock()
+	defer db.watchMutex.Unlock()
+	if _, ok := db.watchers[w]; !ok {
+		return
+	}
+	delete(db.watchers, w)
+	if err != nil {
+		w.fail(err)
+	}
+	close(w.in)
+}
+
+// publish hands a record the writer has just appended to the watchers. It
+// never blocks: a watcher whose queue is full is dropped.
+func (db *Db) publish(record entry, pos Position) {
+	db.watchMutex.Lock()
+	defer db.watchMutex.Unlock()
+	for w := range db.watchers {
+		if !strings.HasPrefix(record.key, w.prefix) {
+			continue
+		}
+		select {
+		case w.in <- storedChange{record: record, pos: pos}:
+		default:
+			delete(db.watchers, w)
+			w.fail(ErrWatchOverflow)
+			close(w.in)
+		}
+	}
+}
+
+// closeWatchers ends every watch once the writer has stopped.
+func (db *Db) closeWatchers() {
+	db.watchMutex.Lock()
+	defer db.watchMutex.Unlock()
+	for w := range db.watchers {
+		w.fail(ErrClosed)
+		close(w.in)
+	}
+	db.watchers = nil
+}
+
+func (db *Db) changeEvent(change storedChange) (ChangeEvent, error) {
+	event := ChangeEvent{Op: OpPut, Key: change.record.key, Version: change.pos, Timestamp: change.record.timestamp, Flags: change.record.clientFlags}
+	if change.record.expires != 0 {
+		event.Expires = time.Unix(0, change.record.expires)
+	}
+	if change.record.flags&flagTombstone != 0 {
+		event.Op = OpDelete
+		return event, nil
+	}
+	if change.record.flags&flagBlob != 0 {
+		event.Blob = true
+		return event, nil
+	}
+	record, err := decrypt(db.opts.keys, change.record)
+	if err == nil {
+		record, err = decompress(record)
+	}
+	event.Value = record.value
+	return event, err
+}
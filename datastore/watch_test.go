@@ -0,0 +1,160 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dk872/architecture-lab5/datastore/vfs"
+)
+
+func nextChange(t *testing.T, w *Watcher) ChangeEvent {
+	t.Helper()
+	select {
+	case event, ok := <-w.C:
+		if !ok {
+			t.Fatalf("Watch ended early: %v", w.Err())
+		}
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for a change")
+	}
+	return ChangeEvent{}
+}
+
+func TestWatch(t *testing.T) {
+	db, err := Open("/data", 128, WithFS(vfs.NewMem()), WithCompression(Flate, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	w, err := db.Watch("user/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	long := strings.Repeat("compressed ", 10)
+	for i, key := range []string{"user/1", "other", "user/2", "user/1"} {
+		if err := db.Put(key, fmt.Sprintf("%s%d", long, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var versions []Position
+	for _, want := range []struct {
+		key   string
+		value string
+	}{{"user/1", long + "0"}, {"user/2", long + "2"}, {"user/1", long + "3"}} {
+		event := nextChange(t, w)
+		if event.Op != OpPut || event.Key != want.key || event.Value != want.value {
+			t.Errorf("Got %v %q = %q, wanted put %q = %q", event.Op, event.Key, event.Value, want.key, want.value)
+		}
+		versions = append(versions, event.Version)
+	}
+	for i := 1; i < len(versions); i++ {
+		if !versions[i-1].less(versions[i]) {
+			t.Errorf("Versions are not increasing: %v", versions)
+		}
+	}
+
+	w.Close()
+	if _, ok := <-w.C; ok {
+		t.Error("Expected C to be closed after Close")
+	}
+	if err := w.Err(); err != nil {
+		t.Errorf("Err() after Close = %v", err)
+	}
+}
+
+func TestWatchFrom(t *testing.T) {
+	db, err := Open("/data", 64, WithFS(vfs.NewMem()), WithCompactionPolicy(&switchPolicy{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	first, err := db.Watch("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var versions []Position
+	for i := 0; i < 10; i++ {
+		versions = append(versions, nextChange(t, first).Version)
+	}
+	first.Close()
+	if versions[9].Segment == 0 {
+		t.Fatal("Expected the writes to span several segments")
+	}
+
+	resumed, err := db.WatchFrom("", versions[4])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resumed.Close()
+	if err := db.Put("key10", "value10"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 4; i <= 10; i++ {
+		event := nextChange(t, resumed)
+		if event.Key != fmt.Sprintf("key%d", i) || event.Value != fmt.Sprintf("value%d", i) {
+			t.Errorf("Got %q = %q, wanted key%d", event.Key, event.Value, i)
+		}
+		if i < 10 && event.Version != versions[i] {
+			t.Errorf("Replayed key%d at %v, was written at %v", i, event.Version, versions[i])
+		}
+	}
+
+	db.opts.compactionPolicy.(*switchPolicy).enabled.Store(true)
+	db.scheduleCompaction()
+	db.mergeWg.Wait()
+	if _, err := db.WatchFrom("", versions[0]); !errors.Is(err, ErrCompacted) {
+		t.Errorf("WatchFrom a merged segment returned %v, wanted ErrCompacted", err)
+	}
+}
+
+func TestWatchEnds(t *testing.T) {
+	db, err := Open("/data", 1<<20, WithFS(vfs.NewMem()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	slow, err := db.Watch("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	idle, err := db.Watch("nothing/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < watchBuffer+10; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	received := 0
+	for range slow.C {
+		received++
+	}
+	if !errors.Is(slow.Err(), ErrWatchOverflow) || received == 0 {
+		t.Errorf("Slow watcher got %d changes and %v, wanted ErrWatchOverflow", received, slow.Err())
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-idle.C; ok || !errors.Is(idle.Err(), ErrClosed) {
+		t.Errorf("Watch after Close ended with %v, wanted ErrClosed", idle.Err())
+	}
+	if _, err := db.Watch(""); !errors.Is(err, ErrClosed) {
+		t.Errorf("Watch on a closed Db returned %v", err)
+	}
+}
@@ -0,0 +1,256 @@
+package dbclient
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/dk872/architecture-lab5/kvwire"
+)
+
+// ErrConnectionClosed is wrapped by the errors of the requests of a
+// BinaryClient whose connection was closed or failed.
+var ErrConnectionClosed = errors.New("binary connection is closed")
+
+// BinaryClient talks to the kvwire listener of cmd/db, -binaryPort, over a
+// single connection. Requests from any number of goroutines are pipelined
+// on it and matched to their responses by ID, so a slow request does not
+// hold up the others. A BinaryClient does not reconnect or retry: once the
+// connection fails every request returns ErrConnectionClosed.
+type BinaryClient struct {
+	conn net.Conn
+
+	writeMutex sync.Mutex
+	w          *bufio.Writer
+
+	mutex   sync.Mutex
+	nextID  uint32
+	pending map[uint32]chan kvwire.Frame
+	err     error
+}
+
+// DialBinary connects to the kvwire listener at addr, such as db:8085.
+func DialBinary(ctx context.Context, addr string) (*BinaryClient, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &BinaryClient{
+		conn:    conn,
+		w:       bufio.NewWriterSize(conn, 64<<10),
+		pending: make(map[uint32]chan kvwire.Frame),
+	}
+	go c.read()
+	return c, nil
+}
+
+// Close closes the connection, failing the requests still waiting.
+func (c *BinaryClient) Close() error {
+	c.fail(net.ErrClosed)
+	return nil
+}
+
+// read hands the responses to the requests waiting for them until the
+// connection fails.
+func (c *BinaryClient) read() {
+	r := bufio.NewReaderSize(c.conn, 64<<10)
+	for {
+		resp, err := kvwire.ReadFrame(r)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		c.mutex.Lock()
+		ch, ok := c.pending[resp.ID]
+		delete(c.pending, resp.ID)
+		c.mutex.Unlock()
+		// Requests that gave up waiting are no longer pending.
+		if ok {
+			ch <- resp
+		}
+	}
+}
+
+func (c *BinaryClient) fail(err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = fmt.Errorf("%w: %w", ErrConnectionClosed, err)
+	c.conn.Close()
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+}
+
+// do sends a request and waits for its response.
+func (c *BinaryClient) do(ctx context.Context, op kvwire.Op, body []byte) (kvwire.Frame, error) {
+	ch := make(chan kvwire.Frame, 1)
+	c.mutex.Lock()
+	if c.err != nil {
+		c.mutex.Unlock()
+		return kvwire.Frame{}, c.err
+	}
+	c.nextID++
+	id := c.nextID
+	c.pending[id] = ch
+	c.mutex.Unlock()
+
+	c.writeMutex.Lock()
+	err := kvwire.WriteFrame(c.w, kvwire.Frame{ID: id, Op: op, Body: body})
+	if err == nil {
+		err = c.w.Flush()
+	}
+	c.writeMutex.Unlock()
+	if errors.Is(err, kvwire.ErrFrameTooLarge) {
+		c.mutex.Lock()
+		delete(c.pending, id)
+		c.mutex.Unlock()
+		return kvwire.Frame{}, err
+	}
+	if err != nil {
+		c.fail(err)
+	}
+
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			c.mutex.Lock()
+			defer c.mutex.Unlock()
+			return kvwire.Frame{}, c.err
+		}
+		return resp, nil
+	case <-ctx.Done():
+		c.mutex.Lock()
+		delete(c.pending, id)
+		c.mutex.Unlock()
+		return kvwire.Frame{}, ctx.Err()
+	}
+}
+
+// statusErr returns nil for 200, ErrNotFound for 404 and a StatusError
+// for the other statuses.
+func statusErr(op kvwire.Op, key string, status uint16, message string) error {
+	switch status {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return ErrNotFound
+	default:
+		return &StatusError{Method: op.String(), Path: key, StatusCode: int(status), Message: message}
+	}
+}
+
+// Get returns the value of key, or ErrNotFound.
+func (c *BinaryClient) Get(ctx context.Context, key string) (string, error) {
+	resp, err := c.do(ctx, kvwire.OpGet, kvwire.AppendString(nil, key))
+	if err != nil {
+		return "", err
+	}
+	if err := statusErr(resp.Op, key, resp.Status, string(resp.Body)); err != nil {
+		return "", err
+	}
+	return string(resp.Body), nil
+}
+
+// Put stores a non-empty value.
+func (c *BinaryClient) Put(ctx context.Context, key, value string) error {
+	resp, err := c.do(ctx, kvwire.OpPut, kvwire.AppendString(kvwire.AppendString(nil, key), value))
+	if err != nil {
+		return err
+	}
+	return statusErr(resp.Op, key, resp.Status, string(resp.Body))
+}
+
+// Delete deletes key, or returns ErrNotFound when it has no value.
+func (c *BinaryClient) Delete(ctx context.Context, key string) error {
+	resp, err := c.do(ctx, kvwire.OpDelete, kvwire.AppendString(nil, key))
+	if err != nil {
+		return err
+	}
+	return statusErr(resp.Op, key, resp.Status, string(resp.Body))
+}
+
+// GetMany returns the values of the keys that have one, read in a single
+// request. It fails with the error of the first key that could not be
+// read for another reason than being missing.
+func (c *BinaryClient) GetMany(ctx context.Context, keys ...string) (map[string]string, error) {
+	body := kvwire.AppendUvarint(nil, uint64(len(keys)))
+	for _, key := range keys {
+		body = kvwire.AppendString(body, key)
+	}
+	resp, err := c.do(ctx, kvwire.OpGetMany, body)
+	if err != nil {
+		return nil, err
+	}
+	if err := statusErr(resp.Op, "", resp.Status, string(resp.Body)); err != nil {
+		return nil, err
+	}
+
+	d := kvwire.NewDecoder(resp.Body)
+	if n := d.Count(); d.Err() == nil && n != len(keys) {
+		return nil, fmt.Errorf("%w: %d results for %d keys", kvwire.ErrMalformed, n, len(keys))
+	}
+	values := make(map[string]string, len(keys))
+	var firstErr error
+	for _, key := range keys {
+		status, value := d.Status(), d.Text()
+		switch err := statusErr(resp.Op, key, status, value); {
+		case err == nil:
+			values[key] = value
+		case errors.Is(err, ErrNotFound):
+		case firstErr == nil:
+			firstErr = err
+		}
+	}
+	if err := d.Err(); err != nil {
+		return nil, err
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return values, nil
+}
+
+// KeyValue is a put of PutMany.
+type KeyValue struct {
+	Key   string
+	Value string
+}
+
+// PutMany stores the values in order in a single request and returns the
+// error of each put, nil for those that succeeded. The puts are not atomic.
+func (c *BinaryClient) PutMany(ctx context.Context, puts ...KeyValue) ([]error, error) {
+	body := kvwire.AppendUvarint(nil, uint64(len(puts)))
+	for _, put := range puts {
+		body = kvwire.AppendString(kvwire.AppendString(body, put.Key), put.Value)
+	}
+	resp, err := c.do(ctx, kvwire.OpPutMany, body)
+	if err != nil {
+		return nil, err
+	}
+	if err := statusErr(resp.Op, "", resp.Status, string(resp.Body)); err != nil {
+		return nil, err
+	}
+
+	d := kvwire.NewDecoder(resp.Body)
+	if n := d.Count(); d.Err() == nil && n != len(puts) {
+		return nil, fmt.Errorf("%w: %d results for %d puts", kvwire.ErrMalformed, n, len(puts))
+	}
+	errs := make([]error, len(puts))
+	for i, put := range puts {
+		status, message := d.Status(), d.Text()
+		errs[i] = statusErr(resp.Op, put.Key, status, message)
+	}
+	if err := d.Err(); err != nil {
+		return nil, err
+	}
+	return errs, nil
+}
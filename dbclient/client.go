@@ -0,0 +1,364 @@
+// Package dbclient talks to the HTTP API of cmd/db, and with BinaryClient
+// to the kvwire listener of cmd/db. A Client may also talk to cmd/dbrouter,
+// which serves the keys, _batch, _mget and _scan of that API but none of
+// the other endpoints, nor the kvwire protocol.
+package dbclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNotFound = errors.New("key not found")
+	// ErrUnavailable is wrapped by the StatusError of a 503, returned once
+	// the retries are used up.
+	ErrUnavailable = errors.New("db is unavailable")
+)
+
+const (
+	scanPageSize = 100
+	maxBackoff   = 2 * time.Second
+)
+
+// StatusError is a response with an unexpected status code.
+type StatusError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	// Message is the body of the response.
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s %s: status %d: %s", e.Method, e.Path, e.StatusCode, e.Message)
+}
+
+func (e *StatusError) Unwrap() error {
+	if e.StatusCode == http.StatusServiceUnavailable {
+		return ErrUnavailable
+	}
+	return nil
+}
+
+type options struct {
+	client  *http.Client
+	timeout time.Duration
+	retries int
+	backoff time.Duration
+}
+
+type Option func(*options)
+
+// WithHTTPClient sets the client requests are sent with. By default the
+// Client has its own transport, which keeps connections to the db open
+// between requests.
+func WithHTTPClient(client *http.Client) Option {
+	return func(o *options) {
+		o.client = client
+	}
+}
+
+// WithTimeout limits every attempt of a request; the default is 5 seconds.
+func WithTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.timeout = d
+	}
+}
+
+// WithRetries sets how many times a request is retried after a network
+// error or a 502, 503 or 504, and the delay before the first retry, which
+// doubles with every further one up to 2 seconds. Each delay is picked at
+// random between zero and that bound, so clients that failed together do
+// not retry together. The default is 3 retries after 100ms. A batch, which
+// may hold increments, is retried only when it could not be sent at all.
+func WithRetries(n int, backoff time.Duration) Option {
+	return func(o *options) {
+		o.retries = n
+		o.backoff = backoff
+	}
+}
+
+// Client is safe for concurrent use.
+type Client struct {
+	baseURL string
+	client  *http.Client
+	timeout time.Duration
+	retries int
+	backoff time.Duration
+	// maxBackoff bounds the delays; tests lower it.
+	maxBackoff time.Duration
+}
+
+// New returns a client of the db at baseURL, such as http://db:8083.
+func New(baseURL string, opts ...Option) *Client {
+	o := options{timeout: 5 * time.Second, retries: 3, backoff: 100 * time.Millisecond}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.client == nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.MaxIdleConnsPerHost = 64
+		o.client = &http.Client{Transport: transport}
+	}
+	return &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		client:     o.client,
+		timeout:    o.timeout,
+		retries:    o.retries,
+		backoff:    o.backoff,
+		maxBackoff: maxBackoff,
+	}
+}
+
+type valueRequest struct {
+	Value string `json:"value"`
+}
+
+type valueResponse struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// Get returns the value of key, or ErrNotFound.
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	var resp valueResponse
+	if err := c.call(ctx, http.MethodGet, keyPath(key), nil, &resp); err != nil {
+		return "", err
+	}
+	return resp.Value, nil
+}
+
+// Put stores a non-empty value.
+func (c *Client) Put(ctx context.Context, key, value string) error {
+	return c.call(ctx, http.MethodPost, keyPath(key), valueRequest{Value: value}, nil)
+}
+
+// Delete deletes key, or returns ErrNotFound when it has no value. A delete
+// retried after its response was lost also returns ErrNotFound.
+func (c *Client) Delete(ctx context.Context, key string) error {
+	return c.call(ctx, http.MethodDelete, keyPath(key), nil, nil)
+}
+
+// Op is a put or a delete of a batch.
+type Op struct {
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+}
+
+func PutOp(key, value string) Op {
+	return Op{Op: "put", Key: key, Value: value}
+}
+
+func DeleteOp(key string) Op {
+	return Op{Op: "delete", Key: key}
+}
+
+// Result is the outcome of an op of a batch.
+type Result struct {
+	Key    string `json:"key"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Err returns nil for an op that succeeded, ErrNotFound for a delete of a
+// missing key and a StatusError for the others.
+func (r Result) Err() error {
+	switch r.Status {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return ErrNotFound
+	default:
+		return &StatusError{Method: http.MethodPost, Path: "/db/_batch", StatusCode: r.Status, Message: r.Error}
+	}
+}
+
+type batchRequest struct {
+	Ops []Op `json:"ops"`
+}
+
+type batchResponse struct {
+	Results []Result `json:"results"`
+}
+
+// Batch runs the ops in order in one request and returns a result for
+// each. The ops are not atomic: an op that fails leaves the others applied.
+// As running them twice could apply an increment twice, the request is
+// retried only when it could not reach the db.
+func (c *Client) Batch(ctx context.Context, ops ...Op) ([]Result, error) {
+	var resp batchResponse
+	if err := c.callOnce(ctx, http.MethodPost, "/db/_batch", batchRequest{Ops: ops}, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Results, nil
+}
+
+type mgetRequest struct {
+	Keys []string `json:"keys"`
+}
+
+type mgetResponse struct {
+	Values  map[string]string `json:"values"`
+	Missing []string          `json:"missing"`
+}
+
+// GetMany reads the values of the keys in one request. It returns the
+// values found and the keys that have none.
+func (c *Client) GetMany(ctx context.Context, keys ...string) (map[string]string, []string, error) {
+	var resp mgetResponse
+	if err := c.call(ctx, http.MethodPost, "/db/_mget", mgetRequest{Keys: keys}, &resp); err != nil {
+		return nil, nil, err
+	}
+	return resp.Values, resp.Missing, nil
+}
+
+type scanResponse struct {
+	Items []valueResponse `json:"items"`
+	Next  string          `json:"next"`
+}
+
+// Scan calls fn with the keys that have the prefix and their values, in
+// key order, a page at a time. It stops at the first error fn returns.
+// Keys written during the scan may or may not be seen.
+func (c *Client) Scan(ctx context.Context, prefix string, fn func(key, value string) error) error {
+	after := ""
+	for {
+		query := url.Values{"prefix": {prefix}, "after": {after}, "limit": {strconv.Itoa(scanPageSize)}}
+		var page scanResponse
+		if err := c.call(ctx, http.MethodGet, "/db/_scan?"+query.Encode(), nil, &page); err != nil {
+			return err
+		}
+		for _, item := range page.Items {
+			if err := fn(item.Key, item.Value); err != nil {
+				return err
+			}
+		}
+		if page.Next == "" {
+			return nil
+		}
+		after = page.Next
+	}
+}
+
+func keyPath(key string) string {
+	return "/db/" + url.PathEscape(key)
+}
+
+// call sends in as JSON and decodes the response into out. The request is
+// retried, so it has to be idempotent.
+func (c *Client) call(ctx context.Context, method, path string, in, out any) error {
+	return c.roundTrip(ctx, method, path, in, out, true)
+}
+
+// callOnce is call for a request that must not run twice.
+func (c *Client) callOnce(ctx context.Context, method, path string, in, out any) error {
+	return c.roundTrip(ctx, method, path, in, out, false)
+}
+
+func (c *Client) roundTrip(ctx context.Context, method, path string, in, out any, idempotent bool) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+	status, data, err := c.do(ctx, method, path, body, idempotent)
+	switch {
+	case err != nil:
+		return err
+	case status == http.StatusNotFound:
+		return ErrNotFound
+	case status != http.StatusOK:
+		return &StatusError{Method: method, Path: path, StatusCode: status, Message: strings.TrimSpace(string(data))}
+	case out != nil:
+		if err := json.Unmarshal(data, out); err != nil {
+			return fmt.Errorf("%s %s: invalid response: %w", method, path, err)
+		}
+	}
+	return nil
+}
+
+// do sends a request until it gets a response that is not worth retrying
+// or runs out of retries. A request that is not idempotent is retried only
+// after it failed to connect, as otherwise the db may have run it.
+func (c *Client) do(ctx context.Context, method, path string, body []byte, idempotent bool) (int, []byte, error) {
+	bound := min(c.backoff, c.maxBackoff)
+	for attempt := 0; ; attempt++ {
+		status, data, err := c.send(ctx, method, path, body)
+		if err == nil && !retryable(status) {
+			return status, data, nil
+		}
+		if attempt == c.retries || ctx.Err() != nil || (!idempotent && !dialFailed(err)) {
+			return status, data, err
+		}
+
+		delay := time.Duration(rand.Int64N(int64(bound) + 1))
+		// Doubling stops at the bound, so the delay cannot overflow.
+		bound = min(bound*2, c.maxBackoff)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return 0, nil, ctx.Err()
+		}
+	}
+}
+
+// send makes one attempt. The body is read to the end, so the connection
+// goes back to the pool.
+func (c *Client) send(ctx context.Context, method, path string, body []byte) (int, []byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	var r io.Reader = http.NoBody
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, r)
+	if err != nil {
+		return 0, nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, err
+	}
+	return resp.StatusCode, data, nil
+}
+
+// dialFailed reports whether err is a failure to connect, which leaves the
+// request unsent.
+func dialFailed(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+func retryable(status int) bool {
+	switch status {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,306 @@
+package dbclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dk872/architecture-lab5/shard"
+)
+
+// fakeDB serves the parts of the cmd/db API the client uses from a map.
+type fakeDB struct {
+	mutex  sync.Mutex
+	values map[string]string
+}
+
+func (f *fakeDB) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	switch r.URL.Path {
+	case "/db/_batch":
+		var req batchRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		var resp batchResponse
+		for _, op := range req.Ops {
+			result := Result{Key: op.Key, Status: http.StatusOK}
+			if _, ok := f.values[op.Key]; op.Op == "delete" && !ok {
+				result.Status = http.StatusNotFound
+			} else if op.Op == "delete" {
+				delete(f.values, op.Key)
+			} else {
+				f.values[op.Key] = op.Value
+			}
+			resp.Results = append(resp.Results, result)
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+		return
+	case "/db/_mget":
+		var req mgetRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		resp := mgetResponse{Values: make(map[string]string)}
+		for _, key := range req.Keys {
+			if value, ok := f.values[key]; ok {
+				resp.Values[key] = value
+			} else {
+				resp.Missing = append(resp.Missing, key)
+			}
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+		return
+	case "/db/_scan":
+		var keys []string
+		for key := range f.values {
+			if strings.HasPrefix(key, r.URL.Query().Get("prefix")) && key > r.URL.Query().Get("after") {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		var resp scanResponse
+		if len(keys) > 1 {
+			keys, resp.Next = keys[:1], keys[0]
+		}
+		for _, key := range keys {
+			resp.Items = append(resp.Items, valueResponse{Key: key, Value: f.values[key]})
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	key := strings.TrimPrefix(r.URL.Path, "/db/")
+	value, ok := f.values[key]
+	switch r.Method {
+	case http.MethodGet:
+		if !ok {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(valueResponse{Key: key, Value: value})
+	case http.MethodPost:
+		var req valueRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		f.values[key] = req.Value
+	case http.MethodDelete:
+		if !ok {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		delete(f.values, key)
+	}
+}
+
+func TestClient(t *testing.T) {
+	server := httptest.NewServer(&fakeDB{values: make(map[string]string)})
+	defer server.Close()
+	testClient(t, New(server.URL+"/"))
+}
+
+// TestClientThroughRouter runs the same requests against a dbrouter in
+// front of two nodes.
+func TestClientThroughRouter(t *testing.T) {
+	var nodes []*fakeDB
+	var urls []string
+	for i := 0; i < 2; i++ {
+		node := &fakeDB{values: make(map[string]string)}
+		server := httptest.NewServer(node)
+		defer server.Close()
+		nodes, urls = append(nodes, node), append(urls, server.URL)
+	}
+	router := shard.NewRouter(urls, shard.WithVirtualNodes(32))
+	defer router.Close()
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	c := New(server.URL)
+	testClient(t, c)
+
+	// Enough keys to land on both nodes.
+	var ops []Op
+	var keys []string
+	for i := 0; i < 20; i++ {
+		keys = append(keys, fmt.Sprintf("key%d", i))
+		ops = append(ops, PutOp(keys[i], "value"))
+	}
+	if _, err := c.Batch(context.Background(), ops...); err != nil {
+		t.Fatal(err)
+	}
+	values, missing, err := c.GetMany(context.Background(), keys...)
+	if err != nil || len(values) != len(keys) || len(missing) != 0 {
+		t.Errorf("GetMany = %v, %v, %v", values, missing, err)
+	}
+	for i, node := range nodes {
+		if len(node.values) == 0 {
+			t.Errorf("Node %d got none of the keys", i)
+		}
+	}
+}
+
+func testClient(t *testing.T, c *Client) {
+	t.Helper()
+	ctx := context.Background()
+
+	if err := c.Put(ctx, "a b", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := c.Get(ctx, "a b"); err != nil || value != "value" {
+		t.Errorf("Get = %q, %v", value, err)
+	}
+	if err := c.Delete(ctx, "a b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get(ctx, "a b"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get of a deleted key returned %v", err)
+	}
+	if err := c.Delete(ctx, "a b"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Delete of a deleted key returned %v", err)
+	}
+
+	results, err := c.Batch(ctx, PutOp("user:1", "x"), PutOp("user:2", "y"), PutOp("user:3", "z"), DeleteOp("missing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 4 || results[0].Err() != nil || !errors.Is(results[3].Err(), ErrNotFound) {
+		t.Errorf("Batch returned %+v", results)
+	}
+
+	values, missing, err := c.GetMany(ctx, "user:1", "missing", "user:3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"user:1": "x", "user:3": "z"}; !reflect.DeepEqual(values, want) || !reflect.DeepEqual(missing, []string{"missing"}) {
+		t.Errorf("GetMany = %v, %v", values, missing)
+	}
+
+	var scanned []string
+	err = c.Scan(ctx, "user:", func(key, value string) error {
+		scanned = append(scanned, key+"="+value)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"user:1=x", "user:2=y", "user:3=z"}; !reflect.DeepEqual(scanned, want) {
+		t.Errorf("Scanned %v, wanted %v", scanned, want)
+	}
+}
+
+func TestClientRetries(t *testing.T) {
+	var calls atomic.Int32
+	failures := int32(2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= failures {
+			http.Error(w, "write queue is full", http.StatusServiceUnavailable)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(valueResponse{Key: "key", Value: "value"})
+	}))
+	defer server.Close()
+
+	c := New(server.URL, WithRetries(2, time.Millisecond))
+	if value, err := c.Get(context.Background(), "key"); err != nil || value != "value" {
+		t.Errorf("Get after two failures = %q, %v", value, err)
+	}
+
+	calls.Store(0)
+	failures = 100
+	_, err := c.Get(context.Background(), "key")
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusServiceUnavailable || !errors.Is(err, ErrUnavailable) {
+		t.Errorf("Get after running out of retries returned %v", err)
+	}
+	if n := calls.Load(); n != 3 {
+		t.Errorf("Sent %d requests, wanted 3", n)
+	}
+}
+
+func TestClientBackoffBound(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		http.Error(w, "write queue is full", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	// Enough retries to shift the first delay past the range of an int64.
+	c := New(server.URL, WithRetries(100, time.Millisecond))
+	c.maxBackoff = time.Microsecond
+	if _, err := c.Get(context.Background(), "key"); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("Get after running out of retries returned %v", err)
+	}
+	if n := calls.Load(); n != 101 {
+		t.Errorf("Sent %d requests, wanted 101", n)
+	}
+}
+
+// roundTripFunc answers the requests of a Client in place of the network.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestClientBatchRetries(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		http.Error(w, "db node is unavailable", http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	c := New(server.URL, WithRetries(2, time.Millisecond))
+	if _, err := c.Batch(context.Background(), PutOp("key", "value")); err == nil {
+		t.Error("Expected the batch to fail")
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("Sent a batch that may have run %d times, wanted once", n)
+	}
+
+	for _, tc := range []struct {
+		err   error
+		calls int32
+	}{
+		{err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, calls: 3},
+		{err: &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset")}, calls: 1},
+	} {
+		calls.Store(0)
+		transport := roundTripFunc(func(*http.Request) (*http.Response, error) {
+			calls.Add(1)
+			return nil, tc.err
+		})
+		c := New(server.URL, WithHTTPClient(&http.Client{Transport: transport}), WithRetries(2, time.Millisecond))
+		if _, err := c.Batch(context.Background(), PutOp("key", "value")); err == nil {
+			t.Errorf("Expected the batch to fail with %v", tc.err)
+		}
+		if n := calls.Load(); n != tc.calls {
+			t.Errorf("Sent a batch failing with %v %d times, wanted %d", tc.err, n, tc.calls)
+		}
+	}
+}
+
+func TestClientTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	c := New(server.URL, WithTimeout(20*time.Millisecond), WithRetries(0, 0))
+	if _, err := c.Get(context.Background(), "key"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Get of a stuck server returned %v", err)
+	}
+}
@@ -0,0 +1,218 @@
+// Package kvwire is the binary protocol of cmd/db, a cheaper way to reach
+// the datastore than JSON over HTTP.
+//
+// Requests and responses are frames:
+//
+//	length uint32 | id uint32 | op uint8 | status uint16 | body
+//
+// with length counting the bytes after itself and every integer big-endian.
+// A response carries the id and op of its request and an HTTP status code,
+// which requests leave 0. Clients may send any number of requests without
+// waiting for responses, which come in whatever order the requests finish.
+//
+// Bodies are built of uvarints and strings, a string being its uvarint
+// length followed by its bytes:
+//
+//	get      key                      -> value, or a message unless 200
+//	put      key value                -> message unless 200
+//	delete   key                      -> message unless 200
+//	getMany  n key...                 -> n (status value-or-message)...
+//	putMany  n (key value)...         -> n (status message)...
+//
+// where status is a uint16 as in the frame.
+package kvwire
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const headerSize = 4 + 1 + 2
+
+const (
+	// MaxFrameSize is the largest length of a frame.
+	MaxFrameSize = 64 << 20
+	MaxBodySize  = MaxFrameSize - headerSize
+)
+
+var (
+	ErrFrameTooLarge = errors.New("frame is too large")
+	// ErrMalformed is returned for frames shorter than the header and by
+	// Decoder for bodies that do not match their op.
+	ErrMalformed = errors.New("malformed frame")
+)
+
+type Op uint8
+
+const (
+	OpGet Op = iota + 1
+	OpPut
+	OpDelete
+	OpGetMany
+	OpPutMany
+)
+
+func (op Op) String() string {
+	switch op {
+	case OpGet:
+		return "get"
+	case OpPut:
+		return "put"
+	case OpDelete:
+		return "delete"
+	case OpGetMany:
+		return "getMany"
+	case OpPutMany:
+		return "putMany"
+	default:
+		return fmt.Sprintf("op(%d)", uint8(op))
+	}
+}
+
+type Frame struct {
+	ID uint32
+	Op Op
+	// Status is set in responses.
+	Status uint16
+	Body   []byte
+}
+
+// ReadFrame reads the next frame. It returns ErrFrameTooLarge, after which
+// the stream cannot be read any further, for frames over MaxFrameSize.
+func ReadFrame(r io.Reader) (Frame, error) {
+	var header [4 + headerSize]byte
+	if _, err := io.ReadFull(r, header[:4]); err != nil {
+		return Frame{}, err
+	}
+	length := binary.BigEndian.Uint32(header[:4])
+	switch {
+	case length > MaxFrameSize:
+		return Frame{}, fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, length)
+	case length < headerSize:
+		return Frame{}, fmt.Errorf("%w: %d bytes is shorter than the header", ErrMalformed, length)
+	}
+	if _, err := io.ReadFull(r, header[4:]); err != nil {
+		return Frame{}, noEOF(err)
+	}
+	f := Frame{
+		ID:     binary.BigEndian.Uint32(header[4:8]),
+		Op:     Op(header[8]),
+		Status: binary.BigEndian.Uint16(header[9:11]),
+		Body:   make([]byte, length-headerSize),
+	}
+	if _, err := io.ReadFull(r, f.Body); err != nil {
+		return Frame{}, noEOF(err)
+	}
+	return f, nil
+}
+
+// noEOF reports a stream that ends inside a frame as cut short.
+func noEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// AppendFrame appends the encoded frame to b.
+func AppendFrame(b []byte, f Frame) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(headerSize+len(f.Body)))
+	b = binary.BigEndian.AppendUint32(b, f.ID)
+	b = append(b, byte(f.Op))
+	b = binary.BigEndian.AppendUint16(b, f.Status)
+	return append(b, f.Body...)
+}
+
+// WriteFrame writes the frame with a single Write.
+func WriteFrame(w io.Writer, f Frame) error {
+	if len(f.Body) > MaxBodySize {
+		return fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, headerSize+len(f.Body))
+	}
+	_, err := w.Write(AppendFrame(make([]byte, 0, 4+headerSize+len(f.Body)), f))
+	return err
+}
+
+func AppendUvarint(b []byte, n uint64) []byte {
+	return binary.AppendUvarint(b, n)
+}
+
+func AppendStatus(b []byte, status uint16) []byte {
+	return binary.BigEndian.AppendUint16(b, status)
+}
+
+func AppendString(b []byte, s string) []byte {
+	return append(binary.AppendUvarint(b, uint64(len(s))), s...)
+}
+
+// Decoder reads a body. Once a read fails the others return zero values,
+// so a body is decoded in full before Err is checked.
+type Decoder struct {
+	b   []byte
+	err error
+}
+
+func NewDecoder(body []byte) *Decoder {
+	return &Decoder{b: body}
+}
+
+func (d *Decoder) Uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	n, size := binary.Uvarint(d.b)
+	if size <= 0 {
+		d.err = fmt.Errorf("%w: invalid uvarint", ErrMalformed)
+		return 0
+	}
+	d.b = d.b[size:]
+	return n
+}
+
+// Count reads the number of the items that follow, which is at most the
+// number of bytes left, so that it can be used to size a slice.
+func (d *Decoder) Count() int {
+	n := d.Uvarint()
+	if d.err == nil && n > uint64(len(d.b)) {
+		d.err = fmt.Errorf("%w: %d items in %d bytes", ErrMalformed, n, len(d.b))
+		return 0
+	}
+	return int(n)
+}
+
+func (d *Decoder) Status() uint16 {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.b) < 2 {
+		d.err = fmt.Errorf("%w: truncated status", ErrMalformed)
+		return 0
+	}
+	status := binary.BigEndian.Uint16(d.b)
+	d.b = d.b[2:]
+	return status
+}
+
+// Text reads a string.
+func (d *Decoder) Text() string {
+	n := d.Uvarint()
+	if d.err != nil {
+		return ""
+	}
+	if n > uint64(len(d.b)) {
+		d.err = fmt.Errorf("%w: truncated string", ErrMalformed)
+		return ""
+	}
+	s := string(d.b[:n])
+	d.b = d.b[n:]
+	return s
+}
+
+// Err returns the first error, or ErrMalformed if bytes are left.
+func (d *Decoder) Err() error {
+	if d.err == nil && len(d.b) > 0 {
+		return fmt.Errorf("%w: %d trailing bytes", ErrMalformed, len(d.b))
+	}
+	return d.err
+}
@@ -0,0 +1,84 @@
+package kvwire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestFrames(t *testing.T) {
+	frames := []Frame{
+		{ID: 1, Op: OpGet, Body: AppendString(nil, "key")},
+		{ID: 2, Op: OpPut, Status: 200, Body: []byte{}},
+		{ID: 1 << 31, Op: OpGetMany, Body: AppendString(AppendUvarint(nil, 1), "key")},
+	}
+	var buf bytes.Buffer
+	for _, f := range frames {
+		if err := WriteFrame(&buf, f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range frames {
+		got, err := ReadFrame(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Read %+v, wanted %+v", got, want)
+		}
+	}
+	if _, err := ReadFrame(&buf); err != io.EOF {
+		t.Errorf("ReadFrame at the end returned %v", err)
+	}
+
+	// A frame cut short.
+	b := AppendFrame(nil, frames[0])
+	if _, err := ReadFrame(bytes.NewReader(b[:len(b)-1])); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("ReadFrame of a truncated frame returned %v", err)
+	}
+	huge := binary.BigEndian.AppendUint32(nil, MaxFrameSize+1)
+	if _, err := ReadFrame(bytes.NewReader(huge)); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("ReadFrame of a huge frame returned %v", err)
+	}
+	if err := WriteFrame(io.Discard, Frame{Body: make([]byte, MaxBodySize+1)}); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("WriteFrame of a huge frame returned %v", err)
+	}
+}
+
+func TestDecoder(t *testing.T) {
+	body := AppendUvarint(nil, 2)
+	body = AppendString(AppendStatus(body, 200), "value")
+	body = AppendString(AppendStatus(body, 404), "")
+	d := NewDecoder(body)
+	n := d.Count()
+	s1, v1 := d.Status(), d.Text()
+	s2, v2 := d.Status(), d.Text()
+	if err := d.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 || s1 != 200 || v1 != "value" || s2 != 404 || v2 != "" {
+		t.Errorf("Decoded %d, %d %q, %d %q", n, s1, v1, s2, v2)
+	}
+
+	text := func(d *Decoder) { d.Text() }
+	count := func(d *Decoder) { d.Count() }
+	for _, c := range []struct {
+		name   string
+		body   []byte
+		decode func(*Decoder)
+	}{
+		{"truncated string", AppendString(nil, "value")[:3], text},
+		{"trailing bytes", append(AppendString(nil, "key"), 0), text},
+		{"count larger than the body", AppendUvarint(nil, 1<<40), count},
+		{"truncated status", []byte{1}, func(d *Decoder) { d.Status() }},
+	} {
+		d := NewDecoder(c.body)
+		c.decode(d)
+		if err := d.Err(); !errors.Is(err, ErrMalformed) {
+			t.Errorf("Decoding a body with a %s returned %v", c.name, err)
+		}
+	}
+}
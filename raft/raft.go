@@ -0,0 +1,807 @@
+// Package raft replicates a log of commands across a cluster of nodes with
+// the Raft consensus algorithm and applies the committed ones to a state
+// machine on every node.
+package raft
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotLeader      = errors.New("not the raft leader")
+	ErrLeadershipLost = errors.New("leadership lost before the entry was applied")
+	ErrChangeInFlight = errors.New("a membership change is already in progress")
+	ErrStopped        = errors.New("raft node is stopped")
+	ErrUnknownMember  = errors.New("unknown raft member")
+)
+
+type EntryType uint8
+
+const (
+	EntryCommand EntryType = iota
+	EntryMembers
+	EntryNoop
+)
+
+type Entry struct {
+	Index uint64    `json:"index"`
+	Term  uint64    `json:"term"`
+	Type  EntryType `json:"type"`
+	Data  []byte    `json:"data,omitempty"`
+}
+
+// Members maps the IDs of the voting members of a cluster to their
+// addresses.
+type Members map[string]string
+
+// StateMachine receives the committed commands in log order. It has to
+// keep its state durable on its own: after a restart the log is applied
+// again from the entry after Applied, or after the last snapshot if that is
+// later.
+type StateMachine interface {
+	// Apply applies the command of the entry at index.
+	Apply(index uint64, command []byte) error
+	// Applied returns the index of the last entry whose effect the state
+	// machine keeps, 0 if it does not track it.
+	Applied() uint64
+	// Snapshot writes the whole state, Restore replaces the state with one
+	// written by Snapshot.
+	Snapshot(w io.Writer) error
+	Restore(r io.Reader) error
+}
+
+type Role int
+
+const (
+	Follower Role = iota
+	Candidate
+	Leader
+)
+
+func (r Role) String() string {
+	switch r {
+	case Follower:
+		return "follower"
+	case Candidate:
+		return "candidate"
+	case Leader:
+		return "leader"
+	default:
+		return fmt.Sprintf("Role(%d)", int(r))
+	}
+}
+
+type options struct {
+	members           Members
+	addr              string
+	transport         Transport
+	electionTimeout   time.Duration
+	heartbeatInterval time.Duration
+	snapshotThreshold int
+	maxBatch          int
+}
+
+type Option func(*options)
+
+// WithMembers bootstraps a new cluster with the given members. Every node
+// of the initial cluster is started with the same members; nodes joining
+// later start without and are added with AddMember.
+func WithMembers(members Members) Option {
+	return func(o *options) {
+		o.members = members
+	}
+}
+
+// WithAddress sets the address other members reach this node at, which
+// followers hand to clients looking for the leader.
+func WithAddress(addr string) Option {
+	return func(o *options) {
+		o.addr = addr
+	}
+}
+
+// WithTransport replaces the default HTTPTransport.
+func WithTransport(t Transport) Option {
+	return func(o *options) {
+		o.transport = t
+	}
+}
+
+// WithTimeouts sets the election timeout, randomised up to twice its value,
+// and the heartbeat interval; the defaults are 300ms and 50ms.
+func WithTimeouts(election, heartbeat time.Duration) Option {
+	return func(o *options) {
+		o.electionTimeout = election
+		o.heartbeatInterval = heartbeat
+	}
+}
+
+// WithSnapshotThreshold sets how many applied entries the log keeps before
+// it is compacted; the default is 1024.
+func WithSnapshotThreshold(entries int) Option {
+	return func(o *options) {
+		o.snapshotThreshold = entries
+	}
+}
+
+type waiter struct {
+	term uint64
+	done chan error
+}
+
+type Node struct {
+	id      string
+	sm      StateMachine
+	opts    options
+	storage *storage
+
+	mutex       sync.Mutex
+	applyCond   *sync.Cond
+	applyMutex  sync.Mutex
+	role        Role
+	term        uint64
+	votedFor    string
+	leader      string
+	leaderAddr  string
+	deadline    time.Time
+	snapshot    snapshotMeta
+	log         []Entry
+	members     Members
+	membersAt   uint64
+	commitIndex uint64
+	lastApplied uint64
+	peers       map[string]*peer
+	waiters     map[uint64]waiter
+
+	stopCh  chan struct{}
+	stopped bool
+	wg      sync.WaitGroup
+}
+
+// Start opens the node state kept in dir and starts taking part in the
+// cluster.
+func Start(id, dir string, sm StateMachine, opts ...Option) (*Node, error) {
+	n := &Node{
+		id: id,
+		sm: sm,
+		opts: options{
+			transport:         HTTPTransport{},
+			electionTimeout:   300 * time.Millisecond,
+			heartbeatInterval: 50 * time.Millisecond,
+			snapshotThreshold: 1024,
+			maxBatch:          256,
+		},
+		waiters: make(map[uint64]waiter),
+		stopCh:  make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(&n.opts)
+	}
+	n.applyCond = sync.NewCond(&n.mutex)
+
+	s, err := openStorage(dir)
+	if err != nil {
+		return nil, err
+	}
+	state, meta, entries, empty, err := s.load()
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+	n.storage = s
+	// The initial members only matter to a node that has never run.
+	if empty && n.opts.members != nil {
+		meta.Members = maps.Clone(n.opts.members)
+		if err := s.rewrite(meta, nil); err != nil {
+			s.close()
+			return nil, err
+		}
+	}
+
+	n.term, n.votedFor = state.Term, state.VotedFor
+	n.snapshot, n.log = meta, entries
+	// Entries the state machine already holds are committed.
+	applied := max(meta.Index, min(sm.Applied(), n.lastIndex()))
+	n.commitIndex, n.lastApplied = applied, applied
+	n.members, n.membersAt = n.latestMembers()
+	n.resetDeadline()
+
+	n.wg.Add(2)
+	go n.ticker()
+	go n.applier()
+	return n, nil
+}
+
+// Stop stops taking part in the cluster. The node can be started again
+// from the same directory.
+func (n *Node) Stop() error {
+	n.mutex.Lock()
+	if n.stopped {
+		n.mutex.Unlock()
+		return nil
+	}
+	n.stopped = true
+	close(n.stopCh)
+	for index, w := range n.waiters {
+		w.done <- ErrStopped
+		delete(n.waiters, index)
+	}
+	n.applyCond.Broadcast()
+	n.mutex.Unlock()
+
+	n.wg.Wait()
+	return n.storage.close()
+}
+
+type Status struct {
+	ID          string
+	Role        Role
+	Term        uint64
+	Leader      string
+	LeaderAddr  string
+	CommitIndex uint64
+	LastApplied uint64
+	LastIndex   uint64
+	Members     Members
+}
+
+func (n *Node) Status() Status {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return Status{
+		ID:          n.id,
+		Role:        n.role,
+		Term:        n.term,
+		Leader:      n.leader,
+		LeaderAddr:  n.leaderAddr,
+		CommitIndex: n.commitIndex,
+		LastApplied: n.lastApplied,
+		LastIndex:   n.lastIndex(),
+		Members:     maps.Clone(n.members),
+	}
+}
+
+// Propose appends a command to the log and waits until it has been applied
+// on this node, returning the error of StateMachine.Apply. Only the leader
+// takes proposals; other nodes fail with ErrNotLeader and Status tells
+// where the leader is. After ErrLeadershipLost or a ctx error the command
+// may or may not have been applied.
+func (n *Node) Propose(ctx context.Context, command []byte) error {
+	done, err := n.appendAsLeader(EntryCommand, command)
+	if err != nil {
+		return err
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// AddMember adds a voting member, or changes the address of one. Changes
+// go one at a time through the log, so a change fails with
+// ErrChangeInFlight until the previous one has committed.
+func (n *Node) AddMember(ctx context.Context, id, addr string) error {
+	return n.changeMembers(ctx, func(m Members) error {
+		m[id] = addr
+		return nil
+	})
+}
+
+// RemoveMember removes a member. A leader that removes itself steps down
+// once the change has committed.
+func (n *Node) RemoveMember(ctx context.Context, id string) error {
+	return n.changeMembers(ctx, func(m Members) error {
+		if _, ok := m[id]; !ok {
+			return fmt.Errorf("%w %q", ErrUnknownMember, id)
+		}
+		delete(m, id)
+		return nil
+	})
+}
+
+func (n *Node) changeMembers(ctx context.Context, change func(Members) error) error {
+	n.mutex.Lock()
+	if n.role == Leader && n.membersAt > n.commitIndex {
+		n.mutex.Unlock()
+		return ErrChangeInFlight
+	}
+	members := maps.Clone(n.members)
+	n.mutex.Unlock()
+
+	if err := change(members); err != nil {
+		return err
+	}
+	done, err := n.appendAsLeader(EntryMembers, encodeMembers(members))
+	if err != nil {
+		return err
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (n *Node) appendAsLeader(typ EntryType, data []byte) (<-chan error, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.stopped {
+		return nil, ErrStopped
+	}
+	if n.role != Leader {
+		return nil, ErrNotLeader
+	}
+	if typ == EntryMembers && n.membersAt > n.commitIndex {
+		return nil, ErrChangeInFlight
+	}
+
+	e := Entry{Index: n.lastIndex() + 1, Term: n.term, Type: typ, Data: data}
+	if err := n.storage.append([]Entry{e}); err != nil {
+		return nil, err
+	}
+	n.log = append(n.log, e)
+	done := make(chan error, 1)
+	n.waiters[e.Index] = waiter{term: n.term, done: done}
+	if typ == EntryMembers {
+		n.setMembers(decodeMembers(data), e.Index)
+	}
+	n.advanceCommit()
+	n.triggerPeers()
+	return done, nil
+}
+
+func (n *Node) lastIndex() uint64 {
+	if len(n.log) == 0 {
+		return n.snapshot.Index
+	}
+	return n.log[len(n.log)-1].Index
+}
+
+func (n *Node) lastTerm() uint64 {
+	if len(n.log) == 0 {
+		return n.snapshot.Term
+	}
+	return n.log[len(n.log)-1].Term
+}
+
+// termAt returns the term of the entry at index, and false when the entry
+// is not in the log or the snapshot.
+func (n *Node) termAt(index uint64) (uint64, bool) {
+	if index == n.snapshot.Index {
+		return n.snapshot.Term, true
+	}
+	if index < n.snapshot.Index || index > n.lastIndex() {
+		return 0, false
+	}
+	return n.log[index-n.snapshot.Index-1].Term, true
+}
+
+func (n *Node) entry(index uint64) Entry {
+	return n.log[index-n.snapshot.Index-1]
+}
+
+// latestMembers returns the newest membership in the log, which takes
+// effect as soon as it is appended, and its index.
+func (n *Node) latestMembers() (Members, uint64) {
+	for i := len(n.log) - 1; i >= 0; i-- {
+		if n.log[i].Type == EntryMembers {
+			return decodeMembers(n.log[i].Data), n.log[i].Index
+		}
+	}
+	return maps.Clone(n.snapshot.Members), n.snapshot.Index
+}
+
+// membersAtIndex returns the membership in effect at index.
+func (n *Node) membersAtIndex(index uint64) Members {
+	for i := len(n.log) - 1; i >= 0; i-- {
+		if n.log[i].Index <= index && n.log[i].Type == EntryMembers {
+			return decodeMembers(n.log[i].Data)
+		}
+	}
+	return maps.Clone(n.snapshot.Members)
+}
+
+func encodeMembers(members Members) []byte {
+	data, _ := json.Marshal(members)
+	return data
+}
+
+func decodeMembers(data []byte) Members {
+	members := make(Members)
+	if err := json.Unmarshal(data, &members); err != nil {
+		log.Printf("raft: invalid membership entry: %v", err)
+	}
+	return members
+}
+
+func (n *Node) setMembers(members Members, index uint64) {
+	n.members, n.membersAt = members, index
+	if n.role == Leader {
+		n.startPeers()
+	}
+}
+
+func (n *Node) quorum() int {
+	return len(n.members)/2 + 1
+}
+
+func (n *Node) resetDeadline() {
+	timeout := n.opts.electionTimeout + time.Duration(rand.Int63n(int64(n.opts.electionTimeout)))
+	n.deadline = time.Now().Add(timeout)
+}
+
+func (n *Node) persistState() error {
+	return n.storage.saveState(hardState{Term: n.term, VotedFor: n.votedFor})
+}
+
+// becomeFollower steps down, moving to a newer term if there is one.
+func (n *Node) becomeFollower(term uint64) {
+	if term > n.term {
+		n.term, n.votedFor = term, ""
+		n.leader, n.leaderAddr = "", ""
+		if err := n.persistState(); err != nil {
+			log.Printf("raft %s: saving state: %v", n.id, err)
+		}
+	}
+	n.role = Follower
+	n.stopPeers()
+	n.resetDeadline()
+}
+
+func (n *Node) ticker() {
+	defer n.wg.Done()
+	tick := time.NewTicker(n.opts.heartbeatInterval / 2)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+		case <-n.stopCh:
+			return
+		}
+		n.mutex.Lock()
+		_, member := n.members[n.id]
+		if n.role != Leader && member && time.Now().After(n.deadline) {
+			n.startElection()
+		}
+		n.mutex.Unlock()
+	}
+}
+
+func (n *Node) startElection() {
+	n.role = Candidate
+	n.term++
+	n.votedFor = n.id
+	n.leader, n.leaderAddr = "", ""
+	n.resetDeadline()
+	if err := n.persistState(); err != nil {
+		log.Printf("raft %s: saving state: %v", n.id, err)
+		return
+	}
+
+	term := n.term
+	req := VoteRequest{Term: term, CandidateID: n.id, LastLogIndex: n.lastIndex(), LastLogTerm: n.lastTerm()}
+	votes := 1
+	if votes >= n.quorum() {
+		n.becomeLeader()
+		return
+	}
+	for id, addr := range n.members {
+		if id == n.id {
+			continue
+		}
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), n.opts.electionTimeout)
+			defer cancel()
+			resp, err := n.opts.transport.RequestVote(ctx, addr, req)
+			if err != nil {
+				return
+			}
+
+			n.mutex.Lock()
+			defer n.mutex.Unlock()
+			if resp.Term > n.term {
+				n.becomeFollower(resp.Term)
+				return
+			}
+			if n.role != Candidate || n.term != term || !resp.Granted {
+				return
+			}
+			votes++
+			if votes == n.quorum() {
+				n.becomeLeader()
+			}
+		}()
+	}
+}
+
+func (n *Node) becomeLeader() {
+	n.role = Leader
+	n.leader, n.leaderAddr = n.id, n.opts.addr
+	n.peers = make(map[string]*peer)
+	n.startPeers()
+
+	// A no-op of the new term lets entries of earlier terms commit.
+	e := Entry{Index: n.lastIndex() + 1, Term: n.term, Type: EntryNoop}
+	if err := n.storage.append([]Entry{e}); err != nil {
+		log.Printf("raft %s: appending: %v", n.id, err)
+		n.becomeFollower(n.term)
+		return
+	}
+	n.log = append(n.log, e)
+	n.advanceCommit()
+	n.triggerPeers()
+}
+
+// advanceCommit commits the newest entry of the current term stored on a
+// majority of the members.
+func (n *Node) advanceCommit() {
+	if n.role != Leader {
+		return
+	}
+	matches := make([]uint64, 0, len(n.members))
+	for id := range n.members {
+		if id == n.id {
+			matches = append(matches, n.lastIndex())
+		} else if p, ok := n.peers[id]; ok {
+			matches = append(matches, p.match)
+		} else {
+			matches = append(matches, 0)
+		}
+	}
+	if len(matches) == 0 {
+		return
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i] > matches[j] })
+	index := matches[n.quorum()-1]
+	if term, ok := n.termAt(index); index > n.commitIndex && ok && term == n.term {
+		n.commitIndex = index
+		n.applyCond.Broadcast()
+	}
+
+	// A leader removed from the cluster hands over once that is committed.
+	if _, member := n.members[n.id]; !member && n.commitIndex >= n.membersAt {
+		n.becomeFollower(n.term)
+	}
+}
+
+func (n *Node) applier() {
+	defer n.wg.Done()
+	for {
+		n.mutex.Lock()
+		for n.lastApplied >= n.commitIndex && !n.stopped {
+			n.applyCond.Wait()
+		}
+		if n.stopped {
+			n.mutex.Unlock()
+			return
+		}
+		n.mutex.Unlock()
+
+		n.applyMutex.Lock()
+		n.mutex.Lock()
+		var entries []Entry
+		for index := n.lastApplied + 1; index <= n.commitIndex && index > n.snapshot.Index; index++ {
+			entries = append(entries, n.entry(index))
+		}
+		n.mutex.Unlock()
+
+		for _, e := range entries {
+			var err error
+			if e.Type == EntryCommand {
+				err = n.sm.Apply(e.Index, e.Data)
+			}
+
+			n.mutex.Lock()
+			n.lastApplied = e.Index
+			if w, ok := n.waiters[e.Index]; ok {
+				if w.term != e.Term {
+					err = ErrLeadershipLost
+				}
+				w.done <- err
+				delete(n.waiters, e.Index)
+			}
+			n.mutex.Unlock()
+		}
+
+		n.mutex.Lock()
+		if len(n.log) > n.opts.snapshotThreshold && n.lastApplied > n.snapshot.Index {
+			n.compact()
+		}
+		n.mutex.Unlock()
+		n.applyMutex.Unlock()
+	}
+}
+
+// compact drops the applied entries from the log. The state machine holds
+// their effect, so nothing else needs saving.
+func (n *Node) compact() {
+	term, _ := n.termAt(n.lastApplied)
+	meta := snapshotMeta{Index: n.lastApplied, Term: term, Members: n.membersAtIndex(n.lastApplied)}
+	entries := append([]Entry(nil), n.log[n.lastApplied-n.snapshot.Index:]...)
+	if err := n.storage.rewrite(meta, entries); err != nil {
+		log.Printf("raft %s: compacting the log: %v", n.id, err)
+		return
+	}
+	n.snapshot, n.log = meta, entries
+}
+
+// truncate drops the entries from index on, failing their proposals.
+func (n *Node) truncate(index uint64) {
+	n.log = n.log[:index-n.snapshot.Index-1]
+	for i, w := range n.waiters {
+		if i >= index {
+			w.done <- ErrLeadershipLost
+			delete(n.waiters, i)
+		}
+	}
+	n.members, n.membersAt = n.latestMembers()
+}
+
+// RequestVote handles a candidate asking for this node's vote.
+func (n *Node) RequestVote(req VoteRequest) (VoteResponse, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.stopped {
+		return VoteResponse{}, ErrStopped
+	}
+
+	if req.Term > n.term {
+		n.becomeFollower(req.Term)
+	}
+	resp := VoteResponse{Term: n.term}
+	if req.Term < n.term || (n.votedFor != "" && n.votedFor != req.CandidateID) {
+		return resp, nil
+	}
+	upToDate := req.LastLogTerm > n.lastTerm() ||
+		(req.LastLogTerm == n.lastTerm() && req.LastLogIndex >= n.lastIndex())
+	if !upToDate {
+		return resp, nil
+	}
+
+	n.votedFor = req.CandidateID
+	if err := n.persistState(); err != nil {
+		return VoteResponse{}, err
+	}
+	n.resetDeadline()
+	resp.Granted = true
+	return resp, nil
+}
+
+// AppendEntries handles the leader replicating its log or sending a
+// heartbeat.
+func (n *Node) AppendEntries(req AppendRequest) (AppendResponse, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.stopped {
+		return AppendResponse{}, ErrStopped
+	}
+
+	if req.Term < n.term {
+		return AppendResponse{Term: n.term}, nil
+	}
+	if req.Term > n.term || n.role != Follower {
+		n.becomeFollower(req.Term)
+	}
+	n.leader, n.leaderAddr = req.LeaderID, req.LeaderAddr
+	n.resetDeadline()
+	resp := AppendResponse{Term: n.term}
+
+	// Entries already compacted into the snapshot are committed and match.
+	entries := req.Entries
+	prev, prevTerm := req.PrevLogIndex, req.PrevLogTerm
+	for len(entries) > 0 && prev < n.snapshot.Index {
+		prev, prevTerm = entries[0].Index, entries[0].Term
+		entries = entries[1:]
+	}
+	if prev < n.snapshot.Index {
+		resp.ConflictIndex = n.snapshot.Index + 1
+		return resp, nil
+	}
+
+	if prev > n.lastIndex() {
+		resp.ConflictIndex = n.lastIndex() + 1
+		return resp, nil
+	}
+	if term, _ := n.termAt(prev); term != prevTerm {
+		// Skip back over the whole conflicting term.
+		conflict := prev
+		for conflict > n.snapshot.Index+1 {
+			if t, _ := n.termAt(conflict - 1); t != term {
+				break
+			}
+			conflict--
+		}
+		resp.ConflictIndex = conflict
+		return resp, nil
+	}
+
+	for i, e := range entries {
+		if e.Index <= n.lastIndex() {
+			if term, _ := n.termAt(e.Index); term == e.Term {
+				continue
+			}
+			n.truncate(e.Index)
+			if err := n.storage.rewrite(n.snapshot, n.log); err != nil {
+				return AppendResponse{}, err
+			}
+		}
+		if err := n.storage.append(entries[i:]); err != nil {
+			return AppendResponse{}, err
+		}
+		n.log = append(n.log, entries[i:]...)
+		n.members, n.membersAt = n.latestMembers()
+		break
+	}
+
+	last := prev + uint64(len(entries))
+	// A delayed request may carry an older commit index or a shorter prefix,
+	// which must not undo a later one.
+	if commit := min(req.LeaderCommit, last); commit > n.commitIndex {
+		n.commitIndex = commit
+		n.applyCond.Broadcast()
+	}
+	resp.Success = true
+	return resp, nil
+}
+
+// InstallSnapshot handles the leader replacing the state of a node that is
+// too far behind for the log.
+func (n *Node) InstallSnapshot(req SnapshotRequest) (SnapshotResponse, error) {
+	n.applyMutex.Lock()
+	defer n.applyMutex.Unlock()
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.stopped {
+		return SnapshotResponse{}, ErrStopped
+	}
+
+	if req.Term < n.term {
+		return SnapshotResponse{Term: n.term}, nil
+	}
+	if req.Term > n.term || n.role != Follower {
+		n.becomeFollower(req.Term)
+	}
+	n.leader, n.leaderAddr = req.LeaderID, req.LeaderAddr
+	n.resetDeadline()
+	resp := SnapshotResponse{Term: n.term}
+	if req.Index <= n.lastApplied {
+		return resp, nil
+	}
+
+	if err := n.sm.Restore(bytes.NewReader(req.Data)); err != nil {
+		return SnapshotResponse{}, err
+	}
+	var entries []Entry
+	if term, ok := n.termAt(req.Index); ok && term == req.IndexTerm {
+		entries = append(entries, n.log[req.Index-n.snapshot.Index:]...)
+	}
+	meta := snapshotMeta{Index: req.Index, Term: req.IndexTerm, Members: req.Members}
+	if err := n.storage.rewrite(meta, entries); err != nil {
+		return SnapshotResponse{}, err
+	}
+	for i, w := range n.waiters {
+		if i <= req.Index {
+			w.done <- ErrLeadershipLost
+			delete(n.waiters, i)
+		}
+	}
+	n.snapshot, n.log = meta, entries
+	n.commitIndex = max(n.commitIndex, req.Index)
+	n.lastApplied = req.Index
+	n.members, n.membersAt = n.latestMembers()
+	return resp, nil
+}
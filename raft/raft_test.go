@@ -0,0 +1,326 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// kvMachine applies "key=value" commands to a map.
+type kvMachine struct {
+	mutex   sync.Mutex
+	data    map[string]string
+	applied uint64
+	// applies counts the commands applied.
+	applies int
+}
+
+func newKVMachine() *kvMachine {
+	return &kvMachine{data: make(map[string]string)}
+}
+
+func (m *kvMachine) Apply(index uint64, command []byte) error {
+	key, value, ok := strings.Cut(string(command), "=")
+	if !ok {
+		return fmt.Errorf("invalid command %q", command)
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.data[key] = value
+	m.applied = index
+	m.applies++
+	return nil
+}
+
+func (m *kvMachine) Applied() uint64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.applied
+}
+
+func (m *kvMachine) Snapshot(w io.Writer) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return json.NewEncoder(w).Encode(m.data)
+}
+
+func (m *kvMachine) Restore(r io.Reader) error {
+	data := make(map[string]string)
+	if err := json.NewDecoder(r).Decode(&data); err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.data = data
+	return nil
+}
+
+func (m *kvMachine) get(key string) string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.data[key]
+}
+
+type testNode struct {
+	id      string
+	dir     string
+	server  *httptest.Server
+	handler atomic.Pointer[http.Handler]
+	node    *Node
+	sm      *kvMachine
+}
+
+type cluster struct {
+	t     *testing.T
+	nodes map[string]*testNode
+}
+
+func newCluster(t *testing.T, size int, opts ...Option) *cluster {
+	c := &cluster{t: t, nodes: make(map[string]*testNode)}
+	members := make(Members)
+	for i := 1; i <= size; i++ {
+		tn := c.addServer(fmt.Sprintf("n%d", i))
+		members[tn.id] = tn.server.URL
+	}
+	for id := range members {
+		c.start(id, append(opts, WithMembers(members))...)
+	}
+	return c
+}
+
+func (c *cluster) addServer(id string) *testNode {
+	tn := &testNode{id: id, dir: c.t.TempDir(), sm: newKVMachine()}
+	tn.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := tn.handler.Load()
+		if h == nil {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		(*h).ServeHTTP(w, r)
+	}))
+	c.t.Cleanup(func() {
+		if tn.node != nil {
+			tn.node.Stop()
+		}
+		tn.server.Close()
+	})
+	c.nodes[id] = tn
+	return tn
+}
+
+func (c *cluster) start(id string, opts ...Option) {
+	c.t.Helper()
+	tn := c.nodes[id]
+	opts = append([]Option{WithTimeouts(100*time.Millisecond, 20*time.Millisecond), WithAddress(tn.server.URL)}, opts...)
+	node, err := Start(id, tn.dir, tn.sm, opts...)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	tn.node = node
+	h := node.Handler()
+	tn.handler.Store(&h)
+}
+
+func (c *cluster) stop(id string) {
+	tn := c.nodes[id]
+	tn.handler.Store(nil)
+	tn.node.Stop()
+	tn.node = nil
+}
+
+func (c *cluster) leader() *testNode {
+	c.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, tn := range c.nodes {
+			if tn.node != nil && tn.node.Status().Role == Leader {
+				return tn
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.t.Fatal("No leader was elected")
+	return nil
+}
+
+func (c *cluster) propose(command string) {
+	c.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		err := c.leader().node.Propose(ctx, []byte(command))
+		cancel()
+		if err == nil {
+			return
+		}
+	}
+	c.t.Fatalf("Failed to commit %q", command)
+}
+
+func (c *cluster) waitFor(id, key, want string) {
+	c.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if c.nodes[id].sm.get(key) == want {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.t.Fatalf("Node %s has %s = %q, wanted %q", id, key, c.nodes[id].sm.get(key), want)
+}
+
+func TestReplication(t *testing.T) {
+	c := newCluster(t, 3)
+	for i := 0; i < 10; i++ {
+		c.propose(fmt.Sprintf("key%d=value%d", i, i))
+	}
+	for id := range c.nodes {
+		c.waitFor(id, "key9", "value9")
+	}
+
+	leader := c.leader()
+	for id, tn := range c.nodes {
+		if id == leader.id {
+			continue
+		}
+		if err := tn.node.Propose(context.Background(), []byte("k=v")); !errors.Is(err, ErrNotLeader) {
+			t.Errorf("Propose on follower %s returned %v", id, err)
+		}
+		if status := tn.node.Status(); status.Leader != leader.id || status.LeaderAddr != leader.server.URL {
+			t.Errorf("Follower %s points at %s (%s), the leader is %s", id, status.Leader, status.LeaderAddr, leader.id)
+		}
+	}
+}
+
+func TestLeaderFailover(t *testing.T) {
+	c := newCluster(t, 3)
+	c.propose("before=1")
+	old := c.leader()
+	c.stop(old.id)
+
+	c.propose("after=2")
+	if c.leader().id == old.id {
+		t.Fatal("The stopped node is still the leader")
+	}
+	for id, tn := range c.nodes {
+		if tn.node != nil {
+			c.waitFor(id, "after", "2")
+		}
+	}
+
+	// The old leader catches up after a restart.
+	c.start(old.id)
+	c.waitFor(old.id, "after", "2")
+	if c.nodes[old.id].node.Status().Term < c.leader().node.Status().Term {
+		t.Error("The restarted node did not move to the new term")
+	}
+}
+
+func TestRestart(t *testing.T) {
+	c := newCluster(t, 1)
+	c.propose("a=1")
+	c.propose("a=2")
+	c.stop("n1")
+
+	c.nodes["n1"].sm = newKVMachine()
+	c.start("n1")
+	c.waitFor("n1", "a", "2")
+	if status := c.nodes["n1"].node.Status(); status.LastApplied < 3 {
+		t.Errorf("Applied %d entries after a restart", status.LastApplied)
+	}
+}
+
+func TestRestartSkipsApplied(t *testing.T) {
+	c := newCluster(t, 1)
+	c.propose("a=1")
+	c.propose("a=2")
+	c.stop("n1")
+
+	// The state machine kept its state, so nothing is applied again.
+	sm := c.nodes["n1"].sm
+	c.start("n1")
+	c.propose("b=3")
+	c.waitFor("n1", "b", "3")
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	if sm.applies != 3 {
+		t.Errorf("Applied %d commands, wanted 3", sm.applies)
+	}
+}
+
+func TestAppendEntriesOutOfOrder(t *testing.T) {
+	sm := newKVMachine()
+	node, err := Start("n1", t.TempDir(), sm, WithMembers(Members{"n1": "http://n1", "n2": "http://n2"}),
+		WithTimeouts(time.Minute, 20*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.Stop()
+
+	var entries []Entry
+	for i := uint64(1); i <= 3; i++ {
+		entries = append(entries, Entry{Index: i, Term: 1, Type: EntryCommand, Data: []byte(fmt.Sprintf("a=%d", i))})
+	}
+	if resp, err := node.AppendEntries(AppendRequest{Term: 1, LeaderID: "n2", Entries: entries, LeaderCommit: 3}); err != nil || !resp.Success {
+		t.Fatalf("AppendEntries = %+v, %v", resp, err)
+	}
+	// A request sent before the one above arrives late, with a shorter
+	// prefix.
+	if resp, err := node.AppendEntries(AppendRequest{Term: 1, LeaderID: "n2", Entries: entries[:1], LeaderCommit: 4}); err != nil || !resp.Success {
+		t.Fatalf("AppendEntries = %+v, %v", resp, err)
+	}
+	if commit := node.Status().CommitIndex; commit != 3 {
+		t.Errorf("Commit index went from 3 to %d", commit)
+	}
+}
+
+func TestMembershipChanges(t *testing.T) {
+	c := newCluster(t, 3, WithSnapshotThreshold(4))
+	for i := 0; i < 20; i++ {
+		c.propose(fmt.Sprintf("key%d=%d", i, i))
+	}
+
+	// A new node starts without members and is sent a snapshot, as the
+	// leader has compacted its log.
+	joined := c.addServer("n4")
+	c.start("n4", WithSnapshotThreshold(4))
+	leader := c.leader()
+	if err := leader.node.AddMember(context.Background(), "n4", joined.server.URL); err != nil {
+		t.Fatal(err)
+	}
+	c.waitFor("n4", "key0", "0")
+	c.propose("joined=yes")
+	c.waitFor("n4", "joined", "yes")
+	if members := joined.node.Status().Members; len(members) != 4 {
+		t.Errorf("New node sees members %v", members)
+	}
+
+	leader = c.leader()
+	if err := leader.node.RemoveMember(context.Background(), leader.id); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for leader.node.Status().Role == Leader && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.stop(leader.id)
+	delete(c.nodes, leader.id)
+
+	c.propose("removed=" + leader.id)
+	next := c.leader()
+	if members := next.node.Status().Members; len(members) != 3 || members[leader.id] != "" {
+		t.Errorf("Members after removing %s: %v", leader.id, members)
+	}
+	for id := range c.nodes {
+		c.waitFor(id, "removed", leader.id)
+	}
+}
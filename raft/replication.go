@@ -0,0 +1,184 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"time"
+)
+
+// peer is the leader's view of another member.
+type peer struct {
+	id      string
+	next    uint64
+	match   uint64
+	trigger chan struct{}
+	stop    chan struct{}
+}
+
+// startPeers starts replicating to the members that have no replicator yet
+// and stops the ones for removed members.
+func (n *Node) startPeers() {
+	for id, p := range n.peers {
+		if _, ok := n.members[id]; !ok {
+			close(p.stop)
+			delete(n.peers, id)
+		}
+	}
+	for id := range n.members {
+		if _, ok := n.peers[id]; ok || id == n.id {
+			continue
+		}
+		p := &peer{
+			id:      id,
+			next:    n.lastIndex() + 1,
+			trigger: make(chan struct{}, 1),
+			stop:    make(chan struct{}),
+		}
+		n.peers[id] = p
+		n.wg.Add(1)
+		go n.replicate(p, n.term)
+	}
+}
+
+func (n *Node) stopPeers() {
+	for id, p := range n.peers {
+		close(p.stop)
+		delete(n.peers, id)
+	}
+}
+
+func (n *Node) triggerPeers() {
+	for _, p := range n.peers {
+		select {
+		case p.trigger <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// replicate sends a peer the entries it is missing, or heartbeats when it
+// has them all, for as long as this node leads in term.
+func (n *Node) replicate(p *peer, term uint64) {
+	defer n.wg.Done()
+	heartbeat := time.NewTicker(n.opts.heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-p.trigger:
+		case <-heartbeat.C:
+		case <-p.stop:
+			return
+		case <-n.stopCh:
+			return
+		}
+
+		n.mutex.Lock()
+		if n.role != Leader || n.term != term {
+			n.mutex.Unlock()
+			return
+		}
+		addr := n.members[p.id]
+		if p.next <= n.snapshot.Index {
+			n.mutex.Unlock()
+			n.sendSnapshot(p, addr, term)
+			continue
+		}
+		prev := p.next - 1
+		prevTerm, _ := n.termAt(prev)
+		last := min(n.lastIndex(), prev+uint64(n.opts.maxBatch))
+		req := AppendRequest{
+			Term:         term,
+			LeaderID:     n.id,
+			LeaderAddr:   n.opts.addr,
+			PrevLogIndex: prev,
+			PrevLogTerm:  prevTerm,
+			LeaderCommit: n.commitIndex,
+		}
+		for index := prev + 1; index <= last; index++ {
+			req.Entries = append(req.Entries, n.entry(index))
+		}
+		n.mutex.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), n.opts.electionTimeout)
+		resp, err := n.opts.transport.AppendEntries(ctx, addr, req)
+		cancel()
+		if err != nil {
+			continue
+		}
+
+		n.mutex.Lock()
+		if resp.Term > n.term {
+			n.becomeFollower(resp.Term)
+			n.mutex.Unlock()
+			return
+		}
+		if n.role != Leader || n.term != term {
+			n.mutex.Unlock()
+			return
+		}
+		if resp.Success {
+			match := prev + uint64(len(req.Entries))
+			p.match = max(p.match, match)
+			p.next = max(p.next, match+1)
+			n.advanceCommit()
+		} else {
+			p.next = max(1, resp.ConflictIndex)
+		}
+		more := p.next <= n.lastIndex()
+		n.mutex.Unlock()
+		if more {
+			select {
+			case p.trigger <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// sendSnapshot installs the current state machine on a peer whose next
+// entry has been compacted away.
+func (n *Node) sendSnapshot(p *peer, addr string, term uint64) {
+	// Holding applyMutex keeps the state machine at lastApplied while it
+	// is written.
+	n.applyMutex.Lock()
+	var data bytes.Buffer
+	err := n.sm.Snapshot(&data)
+	n.mutex.Lock()
+	index := n.lastApplied
+	indexTerm, _ := n.termAt(index)
+	req := SnapshotRequest{
+		Term:       term,
+		LeaderID:   n.id,
+		LeaderAddr: n.opts.addr,
+		Index:      index,
+		IndexTerm:  indexTerm,
+		Members:    n.membersAtIndex(index),
+		Data:       data.Bytes(),
+	}
+	n.mutex.Unlock()
+	n.applyMutex.Unlock()
+	if err != nil {
+		log.Printf("raft %s: snapshot for %s: %v", n.id, p.id, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*n.opts.electionTimeout)
+	resp, err := n.opts.transport.InstallSnapshot(ctx, addr, req)
+	cancel()
+	if err != nil {
+		return
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if resp.Term > n.term {
+		n.becomeFollower(resp.Term)
+		return
+	}
+	if n.role == Leader && n.term == term {
+		p.match = max(p.match, index)
+		p.next = max(p.next, index+1)
+		n.advanceCommit()
+	}
+}
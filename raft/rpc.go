@@ -0,0 +1,145 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+type VoteRequest struct {
+	Term         uint64 `json:"term"`
+	CandidateID  string `json:"candidateId"`
+	LastLogIndex uint64 `json:"lastLogIndex"`
+	LastLogTerm  uint64 `json:"lastLogTerm"`
+}
+
+type VoteResponse struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+type AppendRequest struct {
+	Term         uint64  `json:"term"`
+	LeaderID     string  `json:"leaderId"`
+	LeaderAddr   string  `json:"leaderAddr"`
+	PrevLogIndex uint64  `json:"prevLogIndex"`
+	PrevLogTerm  uint64  `json:"prevLogTerm"`
+	Entries      []Entry `json:"entries,omitempty"`
+	LeaderCommit uint64  `json:"leaderCommit"`
+}
+
+type AppendResponse struct {
+	Term    uint64 `json:"term"`
+	Success bool   `json:"success"`
+	// ConflictIndex is where the leader should retry from after a failure.
+	ConflictIndex uint64 `json:"conflictIndex,omitempty"`
+}
+
+// SnapshotRequest carries the whole state machine, as written by
+// StateMachine.Snapshot, to a follower that is behind the leader's log.
+type SnapshotRequest struct {
+	Term       uint64  `json:"term"`
+	LeaderID   string  `json:"leaderId"`
+	LeaderAddr string  `json:"leaderAddr"`
+	Index      uint64  `json:"index"`
+	IndexTerm  uint64  `json:"indexTerm"`
+	Members    Members `json:"members"`
+	Data       []byte  `json:"data"`
+}
+
+type SnapshotResponse struct {
+	Term uint64 `json:"term"`
+}
+
+// Transport carries the RPCs between nodes. addr is the address a member
+// was added with.
+type Transport interface {
+	RequestVote(ctx context.Context, addr string, req VoteRequest) (VoteResponse, error)
+	AppendEntries(ctx context.Context, addr string, req AppendRequest) (AppendResponse, error)
+	InstallSnapshot(ctx context.Context, addr string, req SnapshotRequest) (SnapshotResponse, error)
+}
+
+// HTTPTransport posts the RPCs as JSON to the paths Node.Handler serves
+// under a member's base URL.
+type HTTPTransport struct {
+	Client *http.Client
+}
+
+func (t HTTPTransport) RequestVote(ctx context.Context, addr string, req VoteRequest) (VoteResponse, error) {
+	var resp VoteResponse
+	err := t.call(ctx, addr, "/raft/vote", req, &resp)
+	return resp, err
+}
+
+func (t HTTPTransport) AppendEntries(ctx context.Context, addr string, req AppendRequest) (AppendResponse, error) {
+	var resp AppendResponse
+	err := t.call(ctx, addr, "/raft/append", req, &resp)
+	return resp, err
+}
+
+func (t HTTPTransport) InstallSnapshot(ctx context.Context, addr string, req SnapshotRequest) (SnapshotResponse, error) {
+	var resp SnapshotResponse
+	err := t.call(ctx, addr, "/raft/snapshot", req, &resp)
+	return resp, err
+}
+
+func (t HTTPTransport) call(ctx context.Context, addr, path string, req, resp any) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(addr, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	client := t.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	httpResp, err := client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(httpResp.Body)
+		return fmt.Errorf("%s%s: status %d: %s", addr, path, httpResp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	return json.NewDecoder(httpResp.Body).Decode(resp)
+}
+
+// Handler serves the RPCs of HTTPTransport.
+func (n *Node) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/raft/vote", rpcHandler(n.RequestVote))
+	mux.HandleFunc("/raft/append", rpcHandler(n.AppendEntries))
+	mux.HandleFunc("/raft/snapshot", rpcHandler(n.InstallSnapshot))
+	return mux
+}
+
+func rpcHandler[Req, Resp any](handle func(Req) (Resp, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req Req
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		resp, err := handle(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(resp)
+	}
+}
@@ -0,0 +1,172 @@
+package raft
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+const (
+	stateFileName    = "raft-state"
+	snapshotFileName = "raft-snapshot"
+	logFileName      = "raft-log"
+)
+
+type hardState struct {
+	Term     uint64 `json:"term"`
+	VotedFor string `json:"votedFor,omitempty"`
+}
+
+// snapshotMeta describes how far the log has been compacted: the entries up
+// to Index are gone, their effect lives on in the state machine.
+type snapshotMeta struct {
+	Index   uint64  `json:"index"`
+	Term    uint64  `json:"term"`
+	Members Members `json:"members"`
+}
+
+// storage keeps the state a node must not lose in dir: the term and vote,
+// the snapshot metadata and the log entries after the snapshot, one JSON
+// document per line.
+type storage struct {
+	dir string
+	log *os.File
+}
+
+func openStorage(dir string) (*storage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &storage{dir: dir}, nil
+}
+
+// load returns what was saved. A torn entry at the end of the log, left by
+// a crash in the middle of an append, is dropped. empty reports that
+// nothing was ever saved.
+func (s *storage) load() (state hardState, meta snapshotMeta, entries []Entry, empty bool, err error) {
+	empty = true
+	if data, err := os.ReadFile(filepath.Join(s.dir, stateFileName)); err == nil {
+		empty = false
+		if err := json.Unmarshal(data, &state); err != nil {
+			return state, meta, nil, false, err
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return state, meta, nil, false, err
+	}
+	if data, err := os.ReadFile(filepath.Join(s.dir, snapshotFileName)); err == nil {
+		empty = false
+		if err := json.Unmarshal(data, &meta); err != nil {
+			return state, meta, nil, false, err
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return state, meta, nil, false, err
+	}
+
+	data, err := os.ReadFile(filepath.Join(s.dir, logFileName))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return state, meta, nil, false, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, len(data)+1)
+	for scanner.Scan() {
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			break
+		}
+		empty = false
+		if e.Index <= meta.Index {
+			continue
+		}
+		if len(entries) > 0 && e.Index != entries[len(entries)-1].Index+1 {
+			break
+		}
+		entries = append(entries, e)
+	}
+	// Rewrite the log so a torn tail does not stay in front of new appends.
+	return state, meta, entries, empty, s.rewrite(meta, entries)
+}
+
+func (s *storage) saveState(state hardState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(s.dir, stateFileName), data)
+}
+
+func (s *storage) append(entries []Entry) error {
+	if s.log == nil {
+		f, err := os.OpenFile(filepath.Join(s.dir, logFileName), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		s.log = f
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	if _, err := s.log.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	return s.log.Sync()
+}
+
+// rewrite replaces the snapshot metadata and the whole log, after the log
+// was truncated or compacted.
+func (s *storage) rewrite(meta snapshotMeta, entries []Entry) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(s.dir, snapshotFileName), data); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	if s.log != nil {
+		s.log.Close()
+		s.log = nil
+	}
+	return writeFileAtomic(filepath.Join(s.dir, logFileName), buf.Bytes())
+}
+
+func (s *storage) close() error {
+	if s.log == nil {
+		return nil
+	}
+	return s.log.Close()
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,394 @@
+package shard
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// maxRequestSize bounds the JSON bodies the router decodes.
+	maxRequestSize = 64 << 20
+	// defaultScanLimit is the page size of a db node's /db/_scan.
+	defaultScanLimit = 100
+)
+
+// nodeError is a response of a node other than 200, passed on to the
+// client as it is.
+type nodeError struct {
+	status  int
+	message string
+}
+
+func (e *nodeError) Error() string {
+	return fmt.Sprintf("status %d: %s", e.status, e.message)
+}
+
+// call sends in, if any, as JSON to node and decodes the response into out.
+func (rt *Router) call(ctx context.Context, method, node, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, node+path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := rt.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+		return &nodeError{status: resp.StatusCode, message: strings.TrimSpace(string(message))}
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// fanOut runs fn for every node at once and returns the first error.
+func fanOut(nodes []string, fn func(i int, node string) error) error {
+	errs := make([]error, len(nodes))
+	var wg sync.WaitGroup
+	for i, node := range nodes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = fn(i, node)
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeBody reads the JSON body of a request, replying 400 when it is
+// not valid.
+func decodeBody(w http.ResponseWriter, r *http.Request, v any) bool {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize)).Decode(v); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// replyJSON writes v, or the error of the node that failed.
+func replyJSON(w http.ResponseWriter, v any, err error) {
+	var nodeErr *nodeError
+	switch {
+	case errors.As(err, &nodeErr):
+		http.Error(w, nodeErr.message, nodeErr.status)
+	case err != nil:
+		log.Printf("Failed to forward a request: %v", err)
+		http.Error(w, "db node is unavailable", http.StatusBadGateway)
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(v)
+	}
+}
+
+type mgetRequest struct {
+	Keys []string `json:"keys"`
+}
+
+type mgetResponse struct {
+	Values  map[string]string `json:"values"`
+	Missing []string          `json:"missing"`
+}
+
+// serveMget asks every node for the keys it owns. During a migration the
+// keys missing on their new node are looked for on the old one, as single
+// reads are.
+func (rt *Router) serveMget(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req mgetRequest
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	rt.mutex.RLock()
+	ring, prev := rt.ring, rt.prev
+	rt.mutex.RUnlock()
+
+	values := make(map[string]string, len(req.Keys))
+	// missing groups the moving keys that have no value yet by node.
+	missing := func(node func(string) string) map[string][]string {
+		byNode := make(map[string][]string)
+		for _, key := range req.Keys {
+			if _, ok := values[key]; !ok && prev.Node(key) != ring.Node(key) && !rt.deleted(key) {
+				byNode[node(key)] = append(byNode[node(key)], key)
+			}
+		}
+		return byNode
+	}
+	byNode := make(map[string][]string)
+	for _, key := range req.Keys {
+		byNode[ring.Node(key)] = append(byNode[ring.Node(key)], key)
+	}
+	err := rt.mget(r.Context(), byNode, values)
+	if err == nil && prev != nil {
+		err = rt.mget(r.Context(), missing(prev.Node), values)
+	}
+	if err == nil && prev != nil {
+		// Copied and removed from the old node in between.
+		err = rt.mget(r.Context(), missing(ring.Node), values)
+	}
+
+	resp := mgetResponse{Values: values, Missing: []string{}}
+	for _, key := range req.Keys {
+		if _, ok := values[key]; !ok && !slices.Contains(resp.Missing, key) {
+			resp.Missing = append(resp.Missing, key)
+		}
+	}
+	replyJSON(w, resp, err)
+}
+
+// mget reads the keys from their nodes into values.
+func (rt *Router) mget(ctx context.Context, byNode map[string][]string, values map[string]string) error {
+	var nodes []string
+	for node := range byNode {
+		if node == "" {
+			return errors.New("no nodes on the ring")
+		}
+		nodes = append(nodes, node)
+	}
+	var mutex sync.Mutex
+	return fanOut(nodes, func(_ int, node string) error {
+		var resp mgetResponse
+		if err := rt.call(ctx, http.MethodPost, node, "/db/_mget", mgetRequest{Keys: byNode[node]}, &resp); err != nil {
+			return err
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		for key, value := range resp.Values {
+			values[key] = value
+		}
+		return nil
+	})
+}
+
+// batchOp is an op of a batch. The router reads only its key and op and
+// passes the rest on untouched.
+type batchOp struct {
+	Op  string `json:"op"`
+	Key string `json:"key"`
+}
+
+type batchRequest struct {
+	Ops []json.RawMessage `json:"ops"`
+}
+
+type batchResult struct {
+	Key    string `json:"key"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type batchResponse struct {
+	Results []batchResult `json:"results"`
+}
+
+// serveBatch sends every node the ops on the keys it owns, in their order,
+// and puts the results back in the order of the request. Ops on moving
+// keys are handled as single writes are.
+func (rt *Router) serveBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req batchRequest
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	ops := make([]batchOp, len(req.Ops))
+	for i, raw := range req.Ops {
+		if err := json.Unmarshal(raw, &ops[i]); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	rt.mutex.RLock()
+	defer rt.mutex.RUnlock()
+	var nodes []string
+	byNode := make(map[string][]int)
+	old := make(map[int]string)
+	var locks []int
+	for i, op := range ops {
+		node, from := rt.owners(op.Key)
+		if node == "" {
+			replyJSON(w, nil, errors.New("no nodes on the ring"))
+			return
+		}
+		if _, ok := byNode[node]; !ok {
+			nodes = append(nodes, node)
+		}
+		byNode[node] = append(byNode[node], i)
+		if from != "" {
+			old[i] = from
+			locks = append(locks, int(hash(op.Key)%keyLockCount))
+		}
+	}
+	// Locks are taken in order, so two batches cannot wait for each other.
+	slices.Sort(locks)
+	for _, i := range slices.Compact(locks) {
+		rt.keyLocks[i].Lock()
+		defer rt.keyLocks[i].Unlock()
+	}
+	// The last op on a key is the one recorded.
+	for i, op := range ops {
+		if _, ok := old[i]; ok {
+			rt.setWritten(op.Key, op.Op == "delete")
+		}
+	}
+
+	// A node that fails fails its own ops only: the others have been applied.
+	resp := batchResponse{Results: make([]batchResult, len(ops))}
+	_ = fanOut(nodes, func(_ int, node string) error {
+		indexes := byNode[node]
+		sub := batchRequest{Ops: make([]json.RawMessage, len(indexes))}
+		for j, i := range indexes {
+			sub.Ops[j] = req.Ops[i]
+		}
+		var nodeResp batchResponse
+		err := rt.call(r.Context(), http.MethodPost, node, "/db/_batch", sub, &nodeResp)
+		if err == nil && len(nodeResp.Results) != len(indexes) {
+			err = fmt.Errorf("%s returned %d results for %d ops", node, len(nodeResp.Results), len(indexes))
+		}
+		for j, i := range indexes {
+			if err != nil {
+				resp.Results[i] = failedResult(ops[i].Key, err)
+			} else {
+				resp.Results[i] = nodeResp.Results[j]
+			}
+		}
+		return nil
+	})
+	for i, op := range ops {
+		from, ok := old[i]
+		if result := &resp.Results[i]; ok && op.Op == "delete" && result.Status == http.StatusNotFound {
+			// The key may not have been copied yet.
+			switch status, err := rt.deleteKey(r.Context(), from, op.Key); {
+			case err != nil:
+				*result = failedResult(op.Key, err)
+			case status == http.StatusOK:
+				result.Status, result.Error = status, ""
+			}
+		}
+	}
+	replyJSON(w, resp, nil)
+}
+
+// failedResult is the result of an op its node did not run.
+func failedResult(key string, err error) batchResult {
+	var nodeErr *nodeError
+	if errors.As(err, &nodeErr) {
+		return batchResult{Key: key, Status: nodeErr.status, Error: nodeErr.message}
+	}
+	log.Printf("Failed to forward a batch: %v", err)
+	return batchResult{Key: key, Status: http.StatusBadGateway, Error: "db node is unavailable"}
+}
+
+type scanItem struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type scanResponse struct {
+	Items []scanItem `json:"items"`
+	Next  string     `json:"next,omitempty"`
+}
+
+// serveScan asks every node for the page and merges them. A node that has
+// more keys cuts the page at its last one, as the keys after it on that
+// node are not known yet. During a migration the keys not copied yet are
+// taken from their old node.
+func (rt *Router) serveScan(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	limit := defaultScanLimit
+	if n, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && n > 0 {
+		limit = n
+	}
+	rt.mutex.RLock()
+	ring, prev := rt.ring, rt.prev
+	rt.mutex.RUnlock()
+	nodes := ring.Nodes()
+	if prev != nil {
+		for _, node := range prev.Nodes() {
+			if !slices.Contains(nodes, node) {
+				nodes = append(nodes, node)
+			}
+		}
+	}
+	if len(nodes) == 0 {
+		replyJSON(w, nil, errors.New("no nodes on the ring"))
+		return
+	}
+
+	pages := make([]scanResponse, len(nodes))
+	err := fanOut(nodes, func(i int, node string) error {
+		return rt.call(r.Context(), http.MethodGet, node, "/db/_scan?"+r.URL.RawQuery, nil, &pages[i])
+	})
+	if err != nil {
+		replyJSON(w, nil, err)
+		return
+	}
+
+	items := make(map[string]scanItem)
+	owned := make(map[string]bool)
+	cutoff := ""
+	for i, node := range nodes {
+		page := pages[i]
+		if page.Next != "" && (cutoff == "" || page.Next < cutoff) {
+			cutoff = page.Next
+		}
+		for _, item := range page.Items {
+			switch {
+			case ring.Node(item.Key) == node:
+				items[item.Key], owned[item.Key] = item, true
+			case prev != nil && prev.Node(item.Key) == node && !owned[item.Key] && !rt.deleted(item.Key):
+				items[item.Key] = item
+			}
+		}
+	}
+
+	resp := scanResponse{Items: make([]scanItem, 0, len(items))}
+	for _, item := range items {
+		if cutoff == "" || item.Key <= cutoff {
+			resp.Items = append(resp.Items, item)
+		}
+	}
+	sort.Slice(resp.Items, func(i, j int) bool { return resp.Items[i].Key < resp.Items[j].Key })
+	resp.Next = cutoff
+	if len(resp.Items) > limit {
+		resp.Items = resp.Items[:limit]
+		resp.Next = resp.Items[limit-1].Key
+	}
+	replyJSON(w, resp, nil)
+}
@@ -0,0 +1,100 @@
+// Package shard partitions keys across several db nodes with a consistent
+// hash ring and routes the /db/{key} API to the node that owns each key.
+package shard
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// Ring maps keys to nodes. Every node is placed on the ring at several
+// points, its virtual nodes, so keys spread evenly and adding or removing
+// a node only moves the keys next to its points. A Ring is never modified,
+// With and Without return new rings.
+type Ring struct {
+	vnodes int
+	nodes  []string
+	points []point
+}
+
+type point struct {
+	hash uint64
+	node string
+}
+
+// NewRing places the nodes on a ring with vnodes points each.
+func NewRing(vnodes int, nodes ...string) *Ring {
+	if vnodes < 1 {
+		vnodes = 1
+	}
+	r := &Ring{vnodes: vnodes}
+	for _, node := range nodes {
+		if !r.Has(node) {
+			r.nodes = append(r.nodes, node)
+		}
+	}
+	sort.Strings(r.nodes)
+	for _, node := range r.nodes {
+		for i := 0; i < vnodes; i++ {
+			r.points = append(r.points, point{hash: hash(fmt.Sprintf("%s#%d", node, i)), node: node})
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].hash != r.points[j].hash {
+			return r.points[i].hash < r.points[j].hash
+		}
+		return r.points[i].node < r.points[j].node
+	})
+	return r
+}
+
+// Node returns the node that owns the key, the first one clockwise from
+// the key's hash. It is empty for an empty ring.
+func (r *Ring) Node(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := hash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].node
+}
+
+// Nodes returns the nodes on the ring in sorted order.
+func (r *Ring) Nodes() []string {
+	return append([]string(nil), r.nodes...)
+}
+
+func (r *Ring) Has(node string) bool {
+	for _, n := range r.nodes {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
+
+// With returns a ring that also has the node.
+func (r *Ring) With(node string) *Ring {
+	return NewRing(r.vnodes, append(r.Nodes(), node)...)
+}
+
+// Without returns a ring without the node.
+func (r *Ring) Without(node string) *Ring {
+	var nodes []string
+	for _, n := range r.nodes {
+		if n != node {
+			nodes = append(nodes, n)
+		}
+	}
+	return NewRing(r.vnodes, nodes...)
+}
+
+func hash(s string) uint64 {
+	sum := sha1.Sum([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
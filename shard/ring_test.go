@@ -0,0 +1,42 @@
+package shard
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRing(t *testing.T) {
+	ring := NewRing(128, "a", "b", "c")
+	counts := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		counts[ring.Node(fmt.Sprintf("key%d", i))]++
+	}
+	for _, node := range ring.Nodes() {
+		if counts[node] < 600 {
+			t.Errorf("Node %s owns %d of 3000 keys", node, counts[node])
+		}
+	}
+
+	// Only keys that move to the new node change owner.
+	bigger := ring.With("d")
+	moved := 0
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if owner := bigger.Node(key); owner != ring.Node(key) {
+			if owner != "d" {
+				t.Fatalf("Key %s moved from %s to %s", key, ring.Node(key), owner)
+			}
+			moved++
+		}
+	}
+	if moved == 0 || moved > 1200 {
+		t.Errorf("Adding a node moved %d of 3000 keys", moved)
+	}
+
+	if smaller := bigger.Without("d"); smaller.Node("key1") != ring.Node("key1") || smaller.Has("d") {
+		t.Error("Removing the node did not restore the ring")
+	}
+	if NewRing(8).Node("key") != "" {
+		t.Error("An empty ring owns a key")
+	}
+}
@@ -0,0 +1,478 @@
+package shard
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrMigrating   = errors.New("a migration is already in progress")
+	ErrNodeExists  = errors.New("node is already on the ring")
+	ErrUnknownNode = errors.New("node is not on the ring")
+	ErrLastNode    = errors.New("cannot remove the last node")
+)
+
+const keyLockCount = 64
+
+// reservedPrefix starts the paths of the endpoints of a db node under /db/,
+// which takes no key that starts with it.
+const reservedPrefix = "_"
+
+type options struct {
+	vnodes     int
+	client     *http.Client
+	retryDelay time.Duration
+}
+
+type Option func(*options)
+
+// WithVirtualNodes sets how many points every node has on the ring; the
+// default is 128.
+func WithVirtualNodes(n int) Option {
+	return func(o *options) {
+		o.vnodes = n
+	}
+}
+
+// WithClient sets the client requests are forwarded with.
+func WithClient(client *http.Client) Option {
+	return func(o *options) {
+		o.client = client
+	}
+}
+
+// WithRetryDelay sets how long a failed migration waits before it reads
+// the node again; the default is a second.
+func WithRetryDelay(d time.Duration) Option {
+	return func(o *options) {
+		o.retryDelay = d
+	}
+}
+
+// Status describes the ring and the migration that is running, if any.
+type Status struct {
+	Nodes     []string `json:"nodes"`
+	Migrating bool     `json:"migrating"`
+	// Moved counts the keys copied to their new node since the router
+	// started.
+	Moved     int64  `json:"moved"`
+	LastError string `json:"lastError,omitempty"`
+}
+
+// Router serves the /db/{key} API of a db node by forwarding each request
+// to the node that owns the key, and /db/_mget, /db/_batch and /db/_scan
+// by splitting them among the nodes and merging the results.
+//
+// Adding or removing a node switches to the new ring at once and copies the
+// keys that moved in the background, removing each from its old node once
+// it is copied. Until the copy is done, reads that miss on the new node
+// fall back to the old one, and a write to a moving key is remembered so
+// the copy does not overwrite it with the old value, nor a read bring back
+// a key deleted since.
+type Router struct {
+	client     *http.Client
+	retryDelay time.Duration
+
+	// mutex guards the rings. Writes hold it for reading while they are
+	// forwarded, so a migration starts with no write in flight to the old
+	// owner of a key.
+	mutex sync.RWMutex
+	ring  *Ring
+	// prev is the ring before the change being migrated, nil when no
+	// migration runs.
+	prev   *Ring
+	done   chan struct{}
+	status Status
+	moved  atomic.Int64
+
+	keyLocks     [keyLockCount]sync.Mutex
+	writtenMutex sync.Mutex
+	// written holds the moving keys written during the migration, true for
+	// those whose last write was a delete.
+	written map[string]bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewRouter(nodes []string, opts ...Option) *Router {
+	o := options{vnodes: 128, client: http.DefaultClient, retryDelay: time.Second}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Router{
+		client:     o.client,
+		retryDelay: o.retryDelay,
+		ring:       NewRing(o.vnodes, nodes...),
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+}
+
+// Close stops a running migration. To finish it, start the next router
+// with the old nodes and add or remove the node again.
+func (rt *Router) Close() {
+	rt.cancel()
+	rt.wg.Wait()
+}
+
+func (rt *Router) Status() Status {
+	rt.mutex.RLock()
+	defer rt.mutex.RUnlock()
+	s := rt.status
+	s.Nodes = rt.ring.Nodes()
+	s.Migrating = rt.prev != nil
+	s.Moved = rt.moved.Load()
+	return s
+}
+
+// Wait blocks until the running migration, if any, is done.
+func (rt *Router) Wait(ctx context.Context) error {
+	rt.mutex.RLock()
+	done := rt.done
+	rt.mutex.RUnlock()
+	if done == nil {
+		return nil
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// AddNode puts a node on the ring and starts moving the keys it now owns.
+func (rt *Router) AddNode(node string) error {
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+	if rt.prev != nil {
+		return ErrMigrating
+	}
+	if rt.ring.Has(node) {
+		return ErrNodeExists
+	}
+	rt.startMigration(rt.ring.With(node))
+	return nil
+}
+
+// RemoveNode takes a node off the ring and starts moving its keys to the
+// other nodes. The node has to stay up until the migration is done.
+func (rt *Router) RemoveNode(node string) error {
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+	if rt.prev != nil {
+		return ErrMigrating
+	}
+	if !rt.ring.Has(node) {
+		return ErrUnknownNode
+	}
+	if len(rt.ring.Nodes()) == 1 {
+		return ErrLastNode
+	}
+	rt.startMigration(rt.ring.Without(node))
+	return nil
+}
+
+func (rt *Router) startMigration(next *Ring) {
+	rt.prev, rt.ring = rt.ring, next
+	rt.done = make(chan struct{})
+	rt.status.LastError = ""
+	rt.writtenMutex.Lock()
+	rt.written = make(map[string]bool)
+	rt.writtenMutex.Unlock()
+
+	rt.wg.Add(1)
+	go rt.migrate(rt.prev, next, rt.done)
+}
+
+func (rt *Router) migrate(prev, next *Ring, done chan struct{}) {
+	defer rt.wg.Done()
+	for _, node := range prev.Nodes() {
+		for {
+			err := rt.migrateNode(node, prev, next)
+			if err == nil {
+				break
+			}
+			if rt.ctx.Err() != nil {
+				return
+			}
+			log.Printf("Migrating keys from %s failed, retrying: %v", node, err)
+			rt.mutex.Lock()
+			rt.status.LastError = err.Error()
+			rt.mutex.Unlock()
+			select {
+			case <-time.After(rt.retryDelay):
+			case <-rt.ctx.Done():
+				return
+			}
+		}
+	}
+
+	rt.mutex.Lock()
+	rt.prev = nil
+	rt.done = nil
+	rt.status.LastError = ""
+	rt.mutex.Unlock()
+	rt.writtenMutex.Lock()
+	rt.written = nil
+	rt.writtenMutex.Unlock()
+	close(done)
+	log.Printf("Migration to %v is done", next.Nodes())
+}
+
+// snapshotRecord is a line of a node's /db/_snapshot stream.
+type snapshotRecord struct {
+	Op        string `json:"op"`
+	Key       string `json:"key"`
+	Value     string `json:"value"`
+	Timestamp uint64 `json:"timestamp,omitempty"`
+	// Expires is in Unix nanoseconds, 0 for values that do not expire.
+	Expires int64  `json:"expires,omitempty"`
+	Flags   uint32 `json:"flags,omitempty"`
+}
+
+// migrateNode copies the keys of node whose owner changed to their new
+// owner. Copying a key again is harmless, so a failed run starts over.
+func (rt *Router) migrateNode(node string, prev, next *Ring) error {
+	req, err := http.NewRequestWithContext(rt.ctx, http.MethodGet, node+"/db/_snapshot", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := rt.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("snapshot of %s returned %d", node, resp.StatusCode)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(nil, 64<<20)
+	for scanner.Scan() {
+		var record snapshotRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return err
+		}
+		// Deleted keys have nothing to copy.
+		if record.Op != "put" || prev.Node(record.Key) != node {
+			continue
+		}
+		if owner := next.Node(record.Key); owner != node {
+			if err := rt.copyKey(record, node, owner); err != nil {
+				return err
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// copyKey copies a key from its old node to its new one, unless it was
+// written since the migration started, and then removes it from the old
+// node. The copy goes through the repair endpoint of the new node, which
+// keeps the timestamp, expiry and flags of the value and does not replace
+// a newer one, such as a write made before a restarted router resumed the
+// migration.
+func (rt *Router) copyKey(record snapshotRecord, from, to string) error {
+	key := record.Key
+	lock := rt.keyLock(key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	rt.writtenMutex.Lock()
+	_, written := rt.written[key]
+	rt.writtenMutex.Unlock()
+	if !written {
+		query := url.Values{"key": {key}, "timestamp": {strconv.FormatUint(record.Timestamp, 10)}}
+		if record.Expires != 0 {
+			query.Set("expires", strconv.FormatInt(record.Expires, 10))
+		}
+		if record.Flags != 0 {
+			query.Set("flags", strconv.FormatUint(uint64(record.Flags), 10))
+		}
+		req, err := http.NewRequestWithContext(rt.ctx, http.MethodPost, to+"/db/_merkle/put?"+query.Encode(), strings.NewReader(record.Value))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/octet-stream")
+		resp, err := rt.client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusOK:
+			rt.moved.Add(1)
+		case http.StatusConflict:
+			// The new node holds a newer value.
+		default:
+			return fmt.Errorf("copying %q to %s returned %d", key, to, resp.StatusCode)
+		}
+	}
+
+	status, err := rt.deleteKey(rt.ctx, from, key)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK && status != http.StatusNotFound {
+		return fmt.Errorf("removing %q from %s returned %d", key, from, status)
+	}
+	return nil
+}
+
+// deleteKey deletes key on node and returns the status of the response.
+func (rt *Router) deleteKey(ctx context.Context, node, key string) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, node+"/db/"+url.PathEscape(key), nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := rt.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// setWritten records a write to a moving key. The caller holds its key
+// lock.
+func (rt *Router) setWritten(key string, deleted bool) {
+	rt.writtenMutex.Lock()
+	defer rt.writtenMutex.Unlock()
+	rt.written[key] = deleted
+}
+
+// deleted reports whether the last write to a moving key was a delete.
+func (rt *Router) deleted(key string) bool {
+	rt.writtenMutex.Lock()
+	defer rt.writtenMutex.Unlock()
+	return rt.written[key]
+}
+
+func (rt *Router) keyLock(key string) *sync.Mutex {
+	return &rt.keyLocks[hash(key)%keyLockCount]
+}
+
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key, ok := strings.CutPrefix(r.URL.Path, "/db/")
+	switch {
+	case !ok || key == "":
+		http.Error(w, "missing key", http.StatusBadRequest)
+		return
+	case key == "_mget":
+		rt.serveMget(w, r)
+		return
+	case key == "_batch":
+		rt.serveBatch(w, r)
+		return
+	case key == "_scan":
+		rt.serveScan(w, r)
+		return
+	case strings.HasPrefix(key, reservedPrefix):
+		// The other endpoints are per node.
+		http.Error(w, "not served by the router", http.StatusNotImplemented)
+		return
+	}
+
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		rt.mutex.RLock()
+		ring, prev := rt.ring, rt.prev
+		rt.mutex.RUnlock()
+		node := ring.Node(key)
+		resp, err := rt.forward(r, node)
+		if err == nil && resp.StatusCode == http.StatusNotFound && prev != nil {
+			if old := prev.Node(key); old != node && !rt.deleted(key) {
+				// The key may not have been copied yet, or have been copied
+				// and removed from the old node in between.
+				resp.Body.Close()
+				resp, err = rt.forward(r, old)
+				if err == nil && resp.StatusCode == http.StatusNotFound {
+					resp.Body.Close()
+					resp, err = rt.forward(r, node)
+				}
+			}
+		}
+		rt.reply(w, resp, err)
+		return
+	}
+
+	rt.mutex.RLock()
+	defer rt.mutex.RUnlock()
+	node, old := rt.owners(key)
+	if old != "" {
+		lock := rt.keyLock(key)
+		lock.Lock()
+		defer lock.Unlock()
+		rt.setWritten(key, r.Method == http.MethodDelete)
+	}
+	resp, err := rt.forward(r, node)
+	if err == nil && resp.StatusCode == http.StatusNotFound && old != "" && r.Method == http.MethodDelete {
+		// The key may not have been copied yet.
+		resp.Body.Close()
+		resp, err = rt.forward(r, old)
+	}
+	rt.reply(w, resp, err)
+}
+
+// owners returns the node of key and, while it moves, its old node. The
+// caller holds rt.mutex.
+func (rt *Router) owners(key string) (node, old string) {
+	node = rt.ring.Node(key)
+	if rt.prev != nil {
+		if old = rt.prev.Node(key); old == node {
+			old = ""
+		}
+	}
+	return node, old
+}
+
+func (rt *Router) forward(r *http.Request, node string) (*http.Response, error) {
+	if node == "" {
+		return nil, errors.New("no nodes on the ring")
+	}
+	target, err := url.Parse(node + r.URL.RequestURI())
+	if err != nil {
+		return nil, err
+	}
+	req := r.Clone(r.Context())
+	req.RequestURI = ""
+	req.URL = target
+	req.Host = target.Host
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		req.Body = nil
+	}
+	return rt.client.Do(req)
+}
+
+func (rt *Router) reply(w http.ResponseWriter, resp *http.Response, err error) {
+	if err != nil {
+		log.Printf("Failed to forward a request: %v", err)
+		http.Error(w, "db node is unavailable", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	for k, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(k, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		log.Printf("Failed to write response: %v", err)
+	}
+}
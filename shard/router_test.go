@@ -0,0 +1,505 @@
+package shard
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeNode serves the part of the db node API the router uses.
+type fakeNode struct {
+	mutex  sync.Mutex
+	values map[string]string
+	// meta holds the timestamp, expiry and flags of the values that have
+	// them.
+	meta   map[string]snapshotRecord
+	server *httptest.Server
+	// snapshot is held to keep the snapshot from being served.
+	snapshot sync.Mutex
+}
+
+func newFakeNode(t *testing.T) *fakeNode {
+	n := &fakeNode{values: make(map[string]string), meta: make(map[string]snapshotRecord)}
+	n.server = httptest.NewServer(http.HandlerFunc(n.serve))
+	t.Cleanup(n.server.Close)
+	return n
+}
+
+func (n *fakeNode) serve(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/db/_snapshot" {
+		n.snapshot.Lock()
+		defer n.snapshot.Unlock()
+	}
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	switch r.URL.Path {
+	case "/db/_snapshot":
+		enc := json.NewEncoder(w)
+		for key, value := range n.values {
+			record := n.meta[key]
+			record.Op, record.Key, record.Value = "put", key, value
+			_ = enc.Encode(record)
+		}
+		_ = enc.Encode(snapshotRecord{Op: "delete", Key: "deleted"})
+		return
+	case "/db/_mget":
+		var req mgetRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		resp := mgetResponse{Values: make(map[string]string)}
+		for _, key := range req.Keys {
+			if value, ok := n.values[key]; ok {
+				resp.Values[key] = value
+			}
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+		return
+	case "/db/_batch":
+		var req struct {
+			Ops []struct{ Op, Key, Value string }
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		var resp batchResponse
+		for _, op := range req.Ops {
+			result := batchResult{Key: op.Key, Status: http.StatusOK}
+			if _, ok := n.values[op.Key]; op.Op == "delete" && !ok {
+				result.Status = http.StatusNotFound
+			} else if op.Op == "delete" {
+				delete(n.values, op.Key)
+			} else {
+				n.values[op.Key] = op.Value
+			}
+			resp.Results = append(resp.Results, result)
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+		return
+	case "/db/_merkle/put":
+		query := r.URL.Query()
+		key := query.Get("key")
+		record := snapshotRecord{Key: key}
+		record.Timestamp, _ = strconv.ParseUint(query.Get("timestamp"), 10, 64)
+		record.Expires, _ = strconv.ParseInt(query.Get("expires"), 10, 64)
+		flags, _ := strconv.ParseUint(query.Get("flags"), 10, 32)
+		record.Flags = uint32(flags)
+		if _, ok := n.values[key]; ok && n.meta[key].Timestamp >= record.Timestamp {
+			http.Error(w, "stale", http.StatusConflict)
+			return
+		}
+		data, _ := io.ReadAll(r.Body)
+		n.values[key], n.meta[key] = string(data), record
+		return
+	case "/db/_scan":
+		query := r.URL.Query()
+		var keys []string
+		for key := range n.values {
+			if strings.HasPrefix(key, query.Get("prefix")) && key > query.Get("after") {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		resp := scanResponse{Items: []scanItem{}}
+		if limit, _ := strconv.Atoi(query.Get("limit")); len(keys) > limit {
+			keys = keys[:limit]
+			resp.Next = keys[limit-1]
+		}
+		for _, key := range keys {
+			resp.Items = append(resp.Items, scanItem{Key: key, Value: n.values[key]})
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	key := strings.TrimPrefix(r.URL.Path, "/db/")
+	value, ok := n.values[key]
+	switch r.Method {
+	case http.MethodGet:
+		if !ok {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"key": key, "value": value})
+	case http.MethodDelete:
+		if !ok {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		delete(n.values, key)
+	default:
+		data, _ := io.ReadAll(r.Body)
+		if len(data) == 0 {
+			http.Error(w, "missing value", http.StatusBadRequest)
+			return
+		}
+		n.values[key] = string(data)
+	}
+}
+
+func (n *fakeNode) has(key string) bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	_, ok := n.values[key]
+	return ok
+}
+
+func get(t *testing.T, url, key string) string {
+	t.Helper()
+	resp, err := http.Get(url + "/db/" + key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s returned %d", key, resp.StatusCode)
+	}
+	var body struct{ Value string }
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	return body.Value
+}
+
+func put(t *testing.T, url, key, value string) {
+	t.Helper()
+	resp, err := http.Post(url+"/db/"+key, "application/octet-stream", strings.NewReader(value))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST %s returned %d", key, resp.StatusCode)
+	}
+}
+
+func TestRouter(t *testing.T) {
+	nodes := map[string]*fakeNode{}
+	for i := 0; i < 3; i++ {
+		n := newFakeNode(t)
+		nodes[n.server.URL] = n
+	}
+	var urls []string
+	for url := range nodes {
+		urls = append(urls, url)
+	}
+	router := NewRouter(urls[:2], WithVirtualNodes(32), WithRetryDelay(10*time.Millisecond))
+	defer router.Close()
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	for i := 0; i < 100; i++ {
+		put(t, server.URL, fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i))
+	}
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if !nodes[router.ring.Node(key)].has(key) {
+			t.Fatalf("Key %s is not on its node", key)
+		}
+	}
+
+	if err := router.AddNode(urls[2]); err != nil {
+		t.Fatal(err)
+	}
+	if err := router.AddNode(urls[2]); err != ErrMigrating && err != ErrNodeExists {
+		t.Errorf("Adding the node again returned %v", err)
+	}
+	// Keys stay readable while they move.
+	for i := 0; i < 100; i++ {
+		if value := get(t, server.URL, fmt.Sprintf("key%d", i)); value != fmt.Sprintf("value%d", i) {
+			t.Errorf("key%d = %q during the migration", i, value)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := router.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	status := router.Status()
+	if status.Migrating || len(status.Nodes) != 3 || status.Moved == 0 {
+		t.Errorf("Status after adding a node: %+v", status)
+	}
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%d", i)
+		for url, node := range nodes {
+			if owner := router.ring.Node(key); node.has(key) != (url == owner) {
+				t.Errorf("Key %s is on %s: %v, its owner is %s", key, url, node.has(key), owner)
+			}
+		}
+	}
+
+	if err := router.RemoveNode(urls[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := router.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	nodes[urls[0]].server.Close()
+	for i := 0; i < 100; i++ {
+		if value := get(t, server.URL, fmt.Sprintf("key%d", i)); value != fmt.Sprintf("value%d", i) {
+			t.Errorf("key%d = %q after removing a node", i, value)
+		}
+	}
+}
+
+func TestRouterKeepsWritesDuringMigration(t *testing.T) {
+	old, added := newFakeNode(t), newFakeNode(t)
+	router := NewRouter([]string{old.server.URL}, WithVirtualNodes(32))
+	defer router.Close()
+	for i := 0; i < 50; i++ {
+		old.values[fmt.Sprintf("key%d", i)] = "old"
+	}
+
+	// Hold the snapshot until the writes are in.
+	old.snapshot.Lock()
+	if err := router.AddNode(added.server.URL); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(router)
+	defer server.Close()
+	var moved []string
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if router.ring.Node(key) == added.server.URL {
+			moved = append(moved, key)
+			put(t, server.URL, key, "new")
+		}
+	}
+	old.snapshot.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := router.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(moved) == 0 {
+		t.Fatal("No key moved to the new node")
+	}
+	for _, key := range moved {
+		if value := get(t, server.URL, key); value != "new" {
+			t.Errorf("%s = %q, the migration overwrote a newer write", key, value)
+		}
+	}
+}
+
+func status(t *testing.T, method, url, key string) int {
+	t.Helper()
+	req, err := http.NewRequest(method, url+"/db/"+key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestRouterKeepsDeletesDuringMigration(t *testing.T) {
+	old, added := newFakeNode(t), newFakeNode(t)
+	router := NewRouter([]string{old.server.URL}, WithVirtualNodes(32))
+	defer router.Close()
+	for i := 0; i < 50; i++ {
+		old.values[fmt.Sprintf("key%d", i)] = "old"
+	}
+
+	old.snapshot.Lock()
+	if err := router.AddNode(added.server.URL); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(router)
+	defer server.Close()
+	var moved []string
+	for i := 0; i < 50; i++ {
+		if key := fmt.Sprintf("key%d", i); router.ring.Node(key) == added.server.URL {
+			moved = append(moved, key)
+		}
+	}
+	if len(moved) < 2 {
+		t.Fatal("Too few keys moved to the new node")
+	}
+	// One key is deleted before it is copied, the other written and
+	// deleted on the new node.
+	if code := status(t, http.MethodDelete, server.URL, moved[0]); code != http.StatusOK {
+		t.Errorf("Deleting a key not copied yet returned %d", code)
+	}
+	put(t, server.URL, moved[1], "new")
+	if code := status(t, http.MethodDelete, server.URL, moved[1]); code != http.StatusOK {
+		t.Errorf("Deleting a written key returned %d", code)
+	}
+	for _, key := range moved[:2] {
+		if code := status(t, http.MethodGet, server.URL, key); code != http.StatusNotFound {
+			t.Errorf("GET %s after the delete returned %d during the migration", key, code)
+		}
+	}
+	old.snapshot.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := router.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range moved[:2] {
+		if code := status(t, http.MethodGet, server.URL, key); code != http.StatusNotFound {
+			t.Errorf("GET %s after the delete returned %d", key, code)
+		}
+		if old.has(key) || added.has(key) {
+			t.Errorf("Deleted key %s is still stored", key)
+		}
+	}
+	for _, key := range moved[2:] {
+		if old.has(key) || !added.has(key) {
+			t.Errorf("Key %s was not moved", key)
+		}
+	}
+}
+
+func postJSON(t *testing.T, url string, in, out any) {
+	t.Helper()
+	data, err := json.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(url, "application/json", strings.NewReader(string(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST %s returned %d", url, resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRouterMultiKey(t *testing.T) {
+	a, b := newFakeNode(t), newFakeNode(t)
+	router := NewRouter([]string{a.server.URL, b.server.URL}, WithVirtualNodes(32))
+	defer router.Close()
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	var ops []map[string]string
+	for i := 0; i < 20; i++ {
+		ops = append(ops, map[string]string{"op": "put", "key": fmt.Sprintf("key%02d", i), "value": fmt.Sprintf("value%d", i)})
+	}
+	ops = append(ops, map[string]string{"op": "delete", "key": "key00"}, map[string]string{"op": "delete", "key": "missing"})
+	var batch batchResponse
+	postJSON(t, server.URL+"/db/_batch", map[string]any{"ops": ops}, &batch)
+	if len(batch.Results) != len(ops) {
+		t.Fatalf("Got %d results for %d ops", len(batch.Results), len(ops))
+	}
+	for i, result := range batch.Results {
+		want := http.StatusOK
+		if i == len(ops)-1 {
+			want = http.StatusNotFound
+		}
+		if result.Key != ops[i]["key"] || result.Status != want {
+			t.Errorf("Result %d = %+v, want %s with %d", i, result, ops[i]["key"], want)
+		}
+	}
+	if len(a.values) == 0 || len(b.values) == 0 {
+		t.Fatalf("The batch did not reach both nodes: %d and %d keys", len(a.values), len(b.values))
+	}
+
+	var mget mgetResponse
+	postJSON(t, server.URL+"/db/_mget", mgetRequest{Keys: []string{"key01", "key00", "key19", "missing", "key00"}}, &mget)
+	if len(mget.Values) != 2 || mget.Values["key01"] != "value1" || mget.Values["key19"] != "value19" {
+		t.Errorf("Values = %v", mget.Values)
+	}
+	if fmt.Sprint(mget.Missing) != "[key00 missing]" {
+		t.Errorf("Missing = %v", mget.Missing)
+	}
+
+	var keys []string
+	after := ""
+	for pages := 0; ; pages++ {
+		if pages > 20 {
+			t.Fatal("The scan does not end")
+		}
+		resp, err := http.Get(server.URL + "/db/_scan?prefix=key&limit=3&after=" + after)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var page scanResponse
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Items) > 3 {
+			t.Fatalf("Got %d items with a limit of 3", len(page.Items))
+		}
+		for _, item := range page.Items {
+			keys = append(keys, item.Key)
+		}
+		if page.Next == "" {
+			break
+		}
+		after = page.Next
+	}
+	if len(keys) != 19 || !sort.StringsAreSorted(keys) || keys[0] != "key01" {
+		t.Errorf("Scanned %v", keys)
+	}
+
+	// The other endpoints are per node.
+	if code := status(t, http.MethodGet, server.URL, "_log"); code != http.StatusNotImplemented {
+		t.Errorf("GET /db/_log returned %d", code)
+	}
+}
+
+func TestRouterCopiesMetadata(t *testing.T) {
+	old, added := newFakeNode(t), newFakeNode(t)
+	router := NewRouter([]string{old.server.URL}, WithVirtualNodes(32))
+	defer router.Close()
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("key%d", i)
+		old.values[key] = "old"
+		old.meta[key] = snapshotRecord{Timestamp: uint64(100 + i), Expires: int64(1e18 + i), Flags: uint32(i)}
+	}
+	// A newer value the new node holds already, as after a restarted
+	// migration.
+	var kept string
+	for i := 0; i < 50 && kept == ""; i++ {
+		if key := fmt.Sprintf("key%d", i); router.ring.With(added.server.URL).Node(key) == added.server.URL {
+			kept = key
+			added.values[key], added.meta[key] = "newer", snapshotRecord{Timestamp: 1000}
+		}
+	}
+	if kept == "" {
+		t.Fatal("No key moves to the new node")
+	}
+
+	if err := router.AddNode(added.server.URL); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := router.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if key == kept || router.ring.Node(key) != added.server.URL {
+			continue
+		}
+		want := snapshotRecord{Key: key, Timestamp: uint64(100 + i), Expires: int64(1e18 + i), Flags: uint32(i)}
+		if got := added.meta[key]; got != want {
+			t.Errorf("%s was copied with %+v, wanted %+v", key, got, want)
+		}
+	}
+	if value := added.values[kept]; value != "newer" {
+		t.Errorf("%s = %q, the migration overwrote a newer value", kept, value)
+	}
+	if old.has(kept) {
+		t.Errorf("%s was left on its old node", kept)
+	}
+}